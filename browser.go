@@ -11,6 +11,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"sort"
 	"strings"
 	"time"
@@ -21,10 +23,17 @@ import (
 const DefaultCollectionInterval = 15 * time.Minute
 
 var (
+	ErrAccessDenied      = errors.New("access denied")
 	ErrAuthentication    = errors.New("user not authenticated")
 	ErrDataNotFound      = errors.New("no data points")
+	ErrExportCanceled    = errors.New("export canceled")
+	ErrExportNotFound    = errors.New("export not found")
+	ErrExportNotReady    = errors.New("export not ready")
+	ErrExportQueueFull   = errors.New("too many queued exports")
 	ErrInternal          = errors.New("internal error")
 	ErrInvalidToken      = errors.New("invalid token")
+	ErrLimitExceeded     = errors.New("request exceeds the allowed number of points")
+	ErrTokenNotFound     = errors.New("token not found")
 	ErrUserNotFound      = errors.New("user not found")
 	ErrUserNotValid      = errors.New("user is not valid")
 	ErrUserAlreadyExists = errors.New("user already exists")
@@ -112,9 +121,106 @@ func unique(slice []string, s string) []string {
 	return append(slice, s)
 }
 
+// Parameter represents the metadata of a measurement independent of a
+// station, as listed in the measurement catalogue.
+type Parameter struct {
+	Label string
+
+	// Description holds a human readable description of the parameter
+	// keyed by language, e.g. "en", "de" or "it".
+	Description  map[string]string
+	Unit         string
+	Aggregation  string
+	Depth        int64
+	SensorHeight float64
+
+	// ValidMin and ValidMax define the range of plausible values. A nil
+	// value means no limit.
+	ValidMin *float64
+	ValidMax *float64
+}
+
+// Title returns the description of the parameter in the given language. It
+// falls back to English and then to the label.
+func (p *Parameter) Title(lang string) string {
+	if d, ok := p.Description[lang]; ok && d != "" {
+		return d
+	}
+	if d, ok := p.Description["en"]; ok && d != "" {
+		return d
+	}
+	return p.Label
+}
+
+// String returns a single line summary of the parameter in English.
+func (p *Parameter) String() string {
+	var b strings.Builder
+
+	b.WriteString(p.Label)
+	b.WriteString(": ")
+	b.WriteString(p.Title("en"))
+	if p.Unit != "" {
+		fmt.Fprintf(&b, " [%s]", p.Unit)
+	}
+	if p.Aggregation != "" {
+		fmt.Fprintf(&b, ", aggregation %s", p.Aggregation)
+	}
+	if p.Depth > 0 {
+		fmt.Fprintf(&b, ", depth %d cm", p.Depth)
+	}
+	if p.SensorHeight != 0 {
+		fmt.Fprintf(&b, ", sensor height %g m", p.SensorHeight)
+	}
+	if p.ValidMin != nil || p.ValidMax != nil {
+		b.WriteString(", valid range ")
+		if p.ValidMin != nil {
+			fmt.Fprintf(&b, "%g", *p.ValidMin)
+		}
+		b.WriteString("..")
+		if p.ValidMax != nil {
+			fmt.Fprintf(&b, "%g", *p.ValidMax)
+		}
+	}
+
+	return b.String()
+}
+
+// Catalogue represents the catalogue of all known parameters.
+type Catalogue []*Parameter
+
+// Get returns the parameter by the given label. If no parameter is found it
+// will return nil and false.
+func (c Catalogue) Get(label string) (*Parameter, bool) {
+	for _, p := range c {
+		if label == p.Label {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Title returns the description of the parameter with the given label in the
+// given language or the label itself if the parameter is unknown.
+func (c Catalogue) Title(label, lang string) string {
+	p, ok := c.Get(label)
+	if !ok {
+		return label
+	}
+	return p.Title(lang)
+}
+
 // TimeSeries represents a group Measurements.
 type TimeSeries []*Measurement
 
+// SortedByStation returns a copy of the TimeSeries sorted by station. The
+// measurements of a station keep their order. The TimeSeries itself will not be
+// modified.
+func (ts TimeSeries) SortedByStation() TimeSeries {
+	c := append(TimeSeries(nil), ts...)
+	sort.SliceStable(c, func(i, j int) bool { return c[i].Station < c[j].Station })
+	return c
+}
+
 // Measurement represents a single measurements with metadata and measured
 // points.
 type Measurement struct {
@@ -128,6 +234,10 @@ type Measurement struct {
 	Latitude    float64
 	Longitude   float64
 	Points      []*Point
+
+	// Level is the processing level of the time series, which is the lowest
+	// quality its points are known to have.
+	Level Quality
 }
 
 // Name returns the label removing the aggregation function from it.
@@ -152,6 +262,10 @@ func (m *Measurement) DepthToString() string {
 type Point struct {
 	Timestamp time.Time
 	Value     float64
+
+	// Quality is the quality flag of the point. Aggregated points have the
+	// minimum quality of the aggregation request.
+	Quality Quality
 }
 
 // Message represents a message exchange between services.
@@ -159,10 +273,258 @@ type Message struct {
 	Stations     []string
 	Measurements []string
 	Landuse      []string
-	Limit        int64
+
+	// Limit is the maximum number of points which may be requested, as
+	// estimated by Estimate. Zero means no limit.
+	Limit int64
 
 	Start time.Time
 	End   time.Time
+
+	// Interval is the temporal resolution of the requested points. The zero
+	// value requests the raw points as collected by the stations.
+	Interval Interval
+
+	// Function is used for aggregating points to the given Interval. If it is
+	// empty, the function is chosen per measurement with AggregateFuncFor.
+	Function AggregateFunc
+
+	// Quality is the minimum quality of the requested points. Points of lower
+	// quality are left out like missing points. The zero value, QualityRaw,
+	// applies no filter, thus points flagged as bad are included as well.
+	Quality Quality
+
+	// Strict makes a request fail with ErrAccessDenied instead of being
+	// redacted by the access rules.
+	Strict bool
+}
+
+// Estimate returns the estimated number of points requested by the message:
+// the number of stations times the number of measurements times the number of
+// intervals between start and end.
+func (m *Message) Estimate() int64 {
+	return int64(len(m.Stations)) * int64(len(m.Measurements)) * m.Interval.Count(m.Start, m.End)
+}
+
+// Estimate represents the estimated size of a request.
+type Estimate struct {
+	// Points is the estimated number of points.
+	Points int64 `json:"points"`
+
+	// Limit is the maximum number of points allowed. Zero means no limit.
+	Limit int64 `json:"limit"`
+}
+
+// Exceeded reports whether the estimated points exceed the limit.
+func (e *Estimate) Exceeded() bool {
+	return e.Limit > 0 && e.Points > e.Limit
+}
+
+// Err returns an error wrapping ErrLimitExceeded if the limit is exceeded.
+func (e *Estimate) Err() error {
+	if !e.Exceeded() {
+		return nil
+	}
+	return fmt.Errorf("%w: %d points requested, %d allowed", ErrLimitExceeded, e.Points, e.Limit)
+}
+
+// Interval represents the temporal resolution of a time series.
+type Interval string
+
+const (
+	Raw     Interval = ""
+	Hourly  Interval = "hourly"
+	Daily   Interval = "daily"
+	Monthly Interval = "monthly"
+)
+
+// String returns the name of the interval, "raw" for Raw.
+func (i Interval) String() string {
+	if i == Raw {
+		return "raw"
+	}
+	return string(i)
+}
+
+// ParseInterval returns the Interval for the given string. An empty string
+// and "raw" will return Raw.
+func ParseInterval(s string) (Interval, error) {
+	switch i := Interval(strings.ToLower(s)); i {
+	case "raw":
+		return Raw, nil
+	case Raw, Hourly, Daily, Monthly:
+		return i, nil
+	default:
+		return Raw, fmt.Errorf("unknown interval %q", s)
+	}
+}
+
+// Truncate returns the start of the interval t falls in. Intervals are aligned
+// to the time Location of the LTER stations.
+func (i Interval) Truncate(t time.Time) time.Time {
+	t = t.In(Location)
+
+	switch i {
+	case Hourly:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, Location)
+	case Daily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, Location)
+	case Monthly:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, Location)
+	default:
+		return t.Truncate(DefaultCollectionInterval)
+	}
+}
+
+// Next returns t advanced by one interval.
+func (i Interval) Next(t time.Time) time.Time {
+	switch i {
+	case Hourly:
+		return t.Add(time.Hour)
+	case Daily:
+		return t.AddDate(0, 0, 1)
+	case Monthly:
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.Add(DefaultCollectionInterval)
+	}
+}
+
+// Fill fills missing timestamps between start and the last point with NaN
+// values, to return a time series with a continuous time range. The interval
+// of raw data in LTER is 15 minutes, aggregated data uses the interval itself.
+// See: https://github.com/euracresearch/browser/issues/10
+func (i Interval) Fill(points []*Point, start time.Time) []*Point {
+	var (
+		filled []*Point
+		next   = i.Truncate(start)
+	)
+
+	for _, p := range points {
+		for next.Before(p.Timestamp) {
+			filled = append(filled, &Point{
+				Timestamp: next,
+				Value:     math.NaN(),
+			})
+			next = i.Next(next)
+		}
+		next = i.Next(p.Timestamp)
+
+		filled = append(filled, p)
+	}
+
+	return filled
+}
+
+// Count returns the number of intervals between the day of start and the day
+// of end, both inclusive.
+func (i Interval) Count(start, end time.Time) int64 {
+	start = Daily.Truncate(start)
+	end = Daily.Truncate(end).AddDate(0, 0, 1)
+	if !end.After(start) {
+		return 0
+	}
+
+	switch i {
+	case Hourly:
+		return int64(end.Sub(start) / time.Hour)
+	case Daily:
+		return int64(end.Sub(start) / (24 * time.Hour))
+	case Monthly:
+		end = end.AddDate(0, 0, -1)
+		return int64((end.Year()-start.Year())*12+int(end.Month())-int(start.Month())) + 1
+	default:
+		return int64(end.Sub(start) / DefaultCollectionInterval)
+	}
+}
+
+// Quality represents the quality level of a point. Levels are ordered from
+// points flagged as bad to manually validated points, so that a minimum level
+// can be requested.
+type Quality int
+
+// Supported quality levels.
+const (
+	QualityBad       Quality = iota - 1 // flagged as bad by a quality check
+	QualityRaw                          // not checked yet
+	QualityChecked                      // passed automatic quality checks
+	QualityValidated                    // validated manually
+)
+
+var qualityNames = map[Quality]string{
+	QualityBad:       "bad",
+	QualityRaw:       "raw",
+	QualityChecked:   "checked",
+	QualityValidated: "validated",
+}
+
+func (q Quality) String() string {
+	if name, ok := qualityNames[q]; ok {
+		return name
+	}
+	return fmt.Sprintf("Quality(%d)", int(q))
+}
+
+// ParseQuality returns the Quality for the given name. An empty string will
+// return QualityRaw.
+func ParseQuality(s string) (Quality, error) {
+	if s == "" {
+		return QualityRaw, nil
+	}
+	for q, name := range qualityNames {
+		if strings.EqualFold(s, name) {
+			return q, nil
+		}
+	}
+	return QualityRaw, fmt.Errorf("unknown quality %q", s)
+}
+
+// AggregateFunc represents a function for aggregating points.
+type AggregateFunc string
+
+const (
+	Mean  AggregateFunc = "mean"
+	Min   AggregateFunc = "min"
+	Max   AggregateFunc = "max"
+	Sum   AggregateFunc = "sum"
+	Count AggregateFunc = "count"
+)
+
+// ParseAggregateFunc returns the AggregateFunc for the given string. An empty
+// string is valid and denotes the default function of each measurement.
+func ParseAggregateFunc(s string) (AggregateFunc, error) {
+	switch f := AggregateFunc(strings.ToLower(s)); f {
+	case "", Mean, Min, Max, Sum, Count:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown aggregation function %q", s)
+	}
+}
+
+// AggregateFuncFor returns the function suited for aggregating the measurement
+// with the given label. Totals (e.g. precipitation) are summed up, minimum and
+// maximum values keep their extreme and all others are averaged.
+func AggregateFuncFor(label string) AggregateFunc {
+	switch {
+	case strings.HasSuffix(label, "_tot"):
+		return Sum
+	case strings.HasSuffix(label, "_min"):
+		return Min
+	case strings.HasSuffix(label, "_max"):
+		return Max
+	default:
+		return Mean
+	}
+}
+
+// FunctionFor returns the function for aggregating the measurement with the
+// given label. It is the requested Function or AggregateFuncFor the label if
+// none was requested.
+func (m *Message) FunctionFor(label string) AggregateFunc {
+	if m.Function != "" {
+		return m.Function
+	}
+	return AggregateFuncFor(label)
 }
 
 // Stmt is a query statement composed of the actual query and the database it is
@@ -170,12 +532,28 @@ type Message struct {
 type Stmt struct {
 	Query    string
 	Database string
+
+	// Dialect is the query language of Query.
+	Dialect Dialect
 }
 
+// Dialect represents the query language of a Stmt.
+type Dialect string
+
+const (
+	InfluxQL Dialect = ""
+	SQL      Dialect = "sql"
+	Flux     Dialect = "flux"
+)
+
 // Metadata represents a backend for retrieving Metadata.
 type Metadata interface {
 	// Stations retrieves metadata about all stations.
 	Stations(ctx context.Context, m *Message) (Stations, error)
+
+	// Catalogue retrieves the metadata of the measurements given in the
+	// message or of all measurements if none are given.
+	Catalogue(ctx context.Context, m *Message) (Catalogue, error)
 }
 
 // Database represents a backend for retrieving time series data.
@@ -189,7 +567,37 @@ type Database interface {
 	Query(ctx context.Context, m *Message) *Stmt
 }
 
-// Role represents a role a User is part of.
+// Estimator is implemented by a Database which limits the size of requests.
+type Estimator interface {
+	// Estimate returns the estimated size of the request of the given
+	// Message together with the limit applying to it.
+	Estimate(ctx context.Context, m *Message) (*Estimate, error)
+}
+
+// Redactor is implemented by a Database applying access rules to requests.
+type Redactor interface {
+	// Redact applies the access rules of the user of the given context to
+	// the given Message once, like Series does, and reports the denials to
+	// the report of the context. The returned Redacted reads the time series
+	// granted at the time of the call, even if the rules change later on.
+	Redact(ctx context.Context, m *Message) (Redacted, error)
+}
+
+// Redacted represents a request redacted by access rules.
+type Redacted interface {
+	// Estimate returns the estimated size of the redacted request.
+	Estimate() *Estimate
+
+	// Series returns the time series of the redacted request.
+	Series(ctx context.Context) (TimeSeries, error)
+
+	// Stream returns the time series of the redacted request as Stream.
+	Stream(ctx context.Context) (*Stream, error)
+}
+
+// Role represents a role a User is part of. Besides the built-in roles any
+// role defined by the access rules can be used, e.g. for groups of project
+// partners.
 type Role string
 
 const (
@@ -199,9 +607,16 @@ const (
 	DefaultRole Role = Public
 )
 
-// Roles is a list of all supported Roles.
+// Roles is a list of all built-in Roles.
 var Roles = []Role{Public, External, FullAccess}
 
+// RoleLister is implemented by a Metadata defining roles, e.g. by access
+// rules.
+type RoleLister interface {
+	// Roles returns all defined roles.
+	Roles() []Role
+}
+
 func (r *Role) UnmarshalJSON(b []byte) error {
 	var s string
 	if err := json.Unmarshal(b, &s); err != nil {
@@ -212,19 +627,26 @@ func (r *Role) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-// NewRole returns a new role from the given string. If the string cannot be
-// parsed to a role the default role will be returned.
+// NewRole returns a new role from the given string. If the string is empty the
+// default role will be returned.
 func NewRole(s string) Role {
-	switch s {
-	default:
+	s = strings.TrimSpace(s)
+	if s == "" {
 		return DefaultRole
+	}
+	return Role(s)
+}
 
-	case "External":
-		return External
-
-	case "FullAccess":
-		return FullAccess
+// ParseRoles returns the roles of the given comma separated list. Empty
+// entries are skipped.
+func ParseRoles(s string) []Role {
+	var roles []Role
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			roles = append(roles, Role(v))
+		}
 	}
+	return roles
 }
 
 // User represents an authenticated user.
@@ -235,6 +657,35 @@ type User struct {
 	Provider string
 	License  bool
 	Role     Role
+
+	// Groups are additional roles of the user. A user has access to
+	// everything any of its roles has access to.
+	Groups []Role `json:",omitempty"`
+}
+
+// Roles returns the role and all groups of the user without duplicates.
+func (u *User) Roles() []Role {
+	var roles []Role
+	seen := make(map[Role]bool)
+	for _, r := range append([]Role{u.Role}, u.Groups...) {
+		if r == "" || seen[r] {
+			continue
+		}
+		seen[r] = true
+		roles = append(roles, r)
+	}
+	return roles
+}
+
+// HasRole reports whether the user has the given role either as role or as
+// group.
+func (u *User) HasRole(r Role) bool {
+	for _, v := range u.Roles() {
+		if v == r {
+			return true
+		}
+	}
+	return false
 }
 
 // Valid determinse if a user is valid. A valid user must have a username, name
@@ -258,6 +709,74 @@ type UserService interface {
 	Update(context.Context, *User) error
 }
 
+// Token represents a personal API token of a user, used for authenticating
+// scripted requests.
+type Token struct {
+	ID      string
+	Name    string
+	Created time.Time
+
+	// Secret is the actual token value. It is only known right after
+	// creation, since a TokenService stores only a hash of it.
+	Secret string
+}
+
+// TokenService is the storage and retrivial of personal API tokens.
+type TokenService interface {
+	// Create creates a new token with the given name for the given user.
+	Create(ctx context.Context, u *User, name string) (*Token, error)
+	// List returns all tokens of the given user.
+	List(ctx context.Context, u *User) ([]*Token, error)
+	// Revoke deletes the token with the given id of the given user.
+	Revoke(ctx context.Context, u *User, id string) error
+	// User returns the owner of the token with the given secret.
+	User(ctx context.Context, secret string) (*User, error)
+}
+
+// ExportStatus represents the state of an Export.
+type ExportStatus string
+
+// Supported ExportStatus values.
+const (
+	ExportQueued  ExportStatus = "queued"
+	ExportRunning ExportStatus = "running"
+	ExportDone    ExportStatus = "done"
+	ExportFailed  ExportStatus = "failed"
+)
+
+// Export represents a download of a time series running in the background.
+// Once done, the time series is available as file until the export expires.
+type Export struct {
+	ID      string       `json:"id"`
+	Format  string       `json:"format"`
+	Status  ExportStatus `json:"status"`
+	Error   string       `json:"error,omitempty"`
+	Created time.Time    `json:"created"`
+	Expires time.Time    `json:"expires"`
+
+	// Progress is the estimated fraction of the time series already
+	// written, between 0 and 1.
+	Progress float64 `json:"progress"`
+
+	// Warnings describes the parts of the request denied by the access
+	// rules.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// ExportService runs exports of time series in the background.
+type ExportService interface {
+	// Create enqueues an export of the time series of the given Message in
+	// the given format for the given user.
+	Create(ctx context.Context, u *User, m *Message, format string) (*Export, error)
+	// List returns all exports of the given user.
+	List(ctx context.Context, u *User) ([]*Export, error)
+	// Get returns the export with the given id of the given user.
+	Get(ctx context.Context, u *User, id string) (*Export, error)
+	// Open returns the file of the done export with the given id of the
+	// given user.
+	Open(ctx context.Context, u *User, id string) (io.ReadCloser, error)
+}
+
 // userContextKey is a custom type to be used as key type for context.Context
 // values.
 type userContextKey string
@@ -5,8 +5,12 @@
 package browser
 
 import (
+	"container/list"
 	"context"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,74 +19,505 @@ var (
 	// Guarantee we implement browser.Metadata.
 	_ Metadata = &InMemCache{}
 
+	// Guarantee we implement browser.Refresher.
+	_ Refresher = &InMemCache{}
+
+	// Guarantee we implement browser.Database.
+	_ Database = &SeriesCache{}
+
+	// Guarantee we implement browser.Streamer.
+	_ Streamer = &SeriesCache{}
+
 	// CacheRefreshInterval is the interval in which the cache will be refeshed.
 	CacheRefreshInterval = 8 * time.Hour
 )
 
+const (
+	// DefaultSeriesCacheTTL is the default duration a time series is cached.
+	DefaultSeriesCacheTTL = time.Hour
+
+	// DefaultSeriesCacheRecentTTL is the default duration a time series
+	// ending today is cached, since new points are still written.
+	DefaultSeriesCacheRecentTTL = 5 * time.Minute
+)
+
+// Refresher is implemented by caches which can be refreshed on demand.
+type Refresher interface {
+	// Refresh reloads the cache from its backend.
+	Refresh(ctx context.Context) error
+}
+
 // InMemCache represents an in memory cache currently for metadata only.
+//
+// The cache is refreshed every CacheRefreshInterval and on demand by Refresh.
+// If refreshing fails for a role, the previously cached metadata of that role
+// is served further and reported as stale by Status.
+//
+// The metadata of all roles of a RoleLister, otherwise of the built-in Roles,
+// is loaded in advance. Users holding several roles are cached on first use
+// under their roles joined by "+".
 type InMemCache struct {
 	metadata Metadata
 
-	mu    sync.RWMutex
-	cache map[Role]Stations
+	loadMu sync.Mutex    // serializes loading the cache
+	done   chan struct{} // closed by Close
+	once   sync.Once
+
+	mu        sync.RWMutex
+	cache     map[Role]Stations
+	catalogue map[Role]Catalogue
+	status    map[Role]CacheStatus
+	users     map[Role]*User // user used for loading the cache of a role
+}
+
+// CacheStatus represents the state of the cached metadata of a single role.
+type CacheStatus struct {
+	// Updated is the time the metadata was last loaded successfully.
+	Updated time.Time
+
+	// Err is the error of the last refresh, if it failed. The metadata
+	// loaded at Updated is served meanwhile.
+	Err error
+}
+
+// Stale reports whether the last refresh failed.
+func (s CacheStatus) Stale() bool {
+	return s.Err != nil
 }
 
 func NewInMemCache(m Metadata) *InMemCache {
 	c := &InMemCache{
-		metadata: m,
-		cache:    make(map[Role]Stations),
+		metadata:  m,
+		done:      make(chan struct{}),
+		cache:     make(map[Role]Stations),
+		catalogue: make(map[Role]Catalogue),
+		status:    make(map[Role]CacheStatus),
+		users:     make(map[Role]*User),
 	}
 
-	c.loadCache()
+	c.loadCache(context.Background())
 	go c.refreshCache()
 
 	return c
 }
 
+// Refresh reloads the cache for all roles immediately. It returns the first
+// error of a role which could not be refreshed.
+func (c *InMemCache) Refresh(ctx context.Context) error {
+	return c.loadCache(ctx)
+}
+
+// Status returns the status of the cached metadata of each role.
+func (c *InMemCache) Status() map[Role]CacheStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	status := make(map[Role]CacheStatus, len(c.status))
+	for r, s := range c.status {
+		status[r] = s
+	}
+	return status
+}
+
+// Close stops refreshing the cache.
+func (c *InMemCache) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
 // loadCache initializes the cache for each Role due to the slow "SHOW TAG
 // VALUES" queries on large datasets inside InfluxDB. Until measurements aren't
 // present in SnipeIT they must be retrieved from InfluxDB.
-func (c *InMemCache) loadCache() {
-	cache := make(map[Role]Stations)
+//
+// The cache of a role is only replaced if both its stations and catalogue
+// could be loaded.
+func (c *InMemCache) loadCache(ctx context.Context) error {
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
 
-	for _, r := range Roles {
+	// Besides the defined roles all roles cached on first use are refreshed.
+	users := make(map[Role]*User)
+	for _, r := range c.roles() {
+		k, u := cacheUser(&User{Role: r, License: true})
+		users[k] = u
+	}
+	c.mu.RLock()
+	for r, u := range c.users {
+		if _, ok := users[r]; !ok {
+			users[r] = u
+		}
+	}
+	c.mu.RUnlock()
+
+	keys := make([]Role, 0, len(users))
+	for r := range users {
+		keys = append(keys, r)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	var firstErr error
+	for _, r := range keys {
 		log.Printf("loading cache for %s\n", r)
 
-		ctx := context.WithValue(context.Background(), UserContextKey, &User{Role: r, License: true})
-		s, err := c.metadata.Stations(ctx, &Message{})
+		s, cat, err := c.load(ctx, users[r])
+		status := c.store(r, users[r], s, cat, err)
+
 		if err != nil {
-			log.Printf("error: cache loading failed for %q: %v", r, err)
-			continue
+			log.Printf("error: cache loading failed for %q, serving data of %v: %v", r, status.Updated, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("cache: loading %s: %w", r, err)
+			}
 		}
-		cache[r] = s
 	}
 
+	return firstErr
+}
+
+// roles returns the roles loaded in advance.
+func (c *InMemCache) roles() []Role {
+	if l, ok := c.metadata.(RoleLister); ok {
+		return append([]Role{Public}, l.Roles()...)
+	}
+	return Roles
+}
+
+// store stores the given stations and catalogue of the given role loaded with
+// the given user, unless loading failed with err. It returns the new status of
+// the role.
+func (c *InMemCache) store(r Role, u *User, s Stations, cat Catalogue, err error) CacheStatus {
 	c.mu.Lock()
-	c.cache = cache
-	c.mu.Unlock()
+	defer c.mu.Unlock()
+
+	status := c.status[r]
+	status.Err = err
+	if err == nil {
+		c.cache[r] = s
+		c.catalogue[r] = cat
+		c.users[r] = u
+		status.Updated = time.Now()
+	}
+	c.status[r] = status
+
+	return status
 }
 
+// cacheUser returns the role the metadata of the given user is cached under
+// and the user for loading it. Like for the access rules, users without a
+// signed license are Public.
+func cacheUser(u *User) (Role, *User) {
+	roles := u.Roles()
+	if !u.License || len(roles) == 0 {
+		return Public, &User{Role: Public, License: true}
+	}
+
+	s := make([]string, len(roles))
+	for i, r := range roles {
+		s[i] = string(r)
+	}
+	sort.Strings(s)
+	return Role(strings.Join(s, "+")), &User{Role: u.Role, Groups: u.Groups, License: true}
+}
+
+// load loads the stations and catalogue of the given user.
+func (c *InMemCache) load(ctx context.Context, u *User) (Stations, Catalogue, error) {
+	ctx = context.WithValue(ctx, UserContextKey, u)
+
+	s, err := c.metadata.Stations(ctx, &Message{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cat, err := c.metadata.Catalogue(ctx, &Message{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s, cat, nil
+}
+
+// refreshCache refreshes the cache every CacheRefreshInterval until the cache
+// is closed.
 func (c *InMemCache) refreshCache() {
 	ticker := time.NewTicker(CacheRefreshInterval)
+	defer ticker.Stop()
 
-	go func() {
-		for range ticker.C {
-			c.loadCache()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.loadCache(context.Background())
 		}
-	}()
+	}
 }
 
 // Stations returns a cached instance of stations if available.
 func (c *InMemCache) Stations(ctx context.Context, m *Message) (Stations, error) {
+	s, _, err := c.get(ctx)
+	return s, err
+}
+
+// Catalogue returns a cached instance of the catalogue if available.
+func (c *InMemCache) Catalogue(ctx context.Context, m *Message) (Catalogue, error) {
+	_, cat, err := c.get(ctx)
+	return cat, err
+}
+
+// get returns the cached stations and catalogue of the user of the given
+// context. On a cache miss they are loaded and cached.
+func (c *InMemCache) get(ctx context.Context) (Stations, Catalogue, error) {
+	r, u := cacheUser(UserFromContext(ctx))
+
 	c.mu.RLock()
-	defer c.mu.RUnlock()
+	s, ok := c.cache[r]
+	cat := c.catalogue[r]
+	c.mu.RUnlock()
+	if ok {
+		return s, cat, nil
+	}
+
+	log.Printf("cache missed for %s\n", r)
+	s, cat, err := c.load(ctx, u)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.store(r, u, s, cat, nil)
+
+	return s, cat, nil
+}
+
+// SeriesCache represents a Database caching the time series of the decorated
+// Database in memory. The least recently used time series are evicted as soon
+// as the total number of cached points exceeds the maximum.
+//
+// Time series are cached by their Message, which must already be redacted by
+// the access rules of the user, i.e. SeriesCache must be decorated by the
+// access control and not the other way around.
+type SeriesCache struct {
+	db        Database
+	maxPoints int64
+
+	// TTL is the duration a time series is cached.
+	TTL time.Duration
 
-	u := UserFromContext(ctx)
-	s, ok := c.cache[u.Role]
+	// RecentTTL is the duration a time series ending today is cached.
+	RecentTTL time.Duration
+
+	now func() time.Time // for testing
+
+	mu      sync.Mutex // guards the fields below
+	lru     *list.List // of *seriesEntry, most recently used first
+	entries map[string]*list.Element
+	points  int64
+	stats   SeriesCacheStats
+}
+
+// seriesEntry represents a single cached time series.
+type seriesEntry struct {
+	key     string
+	ts      TimeSeries
+	points  int64
+	expires time.Time
+}
+
+// SeriesCacheStats represents the statistics of a SeriesCache.
+type SeriesCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int
+	Points    int64
+
+	// Streamed counts the streams read from the decorated Database, which
+	// bypass the cache and thus are not counted as misses.
+	Streamed int64
+}
+
+// NewSeriesCache returns a SeriesCache for the given Database holding at most
+// maxPoints points.
+func NewSeriesCache(db Database, maxPoints int64) *SeriesCache {
+	return &SeriesCache{
+		db:        db,
+		maxPoints: maxPoints,
+		TTL:       DefaultSeriesCacheTTL,
+		RecentTTL: DefaultSeriesCacheRecentTTL,
+		now:       time.Now,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+}
+
+// Series returns the cached time series of the given message if available,
+// otherwise the time series is read from the decorated Database and cached.
+// The returned TimeSeries is a copy, but shares the points with the cache, which
+// must not be modified.
+func (c *SeriesCache) Series(ctx context.Context, m *Message) (TimeSeries, error) {
+	if m == nil {
+		return c.db.Series(ctx, m)
+	}
+
+	key := seriesKey(m)
+	if ts, ok := c.get(key, false); ok {
+		return ts, nil
+	}
+
+	ts, err := c.db.Series(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	c.add(key, ts, c.expires(m))
+
+	return copySeries(ts), nil
+}
+
+// Stream returns a Stream of the cached time series of the given message if
+// available. Otherwise the stream of the decorated Database is returned,
+// which is not cached since streams are used for large time series.
+func (c *SeriesCache) Stream(ctx context.Context, m *Message) (*Stream, error) {
+	if m == nil {
+		return StreamSeries(ctx, c.db, m)
+	}
+
+	if ts, ok := c.get(seriesKey(m), true); ok {
+		return NewStream(ts), nil
+	}
+	return StreamSeries(ctx, c.db, m)
+}
+
+func (c *SeriesCache) Query(ctx context.Context, m *Message) *Stmt {
+	return c.db.Query(ctx, m)
+}
+
+// Stats returns the current statistics of the cache.
+func (c *SeriesCache) Stats() SeriesCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.Points = c.points
+	return stats
+}
+
+// get returns a copy of the cached time series with the given key if
+// available and not expired. Otherwise a miss is counted, or a streamed
+// request if stream is true.
+func (c *SeriesCache) get(key string, stream bool) (TimeSeries, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	miss := &c.stats.Misses
+	if stream {
+		miss = &c.stats.Streamed
+	}
+
+	el, ok := c.entries[key]
 	if !ok {
-		log.Println("cache missed")
-		return c.metadata.Stations(ctx, m)
+		*miss++
+		return nil, false
+	}
+
+	e := el.Value.(*seriesEntry)
+	if !c.now().Before(e.expires) {
+		c.remove(el)
+		*miss++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	c.stats.Hits++
+	return copySeries(e.ts), true
+}
+
+// add caches the given time series until expires and evicts the least
+// recently used time series exceeding the maximum number of points. Time
+// series larger than the cache are not cached at all.
+func (c *SeriesCache) add(key string, ts TimeSeries, expires time.Time) {
+	var points int64
+	for _, m := range ts {
+		points += int64(len(m.Points))
+	}
+	if points > c.maxPoints {
+		return
 	}
 
-	return s, nil
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	c.entries[key] = c.lru.PushFront(&seriesEntry{
+		key:     key,
+		ts:      ts,
+		points:  points,
+		expires: expires,
+	})
+	c.points += points
+
+	for c.points > c.maxPoints {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove removes the given element from the cache. c.mu must be held.
+func (c *SeriesCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*seriesEntry)
+	delete(c.entries, e.key)
+	c.points -= e.points
+}
+
+// expires returns the time the time series of the given message expires.
+func (c *SeriesCache) expires(m *Message) time.Time {
+	now := c.now()
+	if !Daily.Truncate(m.End).Before(Daily.Truncate(now)) {
+		return now.Add(c.RecentTTL)
+	}
+	return now.Add(c.TTL)
+}
+
+// seriesKey returns the cache key of the given message. Messages requesting
+// the same time series in a different order have the same key.
+func seriesKey(m *Message) string {
+	return fmt.Sprintf("%s|%s|%s|%d|%d|%s|%s|%d",
+		normalize(m.Stations),
+		normalize(m.Measurements),
+		normalize(m.Landuse),
+		m.Start.Unix(),
+		m.End.Unix(),
+		m.Interval,
+		m.Function,
+		m.Quality,
+	)
+}
+
+// normalize returns the given values sorted and without duplicates as a
+// single string.
+func normalize(values []string) string {
+	c := append([]string(nil), values...)
+	sort.Strings(c)
+
+	n := 0
+	for i, v := range c {
+		if i > 0 && v == c[n-1] {
+			continue
+		}
+		c[n] = v
+		n++
+	}
+
+	return strings.Join(c[:n], ",")
+}
+
+// copySeries returns a copy of the given TimeSeries sharing its points.
+func copySeries(ts TimeSeries) TimeSeries {
+	c := make(TimeSeries, len(ts))
+	for i, m := range ts {
+		cm := *m
+		cm.Points = append([]*Point(nil), m.Points...)
+		c[i] = &cm
+	}
+	return c
 }
@@ -0,0 +1,291 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package browser
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingDB is a Database returning a time series with one point per
+// measurement and counting the Series calls.
+type countingDB struct {
+	calls int
+	err   error
+}
+
+func (db *countingDB) Series(ctx context.Context, m *Message) (TimeSeries, error) {
+	db.calls++
+	if db.err != nil {
+		return nil, db.err
+	}
+
+	var ts TimeSeries
+	for _, label := range m.Measurements {
+		ts = append(ts, &Measurement{
+			Label:  label,
+			Points: []*Point{{Timestamp: m.Start, Value: 1}},
+		})
+	}
+	return ts, nil
+}
+
+func (db *countingDB) Query(ctx context.Context, m *Message) *Stmt {
+	return &Stmt{}
+}
+
+func TestSeriesCache(t *testing.T) {
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, Location)
+	past := time.Date(2020, 1, 1, 0, 0, 0, 0, Location)
+
+	db := &countingDB{}
+	c := NewSeriesCache(db, 3)
+	c.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	series := func(m *Message) TimeSeries {
+		t.Helper()
+		ts, err := c.Series(ctx, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+
+	ab := &Message{Measurements: []string{"a", "b"}, Stations: []string{"1", "2"}, Start: past, End: past}
+	ts := series(ab)
+	ts[0].Label = "modified"
+	ts[0].Points[0] = nil
+
+	// The same request in a different order is a hit and not affected by
+	// modifications of the previous result.
+	ts = series(&Message{Measurements: []string{"b", "a", "a"}, Stations: []string{"2", "1"}, Start: past, End: past})
+	if ts[0].Label != "a" || ts[0].Points[0] == nil {
+		t.Fatalf("got modified time series %v", ts[0])
+	}
+	if db.calls != 1 {
+		t.Fatalf("got %d database calls, want 1", db.calls)
+	}
+
+	// Exceeding the maximum points evicts the least recently used time series.
+	series(&Message{Measurements: []string{"c"}, Start: past, End: past})
+	series(&Message{Measurements: []string{"d"}, Start: past, End: past})
+	series(ab)
+	if db.calls != 4 {
+		t.Fatalf("got %d database calls, want 4", db.calls)
+	}
+
+	// Time series ending today expire after RecentTTL.
+	today := &Message{Measurements: []string{"c"}, Start: past, End: now}
+	series(today)
+	now = now.Add(c.RecentTTL)
+	series(today)
+	if db.calls != 6 {
+		t.Fatalf("got %d database calls, want 6", db.calls)
+	}
+
+	// Errors are not cached.
+	db.err = ErrDataNotFound
+	e := &Message{Measurements: []string{"e"}, Start: past, End: past}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Series(ctx, e); !errors.Is(err, ErrDataNotFound) {
+			t.Fatalf("got error %v, want %v", err, ErrDataNotFound)
+		}
+	}
+
+	// Streams bypass the cache and are not counted as misses.
+	db.err = nil
+	if _, err := c.Stream(ctx, &Message{Measurements: []string{"f"}, Start: past, End: past}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := SeriesCacheStats{Hits: 1, Misses: 8, Evictions: 3, Entries: 2, Points: 3, Streamed: 1}
+	if got := c.Stats(); got != want {
+		t.Fatalf("got stats %+v, want %+v", got, want)
+	}
+}
+
+func TestSeriesCacheExpires(t *testing.T) {
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, Location)
+	c := NewSeriesCache(&countingDB{}, 1)
+	c.now = func() time.Time { return now }
+
+	testCases := map[string]struct {
+		end  time.Time
+		want time.Duration
+	}{
+		"Past":      {time.Date(2020, 6, 14, 0, 0, 0, 0, Location), c.TTL},
+		"Today":     {time.Date(2020, 6, 15, 0, 0, 0, 0, Location), c.RecentTTL},
+		"TodayUTC":  {time.Date(2020, 6, 14, 23, 0, 0, 0, time.UTC), c.RecentTTL},
+		"Yesterday": {time.Date(2020, 6, 14, 22, 59, 0, 0, time.UTC), c.TTL},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			if got := c.expires(&Message{End: tc.end}); !got.Equal(now.Add(tc.want)) {
+				t.Fatalf("got expiry %v, want %v", got, now.Add(tc.want))
+			}
+		})
+	}
+}
+
+// testMetadata is a Metadata returning the given stations or error.
+type testMetadata struct {
+	mu       sync.Mutex
+	stations Stations
+	err      error
+}
+
+func (md *testMetadata) set(stations Stations, err error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.stations, md.err = stations, err
+}
+
+func (md *testMetadata) Stations(ctx context.Context, m *Message) (Stations, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	return md.stations, md.err
+}
+
+func (md *testMetadata) Catalogue(ctx context.Context, m *Message) (Catalogue, error) {
+	return Catalogue{}, nil
+}
+
+func TestInMemCacheRefresh(t *testing.T) {
+	md := &testMetadata{stations: Stations{{ID: "1"}}}
+	c := NewInMemCache(md)
+	defer c.Close()
+
+	ctx := context.WithValue(context.Background(), UserContextKey, &User{Role: FullAccess, License: true})
+	stations := func() int {
+		t.Helper()
+		s, err := c.Stations(ctx, &Message{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(s)
+	}
+
+	// New stations are visible after a refresh.
+	md.set(Stations{{ID: "1"}, {ID: "2"}}, nil)
+	if got := stations(); got != 1 {
+		t.Fatalf("got %d stations before refresh, want 1", got)
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := stations(); got != 2 {
+		t.Fatalf("got %d stations after refresh, want 2", got)
+	}
+	updated := c.Status()[FullAccess].Updated
+
+	// Stale stations are served if refreshing fails.
+	md.set(nil, ErrInternal)
+	if err := c.Refresh(context.Background()); !errors.Is(err, ErrInternal) {
+		t.Fatalf("got error %v, want %v", err, ErrInternal)
+	}
+	if got := stations(); got != 2 {
+		t.Fatalf("got %d stations after failed refresh, want 2", got)
+	}
+	status := c.Status()[FullAccess]
+	if !status.Stale() || !status.Updated.Equal(updated) {
+		t.Fatalf("got status %+v, want stale status updated at %v", status, updated)
+	}
+
+	// The status recovers with the next successful refresh.
+	md.set(Stations{{ID: "1"}}, nil)
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.Status()[FullAccess].Stale() {
+		t.Fatal("got stale status after successful refresh")
+	}
+
+	// Closing twice must not panic.
+	c.Close()
+	c.Close()
+}
+
+// roleMetadata is a Metadata defining roles and returning a station named
+// after the roles of the user.
+type roleMetadata struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (md *roleMetadata) Roles() []Role {
+	return []Role{"UniInnsbruck", FullAccess}
+}
+
+func (md *roleMetadata) Stations(ctx context.Context, m *Message) (Stations, error) {
+	u := UserFromContext(ctx)
+
+	var roles []string
+	for _, r := range u.Roles() {
+		roles = append(roles, string(r))
+	}
+	id := strings.Join(roles, ",")
+
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.calls[id]++
+	return Stations{{ID: id}}, nil
+}
+
+func (md *roleMetadata) Catalogue(ctx context.Context, m *Message) (Catalogue, error) {
+	return Catalogue{}, nil
+}
+
+func TestInMemCacheRoles(t *testing.T) {
+	md := &roleMetadata{calls: make(map[string]int)}
+	c := NewInMemCache(md)
+	defer c.Close()
+
+	for _, r := range []Role{Public, "UniInnsbruck", FullAccess} {
+		if _, ok := c.Status()[r]; !ok {
+			t.Fatalf("role %s not loaded in advance", r)
+		}
+	}
+
+	testCases := map[string]struct {
+		user *User
+		want string
+	}{
+		"Role":      {&User{Role: "UniInnsbruck", License: true}, "UniInnsbruck"},
+		"Groups":    {&User{Role: External, Groups: []Role{"UniInnsbruck"}, License: true}, "External,UniInnsbruck"},
+		"NoLicense": {&User{Role: FullAccess}, "Public"},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), UserContextKey, tc.user)
+			for i := 0; i < 2; i++ {
+				s, err := c.Stations(ctx, &Message{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(s) != 1 || s[0].ID != tc.want {
+					t.Fatalf("got stations %v, want %s", s, tc.want)
+				}
+			}
+
+			md.mu.Lock()
+			defer md.mu.Unlock()
+			if md.calls[tc.want] != 1 {
+				t.Fatalf("loaded stations of %s %d times, want once", tc.want, md.calls[tc.want])
+			}
+		})
+	}
+
+	// Roles cached on first use are reported by Status.
+	if _, ok := c.Status()["External+UniInnsbruck"]; !ok {
+		t.Fatal("roles of groups not cached")
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/euracresearch/browser"
+	"github.com/euracresearch/browser/internal/access"
+)
+
+// errProblems is returned by the access check command if the access file has
+// problems.
+var errProblems = errors.New("access file has problems")
+
+// accessCommand runs the access subcommand with the given arguments against
+// the given access file and metadata, writing its output to w. The
+// subcommands are:
+//
+//	check    validate the access file against the metadata
+//	explain  print how the rules redact a request of a role
+func accessCommand(ctx context.Context, w io.Writer, file string, md browser.Metadata, args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: browser [flags] access <check|explain> [command flags]")
+	}
+
+	switch args[0] {
+	case "check":
+		return checkAccess(ctx, w, file, md)
+	case "explain":
+		return explainAccess(w, file, md, args[1:])
+	}
+	return fmt.Errorf("unknown access command %q", args[0])
+}
+
+// checkAccess prints all problems of the given access file. It returns
+// errProblems if there are any.
+func checkAccess(ctx context.Context, w io.Writer, file string, md browser.Metadata) error {
+	problems, err := access.Check(ctx, file, md)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range problems {
+		fmt.Fprintln(w, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %d found in %q", errProblems, len(problems), file)
+	}
+
+	fmt.Fprintf(w, "%s: ok\n", file)
+	return nil
+}
+
+// explainAccess prints the redacted messages and the denials of a request
+// given by the flags in args.
+func explainAccess(w io.Writer, file string, md browser.Metadata, args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	var (
+		role         = fs.String("role", string(browser.DefaultRole), "Role of the user.")
+		groups       = fs.String("groups", "", "Comma separated groups of the user.")
+		license      = fs.Bool("license", true, "Whether the user agreed to the license.")
+		stations     = fs.String("stations", "", "Comma separated list of station IDs.")
+		measurements = fs.String("measurements", "", "Comma separated list of measurements.")
+		landuse      = fs.String("landuse", "", "Comma separated list of landuse.")
+		start        = fs.String("start", time.Now().AddDate(0, 0, -7).Format("2006-01-02"), "Start date in the format YYYY-MM-DD.")
+		end          = fs.String("end", time.Now().Format("2006-01-02"), "End date in the format YYYY-MM-DD.")
+		interval     = fs.String("interval", "", "Aggregation interval: hourly, daily or monthly. Default are the raw points.")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	m := &browser.Message{
+		Stations:     split(*stations),
+		Measurements: split(*measurements),
+		Landuse:      split(*landuse),
+	}
+
+	var err error
+	if m.Start, err = time.ParseInLocation("2006-01-02", *start, browser.Location); err != nil {
+		return fmt.Errorf("could not parse start date %v", err)
+	}
+	if m.End, err = time.ParseInLocation("2006-01-02", *end, browser.Location); err != nil {
+		return fmt.Errorf("could not parse end date %v", err)
+	}
+	if m.Interval, err = browser.ParseInterval(*interval); err != nil {
+		return err
+	}
+
+	// The rules are only evaluated, thus no database is needed.
+	a, err := access.New(file, nil, md)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	u := &browser.User{Role: browser.NewRole(*role), Groups: browser.ParseRoles(*groups), License: *license}
+	e := a.Explain(u, m)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "RULE\t%s\n", e.Rule)
+	for i, m := range e.Messages {
+		fmt.Fprintf(tw, "\nMESSAGE\t%d\n", i+1)
+		fmt.Fprintf(tw, "stations\t%s\n", list(m.Stations))
+		fmt.Fprintf(tw, "measurements\t%s\n", list(m.Measurements))
+		fmt.Fprintf(tw, "landuse\t%s\n", list(m.Landuse))
+		fmt.Fprintf(tw, "start\t%s\n", m.Start.Format("2006-01-02"))
+		fmt.Fprintf(tw, "end\t%s\n", m.End.Format("2006-01-02"))
+		fmt.Fprintf(tw, "interval\t%s\n", m.Interval)
+		fmt.Fprintf(tw, "limit\t%d\n", m.Limit)
+	}
+	if len(e.Messages) == 0 {
+		fmt.Fprintln(tw, "\nno data accessible")
+	}
+	if len(e.Denials) > 0 {
+		fmt.Fprintln(tw, "\nDENIED")
+		for _, d := range e.Denials {
+			fmt.Fprintln(tw, d)
+		}
+	}
+	return tw.Flush()
+}
+
+// list returns the given values comma separated or "all" if there are none.
+func list(values []string) string {
+	if len(values) == 0 {
+		return "all"
+	}
+	return strings.Join(values, ",")
+}
+
+// split splits a comma separated list and drops empty elements. It returns
+// nil if the list is empty.
+func split(s string) []string {
+	var r []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			r = append(r, e)
+		}
+	}
+	return r
+}
@@ -5,22 +5,31 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/euracresearch/browser"
 	"github.com/euracresearch/browser/internal/access"
+	"github.com/euracresearch/browser/internal/export"
 	"github.com/euracresearch/browser/internal/http"
 	"github.com/euracresearch/browser/internal/influx"
+	"github.com/euracresearch/browser/internal/influx2"
 	"github.com/euracresearch/browser/internal/middleware"
 	"github.com/euracresearch/browser/internal/oauth2"
+	"github.com/euracresearch/browser/internal/registry"
 	"github.com/euracresearch/browser/internal/snipeit"
+	"github.com/euracresearch/browser/internal/timescale"
 
 	"github.com/gorilla/securecookie"
 	client "github.com/influxdata/influxdb1-client/v2"
+	_ "github.com/lib/pq"
 	"github.com/peterbourgon/ff"
 )
 
@@ -32,17 +41,40 @@ func main() {
 	fs := flag.NewFlagSet("browser", flag.ExitOnError)
 	var (
 		httpAddr          = fs.String("http", defaultAddr, "HTTP service address.")
+		httpTimeout       = fs.Duration("http.timeout", 10*time.Minute, "Maximum duration of a HTTP request, except streamed downloads (0 disables).")
 		influxAddr        = fs.String("influx.addr", "http://127.0.0.1:8086", "Influx (http:https)://host:port")
 		influxUser        = fs.String("influx.username", "", "Influx username")
 		influxPass        = fs.String("influx.password", "", "Influx password")
 		influxDatabase    = fs.String("influx.database", "", "Influx database name")
+		influxTimeout     = fs.Duration("influx.timeout", 2*time.Minute, "Maximum duration of a single Influx series query (0 disables).")
+		influxWorkers     = fs.Int("influx.workers", influx.DefaultWorkers, "Maximum number of concurrent Influx queries per series request.")
+		splitStations     = fs.Bool("influx.split.stations", false, "Split Influx series queries additionally by station.")
+		splitYears        = fs.Bool("influx.split.years", false, "Split Influx series queries additionally by year.")
+		databaseBackend   = fs.String("database.backend", "influx", "Time series database backend: influx, influx2 or timescale.")
+		timescaleDSN      = fs.String("timescale.dsn", "", "PostgreSQL/TimescaleDB connection string, used by the timescale database backend.")
+		timescaleTable    = fs.String("timescale.table", timescale.DefaultTable, "PostgreSQL/TimescaleDB table holding the points.")
+		influx2Addr       = fs.String("influx2.addr", "http://127.0.0.1:8086", "InfluxDB 2.x (http:https)://host:port, used by the influx2 database backend.")
+		influx2Token      = fs.String("influx2.token", "", "InfluxDB 2.x API token.")
+		influx2Org        = fs.String("influx2.org", "", "InfluxDB 2.x organization.")
+		influx2Bucket     = fs.String("influx2.bucket", "", "InfluxDB 2.x bucket.")
+		influx2Workers    = fs.Int("influx2.workers", influx2.DefaultWorkers, "Maximum number of concurrent InfluxDB 2.x queries per series request.")
+		cachePoints       = fs.Int64("cache.series.points", 2000000, "Maximum number of points of cached time series (0 disables the cache).")
+		cacheTTL          = fs.Duration("cache.series.ttl", browser.DefaultSeriesCacheTTL, "Duration a time series is cached.")
+		cacheRecentTTL    = fs.Duration("cache.series.recentttl", browser.DefaultSeriesCacheRecentTTL, "Duration a time series ending today is cached.")
 		usersDatabase     = fs.String("users.database", "", "Database name for storing user information.")
 		usersEnvironment  = fs.String("users.env", "testing", "The environment the app is running.")
+		metadataBackend   = fs.String("metadata.backend", "snipeit", "Metadata backend: snipeit or file.")
+		metadataFile      = fs.String("metadata.file", "/etc/browser/metadata.yaml", "YAML or JSON file with stations and measurement catalogue, used by the file metadata backend.")
 		snipeitAddr       = fs.String("snipeit.addr", "", "SnipeIT API URL")
 		snipeitToken      = fs.String("snipeit.token", "", "SnipeIT API Token")
+		catalogueFile     = fs.String("catalogue.file", "", "Measurement catalogue file (optional). If empty the catalogue is read from SnipeIT.")
+		catalogueCategory = fs.Int("catalogue.category", 0, "SnipeIT category ID holding the measurement catalogue.")
 		jwtKey            = fs.String("jwt.key", "", "Secret key used to create a JWT. Don't share it.")
 		xsrfKey           = fs.String("xsrf.key", "d71404b42640716b0050ad187489c128ec3d611179cf14a29ddd6ea0d536a2c1", "Random string used for generating XSRF token.")
 		accessFile        = fs.String("access.file", "/etc/browser/access.json", "Access file.")
+		exportDir         = fs.String("export.dir", "", "Directory for storing the files of asynchronous exports (optional). If empty exports are disabled.")
+		exportWorkers     = fs.Int("export.workers", export.DefaultWorkers, "Maximum number of concurrently running exports.")
+		exportTTL         = fs.Duration("export.ttl", export.DefaultTTL, "Duration a finished export is kept.")
 		analyticsCode     = fs.String("analytics.code", "", "Google Analytics Code")
 		cookieHashKey     = fs.String("cookie.hash", "3998130314e70d9037e05bf872881156da20e07f344f6d9ae58f92e4be85a07dbdb8949c2eee7e0498247176df3d7785200e586c1b52b7f87210119297f77552", "Hash key used for securing the HTTP cookie. Should be at least 32 bytes long.")
 		cookieBlockKey    = fs.String("cookie.block", "e48f59d35c3871586f68d788bcff6c45", "Block keys should be 16 bytes (AES-128) or 32 bytes (AES-256) long. Shorter keys may weaken the encryption used.")
@@ -67,10 +99,6 @@ func main() {
 
 	required("influx.addr", *influxAddr)
 	required("influx.database", *influxDatabase)
-	required("users.database", *usersDatabase)
-	required("snipeit.addr", *snipeitAddr)
-	required("snipeit.token", *snipeitToken)
-	required("jwt.key", *jwtKey)
 
 	// Initialize influx v1 client.
 	ic, err := client.NewHTTPClient(client.HTTPConfig{
@@ -83,33 +111,113 @@ func main() {
 	}
 	defer ic.Close()
 
+	// The access subcommand only needs the metadata for checking and
+	// explaining the access file, e.g.:
+	//
+	//	browser -config browser.conf access check
+	//	browser -config browser.conf access explain -role External -stations 1 -measurements air_t_avg
+	if fs.Arg(0) == "access" {
+		metadata, err := newMetadata(*metadataBackend, *metadataFile, *snipeitAddr, *snipeitToken, *catalogueFile, *catalogueCategory, ic, *influxDatabase)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := accessCommand(context.Background(), os.Stdout, *accessFile, metadata, fs.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	required("users.database", *usersDatabase)
+	required("jwt.key", *jwtKey)
+
 	_, _, err = ic.Ping(10 * time.Second)
 	if err != nil {
 		log.Fatalf("influx: could not contact Influx DB: %v\n", err)
 	}
 
 	// Initialize services.
-	db := influx.NewDB(ic, *influxDatabase)
-	metadata, err := snipeit.NewSnipeITService(*snipeitAddr, *snipeitToken, ic, *influxDatabase)
+	db, err := newDatabase(&databaseConfig{
+		backend:        *databaseBackend,
+		influxClient:   ic,
+		influxDatabase: *influxDatabase,
+		influxWorkers:  *influxWorkers,
+		influxTimeout:  *influxTimeout,
+		splitStations:  *splitStations,
+		splitYears:     *splitYears,
+		timescaleDSN:   *timescaleDSN,
+		timescaleTable: *timescaleTable,
+		influx2Addr:    *influx2Addr,
+		influx2Token:   *influx2Token,
+		influx2Org:     *influx2Org,
+		influx2Bucket:  *influx2Bucket,
+		influx2Workers: *influx2Workers,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	metadata, err := newMetadata(*metadataBackend, *metadataFile, *snipeitAddr, *snipeitToken, *catalogueFile, *catalogueCategory, ic, *influxDatabase)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Decorating the Database with a cache of time series. The cache is
+	// decorated by the ACL service, so that it caches redacted requests.
+	if *cachePoints > 0 {
+		cache := browser.NewSeriesCache(db, *cachePoints)
+		cache.TTL = *cacheTTL
+		cache.RecentTTL = *cacheRecentTTL
+		db = cache
+	}
+
 	// Decorating the Database and Metadata with an ACL service.
 	acl, err := access.New(*accessFile, db, metadata)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer acl.Close()
 
-	// Decorating the Metadata service with an in memory cache service.
-	cache := browser.NewInMemCache(acl)
+	// Decorating the Metadata service with an in memory cache service. The
+	// file backend is already held in memory and reloads on its own.
+	var cache browser.Metadata = acl
+	if *metadataBackend == "snipeit" {
+		c := browser.NewInMemCache(acl)
+		defer c.Close()
+		cache = c
+	}
 
-	// Initialize HTTP endpoints.
-	frontend := http.NewHandler(
+	// Initialize the user and API token services.
+	users := &influx.UserService{
+		Client:   ic,
+		Database: *usersDatabase,
+		Env:      *usersEnvironment,
+	}
+	tokens := &influx.TokenService{
+		Client:   ic,
+		Database: *usersDatabase,
+		Env:      *usersEnvironment,
+		Users:    users,
+	}
+
+	// Initialize the optional export service, applying the access rules of
+	// the user when an export is created.
+	options := []http.Option{
 		http.WithDatabase(acl),
 		http.WithMetadata(cache),
+		http.WithTokens(tokens),
 		http.WithAnalyticsCode(*analyticsCode),
-	)
+	}
+	if *exportDir != "" {
+		exports, err := export.NewService(acl, *exportDir, *exportWorkers, *exportTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer exports.Close()
+
+		options = append(options, http.WithExports(exports))
+	}
+
+	// Initialize HTTP endpoints.
+	frontend := http.NewHandler(options...)
 
 	// Initialize authentication handler.
 	handler := &oauth2.Handler{
@@ -120,11 +228,8 @@ func main() {
 			Secret: *jwtKey,
 			Cookie: securecookie.New([]byte(*cookieHashKey), []byte(*cookieBlockKey)),
 		},
-		Users: &influx.UserService{
-			Client:   ic,
-			Database: *usersDatabase,
-			Env:      *usersEnvironment,
-		},
+		Users:  users,
+		Tokens: tokens,
 	}
 
 	// Initialize OAuth2 providers.
@@ -150,13 +255,134 @@ func main() {
 
 	// Add some common middleware.
 	mw := middleware.Chain(
+		// Streamed series and export downloads may take longer than any
+		// sensible request timeout.
+		middleware.Timeout(*httpTimeout, "/api/v1/series", "/api/v1/exports/"),
 		middleware.SecureHeaders(),
 		middleware.XSRFProtect(*xsrfKey),
 		middleware.Robots("robots.txt"),
 	)
 
+	// Refresh the metadata cache on SIGHUP and shut down on SIGINT or SIGTERM.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	refresher, _ := cache.(browser.Refresher)
+	go handleSignals(cancel, refresher)
+
 	log.Printf("Starting server on %s\n", *httpAddr)
-	log.Fatal(http.ListenAndServe(*httpAddr, mw(handler)))
+	if err := http.Serve(ctx, *httpAddr, mw(handler)); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Server stopped")
+}
+
+// handleSignals refreshes r on SIGHUP, if r is not nil, and calls shutdown on
+// SIGINT or SIGTERM.
+func handleSignals(shutdown func(), r browser.Refresher) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	for sig := range c {
+		if sig != syscall.SIGHUP {
+			log.Printf("Received %v, shutting down\n", sig)
+			signal.Stop(c)
+			shutdown()
+			return
+		}
+
+		if r == nil {
+			continue
+		}
+		log.Println("Received SIGHUP, refreshing cache")
+		if err := r.Refresh(context.Background()); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// databaseConfig holds the configuration of all database backends.
+type databaseConfig struct {
+	backend string
+
+	influxClient   client.Client
+	influxDatabase string
+	influxWorkers  int
+	influxTimeout  time.Duration
+	splitStations  bool
+	splitYears     bool
+
+	timescaleDSN   string
+	timescaleTable string
+
+	influx2Addr    string
+	influx2Token   string
+	influx2Org     string
+	influx2Bucket  string
+	influx2Workers int
+}
+
+// newDatabase returns the time series database of the configured backend.
+func newDatabase(c *databaseConfig) (browser.Database, error) {
+	switch c.backend {
+	case "influx":
+		db := influx.NewDB(c.influxClient, c.influxDatabase)
+		db.Workers = c.influxWorkers
+		db.Timeout = c.influxTimeout
+		db.SplitStations = c.splitStations
+		db.SplitYears = c.splitYears
+		return db, nil
+
+	case "influx2":
+		required("influx2.token", c.influx2Token)
+		required("influx2.org", c.influx2Org)
+		required("influx2.bucket", c.influx2Bucket)
+
+		db := influx2.NewDB(c.influx2Addr, c.influx2Token, c.influx2Org, c.influx2Bucket)
+		db.Workers = c.influx2Workers
+		return db, nil
+
+	case "timescale":
+		required("timescale.dsn", c.timescaleDSN)
+
+		conn, err := sql.Open("postgres", c.timescaleDSN)
+		if err != nil {
+			return nil, fmt.Errorf("timescale: could not open database: %v", err)
+		}
+
+		// The database name is shown in the code templates.
+		var name string
+		if err := conn.QueryRow("SELECT current_database()").Scan(&name); err != nil {
+			return nil, fmt.Errorf("timescale: could not contact database: %v", err)
+		}
+
+		db := timescale.NewDB(conn, name)
+		db.Table = c.timescaleTable
+		return db, nil
+	}
+
+	return nil, fmt.Errorf("unknown database backend %q", c.backend)
+}
+
+// newMetadata returns the metadata service of the given backend.
+func newMetadata(backend, file, snipeitAddr, snipeitToken, catalogueFile string, catalogueCategory int, ic client.Client, database string) (browser.Metadata, error) {
+	switch backend {
+	case "file":
+		return registry.New(file)
+
+	case "snipeit":
+		required("snipeit.addr", snipeitAddr)
+		required("snipeit.token", snipeitToken)
+
+		s, err := snipeit.NewSnipeITService(snipeitAddr, snipeitToken, ic, database)
+		if err != nil {
+			return nil, err
+		}
+		s.CatalogueFile = catalogueFile
+		s.CatalogueCategory = catalogueCategory
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("unknown metadata backend %q", backend)
 }
 
 func required(name, value string) {
@@ -0,0 +1,83 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/euracresearch/browser"
+	"github.com/euracresearch/browser/internal/encoding/csv"
+	"github.com/euracresearch/browser/internal/encoding/csvf"
+	"github.com/euracresearch/browser/internal/encoding/json"
+	"github.com/euracresearch/browser/internal/encoding/netcdf"
+	"github.com/euracresearch/browser/internal/encoding/parquet"
+)
+
+// direct is a backend querying the database and metadata services directly.
+// All requests are made on behalf of user, so that the access rules of the
+// services apply as on the server.
+type direct struct {
+	db       browser.Database
+	metadata browser.Metadata
+	user     *browser.User
+}
+
+// Stations implements backend.
+func (d *direct) Stations(ctx context.Context) (browser.Stations, error) {
+	return d.metadata.Stations(d.context(ctx), &browser.Message{})
+}
+
+// Download implements backend.
+func (d *direct) Download(ctx context.Context, m *browser.Message, format string, metadata bool, w io.Writer) error {
+	ctx = d.context(ctx)
+
+	var catalogue browser.Catalogue
+	if metadata {
+		var err error
+		catalogue, err = d.metadata.Catalogue(ctx, &browser.Message{Measurements: m.Measurements})
+		if err != nil {
+			return err
+		}
+	}
+
+	switch format {
+	case "json", "parquet", "netcdf":
+		ts, err := d.db.Series(ctx, m)
+		if err != nil {
+			return err
+		}
+
+		switch format {
+		case "parquet":
+			return parquet.NewWriter(w).Write(ts)
+		case "netcdf":
+			return netcdf.NewWriter(w).Write(ts)
+		default:
+			return json.NewWriter(w).Write(ts)
+		}
+	}
+
+	// The CSV formats are written while reading the points from the database.
+	stream, err := browser.StreamSeries(ctx, d.db, m)
+	if err != nil {
+		return err
+	}
+
+	if format == "wide" {
+		writer := csvf.NewWriter(w)
+		writer.Catalogue = catalogue
+		return writer.WriteStream(stream)
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Catalogue = catalogue
+	return writer.WriteStream(stream)
+}
+
+// context returns a copy of ctx carrying the user of the backend.
+func (d *direct) context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, browser.UserContextKey, d.user)
+}
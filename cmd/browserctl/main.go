@@ -0,0 +1,351 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Command browserctl is a command line client for listing stations and
+// measurements and downloading time series. It either talks to a running
+// browser server using a personal API token or directly to InfluxDB and
+// SnipeIT using the same access rules as the server.
+//
+// Usage:
+//
+//  browserctl [flags] <command> [command flags]
+//
+// The commands are:
+//
+//  stations      list all stations
+//  measurements  list all measurements
+//  download      download time series
+//
+// Examples:
+//
+//  browserctl -server https://browser.lter.eurac.edu -token $TOKEN stations
+//  browserctl -server https://browser.lter.eurac.edu -token $TOKEN download \
+//      -stations 1,2 -measurements air_t_avg,air_rh_avg \
+//      -start 2020-01-01 -end 2020-01-31 -format wide -o air.csv
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/euracresearch/browser"
+	"github.com/euracresearch/browser/internal/access"
+	"github.com/euracresearch/browser/internal/influx"
+	"github.com/euracresearch/browser/internal/snipeit"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/peterbourgon/ff"
+)
+
+// backend is the source of stations and time series.
+type backend interface {
+	// Stations returns all stations.
+	Stations(ctx context.Context) (browser.Stations, error)
+
+	// Download writes the time series of the given message encoded in the
+	// given format to w. If metadata is true a description of each
+	// measurement is added to CSV downloads.
+	Download(ctx context.Context, m *browser.Message, format string, metadata bool, w io.Writer) error
+}
+
+func main() {
+	log.SetPrefix("browserctl: ")
+	log.SetFlags(0)
+
+	fs := flag.NewFlagSet("browserctl", flag.ExitOnError)
+	var (
+		serverAddr     = fs.String("server", "", "Address of a running browser server, e.g. https://browser.lter.eurac.edu. If empty InfluxDB and SnipeIT are queried directly.")
+		token          = fs.String("token", "", "Personal API token used for authenticating against the server.")
+		influxAddr     = fs.String("influx.addr", "http://127.0.0.1:8086", "Influx (http:https)://host:port")
+		influxUser     = fs.String("influx.username", "", "Influx username")
+		influxPass     = fs.String("influx.password", "", "Influx password")
+		influxDatabase = fs.String("influx.database", "", "Influx database name")
+		snipeitAddr    = fs.String("snipeit.addr", "", "SnipeIT API URL")
+		snipeitToken   = fs.String("snipeit.token", "", "SnipeIT API Token")
+		accessFile     = fs.String("access.file", "/etc/browser/access.json", "Access file.")
+		role           = fs.String("role", string(browser.DefaultRole), "Role used for applying the access rules when querying InfluxDB directly.")
+		groups         = fs.String("groups", "", "Comma separated groups used together with the role for applying the access rules.")
+		timeout        = fs.Duration("timeout", 10*time.Minute, "Timeout of a single command.")
+		_              = fs.String("config", "", "Config file (optional)")
+	)
+	fs.Usage = usage(fs)
+
+	ff.Parse(fs, os.Args[1:],
+		ff.WithConfigFileFlag("config"),
+		ff.WithConfigFileParser(ff.PlainParser),
+		ff.WithEnvVarPrefix("BROWSERCTL"),
+	)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var b backend
+	if *serverAddr != "" {
+		b = newServer(*serverAddr, *token)
+	} else {
+		required("influx.database", *influxDatabase)
+		required("snipeit.addr", *snipeitAddr)
+		required("snipeit.token", *snipeitToken)
+
+		ic, err := client.NewHTTPClient(client.HTTPConfig{
+			Addr:     *influxAddr,
+			Username: *influxUser,
+			Password: *influxPass,
+		})
+		if err != nil {
+			log.Fatalf("influx: could not create client: %v\n", err)
+		}
+		defer ic.Close()
+
+		metadata, err := snipeit.NewSnipeITService(*snipeitAddr, *snipeitToken, ic, *influxDatabase)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		acl, err := access.New(*accessFile, influx.NewDB(ic, *influxDatabase), metadata)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer acl.Close()
+
+		b = &direct{
+			db:       acl,
+			metadata: acl,
+			user:     &browser.User{Role: browser.NewRole(*role), Groups: browser.ParseRoles(*groups), License: true},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+
+	var err error
+	switch cmd {
+	default:
+		fmt.Fprintf(os.Stderr, "browserctl: unknown command %q\n\n", cmd)
+		fs.Usage()
+		os.Exit(2)
+	case "stations":
+		err = stations(ctx, b, args)
+	case "measurements":
+		err = measurements(ctx, b, args)
+	case "download":
+		err = download(ctx, b, args)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// stations lists all stations matching the given filters.
+func stations(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("stations", flag.ExitOnError)
+	landuse := fs.String("landuse", "", "Comma separated list of landuse to filter by.")
+	fs.Parse(args)
+
+	stations, err := b.Stations(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tLANDUSE\tELEVATION\tLATITUDE\tLONGITUDE")
+	for _, s := range filter(stations, nil, split(*landuse)) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%g\t%g\n", s.ID, s.Name, s.Landuse, s.Elevation, s.Latitude, s.Longitude)
+	}
+	return tw.Flush()
+}
+
+// measurements lists the measurements of all stations matching the given
+// filters.
+func measurements(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("measurements", flag.ExitOnError)
+	ids := fs.String("stations", "", "Comma separated list of station IDs to filter by.")
+	landuse := fs.String("landuse", "", "Comma separated list of landuse to filter by.")
+	fs.Parse(args)
+
+	stations, err := b.Stations(ctx)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	var labels []string
+	for _, s := range filter(stations, split(*ids), split(*landuse)) {
+		for _, m := range s.Measurements {
+			if seen[m] {
+				continue
+			}
+			seen[m] = true
+			labels = append(labels, m)
+		}
+	}
+	sort.Strings(labels)
+
+	for _, l := range labels {
+		fmt.Println(l)
+	}
+	return nil
+}
+
+// download writes the requested time series to a file or to stdout.
+func download(ctx context.Context, b backend, args []string) error {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	var (
+		ids      = fs.String("stations", "", "Comma separated list of station IDs (required).")
+		labels   = fs.String("measurements", "", "Comma separated list of measurements (required).")
+		landuse  = fs.String("landuse", "", "Comma separated list of landuse.")
+		start    = fs.String("start", "", "Start date in the format YYYY-MM-DD (required).")
+		end      = fs.String("end", "", "End date in the format YYYY-MM-DD (required).")
+		interval = fs.String("interval", "", "Aggregation interval: hourly, daily or monthly. Default are the raw points.")
+		function = fs.String("function", "", "Aggregation function: mean, min, max, sum or count.")
+		format   = fs.String("format", "csv", "Output format: csv, wide, json, parquet or netcdf.")
+		metadata = fs.Bool("metadata", false, "Describe each measurement in a header of CSV downloads.")
+		output   = fs.String("o", "", "Output file. Default is stdout.")
+	)
+	fs.Parse(args)
+
+	m, err := newMessage(*ids, *labels, *landuse, *start, *end, *interval, *function)
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "csv", "wide", "json", "parquet", "netcdf":
+	default:
+		return fmt.Errorf("unsupported format %q", *format)
+	}
+
+	if *output == "" {
+		return b.Download(ctx, m, *format, *metadata, os.Stdout)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+
+	// Remove the partially written file on failure, so that it is not
+	// mistaken for a complete download.
+	err = b.Download(ctx, m, *format, *metadata, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*output)
+		return err
+	}
+	return nil
+}
+
+// newMessage returns a new message from the given download flags.
+func newMessage(ids, labels, landuse, start, end, interval, function string) (*browser.Message, error) {
+	m := &browser.Message{
+		Stations:     split(ids),
+		Measurements: split(labels),
+		Landuse:      split(landuse),
+	}
+
+	if m.Stations == nil {
+		return nil, fmt.Errorf("at least one station must be given")
+	}
+
+	if m.Measurements == nil {
+		return nil, fmt.Errorf("at least one measurement must be given")
+	}
+
+	var err error
+	m.Start, err = time.ParseInLocation("2006-01-02", start, browser.Location)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse start date %v", err)
+	}
+
+	m.End, err = time.ParseInLocation("2006-01-02", end, browser.Location)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse end date %v", err)
+	}
+
+	if m.End.Before(m.Start) {
+		return nil, fmt.Errorf("end date is before start date")
+	}
+
+	m.Interval, err = browser.ParseInterval(interval)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Function, err = browser.ParseAggregateFunc(function)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// filter returns the stations with one of the given IDs and landuse. Empty
+// filters match all stations.
+func filter(stations browser.Stations, ids, landuse []string) browser.Stations {
+	var filtered browser.Stations
+	for _, s := range stations {
+		if ids != nil && !contains(ids, s.ID) {
+			continue
+		}
+		if landuse != nil && !contains(landuse, s.Landuse) {
+			continue
+		}
+		filtered = append(filtered, s)
+	}
+	return filtered
+}
+
+// split splits a comma separated list and drops empty elements. It returns
+// nil if the list is empty.
+func split(s string) []string {
+	var r []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			r = append(r, e)
+		}
+	}
+	return r
+}
+
+func contains(s []string, e string) bool {
+	for _, v := range s {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
+
+func usage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "Usage: browserctl [flags] <command> [command flags]\n\n")
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  stations      list all stations\n")
+		fmt.Fprintf(os.Stderr, "  measurements  list all measurements\n")
+		fmt.Fprintf(os.Stderr, "  download      download time series\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		fs.PrintDefaults()
+	}
+}
+
+func required(name, value string) {
+	if value == "" {
+		fmt.Fprintf(os.Stderr, "flag needs an argument: -%s\n\n", name)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/euracresearch/browser"
+)
+
+// failingBackend writes a partial download before failing.
+type failingBackend struct{}
+
+func (failingBackend) Stations(ctx context.Context) (browser.Stations, error) {
+	return nil, nil
+}
+
+func (failingBackend) Download(ctx context.Context, m *browser.Message, format string, metadata bool, w io.Writer) error {
+	io.WriteString(w, "time,station\n")
+	return errors.New("connection reset")
+}
+
+func TestDownloadRemovesPartialFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "browserctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out.csv")
+	err = download(context.Background(), failingBackend{}, []string{
+		"-stations", "1", "-measurements", "a", "-start", "2020-01-01", "-end", "2020-01-02", "-o", out,
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("partial output file not removed: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/euracresearch/browser"
+)
+
+// server is a backend talking to the JSON API of a running browser server.
+type server struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+func newServer(addr, token string) *server {
+	return &server{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		client: http.DefaultClient,
+	}
+}
+
+// Stations implements backend.
+func (s *server) Stations(ctx context.Context) (browser.Stations, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.addr+"/api/v1/stations", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var stations browser.Stations
+	if err := json.NewDecoder(resp.Body).Decode(&stations); err != nil {
+		return nil, fmt.Errorf("could not decode stations: %v", err)
+	}
+	return stations, nil
+}
+
+// Download implements backend.
+func (s *server) Download(ctx context.Context, m *browser.Message, format string, metadata bool, w io.Writer) error {
+	form := url.Values{
+		"stations":     m.Stations,
+		"measurements": m.Measurements,
+		"landuse":      m.Landuse,
+	}
+	form.Set("startDate", m.Start.Format("2006-01-02"))
+	form.Set("endDate", m.End.Format("2006-01-02"))
+	form.Set("interval", string(m.Interval))
+	form.Set("function", string(m.Function))
+	form.Set("format", format)
+	if metadata {
+		form.Set("metadata", "true")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.addr+"/api/v1/series", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// do sends the given request authenticated with the token of the server. An
+// error containing the message of the server is returned if the response has
+// no 2xx status code.
+func (s *server) do(req *http.Request) (*http.Response, error) {
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestServer(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/stations", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"ID":"1","Name":"s1","Measurements":["a_avg"]}]`)
+	})
+	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		r.ParseForm()
+		fmt.Fprintf(w, "%s|%s|%s|%s|%s|%s", r.Form["stations"], r.Form["measurements"], r.FormValue("startDate"), r.FormValue("endDate"), r.FormValue("interval"), r.FormValue("format"))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	stations, err := newServer(ts.URL+"/", "secret").Stations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"a_avg"}, stations[0].Measurements); len(stations) != 1 || diff != "" {
+		t.Fatalf("got unexpected stations %v", stations)
+	}
+
+	m, err := newMessage("1, 2", "a_avg", "", "2020-01-01", "2020-01-31", "daily", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	if err := newServer(ts.URL, "secret").Download(ctx, m, "wide", false, &b); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "[1 2]|[a_avg]|2020-01-01|2020-01-31|daily|wide"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	err = newServer(ts.URL, "invalid").Download(ctx, m, "csv", false, &b)
+	if err == nil || !strings.Contains(err.Error(), "invalid token") {
+		t.Fatalf("got error %v, want error containing %q", err, "invalid token")
+	}
+}
+
+func TestNewMessage(t *testing.T) {
+	testCases := map[string]struct {
+		ids, labels, start, end, interval string
+		wantErr                           bool
+	}{
+		"ok":              {"1", "a_avg", "2020-01-01", "2020-01-02", "", false},
+		"noStations":      {"", "a_avg", "2020-01-01", "2020-01-02", "", true},
+		"noMeasurements":  {"1", " , ", "2020-01-01", "2020-01-02", "", true},
+		"invalidStart":    {"1", "a_avg", "01.01.2020", "2020-01-02", "", true},
+		"endBeforeStart":  {"1", "a_avg", "2020-01-02", "2020-01-01", "", true},
+		"invalidInterval": {"1", "a_avg", "2020-01-01", "2020-01-02", "weekly", true},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			_, err := newMessage(tc.ids, tc.labels, "", tc.start, tc.end, tc.interval, "")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -6,18 +6,52 @@
 //
 // An access file is composed of several access rules. An access rule has a
 // unique name and an access control list for controlling access to specific
-// fields of data for measurements, stations and landuse.
+// fields of data for measurements, stations and landuse. Optionally a rule
+// limits the number of points of a single request.
+//
+// The name of a rule is the role it applies to. Besides the built-in roles
+// any name can be used, e.g. for groups of project partners. The rules of a
+// user holding several roles are applied separately to a request, each with
+// its own restrictions, and the data accessible under any of them is returned.
+// Since a response must not mix raw and aggregated points, requests for which
+// the rules grant different intervals are denied.
+//
+// A rule can further restrict access with:
+//
+//	grants      station and measurement pairs, only granted pairs are accessible
+//	embargo     period before now in which data is not accessible, e.g. "12mo"
+//	history     period before now older data is not accessible, e.g. "10y"
+//	resolution  finest accessible temporal resolution, e.g. "daily"
+//
+// Everything a rule removes from or changes in a request is reported as
+// browser.Denial to the browser.Report of the request context. Requests
+// marked as strict fail with browser.ErrAccessDenied instead.
+//
+// The access file is reloaded as soon as it changes. Files which cannot be
+// decoded, contain invalid rules or no rule for browser.Public are refused
+// and the last valid rules are kept, see Access.Status.
 //
 // An example of an access file is presented below:
 // 	[
 //		{
 //			"name": "Public",
+//			"limit": 5000000,
 //			"acl": {
 //				"measurements": ["a"],
 //				"stations": [1, 2],
 //				"landuse": ["me"]
 //		},
 //		{
+//			"name": "External",
+//			"embargo": "12mo",
+//			"resolution": "hourly",
+//			"grants": [
+//				{"stations": ["12"], "measurements": ["air_t_avg"]},
+//				{"stations": ["13", "14"]}
+//			],
+//			"acl": {}
+//		},
+//		{
 //			"name": "FullAccess",
 //			"acl": {
 //				"measurements": [],
@@ -30,31 +64,53 @@ package access
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/euracresearch/browser"
+
+	"github.com/fsnotify/fsnotify"
 )
 
+// DefautlRefreshInterval is the interval the access file is polled in if it
+// cannot be watched for changes.
 const DefautlRefreshInterval = 10 * time.Minute
 
 var (
 	// Guarantee we implement browser.Database.
 	_ browser.Database = &Access{}
 
+	// Guarantee we implement browser.Streamer.
+	_ browser.Streamer = &Access{}
+
+	// Guarantee we implement browser.Estimator.
+	_ browser.Estimator = &Access{}
+
+	// Guarantee we implement browser.Redactor.
+	_ browser.Redactor = &Access{}
+
 	// Guarantee we implement browser.Metadata.
 	_ browser.Metadata = &Access{}
 
+	// Guarantee we implement browser.RoleLister.
+	_ browser.RoleLister = &Access{}
+
 	// ErrNoRuleFound means that no rule was found for the given name.
 	ErrNoRuleFound = errors.New("access: no rule found")
 
+	// reloadDelay is the delay between a change of the access file and
+	// reloading it.
+	reloadDelay = 100 * time.Millisecond
+
 	// identifier is a regular expression used for checking if a given user
 	// input is a valid identifier.
 	identifier = regexp.MustCompile(`^\w+$`)
@@ -81,15 +137,70 @@ type Access struct {
 	db       browser.Database
 	metadata browser.Metadata
 
-	mu    sync.RWMutex // guards the fields below
-	last  time.Time
-	rules []*Rule
+	// now returns the current time, used for embargo and history periods.
+	now func() time.Time
+
+	// delay is the delay between a change of the access file and reloading
+	// it, see reloadDelay.
+	delay time.Duration
+
+	done    chan struct{} // closed on Close
+	stopped chan struct{} // closed once the rules are not reloaded anymore
+	once    sync.Once
+
+	mu     sync.RWMutex // guards the fields below
+	status RulesStatus
+	rules  []*Rule
+}
+
+// RulesStatus represents the state of the access rules.
+type RulesStatus struct {
+	// Version identifies the content of the access file the active rules
+	// were loaded from. It is empty for the built-in rules.
+	Version string
+
+	// Updated is the time the active rules were loaded.
+	Updated time.Time
+
+	// Err is the error of the last reload, if it failed. The active rules
+	// are kept meanwhile.
+	Err error
+}
+
+// Stale reports whether the last reload failed.
+func (s RulesStatus) Stale() bool {
+	return s.Err != nil
+}
+
+// active describes the active rules for logging.
+func (s RulesStatus) active() string {
+	if s.Version == "" {
+		return "build in rules"
+	}
+	return "rules version " + s.Version
 }
 
 // Rule represents a single access rule.
 type Rule struct {
 	Name browser.Role
 	ACL  *AccessControlList
+
+	// Limit is the maximum number of points a single request may return,
+	// see browser.Message.Estimate. Zero means no limit.
+	Limit int64
+
+	// Grants restricts access to the granted station and measurement pairs
+	// in addition to the ACL. If empty all pairs are granted.
+	Grants []*Grant
+
+	// Embargo hides data newer than the period before now. History hides
+	// data older than the period before now. The zero Period hides nothing.
+	Embargo Period
+	History Period
+
+	// Resolution is the finest accessible temporal resolution. Requests for
+	// finer resolutions are aggregated to it.
+	Resolution browser.Interval
 }
 
 // AccessControlList represents an access list.
@@ -99,11 +210,17 @@ type AccessControlList struct {
 	Landuse      []string
 }
 
-// New returns a new instance of Access.
+// New returns a new instance of Access. The rules are reloaded as soon as the
+// given file changes until Close is called. Invalid rules are refused and the
+// last valid rules are kept.
 func New(file string, db browser.Database, m browser.Metadata) (*Access, error) {
 	a := &Access{
 		db:       db,
 		metadata: m,
+		now:      time.Now,
+		delay:    reloadDelay,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
 	}
 
 	// Create build-in default rules.
@@ -119,33 +236,534 @@ func New(file string, db browser.Database, m browser.Metadata) (*Access, error)
 		},
 	)
 
+	if file == "" {
+		log.Println("access: no access file given, use build in rules.")
+		close(a.stopped)
+		return a, nil
+	}
+
 	if err := a.loadRules(file); err != nil {
 		return nil, err
 	}
 
-	go a.refreshRules(file)
+	// The directory is watched before returning, so that no change is
+	// missed.
+	w, err := watch(file)
+	if err != nil {
+		log.Printf("access: could not watch %q, poll every %v: %v\n", file, DefautlRefreshInterval, err)
+		go a.pollRules(file)
+		return a, nil
+	}
+	go a.watchRules(file, w)
 
 	return a, nil
-
 }
 
 func (a *Access) Series(ctx context.Context, m *browser.Message) (browser.TimeSeries, error) {
-	return a.db.Series(ctx, a.redact(ctx, m))
+	parts, err := a.messages(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	return a.series(ctx, parts)
+}
+
+// series returns the time series of the given redacted messages of each rule.
+// Measurements returned for an earlier rule are dropped.
+func (a *Access) series(ctx context.Context, parts [][]*browser.Message) (browser.TimeSeries, error) {
+	if len(parts) == 1 && len(parts[0]) == 1 {
+		return a.db.Series(ctx, parts[0][0])
+	}
+
+	var (
+		ts    browser.TimeSeries
+		dedup = newDeduplicator()
+		found bool
+	)
+	for _, messages := range parts {
+		for _, m := range messages {
+			s, err := a.db.Series(ctx, m)
+			if errors.Is(err, browser.ErrDataNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			ts = append(ts, dedup.filter(s)...)
+			found = true
+		}
+		dedup.next()
+	}
+	if !found {
+		return nil, browser.ErrDataNotFound
+	}
+
+	return ts, nil
+}
+
+func (a *Access) Stream(ctx context.Context, m *browser.Message) (*browser.Stream, error) {
+	parts, err := a.messages(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	return a.stream(ctx, parts)
+}
+
+// stream returns the time series of the given redacted messages of each rule
+// as stream. Measurements returned for an earlier rule are dropped.
+func (a *Access) stream(ctx context.Context, parts [][]*browser.Message) (*browser.Stream, error) {
+	if len(parts) == 1 && len(parts[0]) == 1 {
+		return browser.StreamSeries(ctx, a.db, parts[0][0])
+	}
+
+	// Points of a measurement are read from the stream it belongs to.
+	var (
+		stream = &browser.Stream{}
+		owner  = make(map[*browser.Measurement]*browser.Stream)
+		dedup  = newDeduplicator()
+		found  bool
+	)
+	for _, messages := range parts {
+		for _, m := range messages {
+			s, err := browser.StreamSeries(ctx, a.db, m)
+			if errors.Is(err, browser.ErrDataNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			ts := dedup.filter(s.TimeSeries)
+			for _, measurement := range ts {
+				owner[measurement] = s
+			}
+			stream.TimeSeries = append(stream.TimeSeries, ts...)
+			found = true
+		}
+		dedup.next()
+	}
+	if !found {
+		return nil, browser.ErrDataNotFound
+	}
+
+	stream.Points = func(m *browser.Measurement) browser.PointIterator {
+		return owner[m].Points(m)
+	}
+	return stream, nil
+}
+
+func (a *Access) Estimate(ctx context.Context, m *browser.Message) (*browser.Estimate, error) {
+	parts, err := a.authorize(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	return a.estimateParts(ctx, parts)
+}
+
+// estimateParts returns the estimated size of the given redacted messages of
+// each rule. Each rule limits its own part of the request, thus the estimate
+// of a part exceeding its limit is returned, otherwise the sum of all parts.
+func (a *Access) estimateParts(ctx context.Context, parts [][]*browser.Message) (*browser.Estimate, error) {
+	total := &browser.Estimate{}
+	limited := true
+	for _, messages := range parts {
+		if len(messages) == 0 {
+			continue
+		}
+
+		e, err := a.estimate(ctx, messages)
+		if err != nil {
+			return nil, err
+		}
+		if e.Exceeded() {
+			return e, nil
+		}
+
+		total.Points += e.Points
+		total.Limit += e.Limit
+		limited = limited && e.Limit > 0
+	}
+	if !limited {
+		total.Limit = 0
+	}
+	return total, nil
+}
+
+// Redact applies the rules of the user of ctx to the given message. The
+// returned browser.Redacted reads the granted time series without applying
+// the rules again.
+func (a *Access) Redact(ctx context.Context, m *browser.Message) (browser.Redacted, error) {
+	parts, err := a.messages(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := a.estimateParts(ctx, parts)
+	if err != nil {
+		return nil, err
+	}
+	return &redacted{access: a, parts: parts, estimate: e}, nil
+}
+
+// redacted implements browser.Redacted holding the redacted messages of each
+// rule.
+type redacted struct {
+	access   *Access
+	parts    [][]*browser.Message
+	estimate *browser.Estimate
+}
+
+func (r *redacted) Estimate() *browser.Estimate {
+	e := *r.estimate
+	return &e
+}
+
+func (r *redacted) Series(ctx context.Context) (browser.TimeSeries, error) {
+	return r.access.series(ctx, r.parts)
+}
+
+func (r *redacted) Stream(ctx context.Context) (*browser.Stream, error) {
+	return r.access.stream(ctx, r.parts)
 }
 
+// Query returns the statement of the redacted message. Since no error can be
+// returned, strict messages are redacted as well, but callers find the
+// denials in the report of ctx.
 func (a *Access) Query(ctx context.Context, m *browser.Message) *browser.Stmt {
-	return a.db.Query(ctx, a.redact(ctx, m))
+	parts, _ := a.authorize(ctx, m)
+
+	var messages []*browser.Message
+	for _, p := range parts {
+		messages = append(messages, p...)
+	}
+	if len(messages) == 0 {
+		return &browser.Stmt{}
+	}
+
+	// Statements of messages split by grants or rules are executed one after
+	// the other.
+	stmt := a.db.Query(ctx, messages[0])
+	for _, m := range messages[1:] {
+		s := a.db.Query(ctx, m)
+		stmt.Query += ";" + s.Query
+	}
+	return stmt
 }
 
 func (a *Access) Stations(ctx context.Context, m *browser.Message) (browser.Stations, error) {
-	return a.metadata.Stations(ctx, a.redact(ctx, m))
+	rules := a.rulesFor(browser.UserFromContext(ctx))
+	redacted, denials := a.redactAll(rules, m)
+	if err := report(ctx, m, denials); err != nil {
+		return nil, err
+	}
+
+	// Stations accessible by several rules are merged.
+	var (
+		stations browser.Stations
+		byID     = make(map[string]*browser.Station)
+	)
+	for i, rule := range rules {
+		if redacted[i] == nil {
+			continue
+		}
+
+		s, err := a.metadata.Stations(ctx, redacted[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, st := range rule.redactStations(s) {
+			if st == nil {
+				continue
+			}
+			if prev, ok := byID[st.ID]; ok {
+				for _, v := range st.Measurements {
+					if !contains(prev.Measurements, v) {
+						prev.Measurements = append(prev.Measurements, v)
+					}
+				}
+				continue
+			}
+
+			c := *st
+			c.Measurements = append([]string(nil), st.Measurements...)
+			byID[c.ID] = &c
+			stations = append(stations, &c)
+		}
+	}
+	return stations, nil
 }
 
-// redact clear every not allowed field and returns a new browser.Message
-func (a *Access) redact(ctx context.Context, m *browser.Message) *browser.Message {
-	u := browser.UserFromContext(ctx)
-	rule := a.rule(u)
+func (a *Access) Catalogue(ctx context.Context, m *browser.Message) (browser.Catalogue, error) {
+	rules := a.rulesFor(browser.UserFromContext(ctx))
+	redacted, denials := a.redactAll(rules, m)
+	if err := report(ctx, m, denials); err != nil {
+		return nil, err
+	}
+
+	var (
+		catalogue browser.Catalogue
+		seen      = make(map[string]bool)
+	)
+	for _, r := range redacted {
+		if r == nil {
+			continue
+		}
 
+		c, err := a.metadata.Catalogue(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range c {
+			if !seen[p.Label] {
+				seen[p.Label] = true
+				catalogue = append(catalogue, p)
+			}
+		}
+	}
+	return catalogue, nil
+}
+
+// messages returns the authorized messages for the given message of each rule
+// of the user. It returns an error wrapping browser.ErrLimitExceeded if the
+// messages of a rule exceed its limit.
+//
+// The time series of all rules are returned as a single time series, which
+// must not mix raw and aggregated points. Thus it returns an error wrapping
+// browser.ErrAccessDenied if the rules coarsen the interval differently.
+func (a *Access) messages(ctx context.Context, m *browser.Message) ([][]*browser.Message, error) {
+	parts, err := a.authorize(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+
+	var first *browser.Message
+	for _, messages := range parts {
+		if len(messages) == 0 {
+			continue
+		}
+
+		if first == nil {
+			first = messages[0]
+		} else if messages[0].Interval != first.Interval {
+			return nil, fmt.Errorf("%w: the roles of the user grant different intervals (%s and %s), request a common interval or the measurements separately",
+				browser.ErrAccessDenied, first.Interval, messages[0].Interval)
+		}
+
+		if err := a.checkLimit(ctx, messages); err != nil {
+			return nil, err
+		}
+	}
+	if first == nil {
+		return nil, browser.ErrDataNotFound
+	}
+	return parts, nil
+}
+
+// authorize returns the redacted messages for the given message of each rule
+// of the user, split by the grants of the rule. All denials are added to the
+// report of ctx. If the message is strict, it returns an error wrapping
+// browser.ErrAccessDenied if anything was denied.
+func (a *Access) authorize(ctx context.Context, m *browser.Message) ([][]*browser.Message, error) {
+	parts, denials := a.apply(a.rulesFor(browser.UserFromContext(ctx)), m)
+	return parts, report(ctx, m, denials)
+}
+
+// apply applies each of the given rules separately to a copy of the given
+// message, so that the restrictions of one rule never widen the access of
+// another. It returns the redacted messages of each rule split by its grants
+// together with the denials of all rules, see merge.
+func (a *Access) apply(rules []*Rule, m *browser.Message) ([][]*browser.Message, browser.Denials) {
+	var (
+		parts    = make([][]*browser.Message, len(rules))
+		denials  = make([]browser.Denials, len(rules))
+		fallback = make([]bool, len(rules))
+	)
+	for i, rule := range rules {
+		r, d, f := a.redact(rule, copyMessage(m))
+		messages, ds, fs := rule.split(r)
+
+		// Nothing requested lies in the time window of the rule.
+		if r.End.Before(r.Start) {
+			messages = nil
+		}
+
+		parts[i] = messages
+		denials[i] = append(d, ds...)
+		fallback[i] = f || fs
+	}
+	return merge(m, parts, denials, fallback)
+}
+
+// merge merges the denials of the redacted messages of several rules for the
+// given message. A rule for which nothing requested is accessible falls back to
+// everything it allows. If another rule grants parts of the request, the
+// messages and denials of the rule falling back are dropped. Denials of
+// anything requested by the messages of another rule are dropped as well.
+func merge(m *browser.Message, parts [][]*browser.Message, denials []browser.Denials, fallback []bool) ([][]*browser.Message, browser.Denials) {
+	if len(parts) == 1 {
+		return parts, denials[0]
+	}
+
+	served := false
+	for i, messages := range parts {
+		if !fallback[i] && len(messages) > 0 {
+			served = true
+		}
+	}
+	if served {
+		for i := range parts {
+			if fallback[i] {
+				parts[i], denials[i] = nil, nil
+			}
+		}
+	}
+
+	// Denials of the same value by several rules are reported once, with
+	// the reason of the first rule.
+	var (
+		merged browser.Denials
+		seen   = make(map[string]bool)
+	)
+	for i, ds := range denials {
+		for _, d := range ds {
+			key := d.Field + "=" + d.Value
+			if seen[key] || requestedByOthers(d, m, parts, i) {
+				continue
+			}
+			seen[key] = true
+			merged = append(merged, d)
+		}
+	}
+	return parts, merged
+}
+
+// requestedByOthers reports whether the value denied by the given denial of
+// the rule at index i is requested by the messages of another rule.
+func requestedByOthers(d browser.Denial, m *browser.Message, parts [][]*browser.Message, i int) bool {
+	for j, messages := range parts {
+		if j == i {
+			continue
+		}
+		for _, c := range messages {
+			switch d.Field {
+			case "stations":
+				if len(c.Stations) == 0 || contains(c.Stations, d.Value) {
+					return true
+				}
+			case "measurements":
+				if len(c.Measurements) == 0 || contains(c.Measurements, d.Value) {
+					return true
+				}
+			case "landuse":
+				if len(c.Landuse) == 0 || contains(c.Landuse, d.Value) {
+					return true
+				}
+			case "start":
+				if m != nil && !c.Start.After(m.Start) {
+					return true
+				}
+			case "end":
+				if m != nil && !c.End.Before(m.End) {
+					return true
+				}
+			case "interval":
+				if m != nil && c.Interval == m.Interval {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// redactAll redacts a copy of the given message by each of the given rules
+// and merges the denials like apply does. The redacted message of a dropped
+// rule is nil.
+func (a *Access) redactAll(rules []*Rule, m *browser.Message) ([]*browser.Message, browser.Denials) {
+	var (
+		parts    = make([][]*browser.Message, len(rules))
+		denials  = make([]browser.Denials, len(rules))
+		fallback = make([]bool, len(rules))
+	)
+	for i, rule := range rules {
+		var r *browser.Message
+		r, denials[i], fallback[i] = a.redact(rule, copyMessage(m))
+		parts[i] = []*browser.Message{r}
+	}
+
+	parts, merged := merge(m, parts, denials, fallback)
+
+	redacted := make([]*browser.Message, len(rules))
+	for i, p := range parts {
+		if len(p) > 0 {
+			redacted[i] = p[0]
+		}
+	}
+	return redacted, merged
+}
+
+// copyMessage returns a shallow copy of the given message, which might be
+// nil. Redacting replaces fields instead of modifying them, thus a shallow
+// copy is sufficient.
+func copyMessage(m *browser.Message) *browser.Message {
+	if m == nil {
+		return nil
+	}
+	c := *m
+	return &c
+}
+
+// deduplicator drops measurements already returned for the messages of a
+// previous rule, since the messages of different rules might overlap.
+type deduplicator struct {
+	previous map[string]bool // returned for previous rules
+	current  map[string]bool // returned for the current rule
+}
+
+func newDeduplicator() *deduplicator {
+	return &deduplicator{
+		previous: make(map[string]bool),
+		current:  make(map[string]bool),
+	}
+}
+
+// filter returns the given measurements not returned for a previous rule.
+func (d *deduplicator) filter(ts browser.TimeSeries) browser.TimeSeries {
+	var filtered browser.TimeSeries
+	for _, m := range ts {
+		key := m.Station + "/" + m.Label
+		if d.previous[key] {
+			continue
+		}
+		d.current[key] = true
+		filtered = append(filtered, m)
+	}
+	return filtered
+}
+
+// next marks the measurements of the current rule as returned.
+func (d *deduplicator) next() {
+	for k := range d.current {
+		d.previous[k] = true
+	}
+	d.current = make(map[string]bool)
+}
+
+// report adds the given denials of the given message to the report of ctx. It
+// returns an error wrapping browser.ErrAccessDenied if the message is strict
+// and anything was denied.
+func report(ctx context.Context, m *browser.Message, denials browser.Denials) error {
+	browser.ReportFromContext(ctx).Add(denials...)
+	if m != nil && m.Strict {
+		return denials.Err()
+	}
+	return nil
+}
+
+// redact clear every not allowed field and returns a new browser.Message
+// together with the denials of everything cleared or changed. It reports
+// whether nothing requested of a field is allowed, thus all allowed values are
+// requested instead.
+func (a *Access) redact(rule *Rule, m *browser.Message) (*browser.Message, browser.Denials, bool) {
 	if m == nil {
 		log.Println("message is nil")
 		m = &browser.Message{
@@ -154,17 +772,74 @@ func (a *Access) redact(ctx context.Context, m *browser.Message) *browser.Messag
 		}
 	}
 
-	m.Landuse = a.clear(m.Landuse, rule.ACL.Landuse)
-	m.Measurements = a.clear(m.Measurements, rule.ACL.Measurements)
-	m.Stations = a.clear(m.Stations, rule.ACL.Stations)
+	var (
+		denials, d browser.Denials
+		fallback   bool
+		f          bool
+	)
+	m.Landuse, d, f = a.clear("landuse", m.Landuse, rule.ACL.Landuse)
+	denials, fallback = append(denials, d...), fallback || f
+	m.Measurements, d, f = a.clear("measurements", m.Measurements, rule.ACL.Measurements)
+	denials, fallback = append(denials, d...), fallback || f
+	m.Stations, d, f = a.clear("stations", m.Stations, rule.ACL.Stations)
+	denials, fallback = append(denials, d...), fallback || f
+
+	denials = append(denials, rule.window(m, a.now())...)
+	denials = append(denials, rule.resolution(m)...)
+
+	// The limit of the rule applies unless the message asks for a lower one.
+	if rule.Limit > 0 && (m.Limit == 0 || m.Limit > rule.Limit) {
+		m.Limit = rule.Limit
+	}
+
+	return m, denials, fallback
+}
+
+// estimate returns the estimated size of the given redacted messages, which
+// share the same limit. If a message is not restricted to some stations, all
+// stations having the requested measurements are counted.
+func (a *Access) estimate(ctx context.Context, messages []*browser.Message) (*browser.Estimate, error) {
+	e := &browser.Estimate{}
+	if len(messages) > 0 {
+		e.Limit = messages[0].Limit
+	}
+	for _, m := range messages {
+		c := *m
+		if len(c.Stations) == 0 {
+			stations, err := a.metadata.Stations(ctx, m)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range stations {
+				c.Stations = append(c.Stations, s.ID)
+			}
+		}
+		e.Points += c.Estimate()
+	}
 
-	return m
+	return e, nil
 }
 
-// clear clears not allowed fields and returns a new slice.
-func (a *Access) clear(input, allowed []string) []string {
+// checkLimit returns an error wrapping browser.ErrLimitExceeded if the given
+// redacted messages exceed their limit.
+func (a *Access) checkLimit(ctx context.Context, messages []*browser.Message) error {
+	if len(messages) == 0 || messages[0].Limit == 0 {
+		return nil
+	}
+
+	e, err := a.estimate(ctx, messages)
+	if err != nil {
+		return err
+	}
+	return e.Err()
+}
+
+// clear clears not allowed fields and returns a new slice together with the
+// denials of the cleared values of the given field. If nothing remains all
+// allowed values are returned, which is reported by the returned bool.
+func (a *Access) clear(field string, input, allowed []string) ([]string, browser.Denials, bool) {
 	if len(input) == 0 {
-		return allowed
+		return allowed, nil, false
 	}
 
 	m := make(map[string]struct{}, len(allowed))
@@ -172,14 +847,19 @@ func (a *Access) clear(input, allowed []string) []string {
 		m[v] = struct{}{}
 	}
 
-	var c []string
+	var (
+		c       []string
+		denials browser.Denials
+	)
 	for _, v := range input {
 		if ok := identifier.MatchString(v); !ok {
+			denials = append(denials, browser.Denial{Field: field, Value: v, Reason: "invalid identifier"})
 			continue
 		}
 
 		_, ok := m[v]
 		if !ok && len(m) > 0 {
+			denials = append(denials, browser.Denial{Field: field, Value: v, Reason: "not allowed"})
 			continue
 		}
 
@@ -187,26 +867,49 @@ func (a *Access) clear(input, allowed []string) []string {
 	}
 
 	if len(c) == 0 {
-		return allowed
+		denials = append(denials, browser.Denial{Field: field, Value: strings.Join(allowed, ","), Reason: "nothing requested is allowed, requesting all allowed instead"})
+		return allowed, denials, true
 	}
 
-	return c
+	return c, denials, false
 }
 
-// rule returns a rule depending on the user roles and licence agreement.
-func (a *Access) rule(user *browser.User) *Rule {
-	p := a.ruleByName(browser.Public)
-	if user == nil || user.Role == "" || !user.License {
-		return p
+// Roles returns the names of all rules.
+func (a *Access) Roles() []browser.Role {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var roles []browser.Role
+	seen := make(map[browser.Role]bool)
+	for _, r := range a.rules {
+		if r.ACL == nil || r.Name == "" || seen[r.Name] {
+			continue
+		}
+		seen[r.Name] = true
+		roles = append(roles, r.Name)
 	}
+	return roles
+}
 
-	r := a.ruleByName(user.Role)
-	// If r is the default rule return the public acl.
-	if r == defaultRule {
-		return p
+// rulesFor returns the rules depending on the user roles and licence
+// agreement. Roles without a rule are skipped. If no rule applies the rule of
+// browser.Public is returned.
+func (a *Access) rulesFor(user *browser.User) []*Rule {
+	p := a.ruleByName(browser.Public)
+	if user == nil || !user.License {
+		return []*Rule{p}
 	}
 
-	return r
+	var rules []*Rule
+	for _, name := range user.Roles() {
+		if r := a.ruleByName(name); r != defaultRule {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		return []*Rule{p}
+	}
+	return rules
 }
 
 // ruleByName will return the rule by the given name. If no rule is found the
@@ -225,51 +928,142 @@ func (a *Access) ruleByName(name browser.Role) *Rule {
 	return defaultRule
 }
 
-// loadRules loads rules from the given file.
+// Status returns the status of the active rules.
+func (a *Access) Status() RulesStatus {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.status
+}
+
+// Close stops reloading the rules and waits until the reloading goroutine has
+// returned.
+func (a *Access) Close() error {
+	a.once.Do(func() { close(a.done) })
+	<-a.stopped
+	return nil
+}
+
+// loadRules loads rules from the given file. The active rules are only
+// replaced if the rules of the file are valid, otherwise they are kept and an
+// error is returned.
 func (a *Access) loadRules(file string) error {
-	fi, err := os.Stat(file)
+	b, err := ioutil.ReadFile(file)
 	if os.IsNotExist(err) {
-		log.Printf("access: no access file %q found, use build in rules.\n", file)
+		log.Printf("access: no access file %q found, keep %s.\n", file, a.Status().active())
 		return nil
 	}
 	if err != nil {
-		return fmt.Errorf("access: %v", err)
+		return a.reject(fmt.Errorf("access: error in opening %q: %v", file, err))
 	}
 
-	mtime := fi.ModTime()
-	if !mtime.After(a.last) && a.rules != nil {
-		return nil // no changes to rules file
+	version := fmt.Sprintf("%x", sha256.Sum256(b))[:12]
+	if a.Status().Version == version {
+		// A previous invalid version might have been reverted.
+		a.mu.Lock()
+		a.status.Err = nil
+		a.mu.Unlock()
+		return nil
 	}
 
-	f, err := ioutil.ReadFile(file)
+	rules, err := decodeRules(b, false)
 	if err != nil {
-		return fmt.Errorf("access: error in opening %q: %v", file, err)
+		return a.reject(fmt.Errorf("access: error in JSON decoding rules file %q: %v", file, err))
 	}
-
-	var r []*Rule
-	if err := json.Unmarshal(f, &r); err != nil {
-		return fmt.Errorf("access: error in JSON decoding rules file %q: %v", file, err)
+	if err := validateRules(rules); err != nil {
+		return a.reject(fmt.Errorf("access: invalid rules file %q: %v", file, err))
+	}
+	// Problems not preventing the rules from being enforced are only logged.
+	for _, p := range checkRules(rules, nil) {
+		log.Printf("access: rules file %q: %s\n", file, p)
 	}
 
 	a.mu.Lock()
-	a.last = mtime
-	a.rules = r
+	a.rules = rules
+	a.status = RulesStatus{Version: version, Updated: a.now()}
 	a.mu.Unlock()
 
-	log.Printf("access: update access rules from file %q\n", file)
+	log.Printf("access: update access rules from file %q to version %s\n", file, version)
 
 	return nil
 }
 
-// refreshRules refreshes the rules from the given file by the
-// DefautlRefreshInterval.
-func (a *Access) refreshRules(file string) {
+// reject records the given error of loading the rules in the status and
+// returns it. The active rules are kept.
+func (a *Access) reject(err error) error {
+	a.mu.Lock()
+	a.status.Err = err
+	active := a.status.active()
+	a.mu.Unlock()
+
+	return fmt.Errorf("%w, keep %s", err, active)
+}
+
+// watch returns a watcher of the directory of the given file. The directory
+// is watched, since editors and configuration management tools often replace
+// the file or a symbolic link to it instead of writing it.
+func watch(file string) (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(filepath.Dir(file)); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// watchRules reloads the rules from the given file on events of the given
+// watcher until Close is called. Reloading is delayed by the reload delay,
+// since a change often causes a burst of events.
+func (a *Access) watchRules(file string, w *fsnotify.Watcher) {
+	defer close(a.stopped)
+	defer w.Close()
+
+	timer := time.NewTimer(a.delay)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case _, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			// Events of other files are not filtered, since the file
+			// might be a symbolic link. Unchanged rules are not reloaded.
+			timer.Reset(a.delay)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("access: error watching %q: %v\n", file, err)
+		case <-timer.C:
+			if err := a.loadRules(file); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// pollRules reloads the rules from the given file every
+// DefautlRefreshInterval until Close is called.
+func (a *Access) pollRules(file string) {
+	defer close(a.stopped)
+
 	ticker := time.NewTicker(DefautlRefreshInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		if err := a.loadRules(file); err != nil {
-			log.Println(err)
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			if err := a.loadRules(file); err != nil {
+				log.Println(err)
+			}
 		}
 	}
 }
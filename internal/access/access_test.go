@@ -6,10 +6,16 @@ package access
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/euracresearch/browser"
 	"github.com/euracresearch/browser/internal/mock"
@@ -232,6 +238,530 @@ func TestAccessBuildInRules(t *testing.T) {
 	}
 }
 
+func TestLimit(t *testing.T) {
+	db := &mock.Database{
+		SeriesFn: func() (browser.TimeSeries, error) {
+			return browser.TimeSeries{}, nil
+		},
+	}
+	md := &mock.Metadata{
+		StationsFn: func(ctx context.Context, m *browser.Message) (browser.Stations, error) {
+			return browser.Stations{{ID: "1"}, {ID: "2"}, {ID: "3"}}, nil
+		},
+	}
+
+	a, err := New("testdata/limit.json", db, md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location)
+
+	// The rule "Public" allows 192 points, which are two days of raw data of
+	// a single measurement and station.
+	testCases := map[string]struct {
+		in   *browser.Message
+		role browser.Role
+		want int64
+		err  error
+	}{
+		"Within": {
+			&browser.Message{Measurements: []string{"a"}, Stations: []string{"1"}, Start: day, End: day.AddDate(0, 0, 1)},
+			browser.Public,
+			192,
+			nil,
+		},
+		"Exceeded": {
+			&browser.Message{Measurements: []string{"a", "b"}, Stations: []string{"1"}, Start: day, End: day.AddDate(0, 0, 1)},
+			browser.Public,
+			384,
+			browser.ErrLimitExceeded,
+		},
+		"AllStations": {
+			&browser.Message{Measurements: []string{"a"}, Start: day, End: day},
+			browser.Public,
+			288,
+			browser.ErrLimitExceeded,
+		},
+		"Aggregated": {
+			&browser.Message{Measurements: []string{"a"}, Stations: []string{"1"}, Start: day, End: day.AddDate(1, 0, 0), Interval: browser.Daily},
+			browser.Public,
+			367,
+			browser.ErrLimitExceeded,
+		},
+		"Unlimited": {
+			&browser.Message{Measurements: []string{"a", "b"}, Stations: []string{"1"}, Start: day, End: day.AddDate(0, 0, 1)},
+			browser.FullAccess,
+			384,
+			nil,
+		},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			ctx := createContext(t, tc.role, true)
+
+			m := *tc.in
+			e, err := a.Estimate(ctx, &m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Points != tc.want {
+				t.Fatalf("got estimate of %d points, want %d", e.Points, tc.want)
+			}
+
+			m = *tc.in
+			if _, err := a.Series(ctx, &m); !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v, want %v", err, tc.err)
+			}
+
+			m = *tc.in
+			r, err := a.Redact(ctx, &m)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("redact: got error %v, want %v", err, tc.err)
+			}
+			if err == nil && r.Estimate().Points != tc.want {
+				t.Fatalf("redact: got estimate of %d points, want %d", r.Estimate().Points, tc.want)
+			}
+		})
+	}
+}
+
+func TestRules(t *testing.T) {
+	db := &mock.Database{}
+	db.QueryFn = func(ctx context.Context, m *browser.Message) *browser.Stmt {
+		return &browser.Stmt{Query: fmt.Sprintf("%s %s %s..%s", messageString(t, m), m.Interval, m.Start.Format("2006-01-02"), m.End.Format("2006-01-02"))}
+	}
+
+	a, err := New("testdata/rules.json", db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return time.Date(2020, 6, 15, 12, 0, 0, 0, browser.Location) }
+
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, browser.Location)
+	}
+
+	// The rule "External" grants measurement "a" of station 12 and all
+	// measurements of stations 13 and 14 with an embargo of 12 months, a
+	// history of 10 years and daily resolution.
+	testCases := map[string]struct {
+		in   *browser.Message
+		role browser.Role
+		want string
+	}{
+		"Grants": {
+			&browser.Message{Measurements: []string{"a", "b"}, Stations: []string{"12", "13", "14"}, Start: date(2019, 1, 1), End: date(2019, 1, 31)},
+			browser.External,
+			"a_12 daily 2019-01-01..2019-01-31;a-b_13-14 daily 2019-01-01..2019-01-31",
+		},
+		"AllStations": {
+			&browser.Message{Measurements: []string{"b"}, Start: date(2019, 1, 1), End: date(2019, 1, 31)},
+			browser.External,
+			"b_13-14 daily 2019-01-01..2019-01-31",
+		},
+		"NotGranted": {
+			&browser.Message{Measurements: []string{"b"}, Stations: []string{"12"}, Start: date(2019, 1, 1), End: date(2019, 1, 31)},
+			browser.External,
+			"a_12 daily 2019-01-01..2019-01-31;a-b_13-14 daily 2019-01-01..2019-01-31",
+		},
+		"Embargo": {
+			&browser.Message{Measurements: []string{"b"}, Stations: []string{"13"}, Start: date(2019, 1, 1), End: date(2020, 6, 1)},
+			browser.External,
+			"b_13 daily 2019-01-01..2019-06-14",
+		},
+		"History": {
+			&browser.Message{Measurements: []string{"b"}, Stations: []string{"13"}, Start: date(2000, 1, 1), End: date(2019, 1, 1)},
+			browser.External,
+			"b_13 daily 2010-06-15..2019-01-01",
+		},
+		"UnderEmbargo": {
+			&browser.Message{Measurements: []string{"b"}, Stations: []string{"13"}, Start: date(2020, 1, 1), End: date(2020, 6, 1)},
+			browser.External,
+			"",
+		},
+		"Coarsened": {
+			&browser.Message{Measurements: []string{"b"}, Stations: []string{"13"}, Start: date(2019, 1, 1), End: date(2019, 1, 1), Interval: browser.Hourly},
+			browser.External,
+			"b_13 daily 2019-01-01..2019-01-01",
+		},
+		"Resolution": {
+			&browser.Message{Measurements: []string{"b"}, Stations: []string{"13"}, Start: date(2019, 1, 1), End: date(2019, 1, 1), Interval: browser.Monthly},
+			browser.External,
+			"b_13 monthly 2019-01-01..2019-01-01",
+		},
+		"FullAccess": {
+			&browser.Message{Measurements: []string{"b"}, Stations: []string{"12"}, Start: date(2020, 1, 1), End: date(2020, 6, 15)},
+			browser.FullAccess,
+			"b_12 raw 2020-01-01..2020-06-15",
+		},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			got := a.Query(createContext(t, tc.role, true), tc.in)
+			if got.Query != tc.want {
+				t.Fatalf("got %q, want %q", got.Query, tc.want)
+			}
+		})
+	}
+}
+
+func TestRulesEmptyWindow(t *testing.T) {
+	db := &mock.Database{
+		SeriesFn: func() (browser.TimeSeries, error) {
+			t.Fatal("database queried for an empty time window")
+			return nil, nil
+		},
+	}
+	a, err := New("testdata/window.json", db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return time.Date(2020, 6, 15, 12, 0, 0, 0, browser.Location) }
+
+	// The embargo of 10 years is longer than the history of 5 years, thus
+	// nothing is accessible.
+	m := &browser.Message{
+		Measurements: []string{"a"},
+		Stations:     []string{"1"},
+		Start:        time.Date(2010, 1, 1, 0, 0, 0, 0, browser.Location),
+		End:          time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+	}
+	ctx := createContext(t, browser.Public, true)
+
+	c := *m
+	if _, err := a.Series(ctx, &c); !errors.Is(err, browser.ErrDataNotFound) {
+		t.Fatalf("series: got error %v, want %v", err, browser.ErrDataNotFound)
+	}
+	c = *m
+	if _, err := a.Stream(ctx, &c); !errors.Is(err, browser.ErrDataNotFound) {
+		t.Fatalf("stream: got error %v, want %v", err, browser.ErrDataNotFound)
+	}
+	c = *m
+	e, err := a.Estimate(ctx, &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Points != 0 {
+		t.Fatalf("got estimate of %d points, want 0", e.Points)
+	}
+}
+
+func TestRulesStations(t *testing.T) {
+	md := &mock.Metadata{
+		StationsFn: func(ctx context.Context, m *browser.Message) (browser.Stations, error) {
+			return browser.Stations{
+				{ID: "11", Measurements: []string{"a", "b"}},
+				{ID: "12", Measurements: []string{"a", "b"}},
+				{ID: "13", Measurements: []string{"b", "c"}},
+			}, nil
+		},
+	}
+
+	a, err := New("testdata/rules.json", &mock.Database{}, md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stations, err := a.Stations(createContext(t, browser.External, true), &browser.Message{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, s := range stations {
+		got = append(got, s.ID+":"+strings.Join(s.Measurements, "-"))
+	}
+	if want := "12:a 13:b-c"; strings.Join(got, " ") != want {
+		t.Fatalf("got stations %v, want %s", got, want)
+	}
+}
+
+func TestReport(t *testing.T) {
+	db := &mock.Database{
+		SeriesFn: func() (browser.TimeSeries, error) {
+			return browser.TimeSeries{{Label: "b"}}, nil
+		},
+	}
+
+	a, err := New("testdata/rules.json", db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return time.Date(2020, 6, 15, 12, 0, 0, 0, browser.Location) }
+
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, browser.Location)
+	}
+
+	testCases := map[string]struct {
+		in   *browser.Message
+		want []string
+	}{
+		"None": {
+			&browser.Message{Measurements: []string{"b"}, Stations: []string{"13"}, Start: date(2019, 1, 1), End: date(2019, 1, 31), Interval: browser.Daily},
+			nil,
+		},
+		"Measurement": {
+			&browser.Message{Measurements: []string{"b", "c", "d'"}, Stations: []string{"13"}, Start: date(2019, 1, 1), End: date(2019, 1, 31), Interval: browser.Daily},
+			[]string{`measurements "c": not allowed`, `measurements "d'": invalid identifier`},
+		},
+		"Grant": {
+			&browser.Message{Measurements: []string{"a", "b"}, Stations: []string{"12"}, Start: date(2019, 1, 1), End: date(2019, 1, 31), Interval: browser.Daily},
+			[]string{`measurements "b": not granted for station 12`},
+		},
+		"Window": {
+			&browser.Message{Measurements: []string{"b"}, Stations: []string{"13"}, Start: date(2000, 1, 1), End: date(2020, 6, 1)},
+			[]string{
+				`start "2000-01-01": data before 2010-06-15 is not accessible`,
+				`end "2020-06-01": data after 2019-06-14 is under embargo`,
+				`interval "raw": finest accessible resolution is daily`,
+			},
+		},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			r := &browser.Report{}
+			ctx := browser.NewReportContext(createContext(t, browser.External, true), r)
+
+			c := *tc.in
+			if _, err := a.Series(ctx, &c); err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Denials().Strings(); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got denials %q, want %q", got, tc.want)
+			}
+
+			// Strict messages fail instead of being redacted.
+			c = *tc.in
+			c.Strict = true
+			_, err := a.Series(ctx, &c)
+			if got, want := err != nil, len(tc.want) > 0; got != want {
+				t.Fatalf("got error %v, want error %v", err, want)
+			}
+			if err != nil && !errors.Is(err, browser.ErrAccessDenied) {
+				t.Fatalf("got error %v, want %v", err, browser.ErrAccessDenied)
+			}
+		})
+	}
+}
+
+func TestGroups(t *testing.T) {
+	a, err := New("testdata/groups.json", &mock.Database{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, browser.Location)
+	a.now = func() time.Time { return now }
+
+	if got, want := a.Roles(), []browser.Role{browser.Public, "UniInnsbruck", "Partners"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got roles %v, want %v", got, want)
+	}
+
+	// Each rule is applied separately, thus no rule widens the access of
+	// another. Messages are described by their measurements, stations, end
+	// date, interval and limit.
+	var (
+		start = time.Date(2019, 1, 1, 0, 0, 0, 0, browser.Location)
+		end   = time.Date(2020, 6, 1, 0, 0, 0, 0, browser.Location)
+	)
+	testCases := map[string]struct {
+		user         *browser.User
+		measurements []string
+		stations     []string
+		rule         browser.Role
+		messages     []string
+		denials      []string
+	}{
+		"Role": {
+			&browser.User{Role: "UniInnsbruck", License: true},
+			[]string{"a", "b"}, []string{"1"},
+			"UniInnsbruck",
+			[]string{"a-b_1 2019-06-14 raw 100"},
+			[]string{`end "2020-06-01": data after 2019-06-14 is under embargo`},
+		},
+		"UnknownGroup": {
+			&browser.User{Role: "UniInnsbruck", Groups: []browser.Role{"knuth"}, License: true},
+			[]string{"a", "b"}, []string{"1"},
+			"UniInnsbruck",
+			[]string{"a-b_1 2019-06-14 raw 100"},
+			[]string{`end "2020-06-01": data after 2019-06-14 is under embargo`},
+		},
+		"NoLicense": {
+			&browser.User{Role: "UniInnsbruck", Groups: []browser.Role{"Partners"}},
+			[]string{"b"}, []string{"1"},
+			browser.Public,
+			[]string{"a_1 2020-06-01 raw 0"},
+			[]string{`measurements "b": not allowed`, `measurements "a": nothing requested is allowed, requesting all allowed instead`},
+		},
+		"Groups": {
+			&browser.User{Role: "UniInnsbruck", Groups: []browser.Role{"Partners"}, License: true},
+			[]string{"b"}, []string{"1", "2"},
+			"UniInnsbruck+Partners",
+			[]string{"b_1 2019-06-14 raw 100", "b_2 2019-12-14 daily 200"},
+			[]string{`end "2020-06-01": data after 2019-06-14 is under embargo`},
+		},
+		"GroupsNotCombined": {
+			&browser.User{Role: "UniInnsbruck", Groups: []browser.Role{"Partners"}, License: true},
+			[]string{"a", "c"}, []string{"1", "2"},
+			"UniInnsbruck+Partners",
+			[]string{"a_1 2019-06-14 raw 100", "c_2 2019-12-14 daily 200"},
+			[]string{`end "2020-06-01": data after 2019-06-14 is under embargo`},
+		},
+		"PublicFallbackDropped": {
+			&browser.User{Role: browser.Public, Groups: []browser.Role{"UniInnsbruck"}, License: true},
+			[]string{"b"}, []string{"1"},
+			"Public+UniInnsbruck",
+			[]string{"b_1 2019-06-14 raw 100"},
+			[]string{`end "2020-06-01": data after 2019-06-14 is under embargo`},
+		},
+		"PublicUnrestricted": {
+			&browser.User{Role: browser.Public, Groups: []browser.Role{"UniInnsbruck"}, License: true},
+			[]string{"a"}, []string{"1"},
+			"Public+UniInnsbruck",
+			[]string{"a_1 2020-06-01 raw 0", "a_1 2019-06-14 raw 100"},
+			nil,
+		},
+		"AllFallback": {
+			&browser.User{Role: "UniInnsbruck", Groups: []browser.Role{"Partners"}, License: true},
+			[]string{"x"}, []string{"3"},
+			"UniInnsbruck+Partners",
+			[]string{"a-b_1 2019-06-14 raw 100", "b-c_2 2019-12-14 daily 200"},
+			[]string{
+				`measurements "x": not allowed`,
+				`measurements "a,b": nothing requested is allowed, requesting all allowed instead`,
+				`stations "3": not allowed`,
+				`stations "1": nothing requested is allowed, requesting all allowed instead`,
+				`end "2020-06-01": data after 2019-06-14 is under embargo`,
+				`measurements "b,c": nothing requested is allowed, requesting all allowed instead`,
+				`stations "2": nothing requested is allowed, requesting all allowed instead`,
+			},
+		},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			in := &browser.Message{
+				Measurements: tc.measurements,
+				Stations:     tc.stations,
+				Start:        start,
+				End:          end,
+			}
+			e := a.Explain(tc.user, in)
+
+			if e.Rule != tc.rule {
+				t.Fatalf("got rule %q, want %q", e.Rule, tc.rule)
+			}
+
+			var got []string
+			for _, m := range e.Messages {
+				got = append(got, fmt.Sprintf("%s %s %s %d", messageString(t, m), m.End.Format("2006-01-02"), m.Interval, m.Limit))
+			}
+			if !reflect.DeepEqual(got, tc.messages) {
+				t.Fatalf("got messages %q, want %q", got, tc.messages)
+			}
+
+			if got := e.Denials.Strings(); !reflect.DeepEqual(got, tc.denials) {
+				t.Fatalf("got denials %q, want %q", got, tc.denials)
+			}
+		})
+	}
+}
+
+func TestGroupsInterval(t *testing.T) {
+	db := &mock.Database{
+		SeriesFn: func() (browser.TimeSeries, error) {
+			return browser.TimeSeries{{Label: "b", Station: "1"}}, nil
+		},
+	}
+	a, err := New("testdata/groups.json", db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return time.Date(2020, 6, 15, 0, 0, 0, 0, browser.Location) }
+
+	u := &browser.User{Role: "UniInnsbruck", Groups: []browser.Role{"Partners"}, License: true}
+	ctx := context.WithValue(context.Background(), browser.UserContextKey, u)
+
+	// UniInnsbruck grants raw data, Partners daily data.
+	testCases := map[string]struct {
+		stations []string
+		interval browser.Interval
+		err      error
+	}{
+		"Raw":       {[]string{"1", "2"}, browser.Raw, browser.ErrAccessDenied},
+		"Daily":     {[]string{"1", "2"}, browser.Daily, nil},
+		"SingleRaw": {[]string{"1"}, browser.Raw, nil},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			m := &browser.Message{
+				Measurements: []string{"b"},
+				Stations:     tc.stations,
+				Start:        time.Date(2019, 1, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2019, 1, 1, 0, 0, 0, 0, browser.Location),
+				Interval:     tc.interval,
+			}
+
+			if _, err := a.Series(ctx, m); !errors.Is(err, tc.err) {
+				t.Fatalf("series: got error %v, want %v", err, tc.err)
+			}
+			if _, err := a.Stream(ctx, m); !errors.Is(err, tc.err) {
+				t.Fatalf("stream: got error %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	d := newDeduplicator()
+	measurement := func(station, label string) *browser.Measurement {
+		return &browser.Measurement{Station: station, Label: label}
+	}
+
+	// Measurements of the same rule are never dropped.
+	if got := d.filter(browser.TimeSeries{measurement("1", "a"), measurement("1", "a")}); len(got) != 2 {
+		t.Fatalf("got %d measurements, want 2", len(got))
+	}
+	d.next()
+
+	got := d.filter(browser.TimeSeries{measurement("1", "a"), measurement("2", "a"), measurement("1", "b")})
+	if len(got) != 2 || got[0].Station != "2" || got[1].Label != "b" {
+		t.Fatalf("got unexpected measurements %v", got)
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	testCases := map[string]struct {
+		in   string
+		want Period
+		err  bool
+	}{
+		"Empty":    {"", Period{}, false},
+		"Months":   {"12mo", Period{Months: 12}, false},
+		"Combined": {"1y6mo10d", Period{Years: 1, Months: 6, Days: 10}, false},
+		"Unknown":  {"12h", Period{}, true},
+		"Trailing": {"1y6", Period{}, true},
+		"Leading":  {"x1y", Period{}, true},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			got, err := ParsePeriod(tc.in)
+			if (err != nil) != tc.err {
+				t.Fatalf("got error %v, want error %v", err, tc.err)
+			}
+			if got != tc.want {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
 func TestClear(t *testing.T) {
 	testCases := map[string]struct {
 		in      []string
@@ -260,7 +790,7 @@ func TestClear(t *testing.T) {
 
 	for k, tc := range testCases {
 		t.Run(k, func(t *testing.T) {
-			got := a.clear(tc.in, tc.allowed)
+			got, _, _ := a.clear("measurements", tc.in, tc.allowed)
 			if !reflect.DeepEqual(got, tc.want) {
 				t.Errorf("got %q, want %q", got, tc.want)
 			}
@@ -298,3 +828,163 @@ func createContext(t *testing.T, role browser.Role, lic bool) context.Context {
 	}
 	return context.WithValue(context.Background(), browser.UserContextKey, u)
 }
+
+func TestCheck(t *testing.T) {
+	md := &mock.Metadata{
+		StationsFn: func(ctx context.Context, m *browser.Message) (browser.Stations, error) {
+			return browser.Stations{
+				{ID: "1", Landuse: "me", Measurements: []string{"a", "b"}},
+				{ID: "2", Landuse: "fo", Measurements: []string{"c"}},
+				{ID: "12", Landuse: "me", Measurements: []string{"a", "b"}},
+				{ID: "13", Landuse: "me", Measurements: []string{"a", "b"}},
+				{ID: "14", Landuse: "me", Measurements: []string{"a", "b"}},
+			}, nil
+		},
+	}
+
+	problems, err := Check(context.Background(), "testdata/check.json", md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	want := []string{
+		`json: unknown field "embargos"`,
+		`access: rule "External": unknown resolution "weekly"`,
+		`rule "External": unknown measurement "x" in acl`,
+		`rule "External": unknown landuse "zz" in acl`,
+		`rule "External": duplicated rule, only the first one applies`,
+		`rule "External": unknown station "9" in grant`,
+		`rule "External": unknown measurement "y" in grant`,
+		`rule "Partner": no acl, the rule is ignored`,
+		`no rule "Public", the built-in default rule applies`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got problems\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if problems, err := Check(context.Background(), "testdata/rules.json", md); err != nil || len(problems) > 0 {
+		t.Fatalf("got problems %v and error %v for valid file", problems, err)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	a, err := New("testdata/rules.json", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return time.Date(2020, 6, 15, 12, 0, 0, 0, browser.Location) }
+
+	in := &browser.Message{
+		Measurements: []string{"a", "b", "c"},
+		Stations:     []string{"12", "13"},
+		Start:        time.Date(2019, 1, 1, 0, 0, 0, 0, browser.Location),
+		End:          time.Date(2019, 1, 31, 0, 0, 0, 0, browser.Location),
+	}
+	e := a.Explain(&browser.User{Role: browser.External, License: true}, in)
+
+	if e.Rule != browser.External {
+		t.Fatalf("got rule %q, want %q", e.Rule, browser.External)
+	}
+
+	var got []string
+	for _, m := range e.Messages {
+		got = append(got, messageString(t, m))
+	}
+	if want := []string{"a_12", "a-b_13"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+
+	want := []string{
+		`measurements "c": not allowed`,
+		`interval "raw": finest accessible resolution is daily`,
+		`measurements "b": not granted for station 12`,
+	}
+	if got := e.Denials.Strings(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got denials %q, want %q", got, want)
+	}
+
+	// The given message is not modified.
+	if len(in.Measurements) != 3 || in.Interval != browser.Raw {
+		t.Fatalf("message modified: %+v", in)
+	}
+}
+
+func TestReload(t *testing.T) {
+	defer func(d time.Duration) { reloadDelay = d }(reloadDelay)
+	reloadDelay = time.Millisecond
+
+	dir, err := ioutil.TempDir("", "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		a    *Access
+		file = filepath.Join(dir, "access.json")
+	)
+	write := func(rules string) {
+		t.Helper()
+		// Files are replaced like most editors do.
+		tmp := file + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor := func(desc string, ok func(RulesStatus) bool) RulesStatus {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if s := a.Status(); ok(s) {
+				return s
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("%s: got status %+v", desc, a.Status())
+		return RulesStatus{}
+	}
+
+	write(`[{"name": "Public", "acl": {"measurements": ["a"]}}]`)
+	a, err = New(file, &mock.Database{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	first := a.Status()
+	if first.Version == "" || first.Stale() {
+		t.Fatalf("got status %+v, want loaded rules", first)
+	}
+
+	// Invalid rules are refused and the active rules are kept.
+	write(`[{"name": "FullAccess", "acl": {}}]`)
+	s := waitFor("invalid rules", RulesStatus.Stale)
+	if s.Version != first.Version {
+		t.Fatalf("got version %s, want %s", s.Version, first.Version)
+	}
+	if got := a.ruleByName(browser.Public); got == defaultRule {
+		t.Fatal("active rules replaced by invalid rules")
+	}
+
+	// Valid rules replace the active rules.
+	write(`[{"name": "Public", "acl": {"measurements": ["b"]}}]`)
+	s = waitFor("valid rules", func(s RulesStatus) bool { return s.Version != first.Version && !s.Stale() })
+	if got := a.ruleByName(browser.Public).ACL.Measurements; !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("got measurements %v, want [b]", got)
+	}
+
+	// Changes after Close are ignored.
+	a.Close()
+	write(`[{"name": "Public", "acl": {"measurements": ["c"]}}]`)
+	time.Sleep(10 * time.Millisecond)
+	if got := a.Status().Version; got != s.Version {
+		t.Fatalf("got version %s after Close, want %s", got, s.Version)
+	}
+}
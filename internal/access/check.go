@@ -0,0 +1,250 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package access
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/euracresearch/browser"
+)
+
+// Problem describes an issue of an access file found by Check.
+type Problem struct {
+	// Rule is the name of the rule the problem was found in. It is empty for
+	// problems of the whole file.
+	Rule browser.Role
+
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Rule == "" {
+		return p.Message
+	}
+	return fmt.Sprintf("rule %q: %s", p.Rule, p.Message)
+}
+
+// Check validates the given access file against the stations of the given
+// metadata, which must not be decorated by an Access. Unlike loading the file
+// for serving, unknown fields, missing or duplicated rules and stations,
+// measurements and landuse not found in the metadata are reported as well. It
+// returns an error if the file cannot be read or decoded.
+func Check(ctx context.Context, file string, md browser.Metadata) ([]Problem, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("access: %v", err)
+	}
+
+	rules, err := decodeRules(b, false)
+	if err != nil {
+		return nil, fmt.Errorf("access: error in JSON decoding rules file %q: %v", file, err)
+	}
+
+	stations, err := md.Stations(ctx, &browser.Message{})
+	if err != nil {
+		return nil, fmt.Errorf("access: could not load stations: %v", err)
+	}
+
+	// Unknown fields are ignored while serving, thus a typo in a field name
+	// silently drops its restriction.
+	var problems []Problem
+	if _, err := decodeRules(b, true); err != nil {
+		problems = append(problems, Problem{Message: err.Error()})
+	}
+
+	return append(problems, checkRules(rules, newInventory(stations))...), nil
+}
+
+// decodeRules decodes the given access file. If strict is true unknown fields
+// are refused. Syntax errors report the line and column of the error.
+func decodeRules(b []byte, strict bool) ([]*Rule, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+
+	var rules []*Rule
+	err := dec.Decode(&rules)
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line, col := position(b, syntaxErr.Offset)
+		return nil, fmt.Errorf("line %d, column %d: %v", line, col, err)
+	}
+	return rules, err
+}
+
+// position returns the line and column of the given byte offset in b.
+func position(b []byte, offset int64) (line, col int) {
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	before := b[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	col = int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// inventory holds the identifiers known to the metadata.
+type inventory struct {
+	stations     map[string]bool
+	measurements map[string]bool
+	landuse      map[string]bool
+}
+
+// newInventory returns the inventory of the given stations.
+func newInventory(stations browser.Stations) *inventory {
+	inv := &inventory{
+		stations:     make(map[string]bool),
+		measurements: make(map[string]bool),
+		landuse:      make(map[string]bool),
+	}
+	for _, s := range stations {
+		if s == nil {
+			continue
+		}
+		inv.stations[s.ID] = true
+		inv.landuse[s.Landuse] = true
+		for _, m := range s.Measurements {
+			inv.measurements[m] = true
+		}
+	}
+	return inv
+}
+
+// checkRules returns the problems of the given rules. Identifiers are only
+// checked if the given inventory is not nil.
+func checkRules(rules []*Rule, inv *inventory) []Problem {
+	var (
+		problems []Problem
+		seen     = make(map[browser.Role]bool)
+	)
+	for i, r := range rules {
+		if r == nil {
+			problems = append(problems, Problem{Message: fmt.Sprintf("rule %d is null", i+1)})
+			continue
+		}
+		report := func(format string, a ...interface{}) {
+			problems = append(problems, Problem{Rule: r.Name, Message: fmt.Sprintf(format, a...)})
+		}
+
+		if r.Name == "" {
+			report("rule %d has no name", i+1)
+		}
+		if seen[r.Name] {
+			report("duplicated rule, only the first one applies")
+		}
+		seen[r.Name] = true
+
+		if r.ACL == nil {
+			report("no acl, the rule is ignored")
+		}
+		if err := r.validate(); err != nil {
+			problems = append(problems, Problem{Message: err.Error()})
+		}
+		if r.Limit < 0 {
+			report("negative limit %d", r.Limit)
+		}
+
+		if inv == nil {
+			continue
+		}
+		if r.ACL != nil {
+			for _, v := range unknown(r.ACL.Stations, inv.stations) {
+				report("unknown station %q in acl", v)
+			}
+			for _, v := range unknown(r.ACL.Measurements, inv.measurements) {
+				report("unknown measurement %q in acl", v)
+			}
+			for _, v := range unknown(r.ACL.Landuse, inv.landuse) {
+				report("unknown landuse %q in acl", v)
+			}
+		}
+		for _, g := range r.Grants {
+			for _, v := range unknown(g.Stations, inv.stations) {
+				report("unknown station %q in grant", v)
+			}
+			for _, v := range unknown(g.Measurements, inv.measurements) {
+				report("unknown measurement %q in grant", v)
+			}
+		}
+	}
+
+	if !seen[browser.Public] {
+		problems = append(problems, Problem{Message: fmt.Sprintf("no rule %q, the built-in default rule applies", browser.Public)})
+	}
+
+	return problems
+}
+
+// validateRules returns an error if the given rules cannot be enforced, which
+// is the case if a rule is invalid or no rule applies to browser.Public.
+// Rules without a name or access control list are ignored.
+func validateRules(rules []*Rule) error {
+	public := false
+	for _, r := range rules {
+		if r == nil || r.ACL == nil {
+			continue
+		}
+		if err := r.validate(); err != nil {
+			return err
+		}
+		if r.Name == browser.Public {
+			public = true
+		}
+	}
+	if !public {
+		return fmt.Errorf("access: no rule %q", browser.Public)
+	}
+	return nil
+}
+
+// unknown returns the sorted values of list not in known.
+func unknown(list []string, known map[string]bool) []string {
+	var u []string
+	for _, v := range list {
+		if !known[v] {
+			u = append(u, v)
+		}
+	}
+	sort.Strings(u)
+	return u
+}
+
+// Explanation describes how the access rules apply to a request.
+type Explanation struct {
+	// Rule is the name of the rule applied. If several rules apply to the
+	// user, their names are joined by "+".
+	Rule browser.Role
+
+	// Messages are the redacted messages sent to the database.
+	Messages []*browser.Message
+
+	// Denials are the parts of the request removed or changed.
+	Denials browser.Denials
+}
+
+// Explain returns how the rules of the given user redact the given message,
+// without querying any data. The message is not modified.
+func (a *Access) Explain(u *browser.User, m *browser.Message) *Explanation {
+	rules := a.rulesFor(u)
+	parts, denials := a.apply(rules, m)
+
+	e := &Explanation{Denials: denials}
+	var names []string
+	for i, r := range rules {
+		names = append(names, string(r.Name))
+		e.Messages = append(e.Messages, parts[i]...)
+	}
+	e.Rule = browser.Role(strings.Join(names, "+"))
+	return e
+}
@@ -0,0 +1,371 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package access
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/euracresearch/browser"
+)
+
+// dateFormat is the format of dates in denials.
+const dateFormat = "2006-01-02"
+
+// resolutions orders the intervals from the finest to the coarsest temporal
+// resolution.
+var resolutions = map[browser.Interval]int{
+	browser.Raw:     0,
+	browser.Hourly:  1,
+	browser.Daily:   2,
+	browser.Monthly: 3,
+}
+
+// Grant grants access to the given measurements of the given stations. An
+// empty list of measurements grants access to all measurements of the
+// stations.
+type Grant struct {
+	Stations     []string
+	Measurements []string
+}
+
+// allows reports whether the grant allows access to the given station.
+func (g *Grant) allows(station string) bool {
+	for _, s := range g.Stations {
+		if s == station {
+			return true
+		}
+	}
+	return false
+}
+
+// Period represents a calendar period relative to a point in time.
+//
+// In JSON a period is written as a string of numbers followed by the units
+// "y" (years), "mo" (months) or "d" (days), e.g. "1y6mo".
+type Period struct {
+	Years, Months, Days int
+}
+
+// period is a regular expression matching a single component of a period.
+var period = regexp.MustCompile(`(\d+)(y|mo|d)`)
+
+// ParsePeriod parses the given string as a Period. An empty string returns the
+// zero Period.
+func ParsePeriod(s string) (Period, error) {
+	var p Period
+	if s == "" {
+		return p, nil
+	}
+
+	matches := period.FindAllStringSubmatchIndex(s, -1)
+	n := 0
+	for _, m := range matches {
+		if m[0] != n {
+			break
+		}
+		n = m[1]
+
+		v, err := strconv.Atoi(s[m[2]:m[3]])
+		if err != nil {
+			return Period{}, fmt.Errorf("access: invalid period %q: %v", s, err)
+		}
+		switch s[m[4]:m[5]] {
+		case "y":
+			p.Years += v
+		case "mo":
+			p.Months += v
+		case "d":
+			p.Days += v
+		}
+	}
+	if n != len(s) {
+		return Period{}, fmt.Errorf("access: invalid period %q", s)
+	}
+
+	return p, nil
+}
+
+// IsZero reports whether p is the zero Period.
+func (p Period) IsZero() bool {
+	return p == Period{}
+}
+
+// Before returns the time the period lies before t.
+func (p Period) Before(t time.Time) time.Time {
+	return t.AddDate(-p.Years, -p.Months, -p.Days)
+}
+
+// String returns the period in the format used in JSON.
+func (p Period) String() string {
+	var b strings.Builder
+	if p.Years != 0 {
+		fmt.Fprintf(&b, "%dy", p.Years)
+	}
+	if p.Months != 0 {
+		fmt.Fprintf(&b, "%dmo", p.Months)
+	}
+	if p.Days != 0 {
+		fmt.Fprintf(&b, "%dd", p.Days)
+	}
+	return b.String()
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *Period) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("access: invalid period %s", b)
+	}
+
+	v, err := ParsePeriod(s)
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p Period) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// validate returns an error if the rule cannot be enforced.
+func (r *Rule) validate() error {
+	if _, ok := resolutions[r.Resolution]; !ok {
+		return fmt.Errorf("access: rule %q: unknown resolution %q", r.Name, r.Resolution)
+	}
+	for _, g := range r.Grants {
+		if len(g.Stations) == 0 {
+			return fmt.Errorf("access: rule %q: grant without stations", r.Name)
+		}
+	}
+	return nil
+}
+
+// window restricts the time range of the given message to the time window of
+// the rule relative to now. Both start and end of a message are inclusive
+// days, thus the end is the day before the embargo begins. If no data is
+// accessible end is before start afterwards and the rule grants nothing of
+// the message. It returns the denials of the changed start or end.
+func (r *Rule) window(m *browser.Message, now time.Time) browser.Denials {
+	var denials browser.Denials
+
+	if !r.History.IsZero() {
+		oldest := browser.Daily.Truncate(r.History.Before(now))
+		if m.Start.Before(oldest) {
+			denials = append(denials, browser.Denial{
+				Field:  "start",
+				Value:  m.Start.Format(dateFormat),
+				Reason: fmt.Sprintf("data before %s is not accessible", oldest.Format(dateFormat)),
+			})
+			m.Start = oldest
+		}
+	}
+
+	if !r.Embargo.IsZero() {
+		latest := browser.Daily.Truncate(r.Embargo.Before(now)).AddDate(0, 0, -1)
+		if m.End.After(latest) {
+			denials = append(denials, browser.Denial{
+				Field:  "end",
+				Value:  m.End.Format(dateFormat),
+				Reason: fmt.Sprintf("data after %s is under embargo", latest.Format(dateFormat)),
+			})
+			m.End = latest
+		}
+	}
+
+	return denials
+}
+
+// resolution coarsens the interval of the given message to the finest
+// resolution of the rule. It returns the denial of a changed interval.
+func (r *Rule) resolution(m *browser.Message) browser.Denials {
+	if resolutions[m.Interval] >= resolutions[r.Resolution] {
+		return nil
+	}
+
+	d := browser.Denial{
+		Field:  "interval",
+		Value:  m.Interval.String(),
+		Reason: fmt.Sprintf("finest accessible resolution is %s", r.Resolution.String()),
+	}
+	m.Interval = r.Resolution
+	return browser.Denials{d}
+}
+
+// split splits the given redacted message into messages requesting only
+// granted station and measurement pairs. Stations granted the same
+// measurements are requested together. Like the access control list, if
+// nothing requested is granted everything accessible is requested, which is
+// reported by the returned bool. It returns no messages if the grants and the
+// access control list have nothing in common. The denials of all station and
+// measurement pairs not granted are returned as well.
+func (r *Rule) split(m *browser.Message) ([]*browser.Message, browser.Denials, bool) {
+	if len(r.Grants) == 0 {
+		return []*browser.Message{m}, nil, false
+	}
+
+	messages, denials := r.group(m, m.Stations)
+	if len(messages) > 0 {
+		return messages, denials, false
+	}
+
+	denials = append(denials, browser.Denial{Field: "stations", Value: strings.Join(m.Stations, ","), Reason: "nothing requested is granted, requesting all granted instead"})
+
+	c := *m
+	c.Measurements = r.ACL.Measurements
+	messages, _ = r.group(&c, r.ACL.Stations)
+	return messages, denials, true
+}
+
+// group returns a message for each group of the given stations granted the
+// same measurements of the given message and the denials of everything not
+// granted. If no stations are given all granted stations are grouped.
+func (r *Rule) group(m *browser.Message, stations []string) ([]*browser.Message, browser.Denials) {
+	requested := len(stations) > 0
+	if !requested {
+		stations = r.stations()
+	}
+
+	var (
+		messages []*browser.Message
+		denials  browser.Denials
+		groups   = make(map[string]*browser.Message)
+	)
+	for _, s := range stations {
+		measurements, ok := r.measurements(s, m.Measurements)
+		if !ok {
+			if requested {
+				denials = append(denials, browser.Denial{Field: "stations", Value: s, Reason: "not granted"})
+			}
+			continue
+		}
+		if len(m.Measurements) > len(measurements) {
+			for _, v := range m.Measurements {
+				if !contains(measurements, v) {
+					denials = append(denials, browser.Denial{Field: "measurements", Value: v, Reason: fmt.Sprintf("not granted for station %s", s)})
+				}
+			}
+		}
+
+		key := strings.Join(measurements, ",")
+		if g, ok := groups[key]; ok {
+			g.Stations = append(g.Stations, s)
+			continue
+		}
+
+		c := *m
+		c.Stations = []string{s}
+		c.Measurements = measurements
+		groups[key] = &c
+		messages = append(messages, &c)
+	}
+
+	return messages, denials
+}
+
+// contains reports whether the given value is in the given list.
+func contains(list []string, v string) bool {
+	for _, l := range list {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
+
+// stations returns all granted stations sorted.
+func (r *Rule) stations() []string {
+	seen := make(map[string]bool)
+	var stations []string
+	for _, g := range r.Grants {
+		for _, s := range g.Stations {
+			if !seen[s] {
+				seen[s] = true
+				stations = append(stations, s)
+			}
+		}
+	}
+	sort.Strings(stations)
+	return stations
+}
+
+// measurements returns the given measurements granted for the given station.
+// An empty list of measurements requests all measurements. It returns false if
+// none of them is granted.
+func (r *Rule) measurements(station string, requested []string) ([]string, bool) {
+	var (
+		granted = make(map[string]bool)
+		all     bool
+		found   bool
+	)
+	for _, g := range r.Grants {
+		if !g.allows(station) {
+			continue
+		}
+		found = true
+		if len(g.Measurements) == 0 {
+			all = true
+		}
+		for _, v := range g.Measurements {
+			granted[v] = true
+		}
+	}
+	if !found {
+		return nil, false
+	}
+
+	if len(requested) == 0 {
+		if all {
+			return nil, true
+		}
+		var measurements []string
+		for v := range granted {
+			measurements = append(measurements, v)
+		}
+		sort.Strings(measurements)
+		return measurements, true
+	}
+
+	var measurements []string
+	for _, v := range requested {
+		if all || granted[v] {
+			measurements = append(measurements, v)
+		}
+	}
+	return measurements, len(measurements) > 0
+}
+
+// redactStations removes stations and measurements not granted from the given
+// stations and returns a new slice.
+func (r *Rule) redactStations(stations browser.Stations) browser.Stations {
+	if len(r.Grants) == 0 {
+		return stations
+	}
+
+	var redacted browser.Stations
+	for _, s := range stations {
+		if s == nil {
+			continue
+		}
+
+		measurements, ok := r.measurements(s.ID, s.Measurements)
+		if !ok {
+			continue
+		}
+
+		c := *s
+		c.Measurements = measurements
+		redacted = append(redacted, &c)
+	}
+	return redacted
+}
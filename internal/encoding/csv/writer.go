@@ -16,13 +16,17 @@
 //  2020-01-01 00:30:00,s2,me_s2,1000,3.14159,2.71828,1,1,1,1
 //  2020-01-01 00:45:00,s2,me_s2,1000,3.14159,2.71828,2,2,2,2
 //
+// If flags are enabled each measurement column is followed by a column named
+// <label>_flag holding the quality of the point, e.g. "checked".
+//
 package csv
 
 import (
 	"encoding/csv"
 	"fmt"
 	"io"
-	"sort"
+	"math"
+	"strconv"
 	"time"
 
 	"github.com/euracresearch/browser"
@@ -34,168 +38,257 @@ const DefaultTimeFormat = "2006-01-02 15:04:05"
 
 // Writer writes a browser.TimeSeries as a CSV file. It wrapps a default
 // csv.Writer.
+//
+// Rows are written as soon as they are complete: for each station the points
+// of all its measurements are merged by timestamp, so that memory usage does
+// not depend on the length of the time series.
 type Writer struct {
-	w *csv.Writer
+	w   *csv.Writer
+	out io.Writer
+
+	// Catalogue is used for writing a metadata header describing each
+	// measurement as comment lines prefixed with "#". If nil no metadata
+	// header is written.
+	Catalogue browser.Catalogue
+
+	// Flags enables writing a quality flag column after each measurement.
+	Flags bool
 
-	// rows represent a buffer for holding individual rows of the CSV file.
-	rows [][]string
+	// Comments are written as comment lines prefixed with "#" before any
+	// other line, e.g. for reporting parts of the request denied by the
+	// access rules.
+	Comments []string
 
 	// pos records the column position of a measurement and ensures that the
 	// measurement is written only once to the header.
 	pos map[string]int
+
+	// row is a reusable buffer for the row currently written.
+	row []string
 }
 
 // NewWriter returns a new Writer that writes to w.
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
 		w:   csv.NewWriter(w),
+		out: w,
 		pos: make(map[string]int),
 	}
 }
 
-type stationRange struct {
-	start, end int
+// Write writes the given browser.TimeSeries as CSV file. The given
+// browser.TimeSeries will not be modified.
+func (w *Writer) Write(ts browser.TimeSeries) error {
+	return w.WriteStream(browser.NewStream(ts))
 }
 
-// Write writes the given browser.TimeSeries as CSV file.
-func (w *Writer) Write(ts browser.TimeSeries) error {
-	if len(ts) == 0 {
+// WriteStream writes the given browser.Stream as CSV file. Points are read
+// from the stream while writing, one station at a time.
+func (w *Writer) WriteStream(s *browser.Stream) error {
+	if len(s.TimeSeries) == 0 {
 		return browser.ErrDataNotFound
 	}
-	// Sort timeseries by station.
-	sort.Slice(ts, func(i, j int) bool { return ts[i].Station < ts[j].Station })
 
-	w.writeHeaderAndUnits(ts)
+	// Sort a copy of the time series by station.
+	ts := s.TimeSeries.SortedByStation()
+
+	if err := w.writeComments(); err != nil {
+		return err
+	}
+
+	if err := w.writeCatalogue(ts); err != nil {
+		return err
+	}
 
-	// stationPosMap is map which stores the starting and ending line number of
-	// a station in the row buffer.
-	stationPosMap := make(map[string]*stationRange)
+	if err := w.writeHeaderAndUnits(ts); err != nil {
+		return err
+	}
 
-	for _, m := range ts {
-		// Sort points by timestamp.
-		sort.Slice(m.Points, func(i, j int) bool { return m.Points[i].Timestamp.Before(m.Points[j].Timestamp) })
+	// Process the time series station by station. Thanks to the sorting all
+	// measurements of a station are consecutive.
+	for start := 0; start < len(ts); {
+		end := start + 1
+		for end < len(ts) && ts[end].Station == ts[start].Station {
+			end++
+		}
 
-		row, ok := stationPosMap[m.Station]
-		if !ok {
-			// Station is not present in the row buffer. For each point append a
-			// new line to the buffer.
-			for i, p := range m.Points {
-				w.rows = append(w.rows, w.newLine(m, p))
-
-				// Store the staring row number of the current station on the
-				// first processed point.
-				if i == 0 {
-					stationPosMap[m.Station] = &stationRange{start: len(w.rows) - 1}
-				}
-
-				stationPosMap[m.Station].end = len(w.rows)
+		if err := w.writeStation(s, ts[start:end]); err != nil {
+			return err
+		}
+
+		start = end
+	}
+
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// writeStation merges the points of the given measurements, which must all
+// belong to the same station, by timestamp and writes a row for each distinct
+// timestamp.
+func (w *Writer) writeStation(s *browser.Stream, ts browser.TimeSeries) error {
+	// iters holds the point iterator of each measurement and cur the next
+	// point to write, which is nil once all points of a measurement are
+	// written.
+	var (
+		iters = make([]browser.PointIterator, len(ts))
+		cur   = make([]*browser.Point, len(ts))
+	)
+	defer func() {
+		for _, it := range iters {
+			if it != nil {
+				it.Close()
 			}
-			continue
 		}
+	}()
+
+	advance := func(i int) error {
+		cur[i] = nil
+		if iters[i].Next() {
+			cur[i] = iters[i].Point()
+		}
+		return iters[i].Err()
+	}
+
+	for i, m := range ts {
+		iters[i] = s.Points(m)
+		if err := advance(i); err != nil {
+			return err
+		}
+	}
 
-		// Station is already present in the row buffer.
-		for i, p := range m.Points {
-			current := row.start + i
-
-			// If measurements of the same station have differenet lengths of
-			// points, it can happen that we overflow the current row buffer so
-			// a newline must be added rather than appending only the value to a
-			// existing one.
-			if len(w.rows) <= current {
-				w.rows = append(w.rows, w.newLine(m, p))
-				stationPosMap[m.Station].end = len(w.rows)
+	for {
+		// Find the earliest timestamp of all pending points. The first
+		// measurement having it provides the metadata of the row.
+		first := -1
+		for i := range ts {
+			if cur[i] == nil {
 				continue
 			}
-
-			// Scan each row of the current station and check where to insert or
-			// append the point according to its timestamp.
-			for j := current; j <= row.end; j++ {
-				t, err := time.ParseInLocation(DefaultTimeFormat, w.rows[j][0], browser.Location)
-				if err != nil {
-					continue
-				}
-
-				// If the current timestamp of the point is before the current
-				// lines timestamp add it at the current position and shift all
-				// lines by one. Timestamps of the points are always sorted.
-				if p.Timestamp.Before(t) {
-					// insert a row at the given current row number.
-					// https://github.com/golang/go/wiki/SliceTricks#insert
-					w.rows = append(w.rows, []string{})
-					copy(w.rows[j+1:], w.rows[j:])
-					w.rows[j] = w.newLine(m, p)
-					break
-				}
-
-				if p.Timestamp.Equal(t) {
-					column, ok := w.pos[m.Label]
-					if !ok {
-						break
-					}
-					w.rows[j][column] = fmt.Sprint(p.Value)
-					break
-				}
+			if first < 0 || cur[i].Timestamp.Before(cur[first].Timestamp) {
+				first = i
 			}
 		}
-	}
+		if first < 0 {
+			return nil
+		}
 
-	return w.w.WriteAll(w.rows)
-}
+		t := cur[first].Timestamp
+		w.newLine(ts[first], t)
 
-// newLine creates a new line from the given browser.Measurement.
-func (w *Writer) newLine(m *browser.Measurement, p *browser.Point) []string {
-	length := w.rows[0]
+		for i, m := range ts {
+			if cur[i] == nil || !cur[i].Timestamp.Equal(t) {
+				continue
+			}
 
-	line := make([]string, len(length))
-	// fill line with NaN's
-	for i := 0; i < len(length); i++ {
-		line[i] = "NaN"
-	}
+			w.row[w.pos[m.Label]] = formatFloat(cur[i].Value)
+			if w.Flags {
+				w.row[w.pos[m.Label]+1] = formatFlag(cur[i])
+			}
+			if err := advance(i); err != nil {
+				return err
+			}
+		}
 
-	line[0] = p.Timestamp.Format(DefaultTimeFormat)
-	line[1] = m.Station
-	line[2] = m.Landuse
-	line[3] = fmt.Sprint(m.Elevation)
-	line[4] = fmt.Sprint(m.Latitude)
-	line[5] = fmt.Sprint(m.Longitude)
+		if err := w.w.Write(w.row); err != nil {
+			return err
+		}
+	}
+}
 
-	pos, ok := w.pos[m.Label]
-	if ok {
-		line[pos] = fmt.Sprint(p.Value)
+// newLine resets the row buffer with the metadata of the given
+// browser.Measurement and the given timestamp, filling all values with NaN's.
+func (w *Writer) newLine(m *browser.Measurement, t time.Time) {
+	for i := range w.row {
+		w.row[i] = "NaN"
+	}
+	if w.Flags {
+		for _, i := range w.pos {
+			w.row[i+1] = ""
+		}
 	}
 
-	return line
+	w.row[0] = t.Format(DefaultTimeFormat)
+	w.row[1] = m.Station
+	w.row[2] = m.Landuse
+	w.row[3] = strconv.FormatInt(m.Elevation, 10)
+	w.row[4] = formatFloat(m.Latitude)
+	w.row[5] = formatFloat(m.Longitude)
 }
 
-// writeHeaderAndUnits writes the header and unit rows to the line buffer.
-func (w *Writer) writeHeaderAndUnits(ts browser.TimeSeries) {
-	// Write header and empty unit line.
-	w.rows = append(w.rows, []string{"time", "station", "landuse", "elevation", "latitude", "longitude"})
-	w.rows = append(w.rows, []string{"", "", "", "", "", ""})
+// writeHeaderAndUnits writes the header and unit rows and records the column
+// position of each measurement.
+func (w *Writer) writeHeaderAndUnits(ts browser.TimeSeries) error {
+	header := []string{"time", "station", "landuse", "elevation", "latitude", "longitude"}
+	units := []string{"", "", "", "", "", ""}
 
 	for _, m := range ts {
 		_, ok := w.pos[m.Label]
 		if !ok {
 			// Label is not present in the header so we will add it and store
 			// its column position.
-			w.appendToLine(0, m.Label)
-			w.pos[m.Label] = len(w.rows[0]) - 1
+			header = append(header, m.Label)
+			w.pos[m.Label] = len(header) - 1
 
 			// Write unit below label.
-			w.appendToLine(1, m.Unit)
+			units = append(units, m.Unit)
+
+			if w.Flags {
+				header = append(header, m.Label+"_flag")
+				units = append(units, "")
+			}
 		}
 	}
+
+	w.row = make([]string, len(header))
+
+	if err := w.w.Write(header); err != nil {
+		return err
+	}
+	return w.w.Write(units)
 }
 
-// appendToLine appens the given content to the end of the given row number. If
-// the give number is out of range a new line will be added.
-func (w *Writer) appendToLine(row int, content string) {
-	// Check if n is out of range. If so create a new line instead of appending
-	// to an exisiting one.
-	if row >= len(w.rows) {
-		w.rows = append(w.rows, []string{content})
-		return
+// formatFloat formats the given float like fmt.Sprint does.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// formatFlag returns the quality flag of the given point, which is empty for
+// missing values.
+func formatFlag(p *browser.Point) string {
+	if math.IsNaN(p.Value) {
+		return ""
+	}
+	return p.Quality.String()
+}
+
+// writeComments writes a comment line for each comment.
+func (w *Writer) writeComments() error {
+	for _, c := range w.Comments {
+		if _, err := fmt.Fprintf(w.out, "# %s\n", c); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// writeCatalogue writes a comment line for each measurement of ts found in the
+// catalogue.
+func (w *Writer) writeCatalogue(ts browser.TimeSeries) error {
+	seen := make(map[string]bool)
+	for _, m := range ts {
+		if seen[m.Label] {
+			continue
+		}
+		seen[m.Label] = true
 
-	w.rows[row] = append(w.rows[row], content)
+		p, ok := w.Catalogue.Get(m.Label)
+		if !ok {
+			continue
+		}
+		if _, err := fmt.Fprintf(w.out, "# %s\n", p); err != nil {
+			return err
+		}
+	}
+	return nil
 }
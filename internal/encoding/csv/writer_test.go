@@ -5,6 +5,7 @@
 package csv
 
 import (
+	"errors"
 	"strings"
 	"testing"
 	"time"
@@ -141,15 +142,15 @@ func TestWrite(t *testing.T) {
 				testMeasurement("precip_rt_nrt_tot", "s2", "mm", 3),
 				testMeasurement("wind_speed", "s1", "km/h", 3),
 			},
-			`time,station,landuse,elevation,latitude,longitude,a_avg,wind_speed,air_rh_avg,precip_rt_nrt_tot
-,,,,,,c,km/h,%,mm
+			`time,station,landuse,elevation,latitude,longitude,a_avg,air_rh_avg,precip_rt_nrt_tot,wind_speed
+,,,,,,c,%,mm,km/h
 2020-01-01 00:15:00,s1,me_s1,1000,3.14159,2.71828,0,0,0,0
 2020-01-01 00:30:00,s1,me_s1,1000,3.14159,2.71828,1,1,1,1
 2020-01-01 00:45:00,s1,me_s1,1000,3.14159,2.71828,NaN,2,2,2
-2020-01-01 00:15:00,s2,me_s2,1000,3.14159,2.71828,0,0,NaN,0
-2020-01-01 00:30:00,s2,me_s2,1000,3.14159,2.71828,1,1,NaN,1
-2020-01-01 00:45:00,s2,me_s2,1000,3.14159,2.71828,2,2,NaN,2
-2020-01-01 00:15:00,s3,me_s3,1000,3.14159,2.71828,NaN,NaN,0,NaN
+2020-01-01 00:15:00,s2,me_s2,1000,3.14159,2.71828,0,NaN,0,0
+2020-01-01 00:30:00,s2,me_s2,1000,3.14159,2.71828,1,NaN,1,1
+2020-01-01 00:45:00,s2,me_s2,1000,3.14159,2.71828,2,NaN,2,2
+2020-01-01 00:15:00,s3,me_s3,1000,3.14159,2.71828,NaN,0,NaN,NaN
 `,
 		},
 		"not_continuous_time_between_measurements": {
@@ -361,6 +362,138 @@ func TestWrite(t *testing.T) {
 	}
 }
 
+func TestWriteCatalogue(t *testing.T) {
+	min, max := -40.0, 50.0
+	catalogue := browser.Catalogue{
+		&browser.Parameter{
+			Label:        "a_avg",
+			Description:  map[string]string{"en": "Air temperature", "de": "Lufttemperatur"},
+			Unit:         "c",
+			Aggregation:  "avg",
+			SensorHeight: 2,
+			ValidMin:     &min,
+			ValidMax:     &max,
+		},
+	}
+
+	var buf strings.Builder
+	w := NewWriter(&buf)
+	w.Catalogue = catalogue
+	err := w.Write(browser.TimeSeries{
+		testMeasurement("a_avg", "s1", "c", 1),
+		testMeasurement("b_avg", "s1", "c", 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# a_avg: Air temperature [c], aggregation avg, sensor height 2 m, valid range -40..50
+time,station,landuse,elevation,latitude,longitude,a_avg,b_avg
+,,,,,,c,c
+2020-01-01 00:15:00,s1,me_s1,1000,3.14159,2.71828,0,0
+`
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteFlags(t *testing.T) {
+	a := testMeasurement("a_avg", "s1", "c", 2)
+	a.Points[0].Quality = browser.QualityValidated
+	b := testMeasurement("b_avg", "s1", "c", 1)
+	b.Points[0].Quality = browser.QualityChecked
+
+	var buf strings.Builder
+	w := NewWriter(&buf)
+	w.Flags = true
+	if err := w.Write(browser.TimeSeries{a, b}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `time,station,landuse,elevation,latitude,longitude,a_avg,a_avg_flag,b_avg,b_avg_flag
+,,,,,,c,,c,
+2020-01-01 00:15:00,s1,me_s1,1000,3.14159,2.71828,0,validated,0,checked
+2020-01-01 00:30:00,s1,me_s1,1000,3.14159,2.71828,1,raw,NaN,
+`
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteComments(t *testing.T) {
+	var buf strings.Builder
+	w := NewWriter(&buf)
+	w.Comments = []string{`measurements "b_avg": not allowed`}
+	if err := w.Write(browser.TimeSeries{testMeasurement("a_avg", "s1", "c", 1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# measurements "b_avg": not allowed
+time,station,landuse,elevation,latitude,longitude,a_avg
+,,,,,,c
+2020-01-01 00:15:00,s1,me_s1,1000,3.14159,2.71828,0
+`
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// errRead is the error returned by a failingIterator.
+var errRead = errors.New("read error")
+
+func TestWriteStream(t *testing.T) {
+	ts := browser.TimeSeries{
+		testMeasurement("a_avg", "s1", "c", 3),
+		testMeasurement("b_avg", "s1", "c", 3),
+	}
+	s := browser.NewStream(ts)
+
+	var closed int
+	points := s.Points
+	s.Points = func(m *browser.Measurement) browser.PointIterator {
+		it := &failingIterator{PointIterator: points(m), closed: &closed}
+		if m.Label == "b_avg" {
+			it.failAfter = 2
+		}
+		return it
+	}
+
+	var buf strings.Builder
+	if err := NewWriter(&buf).WriteStream(s); err != errRead {
+		t.Fatalf("got error %v, want %v", err, errRead)
+	}
+	if closed != len(ts) {
+		t.Fatalf("got %d closed iterators, want %d", closed, len(ts))
+	}
+}
+
+// failingIterator wraps a browser.PointIterator and fails after failAfter
+// points if failAfter is greater than zero.
+type failingIterator struct {
+	browser.PointIterator
+	failAfter int
+	closed    *int
+
+	n   int
+	err error
+}
+
+func (it *failingIterator) Next() bool {
+	if it.failAfter > 0 && it.n == it.failAfter {
+		it.err = errRead
+		return false
+	}
+	it.n++
+	return it.PointIterator.Next()
+}
+
+func (it *failingIterator) Err() error { return it.err }
+
+func (it *failingIterator) Close() error {
+	*it.closed++
+	return it.PointIterator.Close()
+}
+
 func testMeasurement(label, station, unit string, n int) *browser.Measurement {
 	m := &browser.Measurement{
 		Label:     label,
@@ -22,6 +22,9 @@
 //      2020-01-07 00:30:00,0,0.03,69,0.128,36
 //      ...
 //
+// If flags are enabled each measurement column is followed by a column with
+// the parameter <parameter>_flag holding the quality of the points.
+//
 // For more information see:
 // https://github.com/euracresearch/browser/-/issues/90
 package csvf
@@ -31,7 +34,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"sort"
+	"math"
+	"strconv"
 	"time"
 
 	"github.com/euracresearch/browser"
@@ -40,110 +44,262 @@ import (
 // DefaultTimeFormat defines the default format to timestamp in the CSV output.
 const DefaultTimeFormat = "2006-01-02 15:04:05"
 
+// ErrNotContinuous is returned if the measurements do not share the same
+// timestamps, which the friendly format does not support.
+var ErrNotContinuous = errors.New("not continuous timerange")
+
 // Writer writes a browser.TimeSeries as a friendly CSV file. It wraps a default
 // csv.Writer.
+//
+// Each row is written as soon as it is complete, so that memory usage does
+// not depend on the length of the time series.
 type Writer struct {
-	w *csv.Writer
+	w   *csv.Writer
+	out io.Writer
+
+	// Catalogue is used for writing a metadata header describing each
+	// measurement as comment lines prefixed with "#". If nil no metadata
+	// header is written.
+	Catalogue browser.Catalogue
 
-	// rows is used as a buffer holding all rows for appending values.
-	rows [][]string
+	// Flags enables writing a quality flag column after each measurement.
+	Flags bool
+
+	// Comments are written as comment lines prefixed with "#" before any
+	// other line, e.g. for reporting parts of the request denied by the
+	// access rules.
+	Comments []string
 }
 
 // NewWriter returns a new Writer that writes too w.
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
-		w: csv.NewWriter(w),
+		w:   csv.NewWriter(w),
+		out: w,
 	}
 }
 
-// Write writes the given browser.TimeSeries as friendly CSV file.
+// Write writes the given browser.TimeSeries as friendly CSV file. The given
+// browser.TimeSeries will not be modified.
 func (w *Writer) Write(ts browser.TimeSeries) error {
-	if len(ts) == 0 {
+	return w.WriteStream(browser.NewStream(ts))
+}
+
+// WriteStream writes the given browser.Stream as friendly CSV file. Points are
+// read from the stream while writing.
+//
+// Measurements starting at different timestamps are detected before anything
+// is written, otherwise ErrNotContinuous may be returned after parts of the
+// file are written.
+func (w *Writer) WriteStream(s *browser.Stream) error {
+	if len(s.TimeSeries) == 0 {
 		return browser.ErrDataNotFound
 	}
 
-	// Sort time series by station.
-	sort.Slice(ts, func(i, j int) bool { return ts[i].Station < ts[j].Station })
-
-	w.writeHeader("station", "landuse", "latitude", "longitude", "elevation", "parameter", "depth", "aggregation", "unit")
-
-	// maxColumns is the length of the time series plus the header.
-	maxColumns := len(ts) + 1
-	for k, m := range ts {
-		w.appendToRow(0, m.Station)
-		w.appendToRow(1, m.Landuse)
-		w.appendToRow(2, fmt.Sprint(m.Latitude))
-		w.appendToRow(3, fmt.Sprint(m.Longitude))
-		w.appendToRow(4, fmt.Sprint(m.Elevation))
-		w.appendToRow(5, m.Name())
-		w.appendToRow(6, m.DepthToString())
-		w.appendToRow(7, m.Aggregation)
-		w.appendToRow(8, m.Unit)
-
-		// Sort points by timestamp.
-		sort.Slice(m.Points, func(i, j int) bool { return m.Points[i].Timestamp.Before(m.Points[j].Timestamp) })
-
-		for i, p := range m.Points {
-			current := 9 + i
-
-			// For the first measurement or if the current measurement has more
-			// points than previous ones, create a new row and write the
-			// timestamp and the value at the specific column.
-			if k == 0 || len(w.rows) <= current {
-				row := make([]string, maxColumns)
-				for j := 0; j < maxColumns; j++ {
-					row[j] = "NaN"
-				}
+	// Sort a copy of the time series by station.
+	ts := s.TimeSeries.SortedByStation()
+
+	// iters holds the point iterator of each measurement and cur the next
+	// point to write, which is nil once all points of a measurement are
+	// written.
+	var (
+		iters = make([]browser.PointIterator, len(ts))
+		cur   = make([]*browser.Point, len(ts))
+	)
+	defer func() {
+		for _, it := range iters {
+			if it != nil {
+				it.Close()
+			}
+		}
+	}()
+
+	advance := func(i int) error {
+		cur[i] = nil
+		if iters[i].Next() {
+			cur[i] = iters[i].Point()
+		}
+		return iters[i].Err()
+	}
 
-				row[0] = p.Timestamp.Format(DefaultTimeFormat)
-				row[k+1] = fmt.Sprint(p.Value)
-				w.appendRow(row)
+	var first time.Time
+	for i, m := range ts {
+		iters[i] = s.Points(m)
+		if err := advance(i); err != nil {
+			return err
+		}
+
+		if cur[i] == nil {
+			continue
+		}
+		if first.IsZero() {
+			first = cur[i].Timestamp
+		} else if !cur[i].Timestamp.Equal(first) {
+			return ErrNotContinuous
+		}
+	}
+
+	if err := w.writeComments(); err != nil {
+		return err
+	}
+
+	if err := w.writeCatalogue(ts); err != nil {
+		return err
+	}
+
+	if err := w.writeHeader(ts); err != nil {
+		return err
+	}
+
+	n := w.columns()
+	row := make([]string, n*len(ts)+1)
+
+	// The n-th point of all measurements belongs to the n-th row, thus all
+	// measurements must share the same timestamps. Shorter measurements are
+	// filled with NaN at the end.
+	for {
+		var t time.Time
+		for i := range ts {
+			col := n*i + 1
+			if cur[i] == nil {
+				row[col] = "NaN"
+				if w.Flags {
+					row[col+1] = ""
+				}
 				continue
 			}
 
-			t, err := time.ParseInLocation(DefaultTimeFormat, w.rows[current][0], browser.Location)
-			if err != nil {
+			// Check if the timestamp of the row is equal to the timestamp of
+			// the point. If not the measurements do not have a continuous
+			// time range, which is currently not supported.
+			// TODO: add support for non continuous time ranges.
+			if t.IsZero() {
+				t = cur[i].Timestamp
+			} else if !cur[i].Timestamp.Equal(t) {
+				return ErrNotContinuous
+			}
+
+			row[col] = formatFloat(cur[i].Value)
+			if w.Flags {
+				row[col+1] = formatFlag(cur[i])
+			}
+			if err := advance(i); err != nil {
 				return err
 			}
+		}
+		if t.IsZero() {
+			break
+		}
 
-			// Check if the timestamp of the current row is equal to the
-			// timestamp of the point. If not means that the measurements do not
-			// have a continuous time range. This is currently not supported and
-			// will through an error.
-			// TODO: add support for non continuous time ranges.
-			if !p.Timestamp.Equal(t) {
-				return errors.New("not continuous timerange")
+		row[0] = t.Format(DefaultTimeFormat)
+		if err := w.w.Write(row); err != nil {
+			return err
+		}
+	}
+
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// writeHeader writes the metadata of each measurement in vertical order, line
+// by line.
+func (w *Writer) writeHeader(ts browser.TimeSeries) error {
+	header := []struct {
+		name  string
+		value func(m *browser.Measurement) string
+		flag  func(m *browser.Measurement) string // value of the flag column
+	}{
+		{"station", func(m *browser.Measurement) string { return m.Station }, nil},
+		{"landuse", func(m *browser.Measurement) string { return m.Landuse }, nil},
+		{"latitude", func(m *browser.Measurement) string { return formatFloat(m.Latitude) }, nil},
+		{"longitude", func(m *browser.Measurement) string { return formatFloat(m.Longitude) }, nil},
+		{"elevation", func(m *browser.Measurement) string { return strconv.FormatInt(m.Elevation, 10) }, nil},
+		{"parameter", func(m *browser.Measurement) string { return m.Name() }, func(m *browser.Measurement) string { return m.Name() + "_flag" }},
+		{"depth", func(m *browser.Measurement) string { return m.DepthToString() }, nil},
+		{"aggregation", func(m *browser.Measurement) string { return m.Aggregation }, empty},
+		{"unit", func(m *browser.Measurement) string { return m.Unit }, empty},
+	}
+
+	n := w.columns()
+	row := make([]string, n*len(ts)+1)
+	for _, h := range header {
+		row[0] = h.name
+		for i, m := range ts {
+			col := n*i + 1
+			row[col] = h.value(m)
+			if !w.Flags {
+				continue
 			}
 
-			// Add value to the current row at the given column.
-			w.rows[current][k+1] = fmt.Sprint(p.Value)
+			// Flag columns share the metadata of their measurement unless
+			// stated otherwise.
+			if h.flag != nil {
+				row[col+1] = h.flag(m)
+			} else {
+				row[col+1] = h.value(m)
+			}
+		}
+
+		if err := w.w.Write(row); err != nil {
+			return err
 		}
 	}
 
-	return w.w.WriteAll(w.rows)
+	return nil
 }
 
-// writeHeader writes the given names in vertical order, line by line.
-func (w *Writer) writeHeader(names ...string) {
-	for _, n := range names {
-		w.appendRow([]string{n})
+// columns returns the number of columns written for each measurement.
+func (w *Writer) columns() int {
+	if w.Flags {
+		return 2
+	}
+	return 1
+}
+
+// empty returns an empty header value.
+func empty(m *browser.Measurement) string { return "" }
+
+// formatFlag returns the quality flag of the given point, which is empty for
+// missing values.
+func formatFlag(p *browser.Point) string {
+	if math.IsNaN(p.Value) {
+		return ""
 	}
+	return p.Quality.String()
 }
 
-// appendRow appends the given line at the end of all buffered rows.
-func (w *Writer) appendRow(line []string) {
-	w.rows = append(w.rows, line)
+// formatFloat formats the given float like fmt.Sprint does.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
 }
 
-// appendToRow appends the given data to the end of the given row. If the given
-// row number is out of range a new row will be added.
-func (w *Writer) appendToRow(row int, data string) {
-	// Check if row is out of range. If so create a new row instead of appending
-	// to an existing one.
-	if row >= len(w.rows) {
-		w.appendRow([]string{data})
-		return
+// writeComments writes a comment line for each comment.
+func (w *Writer) writeComments() error {
+	for _, c := range w.Comments {
+		if _, err := fmt.Fprintf(w.out, "# %s\n", c); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// writeCatalogue writes a comment line for each measurement of ts found in the
+// catalogue.
+func (w *Writer) writeCatalogue(ts browser.TimeSeries) error {
+	seen := make(map[string]bool)
+	for _, m := range ts {
+		if seen[m.Label] {
+			continue
+		}
+		seen[m.Label] = true
 
-	w.rows[row] = append(w.rows[row], data)
+		p, ok := w.Catalogue.Get(m.Label)
+		if !ok {
+			continue
+		}
+		if _, err := fmt.Fprintf(w.out, "# %s\n", p); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -6,6 +6,7 @@ package csvf
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 	"time"
 
@@ -143,6 +144,176 @@ unit,c,b,a
 	}
 }
 
+func TestWriteNotContinuous(t *testing.T) {
+	s1 := &browser.Measurement{
+		Label:   "a_avg",
+		Station: "s1",
+		Points: []*browser.Point{
+			testPoint("2020-01-01T00:45:00+01:00", 2),
+			testPoint("2020-01-01T00:15:00+01:00", 0),
+		},
+	}
+
+	testCases := map[string]struct {
+		in        browser.TimeSeries
+		wantEmpty bool
+	}{
+		"different_timestamps": {
+			browser.TimeSeries{
+				s1,
+				&browser.Measurement{
+					Label:   "a_avg",
+					Station: "s2",
+					Points: []*browser.Point{
+						testPoint("2020-01-01T00:15:00+01:00", 10),
+						testPoint("2020-01-01T00:30:00+01:00", 11),
+					},
+				},
+			},
+			false,
+		},
+		"different_start": {
+			browser.TimeSeries{
+				s1,
+				&browser.Measurement{
+					Label:   "a_avg",
+					Station: "s2",
+					Points: []*browser.Point{
+						testPoint("2020-01-01T00:30:00+01:00", 11),
+					},
+				},
+			},
+			true,
+		},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewWriter(&buf).Write(tc.in); !errors.Is(err, ErrNotContinuous) {
+				t.Fatalf("got error %v, want %v", err, ErrNotContinuous)
+			}
+			if tc.wantEmpty && buf.Len() > 0 {
+				t.Fatalf("got output before the error:\n%s", buf.String())
+			}
+		})
+	}
+}
+
+func TestWriteKeepsInput(t *testing.T) {
+	in := browser.TimeSeries{
+		testMeasurement("a_avg", "s2", "c", 2),
+		testMeasurement("a_avg", "s1", "c", 2),
+	}
+	in[0].Points[0], in[0].Points[1] = in[0].Points[1], in[0].Points[0]
+
+	var buf bytes.Buffer
+	if err := NewWriter(&buf).Write(in); err != nil {
+		t.Fatal(err)
+	}
+
+	if in[0].Station != "s2" || in[0].Points[0].Value != 1 {
+		t.Fatal("Write modified the given time series")
+	}
+}
+
+func TestWriteCatalogue(t *testing.T) {
+	min, max := -40.0, 50.0
+	catalogue := browser.Catalogue{
+		&browser.Parameter{
+			Label:        "a_avg",
+			Description:  map[string]string{"en": "Air temperature", "de": "Lufttemperatur"},
+			Unit:         "c",
+			Aggregation:  "avg",
+			SensorHeight: 2,
+			ValidMin:     &min,
+			ValidMax:     &max,
+		},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Catalogue = catalogue
+	err := w.Write(browser.TimeSeries{
+		testMeasurement("a_avg", "s1", "c", 1),
+		testMeasurement("b_avg", "s1", "c", 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# a_avg: Air temperature [c], aggregation avg, sensor height 2 m, valid range -40..50
+station,s1,s1
+landuse,me_s1,me_s1
+latitude,3.14159,3.14159
+longitude,2.71828,2.71828
+elevation,1000,1000
+parameter,a,b
+depth,,
+aggregation,avg,avg
+unit,c,c
+2020-01-01 00:15:00,0,0
+`
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteFlags(t *testing.T) {
+	a := testMeasurement("a_avg", "s1", "c", 2)
+	a.Points[0].Quality = browser.QualityValidated
+	b := testMeasurement("a_avg", "s2", "c", 1)
+	b.Points[0].Quality = browser.QualityBad
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Flags = true
+	if err := w.Write(browser.TimeSeries{a, b}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `station,s1,s1,s2,s2
+landuse,me_s1,me_s1,me_s2,me_s2
+latitude,3.14159,3.14159,3.14159,3.14159
+longitude,2.71828,2.71828,2.71828,2.71828
+elevation,1000,1000,1000,1000
+parameter,a,a_flag,a,a_flag
+depth,,,,
+aggregation,avg,,avg,
+unit,c,,c,
+2020-01-01 00:15:00,0,validated,0,bad
+2020-01-01 00:30:00,1,raw,NaN,
+`
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteComments(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Comments = []string{`measurements "b_avg": not allowed`}
+	if err := w.Write(browser.TimeSeries{testMeasurement("a_avg", "s1", "c", 1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# measurements "b_avg": not allowed
+station,s1
+landuse,me_s1
+latitude,3.14159
+longitude,2.71828
+elevation,1000
+parameter,a
+depth,
+aggregation,avg
+unit,c
+2020-01-01 00:15:00,0
+`
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
 func testMeasurement(label, station, unit string, n int) *browser.Measurement {
 	m := &browser.Measurement{
 		Label:       label,
@@ -167,3 +338,11 @@ func testMeasurement(label, station, unit string, n int) *browser.Measurement {
 
 	return m
 }
+
+func testPoint(t string, value float64) *browser.Point {
+	ts, _ := time.ParseInLocation(time.RFC3339, t, browser.Location)
+	return &browser.Point{
+		Timestamp: ts,
+		Value:     value,
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package json writes a browser.TimeSeries as JSON document.
+//
+// The document is an array of measurements, each with its metadata and the
+// measured points. Missing values (NaN) are encoded as null:
+//
+//  [
+//    {
+//      "label": "air_t_avg",
+//      "name": "air_t",
+//      "station": "s1",
+//      "landuse": "me",
+//      "unit": "deg c",
+//      "aggregation": "avg",
+//      "depth": 0,
+//      "elevation": 1000,
+//      "latitude": 3.14159,
+//      "longitude": 2.71828,
+//      "points": [
+//        {"time": "2020-01-01T00:15:00+01:00", "value": 9.46},
+//        {"time": "2020-01-01T00:30:00+01:00", "value": null}
+//      ]
+//    }
+//  ]
+//
+package json
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"time"
+
+	"github.com/euracresearch/browser"
+)
+
+// Writer writes a browser.TimeSeries as JSON document.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter returns a new Writer that writes to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w: bufio.NewWriter(w),
+	}
+}
+
+// measurement is the JSON representation of a browser.Measurement.
+type measurement struct {
+	Label       string   `json:"label"`
+	Name        string   `json:"name"`
+	Station     string   `json:"station"`
+	Landuse     string   `json:"landuse"`
+	Unit        string   `json:"unit"`
+	Aggregation string   `json:"aggregation"`
+	Depth       int64    `json:"depth"`
+	Elevation   int64    `json:"elevation"`
+	Latitude    float64  `json:"latitude"`
+	Longitude   float64  `json:"longitude"`
+	Points      []*point `json:"points"`
+}
+
+// point is the JSON representation of a browser.Point. A nil Value denotes a
+// missing value.
+type point struct {
+	Time  string   `json:"time"`
+	Value *float64 `json:"value"`
+}
+
+// Write writes the given browser.TimeSeries as JSON document. Measurements are
+// encoded one by one so that only a single measurement is held in its JSON
+// representation at a time.
+func (w *Writer) Write(ts browser.TimeSeries) error {
+	if len(ts) == 0 {
+		return browser.ErrDataNotFound
+	}
+
+	if err := w.w.WriteByte('['); err != nil {
+		return err
+	}
+
+	for i, m := range ts {
+		if i > 0 {
+			if err := w.w.WriteByte(','); err != nil {
+				return err
+			}
+		}
+
+		// json.Encoder would terminate each measurement with a newline.
+		b, err := json.Marshal(newMeasurement(m))
+		if err != nil {
+			return err
+		}
+		if _, err := w.w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.w.WriteString("]\n"); err != nil {
+		return err
+	}
+
+	return w.w.Flush()
+}
+
+// newMeasurement converts the given browser.Measurement to its JSON
+// representation.
+func newMeasurement(m *browser.Measurement) *measurement {
+	jm := &measurement{
+		Label:       m.Label,
+		Name:        m.Name(),
+		Station:     m.Station,
+		Landuse:     m.Landuse,
+		Unit:        m.Unit,
+		Aggregation: m.Aggregation,
+		Depth:       m.Depth,
+		Elevation:   m.Elevation,
+		Latitude:    m.Latitude,
+		Longitude:   m.Longitude,
+		Points:      make([]*point, 0, len(m.Points)),
+	}
+
+	for _, p := range m.Points {
+		jp := &point{
+			Time: p.Timestamp.Format(time.RFC3339),
+		}
+
+		if !math.IsNaN(p.Value) && !math.IsInf(p.Value, 0) {
+			v := p.Value
+			jp.Value = &v
+		}
+
+		jm.Points = append(jm.Points, jp)
+	}
+
+	return jm
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/euracresearch/browser"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWrite(t *testing.T) {
+	testCases := map[string]struct {
+		in   browser.TimeSeries
+		want string
+	}{
+		"empty": {
+			browser.TimeSeries{},
+			"",
+		},
+		"one_measurement": {
+			browser.TimeSeries{
+				testMeasurement("a_avg", "s1", "c", 2),
+			},
+			`[{"label":"a_avg","name":"a","station":"s1","landuse":"me_s1","unit":"c","aggregation":"avg","depth":0,"elevation":1000,"latitude":3.14159,"longitude":2.71828,"points":[{"time":"2020-01-01T00:15:00+01:00","value":0},{"time":"2020-01-01T00:30:00+01:00","value":1}]}]
+`,
+		},
+		"two_measurements_with_nan": {
+			browser.TimeSeries{
+				testMeasurement("a_avg", "s1", "c", 1),
+				&browser.Measurement{
+					Label:       "b_02_avg",
+					Station:     "s2",
+					Aggregation: "avg",
+					Landuse:     "me_s2",
+					Unit:        "mm",
+					Depth:       2,
+					Elevation:   50,
+					Latitude:    3,
+					Longitude:   2,
+					Points: []*browser.Point{
+						testPoint("2020-01-01T00:15:00+01:00", math.NaN()),
+						testPoint("2020-01-01T00:30:00+01:00", 2.5),
+					},
+				},
+			},
+			`[{"label":"a_avg","name":"a","station":"s1","landuse":"me_s1","unit":"c","aggregation":"avg","depth":0,"elevation":1000,"latitude":3.14159,"longitude":2.71828,"points":[{"time":"2020-01-01T00:15:00+01:00","value":0}]},{"label":"b_02_avg","name":"b","station":"s2","landuse":"me_s2","unit":"mm","aggregation":"avg","depth":2,"elevation":50,"latitude":3,"longitude":2,"points":[{"time":"2020-01-01T00:15:00+01:00","value":null},{"time":"2020-01-01T00:30:00+01:00","value":2.5}]}]
+`,
+		},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			var buf strings.Builder
+			w := NewWriter(&buf)
+			w.Write(tc.in)
+
+			diff := cmp.Diff(tc.want, buf.String())
+			if diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func testMeasurement(label, station, unit string, n int) *browser.Measurement {
+	m := &browser.Measurement{
+		Label:       label,
+		Station:     station,
+		Aggregation: "avg",
+		Landuse:     "me_" + station,
+		Unit:        unit,
+		Elevation:   1000,
+		Latitude:    3.14159,
+		Longitude:   2.71828,
+	}
+
+	ts := time.Date(2020, time.January, 1, 0, 0, 0, 0, browser.Location)
+
+	for i := 0; i < n; i++ {
+		ts = ts.Add(15 * time.Minute)
+		m.Points = append(m.Points, &browser.Point{
+			Timestamp: ts,
+			Value:     float64(i),
+		})
+	}
+
+	return m
+}
+
+func testPoint(t string, value float64) *browser.Point {
+	ts, _ := time.ParseInLocation(time.RFC3339, t, browser.Location)
+	return &browser.Point{
+		Timestamp: ts,
+		Value:     value,
+	}
+}
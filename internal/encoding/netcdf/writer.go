@@ -0,0 +1,507 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package netcdf writes a browser.TimeSeries as NetCDF file following the
+// Climate and Forecast (CF) conventions.
+//
+// The file uses the classic data model and is written in the 64-bit offset
+// format. Stations are represented as orthogonal multidimensional array of
+// time series (CF-1.8, section H.2.1):
+//
+//  dimensions:
+//    station = 2 ;
+//    time = 96 ;
+//    name_strlen = 2 ;
+//  variables:
+//    double time(time) ;
+//      time:units = "seconds since 1970-01-01 00:00:00 UTC" ;
+//    char station_name(station, name_strlen) ;
+//      station_name:cf_role = "timeseries_id" ;
+//    double lat(station) ;
+//    double lon(station) ;
+//    double alt(station) ;
+//    double air_t_avg(station, time) ;
+//      air_t_avg:units = "deg c" ;
+//      air_t_avg:cell_methods = "time: mean" ;
+//
+// Every measurement label becomes a variable holding the values of all
+// stations on a common time axis. Missing values are NaN, which is also the
+// _FillValue of the variable. If a station has more than one measurement with
+// the same label or a label equals the name of another variable, a suffix
+// "_2", "_3", ... is added to the variable name.
+//
+// See: https://cfconventions.org and
+// https://docs.unidata.ucar.edu/netcdf-c/current/file_format_specifications.html
+package netcdf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/euracresearch/browser"
+)
+
+// NetCDF tags and types of the classic format.
+const (
+	tagDimension = 0x0a
+	tagVariable  = 0x0b
+	tagAttribute = 0x0c
+
+	typeChar   = 2
+	typeInt    = 4
+	typeDouble = 6
+)
+
+// magic denotes the 64-bit offset format (CDF-2).
+var magic = []byte{'C', 'D', 'F', 2}
+
+// Writer writes a browser.TimeSeries as NetCDF file.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter returns a new Writer that writes to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w: bufio.NewWriter(w),
+	}
+}
+
+// attribute is a NetCDF attribute. The value must be of type string, int32 or
+// float64.
+type attribute struct {
+	name  string
+	value interface{}
+}
+
+// variable is a NetCDF variable with the function writing its data.
+type variable struct {
+	name  string
+	dims  []int
+	typ   int32
+	attrs []attribute
+	size  int64
+	data  func(w io.Writer) error
+}
+
+// Write writes the given browser.TimeSeries as NetCDF file. The given
+// browser.TimeSeries will not be modified.
+func (w *Writer) Write(ts browser.TimeSeries) error {
+	if len(ts) == 0 {
+		return browser.ErrDataNotFound
+	}
+
+	stations, meta := stationsOf(ts)
+	times := timeAxis(ts)
+	series := seriesOf(ts)
+
+	nameLen := 1
+	for _, s := range stations {
+		if len(s) > nameLen {
+			nameLen = len(s)
+		}
+	}
+
+	dims := []struct {
+		name string
+		len  int
+	}{
+		{"station", len(stations)},
+		{"time", len(times)},
+		{"name_strlen", nameLen},
+	}
+	const (
+		dimStation = iota
+		dimTime
+		dimNameLen
+	)
+
+	vars := []*variable{
+		{
+			name: "time",
+			dims: []int{dimTime},
+			typ:  typeDouble,
+			attrs: []attribute{
+				{"standard_name", "time"},
+				{"long_name", "time"},
+				{"units", "seconds since 1970-01-01 00:00:00 UTC"},
+				{"calendar", "standard"},
+				{"axis", "T"},
+			},
+			data: func(w io.Writer) error {
+				for _, t := range times {
+					if err := writeDouble(w, float64(t.Unix())); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name: "station_name",
+			dims: []int{dimStation, dimNameLen},
+			typ:  typeChar,
+			attrs: []attribute{
+				{"long_name", "station name"},
+				{"cf_role", "timeseries_id"},
+			},
+			data: func(w io.Writer) error {
+				for _, s := range stations {
+					b := make([]byte, nameLen)
+					copy(b, s)
+					if _, err := w.Write(b); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		stationVariable("lat", stations, meta, func(m *browser.Measurement) float64 { return m.Latitude },
+			attribute{"standard_name", "latitude"},
+			attribute{"long_name", "station latitude"},
+			attribute{"units", "degrees_north"},
+		),
+		stationVariable("lon", stations, meta, func(m *browser.Measurement) float64 { return m.Longitude },
+			attribute{"standard_name", "longitude"},
+			attribute{"long_name", "station longitude"},
+			attribute{"units", "degrees_east"},
+		),
+		stationVariable("alt", stations, meta, func(m *browser.Measurement) float64 { return float64(m.Elevation) },
+			attribute{"standard_name", "altitude"},
+			attribute{"long_name", "station elevation"},
+			attribute{"units", "m"},
+			attribute{"positive", "up"},
+			attribute{"axis", "Z"},
+		),
+	}
+
+	for _, s := range series {
+		vars = append(vars, measurementVariable(s, stations, times, dimStation, dimTime))
+	}
+
+	for _, v := range vars {
+		v.size = int64(typeSize(v.typ))
+		for _, d := range v.dims {
+			v.size *= int64(dims[d].len)
+		}
+	}
+
+	gattrs := []attribute{
+		{"Conventions", "CF-1.8"},
+		{"featureType", "timeSeries"},
+		{"title", "LTSER IT25 Matsch | Mazia"},
+		{"institution", "Eurac Research"},
+		{"source", "https://browser.lter.eurac.edu"},
+	}
+
+	// The size of the header does not depend on the offsets of the
+	// variables, so it is encoded twice: once for computing its size and once
+	// with the actual offsets.
+	var header bytes.Buffer
+	offsets := make([]int64, len(vars))
+	for pass := 0; pass < 2; pass++ {
+		header.Reset()
+		header.Write(magic)
+		writeInt(&header, 0) // numrecs: no record variables.
+
+		writeInt(&header, tagDimension)
+		writeInt(&header, int32(len(dims)))
+		for _, d := range dims {
+			writeName(&header, d.name)
+			writeInt(&header, int32(d.len))
+		}
+
+		writeAttributes(&header, gattrs)
+
+		writeInt(&header, tagVariable)
+		writeInt(&header, int32(len(vars)))
+		for i, v := range vars {
+			writeName(&header, v.name)
+			writeInt(&header, int32(len(v.dims)))
+			for _, d := range v.dims {
+				writeInt(&header, int32(d))
+			}
+			writeAttributes(&header, v.attrs)
+			writeInt(&header, v.typ)
+			writeInt(&header, vsize(v.size))
+			binary.Write(&header, binary.BigEndian, offsets[i])
+		}
+
+		offset := int64(header.Len())
+		for i, v := range vars {
+			offsets[i] = offset
+			offset += padded(v.size)
+		}
+	}
+
+	if _, err := w.w.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	for _, v := range vars {
+		if err := v.data(w.w); err != nil {
+			return err
+		}
+		if _, err := w.w.Write(make([]byte, padded(v.size)-v.size)); err != nil {
+			return err
+		}
+	}
+
+	return w.w.Flush()
+}
+
+// stationVariable returns a variable of the given name holding a value for
+// each station.
+func stationVariable(name string, stations []string, meta map[string]*browser.Measurement, value func(*browser.Measurement) float64, attrs ...attribute) *variable {
+	return &variable{
+		name:  name,
+		dims:  []int{0},
+		typ:   typeDouble,
+		attrs: attrs,
+		data: func(w io.Writer) error {
+			for _, s := range stations {
+				if err := writeDouble(w, value(meta[s])); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// measurementVariable returns a variable for the given series holding the
+// values of all stations on the given time axis.
+func measurementVariable(s *series, stations []string, times []time.Time, dimStation, dimTime int) *variable {
+	first := s.first
+	attrs := []attribute{
+		{"long_name", first.Name()},
+		{"units", first.Unit},
+	}
+	if cm := cellMethods(first.Aggregation); cm != "" {
+		attrs = append(attrs, attribute{"cell_methods", cm})
+	}
+	if first.Depth > 0 {
+		attrs = append(attrs, attribute{"depth", int32(first.Depth)})
+	}
+	attrs = append(attrs,
+		attribute{"coordinates", "lat lon alt station_name"},
+		attribute{"_FillValue", math.NaN()},
+	)
+
+	return &variable{
+		name:  s.name,
+		dims:  []int{dimStation, dimTime},
+		typ:   typeDouble,
+		attrs: attrs,
+		data: func(w io.Writer) error {
+			for _, station := range stations {
+				var points []*browser.Point
+				if m, ok := s.byStation[station]; ok {
+					points = browser.SortedPoints(m.Points)
+				}
+
+				next := 0
+				for _, t := range times {
+					for next < len(points) && points[next].Timestamp.Before(t) {
+						next++
+					}
+
+					v := math.NaN()
+					if next < len(points) && points[next].Timestamp.Equal(t) {
+						v = points[next].Value
+						next++
+					}
+
+					if err := writeDouble(w, v); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// cellMethods returns the CF cell_methods attribute for the given LTER
+// aggregation. An empty string is returned for unknown aggregations.
+func cellMethods(aggregation string) string {
+	switch strings.ToLower(aggregation) {
+	case "avg":
+		return "time: mean"
+	case "tot":
+		return "time: sum"
+	case "min":
+		return "time: minimum"
+	case "max":
+		return "time: maximum"
+	case "std":
+		return "time: standard_deviation"
+	case "smp":
+		return "time: point"
+	}
+	return ""
+}
+
+// stationsOf returns the sorted station names of the given time series and
+// the first measurement of each station for retrieving its metadata.
+func stationsOf(ts browser.TimeSeries) ([]string, map[string]*browser.Measurement) {
+	meta := make(map[string]*browser.Measurement)
+	var stations []string
+	for _, m := range ts {
+		if _, ok := meta[m.Station]; ok {
+			continue
+		}
+		meta[m.Station] = m
+		stations = append(stations, m.Station)
+	}
+	sort.Strings(stations)
+
+	return stations, meta
+}
+
+// series holds the measurements stored in a single variable, at most one for
+// each station.
+type series struct {
+	name      string
+	first     *browser.Measurement // provides the metadata of the variable
+	byStation map[string]*browser.Measurement
+}
+
+// seriesOf groups the measurements of the given time series by label in order
+// of their first appearance. Each series has a unique variable name, which
+// does not collide with the names of the coordinate variables.
+func seriesOf(ts browser.TimeSeries) []*series {
+	taken := map[string]bool{
+		"time":         true,
+		"station_name": true,
+		"lat":          true,
+		"lon":          true,
+		"alt":          true,
+	}
+
+	var list []*series
+	for _, m := range ts {
+		var s *series
+		for _, c := range list {
+			if _, ok := c.byStation[m.Station]; !ok && c.first.Label == m.Label {
+				s = c
+				break
+			}
+		}
+
+		if s == nil {
+			name := m.Label
+			for i := 2; taken[name]; i++ {
+				name = fmt.Sprintf("%s_%d", m.Label, i)
+			}
+			taken[name] = true
+
+			s = &series{name: name, first: m, byStation: make(map[string]*browser.Measurement)}
+			list = append(list, s)
+		}
+		s.byStation[m.Station] = m
+	}
+	return list
+}
+
+// timeAxis returns the sorted distinct timestamps of all points of the given
+// time series.
+func timeAxis(ts browser.TimeSeries) []time.Time {
+	seen := make(map[int64]bool)
+	var times []time.Time
+	for _, m := range ts {
+		for _, p := range m.Points {
+			n := p.Timestamp.UnixNano()
+			if seen[n] {
+				continue
+			}
+			seen[n] = true
+			times = append(times, p.Timestamp)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	return times
+}
+
+func writeAttributes(buf *bytes.Buffer, attrs []attribute) {
+	if len(attrs) == 0 {
+		// ABSENT
+		writeInt(buf, 0)
+		writeInt(buf, 0)
+		return
+	}
+
+	writeInt(buf, tagAttribute)
+	writeInt(buf, int32(len(attrs)))
+	for _, a := range attrs {
+		writeName(buf, a.name)
+
+		switch v := a.value.(type) {
+		case string:
+			writeInt(buf, typeChar)
+			writeInt(buf, int32(len(v)))
+			buf.WriteString(v)
+			buf.Write(make([]byte, padded(int64(len(v)))-int64(len(v))))
+		case int32:
+			writeInt(buf, typeInt)
+			writeInt(buf, 1)
+			writeInt(buf, v)
+		case float64:
+			writeInt(buf, typeDouble)
+			writeInt(buf, 1)
+			writeDouble(buf, v)
+		}
+	}
+}
+
+func writeName(buf *bytes.Buffer, name string) {
+	writeInt(buf, int32(len(name)))
+	buf.WriteString(name)
+	buf.Write(make([]byte, padded(int64(len(name)))-int64(len(name))))
+}
+
+func writeInt(w io.Writer, v int32) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func writeDouble(w io.Writer, v float64) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(v))
+	_, err := w.Write(b[:])
+	return err
+}
+
+func typeSize(typ int32) int {
+	switch typ {
+	case typeChar:
+		return 1
+	case typeInt:
+		return 4
+	}
+	return 8
+}
+
+// padded returns n rounded up to the next multiple of four.
+func padded(n int64) int64 {
+	return (n + 3) &^ 3
+}
+
+// vsize returns the vsize header entry of a variable with the given size. If
+// the size does not fit into 32 bits, the maximum value is used as defined in
+// the specification.
+func vsize(size int64) int32 {
+	size = padded(size)
+	if size > math.MaxUint32-1 {
+		return -1
+	}
+	return int32(uint32(size))
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package netcdf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/euracresearch/browser"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewWriter(&buf).Write(browser.TimeSeries{}); !errors.Is(err, browser.ErrDataNotFound) {
+		t.Fatalf("empty: got error %v, want %v", err, browser.ErrDataNotFound)
+	}
+
+	ts := browser.TimeSeries{
+		testMeasurement("a_avg", "s2", "c", 2),
+		testMeasurement("b_tot", "s1", "mm", 3),
+		testMeasurement("a_avg", "s1", "c", 3),
+	}
+	ts[2].Points[1].Value = math.NaN()
+
+	if err := NewWriter(&buf).Write(ts); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	if !bytes.Equal(b[:4], magic) {
+		t.Fatalf("got magic %q, want %q", b[:4], magic)
+	}
+
+	// The header starts with numrecs followed by the dimension list.
+	var header struct {
+		Numrecs, Tag, N int32
+	}
+	if err := binary.Read(bytes.NewReader(b[4:]), binary.BigEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Numrecs != 0 || header.Tag != tagDimension || header.N != 3 {
+		t.Fatalf("unexpected header %+v", header)
+	}
+
+	// The last variable is b_tot(station, time) with stations s1, s2 and
+	// three timestamps, written at the end of the file.
+	want := []float64{0, 1, 2, math.NaN(), math.NaN(), math.NaN()}
+	got := make([]float64, len(want))
+	if err := binary.Read(bytes.NewReader(b[len(b)-8*len(want):]), binary.BigEndian, got); err != nil {
+		t.Fatal(err)
+	}
+	diff := cmp.Diff(want, got, cmp.Comparer(func(x, y float64) bool {
+		return (math.IsNaN(x) && math.IsNaN(y)) || x == y
+	}))
+	if diff != "" {
+		t.Fatalf("b_tot mismatch (-want +got):\n%s", diff)
+	}
+
+	// Followed by a_avg, with the NaN of station s1 and the missing point of
+	// station s2.
+	want = []float64{0, math.NaN(), 2, 0, 1, math.NaN()}
+	if err := binary.Read(bytes.NewReader(b[len(b)-16*len(want):]), binary.BigEndian, got); err != nil {
+		t.Fatal(err)
+	}
+	diff = cmp.Diff(want, got, cmp.Comparer(func(x, y float64) bool {
+		return (math.IsNaN(x) && math.IsNaN(y)) || x == y
+	}))
+	if diff != "" {
+		t.Fatalf("a_avg mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSeriesOf(t *testing.T) {
+	testCases := map[string]struct {
+		in   browser.TimeSeries
+		want []string
+	}{
+		"unique": {
+			browser.TimeSeries{
+				testMeasurement("a_avg", "s1", "c", 1),
+				testMeasurement("b_avg", "s1", "c", 1),
+				testMeasurement("a_avg", "s2", "c", 1),
+			},
+			[]string{"a_avg", "b_avg"},
+		},
+		"same_label_same_station": {
+			browser.TimeSeries{
+				testMeasurement("a_avg", "s1", "c", 1),
+				testMeasurement("a_avg", "s1", "c", 1),
+				testMeasurement("a_avg", "s2", "c", 1),
+				testMeasurement("a_avg", "s1", "c", 1),
+			},
+			[]string{"a_avg", "a_avg_2", "a_avg_3"},
+		},
+		"reserved": {
+			browser.TimeSeries{
+				testMeasurement("time", "s1", "c", 1),
+				testMeasurement("lat", "s1", "c", 1),
+				testMeasurement("time_2", "s1", "c", 1),
+			},
+			[]string{"time_2", "lat_2", "time_2_2"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			for _, s := range seriesOf(tc.in) {
+				got = append(got, s.name)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCellMethods(t *testing.T) {
+	testCases := map[string]string{
+		"avg": "time: mean",
+		"tot": "time: sum",
+		"min": "time: minimum",
+		"max": "time: maximum",
+		"std": "time: standard_deviation",
+		"smp": "time: point",
+		"":    "",
+		"xyz": "",
+	}
+
+	for in, want := range testCases {
+		if got := cellMethods(in); got != want {
+			t.Errorf("cellMethods(%q): got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func testMeasurement(label, station, unit string, n int) *browser.Measurement {
+	m := &browser.Measurement{
+		Label:       label,
+		Station:     station,
+		Aggregation: "avg",
+		Landuse:     "me_" + station,
+		Unit:        unit,
+		Elevation:   1000,
+		Latitude:    3.14159,
+		Longitude:   2.71828,
+	}
+
+	ts := time.Date(2020, time.January, 1, 0, 0, 0, 0, browser.Location)
+
+	for i := 0; i < n; i++ {
+		ts = ts.Add(15 * time.Minute)
+		m.Points = append(m.Points, &browser.Point{
+			Timestamp: ts,
+			Value:     float64(i),
+		})
+	}
+
+	return m
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Field types of the Thrift compact protocol.
+// See: https://github.com/apache/thrift/blob/master/doc/specs/thrift-compact-protocol.md
+const (
+	compactI32    = 5
+	compactI64    = 6
+	compactBinary = 8
+	compactList   = 9
+	compactStruct = 12
+)
+
+// thrift is a minimal encoder for the Thrift compact protocol, supporting only
+// what is needed for writing Parquet metadata. Every encoded value must be
+// enclosed by structBegin(0) and structEnd.
+type thrift struct {
+	buf bytes.Buffer
+
+	// last holds the id of the last written field for each nested struct.
+	last []int16
+}
+
+// Bytes returns the encoded data.
+func (t *thrift) Bytes() []byte {
+	return t.buf.Bytes()
+}
+
+// field writes a field header with the given id and compact type.
+func (t *thrift) field(id int16, typ byte) {
+	delta := id - t.last[len(t.last)-1]
+	if delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	t.last[len(t.last)-1] = id
+}
+
+// varint writes v as zigzag encoded varint.
+func (t *thrift) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	t.buf.Write(b[:n])
+}
+
+// uvarint writes v as unsigned varint.
+func (t *thrift) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	t.buf.Write(b[:n])
+}
+
+func (t *thrift) i32(id int16, v int32) {
+	t.field(id, compactI32)
+	t.varint(int64(v))
+}
+
+func (t *thrift) i64(id int16, v int64) {
+	t.field(id, compactI64)
+	t.varint(v)
+}
+
+func (t *thrift) binary(id int16, s string) {
+	t.field(id, compactBinary)
+	t.uvarint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+// list writes a list header with n elements of the given compact type.
+func (t *thrift) list(id int16, typ byte, n int) {
+	t.field(id, compactList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | typ)
+		return
+	}
+	t.buf.WriteByte(0xf0 | typ)
+	t.uvarint(uint64(n))
+}
+
+// listI32 writes a list of i32 values.
+func (t *thrift) listI32(id int16, v ...int32) {
+	t.list(id, compactI32, len(v))
+	for _, i := range v {
+		t.varint(int64(i))
+	}
+}
+
+// listBinary writes a list of strings.
+func (t *thrift) listBinary(id int16, v ...string) {
+	t.list(id, compactBinary, len(v))
+	for _, s := range v {
+		t.uvarint(uint64(len(s)))
+		t.buf.WriteString(s)
+	}
+}
+
+// structBegin starts a nested struct. If id is zero no field header is
+// written, which is needed for struct elements of a list.
+func (t *thrift) structBegin(id int16) {
+	if id > 0 {
+		t.field(id, compactStruct)
+	}
+	t.last = append(t.last, 0)
+}
+
+// structEnd ends the current struct.
+func (t *thrift) structEnd() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
@@ -0,0 +1,522 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package parquet writes a browser.TimeSeries as Apache Parquet file.
+//
+// The file has one row per station and timestamp, like the LTER default CSV
+// format, with the following columns:
+//
+//  time       INT64 (TIMESTAMP_MILLIS, UTC)
+//  station    BYTE_ARRAY (UTF8)
+//  landuse    BYTE_ARRAY (UTF8)
+//  elevation  INT64
+//  latitude   DOUBLE
+//  longitude  DOUBLE
+//  depth      INT64, optional
+//  <label>    DOUBLE, optional
+//  ...
+//
+// Each measurement label is an optional column, where missing values are
+// null. Rows hold the measurements of a single depth, which is null for
+// measurements without depth. The unit and aggregation of a measurement are
+// stored as "unit" and "aggregation" in the key value metadata of its column
+// chunks.
+//
+// Only the subset of the format needed for the export is implemented: PLAIN
+// encoded, GZIP compressed data pages (v1) with one page per column chunk.
+// See: https://github.com/apache/parquet-format
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/euracresearch/browser"
+)
+
+// DefaultRowGroupSize is the default maximum number of rows of a row group.
+const DefaultRowGroupSize = 64 * 1024
+
+const magic = "PAR1"
+
+// Parquet physical types, repetition types, converted types, encodings,
+// compression codecs and page types.
+const (
+	typeInt64     = 2
+	typeDouble    = 5
+	typeByteArray = 6
+
+	repetitionRequired = 0
+	repetitionOptional = 1
+
+	convertedNone            = -1
+	convertedUTF8            = 0
+	convertedTimestampMillis = 9
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecGzip = 2
+
+	pageData = 0
+)
+
+// Writer writes a browser.TimeSeries as Parquet file.
+type Writer struct {
+	w      io.Writer
+	offset int64
+
+	// RowGroupSize is the maximum number of rows buffered in memory before
+	// they are written as a row group.
+	RowGroupSize int
+
+	columns   []*column
+	rowGroups []*rowGroup
+	numRows   int64
+}
+
+// NewWriter returns a new Writer that writes to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:            w,
+		RowGroupSize: DefaultRowGroupSize,
+	}
+}
+
+// column holds the schema and the buffered values of a single column.
+type column struct {
+	name      string
+	typ       int32
+	converted int32
+	optional  bool
+
+	// metadata holds the key value metadata written with each column chunk.
+	metadata []keyValue
+
+	// values holds the PLAIN encoded non null values of the current row group
+	// and defs the definition level of each row.
+	values bytes.Buffer
+	defs   []bool
+}
+
+type keyValue struct {
+	key, value string
+}
+
+type rowGroup struct {
+	numRows   int64
+	totalSize int64
+	chunks    []*columnChunk
+}
+
+type columnChunk struct {
+	offset           int64
+	numValues        int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+// Write writes the given browser.TimeSeries as Parquet file. The given
+// browser.TimeSeries will not be modified.
+func (w *Writer) Write(ts browser.TimeSeries) error {
+	if len(ts) == 0 {
+		return browser.ErrDataNotFound
+	}
+	if w.RowGroupSize <= 0 {
+		w.RowGroupSize = DefaultRowGroupSize
+	}
+
+	// Sort a copy of the time series by station.
+	ts = ts.SortedByStation()
+
+	pos := w.createSchema(ts)
+
+	if err := w.write([]byte(magic)); err != nil {
+		return err
+	}
+
+	// Process the time series station by station. Thanks to the sorting all
+	// measurements of a station are consecutive.
+	for start := 0; start < len(ts); {
+		end := start + 1
+		for end < len(ts) && ts[end].Station == ts[start].Station {
+			end++
+		}
+
+		if err := w.writeStation(ts[start:end], pos); err != nil {
+			return err
+		}
+
+		start = end
+	}
+
+	if err := w.flushRowGroup(); err != nil {
+		return err
+	}
+
+	return w.writeFooter()
+}
+
+// createSchema creates the columns for the given browser.TimeSeries and
+// returns the column position of each measurement label.
+func (w *Writer) createSchema(ts browser.TimeSeries) map[string]int {
+	w.columns = []*column{
+		{name: "time", typ: typeInt64, converted: convertedTimestampMillis},
+		{name: "station", typ: typeByteArray, converted: convertedUTF8},
+		{name: "landuse", typ: typeByteArray, converted: convertedUTF8},
+		{name: "elevation", typ: typeInt64, converted: convertedNone},
+		{name: "latitude", typ: typeDouble, converted: convertedNone},
+		{name: "longitude", typ: typeDouble, converted: convertedNone},
+		{name: "depth", typ: typeInt64, converted: convertedNone, optional: true},
+	}
+
+	pos := make(map[string]int)
+	for _, m := range ts {
+		if _, ok := pos[m.Label]; ok {
+			continue
+		}
+
+		pos[m.Label] = len(w.columns)
+		w.columns = append(w.columns, &column{
+			name:      m.Label,
+			typ:       typeDouble,
+			converted: convertedNone,
+			optional:  true,
+			metadata: []keyValue{
+				{"unit", m.Unit},
+				{"aggregation", m.Aggregation},
+			},
+		})
+	}
+
+	return pos
+}
+
+// writeStation appends the rows of the given measurements, which must all
+// belong to the same station, depth by depth.
+func (w *Writer) writeStation(ts browser.TimeSeries, pos map[string]int) error {
+	var depths []int64
+	seen := make(map[int64]bool)
+	for _, m := range ts {
+		if !seen[m.Depth] {
+			seen[m.Depth] = true
+			depths = append(depths, m.Depth)
+		}
+	}
+	sort.Slice(depths, func(i, j int) bool { return depths[i] < depths[j] })
+
+	for _, d := range depths {
+		var group browser.TimeSeries
+		for _, m := range ts {
+			if m.Depth == d {
+				group = append(group, m)
+			}
+		}
+
+		if err := w.writeRows(group, pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRows merges the points of the given measurements, which must all
+// belong to the same station and depth, by timestamp and appends a row for
+// each distinct timestamp.
+func (w *Writer) writeRows(ts browser.TimeSeries, pos map[string]int) error {
+	points := make([][]*browser.Point, len(ts))
+	for i, m := range ts {
+		points[i] = browser.SortedPoints(m.Points)
+	}
+
+	// next holds the index of the next point to write for each measurement.
+	next := make([]int, len(ts))
+	values := make([]float64, len(w.columns))
+
+	for {
+		// Find the earliest timestamp of all pending points. The first
+		// measurement having it provides the metadata of the row.
+		first := -1
+		for i := range ts {
+			if next[i] >= len(points[i]) {
+				continue
+			}
+			if first < 0 || points[i][next[i]].Timestamp.Before(points[first][next[first]].Timestamp) {
+				first = i
+			}
+		}
+		if first < 0 {
+			return nil
+		}
+
+		t := points[first][next[first]].Timestamp
+		for i := range values {
+			values[i] = math.NaN()
+		}
+		for i, m := range ts {
+			if next[i] >= len(points[i]) || !points[i][next[i]].Timestamp.Equal(t) {
+				continue
+			}
+
+			values[pos[m.Label]] = points[i][next[i]].Value
+			next[i]++
+		}
+
+		m := ts[first]
+		w.columns[0].appendInt64(t.UnixNano() / int64(1e6))
+		w.columns[1].appendString(m.Station)
+		w.columns[2].appendString(m.Landuse)
+		w.columns[3].appendInt64(m.Elevation)
+		w.columns[4].appendDouble(m.Latitude)
+		w.columns[5].appendDouble(m.Longitude)
+		if m.Depth > 0 {
+			w.columns[6].appendInt64(m.Depth)
+		} else {
+			w.columns[6].appendNull()
+		}
+		for i := 7; i < len(w.columns); i++ {
+			w.columns[i].appendDouble(values[i])
+		}
+
+		w.numRows++
+		if len(w.columns[0].defs) >= w.RowGroupSize {
+			if err := w.flushRowGroup(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *column) appendInt64(v int64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(v))
+	c.values.Write(b[:])
+	c.defs = append(c.defs, true)
+}
+
+func (c *column) appendString(s string) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(len(s)))
+	c.values.Write(b[:])
+	c.values.WriteString(s)
+	c.defs = append(c.defs, true)
+}
+
+// appendNull appends a null value to an optional column.
+func (c *column) appendNull() {
+	c.defs = append(c.defs, false)
+}
+
+// appendDouble appends the given value. NaN values are appended as null if
+// the column is optional.
+func (c *column) appendDouble(v float64) {
+	if c.optional && math.IsNaN(v) {
+		c.appendNull()
+		return
+	}
+
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+	c.values.Write(b[:])
+	c.defs = append(c.defs, true)
+}
+
+// flushRowGroup writes all buffered rows as a single row group.
+func (w *Writer) flushRowGroup() error {
+	n := len(w.columns[0].defs)
+	if n == 0 {
+		return nil
+	}
+
+	rg := &rowGroup{numRows: int64(n)}
+	for _, c := range w.columns {
+		chunk, err := w.writeColumnChunk(c)
+		if err != nil {
+			return err
+		}
+
+		rg.chunks = append(rg.chunks, chunk)
+		rg.totalSize += chunk.uncompressedSize
+
+		c.values.Reset()
+		c.defs = c.defs[:0]
+	}
+	w.rowGroups = append(w.rowGroups, rg)
+
+	return nil
+}
+
+// writeColumnChunk writes the buffered values of the given column as a single
+// data page.
+func (w *Writer) writeColumnChunk(c *column) (*columnChunk, error) {
+	var page bytes.Buffer
+	if c.optional {
+		levels := encodeLevels(c.defs)
+
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(len(levels)))
+		page.Write(b[:])
+		page.Write(levels)
+	}
+	page.Write(c.values.Bytes())
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(page.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	t := new(thrift)
+	t.structBegin(0)
+	t.i32(1, pageData)
+	t.i32(2, int32(page.Len()))
+	t.i32(3, int32(compressed.Len()))
+	t.structBegin(5)
+	t.i32(1, int32(len(c.defs)))
+	t.i32(2, encodingPlain)
+	t.i32(3, encodingRLE)
+	t.i32(4, encodingRLE)
+	t.structEnd()
+	t.structEnd()
+	header := t.Bytes()
+
+	chunk := &columnChunk{
+		offset:           w.offset,
+		numValues:        int64(len(c.defs)),
+		uncompressedSize: int64(len(header) + page.Len()),
+		compressedSize:   int64(len(header) + compressed.Len()),
+	}
+
+	if err := w.write(header); err != nil {
+		return nil, err
+	}
+	if err := w.write(compressed.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return chunk, nil
+}
+
+// encodeLevels encodes the given definition levels, with a maximum level of
+// one, using the run length encoding of the RLE/bit-packing hybrid.
+func encodeLevels(defs []bool) []byte {
+	var (
+		buf bytes.Buffer
+		b   [binary.MaxVarintLen64]byte
+	)
+
+	for i := 0; i < len(defs); {
+		j := i + 1
+		for j < len(defs) && defs[j] == defs[i] {
+			j++
+		}
+
+		n := binary.PutUvarint(b[:], uint64(j-i)<<1)
+		buf.Write(b[:n])
+		if defs[i] {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+
+		i = j
+	}
+
+	return buf.Bytes()
+}
+
+// writeFooter writes the file metadata and the closing magic bytes.
+func (w *Writer) writeFooter() error {
+	t := new(thrift)
+	t.structBegin(0)
+	t.i32(1, 1)
+
+	t.list(2, compactStruct, len(w.columns)+1)
+	t.structBegin(0)
+	t.binary(4, "schema")
+	t.i32(5, int32(len(w.columns)))
+	t.structEnd()
+	for _, c := range w.columns {
+		repetition := int32(repetitionRequired)
+		if c.optional {
+			repetition = repetitionOptional
+		}
+
+		t.structBegin(0)
+		t.i32(1, c.typ)
+		t.i32(3, repetition)
+		t.binary(4, c.name)
+		if c.converted != convertedNone {
+			t.i32(6, c.converted)
+		}
+		t.structEnd()
+	}
+
+	t.i64(3, w.numRows)
+
+	t.list(4, compactStruct, len(w.rowGroups))
+	for _, rg := range w.rowGroups {
+		t.structBegin(0)
+		t.list(1, compactStruct, len(rg.chunks))
+		for i, chunk := range rg.chunks {
+			c := w.columns[i]
+
+			t.structBegin(0)
+			t.i64(2, chunk.offset)
+			t.structBegin(3)
+			t.i32(1, c.typ)
+			t.listI32(2, encodingPlain, encodingRLE)
+			t.listBinary(3, c.name)
+			t.i32(4, codecGzip)
+			t.i64(5, chunk.numValues)
+			t.i64(6, chunk.uncompressedSize)
+			t.i64(7, chunk.compressedSize)
+			if len(c.metadata) > 0 {
+				t.list(8, compactStruct, len(c.metadata))
+				for _, kv := range c.metadata {
+					t.structBegin(0)
+					t.binary(1, kv.key)
+					t.binary(2, kv.value)
+					t.structEnd()
+				}
+			}
+			t.i64(9, chunk.offset)
+			t.structEnd()
+			t.structEnd()
+		}
+		t.i64(2, rg.totalSize)
+		t.i64(3, rg.numRows)
+		t.structEnd()
+	}
+
+	t.binary(6, "github.com/euracresearch/browser")
+	t.structEnd()
+
+	footer := t.Bytes()
+	if err := w.write(footer); err != nil {
+		return err
+	}
+
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(len(footer)))
+	if err := w.write(b[:]); err != nil {
+		return err
+	}
+
+	return w.write([]byte(magic))
+}
+
+// write writes b to the underlying writer and keeps track of the offset.
+func (w *Writer) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.offset += int64(n)
+	return err
+}
@@ -0,0 +1,314 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/euracresearch/browser"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.Write(browser.TimeSeries{}); !errors.Is(err, browser.ErrDataNotFound) {
+		t.Fatalf("empty: got error %v, want %v", err, browser.ErrDataNotFound)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("empty: got %d bytes written, want 0", buf.Len())
+	}
+
+	ts := browser.TimeSeries{
+		testMeasurement("a_avg", "s2", "c", 3),
+		testMeasurement("b_avg", "s1", "mm", 5),
+		testMeasurement("a_avg", "s1", "c", 4),
+		testMeasurement("c_05_avg", "s1", "%", 2),
+	}
+	ts[1].Points[2].Value = math.NaN()
+	ts[3].Depth = 5
+
+	w = NewWriter(&buf)
+	w.RowGroupSize = 2
+	if err := w.Write(ts); err != nil {
+		t.Fatal(err)
+	}
+
+	b := buf.Bytes()
+	if got := string(b[:4]); got != magic {
+		t.Fatalf("got leading magic %q, want %q", got, magic)
+	}
+	if got := string(b[len(b)-4:]); got != magic {
+		t.Fatalf("got trailing magic %q, want %q", got, magic)
+	}
+
+	footer := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	if footer <= 0 || footer > len(b)-12 {
+		t.Fatalf("invalid footer length %d", footer)
+	}
+
+	// s1 has 5 rows without depth and 2 rows at depth 5, s2 has 3 rows.
+	if got, want := w.numRows, int64(10); got != want {
+		t.Fatalf("got %d rows, want %d", got, want)
+	}
+	if got, want := len(w.rowGroups), 5; got != want {
+		t.Fatalf("got %d row groups, want %d", got, want)
+	}
+
+	var names []string
+	for _, c := range w.columns {
+		names = append(names, c.name)
+	}
+	want := []string{"time", "station", "landuse", "elevation", "latitude", "longitude", "depth", "b_avg", "a_avg", "c_05_avg"}
+	if diff := cmp.Diff(want, names); diff != "" {
+		t.Fatalf("columns mismatch (-want +got):\n%s", diff)
+	}
+
+	// Read the file back using its metadata.
+	meta := newThriftReader(b[len(b)-8-footer : len(b)-8]).readStruct()
+	if got, want := meta[1], int64(1); got != want {
+		t.Fatalf("got version %v, want %v", got, want)
+	}
+	if got, want := meta[3], int64(10); got != want {
+		t.Fatalf("got %v rows in the file metadata, want %v", got, want)
+	}
+
+	schema := meta[2].([]interface{})
+	names = nil
+	for _, e := range schema[1:] {
+		names = append(names, e.(map[int16]interface{})[4].(string))
+	}
+	if diff := cmp.Diff(want, names); diff != "" {
+		t.Fatalf("schema mismatch (-want +got):\n%s", diff)
+	}
+
+	wantMetadata := map[string][]interface{}{
+		"b_avg":    {map[int16]interface{}{1: "unit", 2: "mm"}, map[int16]interface{}{1: "aggregation", 2: "avg"}},
+		"a_avg":    {map[int16]interface{}{1: "unit", 2: "c"}, map[int16]interface{}{1: "aggregation", 2: "avg"}},
+		"c_05_avg": {map[int16]interface{}{1: "unit", 2: "%"}, map[int16]interface{}{1: "aggregation", 2: "avg"}},
+	}
+	rowGroups := meta[4].([]interface{})
+	if got, want := len(rowGroups), 5; got != want {
+		t.Fatalf("got %d row groups in the file metadata, want %d", got, want)
+	}
+	for i, rg := range rowGroups {
+		for j, c := range rg.(map[int16]interface{})[1].([]interface{}) {
+			cm := c.(map[int16]interface{})[3].(map[int16]interface{})
+			name := cm[3].([]interface{})[0].(string)
+			if name != want[j] {
+				t.Fatalf("row group %d: got column %q, want %q", i, name, want[j])
+			}
+
+			got, _ := cm[8].([]interface{})
+			if diff := cmp.Diff(wantMetadata[name], got); diff != "" {
+				t.Fatalf("row group %d: column %s metadata mismatch (-want +got):\n%s", i, name, diff)
+			}
+
+			// Each chunk holds a single GZIP compressed data page.
+			r := newThriftReader(b[cm[9].(int64):])
+			header := r.readStruct()
+			if got, want := header[5].(map[int16]interface{})[1], cm[5]; got != want {
+				t.Fatalf("row group %d: column %s: got %v values in the page, want %v", i, name, got, want)
+			}
+			page := gunzip(t, r.b[r.pos:r.pos+int(header[3].(int64))])
+			if got, want := int64(len(page)), header[2]; got != want {
+				t.Fatalf("row group %d: column %s: got page of %d bytes, want %v", i, name, got, want)
+			}
+
+			// The second row group of b_avg holds the NaN value as null.
+			if i == 1 && name == "b_avg" {
+				levels := int(binary.LittleEndian.Uint32(page))
+				if diff := cmp.Diff([]byte{2, 0, 2, 1}, page[4:4+levels]); diff != "" {
+					t.Fatalf("b_avg definition levels mismatch (-want +got):\n%s", diff)
+				}
+				if got := math.Float64frombits(binary.LittleEndian.Uint64(page[4+levels:])); got != 3 {
+					t.Fatalf("got b_avg value %v, want 3", got)
+				}
+			}
+		}
+	}
+
+	// The first row group of each column must start right after the leading
+	// magic bytes and the chunks must follow each other.
+	offset := int64(len(magic))
+	for _, rg := range w.rowGroups {
+		for _, c := range rg.chunks {
+			if c.offset != offset {
+				t.Fatalf("got chunk offset %d, want %d", c.offset, offset)
+			}
+			offset += c.compressedSize
+		}
+	}
+	if got, want := offset, int64(len(b)-footer-8); got != want {
+		t.Fatalf("got footer offset %d, want %d", got, want)
+	}
+}
+
+func TestEncodeLevels(t *testing.T) {
+	testCases := map[string]struct {
+		in   []bool
+		want []byte
+	}{
+		"empty":   {nil, nil},
+		"defined": {[]bool{true, true, true}, []byte{6, 1}},
+		"mixed":   {[]bool{true, false, false, true}, []byte{2, 1, 4, 0, 2, 1}},
+		"long":    {make([]bool, 100), []byte{200, 1, 0}},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got := encodeLevels(tc.in)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestThrift(t *testing.T) {
+	tr := new(thrift)
+	tr.structBegin(0)
+	tr.i32(1, 1)
+	tr.binary(4, "ab")
+	tr.i64(20, -2)
+	tr.listI32(21, 0, 3)
+	tr.structBegin(22)
+	tr.i32(1, 5)
+	tr.structEnd()
+	tr.structEnd()
+
+	want := []byte{
+		0x15, 0x02, // field 1, i32 1
+		0x38, 0x02, 'a', 'b', // field 4, binary "ab"
+		0x06, 0x28, 0x03, // field 20, i64 -2
+		0x19, 0x25, 0x00, 0x06, // field 21, list of two i32
+		0x1c, 0x15, 0x0a, 0x00, // field 22, struct with field 1, i32 5
+		0x00,
+	}
+	if diff := cmp.Diff(want, tr.Bytes()); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// thriftReader decodes the Thrift compact protocol. Structs are decoded as
+// map of field ids to values, lists as slices, integers as int64 and binary as
+// string.
+type thriftReader struct {
+	b   []byte
+	pos int
+}
+
+func newThriftReader(b []byte) *thriftReader {
+	return &thriftReader{b: b}
+}
+
+func (r *thriftReader) byte() byte {
+	c := r.b[r.pos]
+	r.pos++
+	return c
+}
+
+func (r *thriftReader) varint() int64 {
+	v, n := binary.Varint(r.b[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) readStruct() map[int16]interface{} {
+	fields := make(map[int16]interface{})
+	var id int16
+	for {
+		h := r.byte()
+		if h == 0 {
+			return fields
+		}
+		if delta := int16(h >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(r.varint())
+		}
+		fields[id] = r.value(h & 0x0f)
+	}
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case compactI32, compactI64:
+		return r.varint()
+	case compactBinary:
+		n := int(r.uvarint())
+		s := string(r.b[r.pos : r.pos+n])
+		r.pos += n
+		return s
+	case compactList:
+		h := r.byte()
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		l := make([]interface{}, n)
+		for i := range l {
+			l[i] = r.value(h & 0x0f)
+		}
+		return l
+	case compactStruct:
+		return r.readStruct()
+	}
+	panic(fmt.Sprintf("unsupported compact type %d", typ))
+}
+
+func gunzip(t *testing.T, b []byte) []byte {
+	t.Helper()
+
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func testMeasurement(label, station, unit string, n int) *browser.Measurement {
+	m := &browser.Measurement{
+		Label:       label,
+		Station:     station,
+		Aggregation: "avg",
+		Landuse:     "me_" + station,
+		Unit:        unit,
+		Elevation:   1000,
+		Latitude:    3.14159,
+		Longitude:   2.71828,
+	}
+
+	ts := time.Date(2020, time.January, 1, 0, 0, 0, 0, browser.Location)
+
+	for i := 0; i < n; i++ {
+		ts = ts.Add(15 * time.Minute)
+		m.Points = append(m.Points, &browser.Point{
+			Timestamp: ts,
+			Value:     float64(i),
+		})
+	}
+
+	return m
+}
@@ -0,0 +1,548 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package export implements browser.ExportService. Exports are queued in
+// memory and run by a pool of workers, which write the encoded time series
+// into files inside a local directory. Done exports and their files are
+// removed once they expire.
+//
+// The access rules of a database implementing browser.Redactor, like
+// access.Access, are applied when an export is created. Queued exports read
+// the time series granted at that time, even if the rules change before they
+// run. Exports exceeding the limit of the user are refused when created. Parts
+// of the request denied by the rules are reported as warnings of the export
+// and as comment lines in CSV files.
+//
+// Files in the directory left over by a previous run of the service are
+// removed, since the exports they belong to are gone.
+package export
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/euracresearch/browser"
+	"github.com/euracresearch/browser/internal/encoding/csv"
+	"github.com/euracresearch/browser/internal/encoding/csvf"
+	"github.com/euracresearch/browser/internal/encoding/json"
+	"github.com/euracresearch/browser/internal/encoding/netcdf"
+	"github.com/euracresearch/browser/internal/encoding/parquet"
+)
+
+const (
+	// DefaultWorkers is the default number of exports running concurrently.
+	DefaultWorkers = 2
+
+	// DefaultTTL is the default duration a done export is kept.
+	DefaultTTL = 24 * time.Hour
+
+	// DefaultQueueSize is the maximum number of queued exports.
+	DefaultQueueSize = 100
+)
+
+var (
+	// Guarantee we implement browser.ExportService.
+	_ browser.ExportService = &Service{}
+
+	// CleanupInterval is the interval in which expired exports are removed.
+	CleanupInterval = time.Minute
+
+	// fileRE matches the names of export files and their temporary files.
+	fileRE = regexp.MustCompile(`^([0-9a-f]{32})(-[0-9]+\.tmp)?$`)
+)
+
+// Service represents a service for running exports in the background.
+type Service struct {
+	db  browser.Database
+	dir string
+	ttl time.Duration
+
+	queue  chan *job
+	ctx    context.Context // canceled on Close
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex // guards jobs and the exports of all jobs
+	jobs map[string]*job
+}
+
+// job represents a single export.
+type job struct {
+	// The 64-bit fields come first for being aligned on 32-bit platforms.
+	total   int64 // estimated number of points
+	written int64 // number of points written, accessed atomically
+
+	export  browser.Export
+	user    *browser.User
+	message *browser.Message
+	file    string
+
+	// redacted is the request redacted by the access rules when the export
+	// was created. If nil, the message is requested.
+	redacted browser.Redacted
+}
+
+// NewService returns a new Service reading time series from db and storing the
+// files in dir, which is created if it does not exist. The given number of
+// workers run exports concurrently and done exports are kept for ttl. If
+// workers or ttl is zero DefaultWorkers and DefaultTTL are used.
+func NewService(db browser.Database, dir string, workers int, ttl time.Duration) (*Service, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("export: %v", err)
+	}
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Service{
+		db:     db,
+		dir:    dir,
+		ttl:    ttl,
+		queue:  make(chan *job, DefaultQueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+		jobs:   make(map[string]*job),
+	}
+
+	s.removeOrphans()
+
+	s.wg.Add(workers + 1)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	go s.cleanup()
+
+	return s, nil
+}
+
+// Close stops all workers and waits for running exports to be canceled.
+// Queued exports fail.
+func (s *Service) Close() error {
+	s.cancel()
+	s.wg.Wait()
+
+	for {
+		select {
+		case j := <-s.queue:
+			s.setStatus(j, browser.ExportFailed, browser.ErrExportCanceled.Error())
+		default:
+			return nil
+		}
+	}
+}
+
+// Create enqueues a new export. It returns an error wrapping
+// browser.ErrLimitExceeded if the export exceeds the limit of the user.
+func (s *Service) Create(ctx context.Context, u *browser.User, m *browser.Message, format string) (*browser.Export, error) {
+	if u == nil || !u.Valid() {
+		return nil, browser.ErrUserNotValid
+	}
+	if m == nil {
+		return nil, browser.ErrDataNotFound
+	}
+	if s.ctx.Err() != nil {
+		return nil, browser.ErrExportCanceled
+	}
+
+	// The message is copied, since a decorating database may modify it.
+	c := *m
+	report := &browser.Report{}
+	ctx = browser.NewReportContext(context.WithValue(ctx, browser.UserContextKey, u), report)
+
+	var (
+		e        = &browser.Estimate{Points: c.Estimate()}
+		redacted browser.Redacted
+		err      error
+	)
+	switch db := s.db.(type) {
+	case browser.Redactor:
+		redacted, err = db.Redact(ctx, &c)
+		if err != nil {
+			return nil, err
+		}
+		e = redacted.Estimate()
+	case browser.Estimator:
+		e, err = db.Estimate(ctx, &c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := e.Err(); err != nil {
+		return nil, err
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	c = *m
+	j := &job{
+		export: browser.Export{
+			ID:       id,
+			Format:   format,
+			Status:   browser.ExportQueued,
+			Created:  now,
+			Expires:  now.Add(s.ttl),
+			Warnings: report.Denials().Strings(),
+		},
+		user:     u,
+		message:  &c,
+		file:     filepath.Join(s.dir, id),
+		total:    e.Points,
+		redacted: redacted,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case s.queue <- j:
+	default:
+		return nil, browser.ErrExportQueueFull
+	}
+	s.jobs[id] = j
+
+	return s.exportOf(j), nil
+}
+
+// List returns all exports of the given user, newest first.
+func (s *Service) List(ctx context.Context, u *browser.User) ([]*browser.Export, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var exports []*browser.Export
+	for _, j := range s.jobs {
+		if owns(u, j) {
+			exports = append(exports, s.exportOf(j))
+		}
+	}
+
+	sort.Slice(exports, func(i, j int) bool {
+		return exports[i].Created.After(exports[j].Created)
+	})
+
+	return exports, nil
+}
+
+// Get returns the export with the given id of the given user.
+func (s *Service) Get(ctx context.Context, u *browser.User, id string) (*browser.Export, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok || !owns(u, j) {
+		return nil, browser.ErrExportNotFound
+	}
+	return s.exportOf(j), nil
+}
+
+// Open returns the file of the done export with the given id of the given
+// user. It returns browser.ErrExportNotReady if the export is not done.
+func (s *Service) Open(ctx context.Context, u *browser.User, id string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	if !ok || !owns(u, j) {
+		s.mu.Unlock()
+		return nil, browser.ErrExportNotFound
+	}
+	status := j.export.Status
+	s.mu.Unlock()
+
+	if status != browser.ExportDone {
+		return nil, browser.ErrExportNotReady
+	}
+
+	return os.Open(j.file)
+}
+
+// exportOf returns a copy of the export of the given job with its current
+// progress. s.mu must be held.
+func (s *Service) exportOf(j *job) *browser.Export {
+	e := j.export
+
+	switch {
+	case e.Status == browser.ExportDone:
+		e.Progress = 1
+	case e.Status == browser.ExportRunning && j.total > 0:
+		e.Progress = float64(atomic.LoadInt64(&j.written)) / float64(j.total)
+		if e.Progress > 1 {
+			e.Progress = 1
+		}
+	}
+
+	return &e
+}
+
+// owns reports whether the given user created the given job.
+func owns(u *browser.User, j *job) bool {
+	return u != nil && u.Valid() && u.Email == j.user.Email && u.Provider == j.user.Provider
+}
+
+// work runs queued exports until the service is closed.
+func (s *Service) work() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case j := <-s.queue:
+			s.run(j)
+		}
+	}
+}
+
+// run runs the given export and updates its status.
+func (s *Service) run(j *job) {
+	s.setStatus(j, browser.ExportRunning, "")
+
+	err := s.write(j)
+	if err == nil {
+		s.setStatus(j, browser.ExportDone, "")
+		return
+	}
+
+	log.Printf("export: export %s failed: %v", j.export.ID, err)
+
+	// Hide internal errors from the user.
+	msg := browser.ErrInternal.Error()
+	switch {
+	case errors.Is(err, browser.ErrDataNotFound) || errors.Is(err, browser.ErrLimitExceeded) || errors.Is(err, browser.ErrAccessDenied):
+		msg = err.Error()
+	case s.ctx.Err() != nil:
+		msg = browser.ErrExportCanceled.Error()
+	}
+	s.setStatus(j, browser.ExportFailed, msg)
+}
+
+// setStatus sets the status of the given job. The export expires ttl after it
+// is done or has failed.
+func (s *Service) setStatus(j *job, status browser.ExportStatus, msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j.export.Status = status
+	j.export.Error = msg
+	if status == browser.ExportDone || status == browser.ExportFailed {
+		j.export.Expires = time.Now().Add(s.ttl)
+	}
+}
+
+// write writes the time series of the given job into its file. The file is
+// written under a temporary name and renamed once complete.
+func (s *Service) write(j *job) error {
+	f, err := ioutil.TempFile(s.dir, j.export.ID+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	// The denials of a redacted request were reported when it was created.
+	report := &browser.Report{}
+	ctx := browser.NewReportContext(context.WithValue(s.ctx, browser.UserContextKey, j.user), report)
+	err = s.encode(ctx, f, j, report)
+	if j.redacted == nil {
+		s.setWarnings(j, report.Denials())
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), j.file)
+}
+
+// setWarnings sets the warnings of the given job to the given denials.
+func (s *Service) setWarnings(j *job, denials browser.Denials) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.export.Warnings = denials.Strings()
+}
+
+// warnings returns the warnings of the given job.
+func (s *Service) warnings(j *job) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return j.export.Warnings
+}
+
+// encode writes the time series of the given job in its format to w. The
+// denials collected by the given report are written as comments in the CSV
+// formats.
+func (s *Service) encode(ctx context.Context, w io.Writer, j *job, report *browser.Report) error {
+	switch j.export.Format {
+	case "json", "parquet", "netcdf":
+		ts, err := s.series(ctx, j)
+		if err != nil {
+			return err
+		}
+
+		switch j.export.Format {
+		case "parquet":
+			return parquet.NewWriter(w).Write(ts)
+		case "netcdf":
+			return netcdf.NewWriter(w).Write(ts)
+		default:
+			return json.NewWriter(w).Write(ts)
+		}
+	}
+
+	// The CSV formats are written while reading the points from the database,
+	// which allows to report the progress.
+	stream, err := s.stream(ctx, j)
+	if err != nil {
+		return err
+	}
+	comments := report.Denials().Strings()
+	if j.redacted != nil {
+		comments = s.warnings(j)
+	}
+
+	points := stream.Points
+	stream.Points = func(m *browser.Measurement) browser.PointIterator {
+		return &countingIterator{PointIterator: points(m), n: &j.written}
+	}
+
+	if j.export.Format == "wide" {
+		writer := csvf.NewWriter(w)
+		writer.Comments = comments
+		return writer.WriteStream(stream)
+	}
+	writer := csv.NewWriter(w)
+	writer.Comments = comments
+	return writer.WriteStream(stream)
+}
+
+// series returns the time series of the given job.
+func (s *Service) series(ctx context.Context, j *job) (browser.TimeSeries, error) {
+	if j.redacted != nil {
+		return j.redacted.Series(ctx)
+	}
+
+	// The message is copied, since a decorating database may modify it.
+	m := *j.message
+	return s.db.Series(ctx, &m)
+}
+
+// stream returns the time series of the given job as stream.
+func (s *Service) stream(ctx context.Context, j *job) (*browser.Stream, error) {
+	if j.redacted != nil {
+		return j.redacted.Stream(ctx)
+	}
+
+	m := *j.message
+	return browser.StreamSeries(ctx, s.db, &m)
+}
+
+// cleanup removes expired exports and their files until the service is
+// closed.
+func (s *Service) cleanup() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.removeExpired(now)
+			s.removeOrphans()
+		}
+	}
+}
+
+// removeExpired removes all done or failed exports expired at the given time.
+func (s *Service) removeExpired(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, j := range s.jobs {
+		if j.export.Status != browser.ExportDone && j.export.Status != browser.ExportFailed {
+			continue
+		}
+		if now.Before(j.export.Expires) {
+			continue
+		}
+
+		if err := os.Remove(j.file); err != nil && !os.IsNotExist(err) {
+			log.Printf("export: could not remove export %s: %v", id, err)
+			continue
+		}
+		delete(s.jobs, id)
+	}
+}
+
+// removeOrphans removes all export files in the directory not belonging to a
+// known export, e.g. files of a previous run of the service.
+func (s *Service) removeOrphans() {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("export: could not read %s: %v", s.dir, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range files {
+		match := fileRE.FindStringSubmatch(f.Name())
+		if match == nil || f.IsDir() {
+			continue
+		}
+		if _, ok := s.jobs[match[1]]; ok {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(s.dir, f.Name())); err != nil && !os.IsNotExist(err) {
+			log.Printf("export: could not remove orphaned file %s: %v", f.Name(), err)
+		}
+	}
+}
+
+// countingIterator is a browser.PointIterator counting the returned points.
+type countingIterator struct {
+	browser.PointIterator
+	n *int64
+}
+
+func (it *countingIterator) Next() bool {
+	if !it.PointIterator.Next() {
+		return false
+	}
+	atomic.AddInt64(it.n, 1)
+	return true
+}
+
+// randomHex returns n random bytes hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,441 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package export
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/euracresearch/browser"
+	"github.com/euracresearch/browser/internal/mock"
+)
+
+var (
+	alice = &browser.User{Name: "Alice", Email: "alice@example.com", Provider: "github", Role: browser.FullAccess, License: true}
+	bob   = &browser.User{Name: "Bob", Email: "bob@example.com", Provider: "github", Role: browser.FullAccess, License: true}
+
+	start = time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location)
+)
+
+// testDatabase is a browser.Database recording the user of the last series
+// request and limiting requests to the given number of points.
+type testDatabase struct {
+	mock.Database
+	limit int64
+	user  chan *browser.User
+}
+
+func (db *testDatabase) Series(ctx context.Context, m *browser.Message) (browser.TimeSeries, error) {
+	db.user <- browser.UserFromContext(ctx)
+	return db.Database.Series(ctx, m)
+}
+
+func (db *testDatabase) Estimate(ctx context.Context, m *browser.Message) (*browser.Estimate, error) {
+	return &browser.Estimate{Points: m.Estimate(), Limit: db.limit}, nil
+}
+
+func newTestService(t *testing.T, db browser.Database) *Service {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s, err := NewService(db, dir, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+// wait waits until the export with the given id is done or has failed.
+func wait(t *testing.T, s *Service, u *browser.User, id string) *browser.Export {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		e, err := s.Get(context.Background(), u, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Status == browser.ExportDone || e.Status == browser.ExportFailed {
+			return e
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("export %s not finished in time", id)
+	return nil
+}
+
+func TestService(t *testing.T) {
+	db := &testDatabase{
+		Database: mock.Database{
+			SeriesFn: func() (browser.TimeSeries, error) {
+				return browser.TimeSeries{
+					{
+						Label:   "a_avg",
+						Station: "s1",
+						Points: []*browser.Point{
+							{Timestamp: start, Value: 1},
+							{Timestamp: start.Add(15 * time.Minute), Value: 2},
+						},
+					},
+				}, nil
+			},
+		},
+		user: make(chan *browser.User, 1),
+	}
+	s := newTestService(t, db)
+	ctx := context.Background()
+
+	m := &browser.Message{Measurements: []string{"a_avg"}, Stations: []string{"1"}, Start: start, End: start}
+	e, err := s.Create(ctx, alice, m, "long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Status != browser.ExportQueued {
+		t.Fatalf("got status %q, want %q", e.Status, browser.ExportQueued)
+	}
+
+	e = wait(t, s, alice, e.ID)
+	if e.Status != browser.ExportDone || e.Progress != 1 {
+		t.Fatalf("got export %+v, want done", e)
+	}
+	if u := <-db.user; u != alice {
+		t.Fatalf("export run with user %v, want %v", u, alice)
+	}
+
+	f, err := s.Open(ctx, alice, e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "s1") {
+		t.Fatalf("export file does not contain the time series:\n%s", b)
+	}
+
+	// Exports are only visible to their owner.
+	if _, err := s.Get(ctx, bob, e.ID); !errors.Is(err, browser.ErrExportNotFound) {
+		t.Fatalf("got error %v, want %v", err, browser.ErrExportNotFound)
+	}
+	if _, err := s.Open(ctx, bob, e.ID); !errors.Is(err, browser.ErrExportNotFound) {
+		t.Fatalf("got error %v, want %v", err, browser.ErrExportNotFound)
+	}
+	if exports, _ := s.List(ctx, bob); len(exports) != 0 {
+		t.Fatalf("got %d exports of another user, want 0", len(exports))
+	}
+	if exports, _ := s.List(ctx, alice); len(exports) != 1 || exports[0].ID != e.ID {
+		t.Fatalf("got exports %v, want %s", exports, e.ID)
+	}
+
+	// Expired exports are removed together with their file.
+	s.removeExpired(e.Expires.Add(-time.Second))
+	if _, err := s.Get(ctx, alice, e.ID); err != nil {
+		t.Fatalf("export removed before expiry: %v", err)
+	}
+	s.removeExpired(e.Expires)
+	if _, err := s.Get(ctx, alice, e.ID); !errors.Is(err, browser.ErrExportNotFound) {
+		t.Fatalf("got error %v, want %v", err, browser.ErrExportNotFound)
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, e.ID)); !os.IsNotExist(err) {
+		t.Fatalf("export file not removed: %v", err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	db := &testDatabase{limit: 96}
+	s := newTestService(t, db)
+
+	day := &browser.Message{Measurements: []string{"a"}, Stations: []string{"1"}, Start: start, End: start}
+
+	testCases := map[string]struct {
+		user *browser.User
+		in   *browser.Message
+		want error
+	}{
+		"NoUser":   {&browser.User{Role: browser.Public}, day, browser.ErrUserNotValid},
+		"Exceeded": {alice, &browser.Message{Measurements: []string{"a", "b"}, Stations: []string{"1"}, Start: start, End: start}, browser.ErrLimitExceeded},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			_, err := s.Create(context.Background(), tc.user, tc.in, "long")
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("got error %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+// deniedDatabase is a browser.Database reporting a denied measurement for each
+// request.
+type deniedDatabase struct {
+	mock.Database
+}
+
+func (db *deniedDatabase) deny(ctx context.Context) {
+	browser.ReportFromContext(ctx).Add(browser.Denial{Field: "measurements", Value: "b", Reason: "not allowed"})
+}
+
+func (db *deniedDatabase) Series(ctx context.Context, m *browser.Message) (browser.TimeSeries, error) {
+	db.deny(ctx)
+	return db.Database.Series(ctx, m)
+}
+
+func (db *deniedDatabase) Estimate(ctx context.Context, m *browser.Message) (*browser.Estimate, error) {
+	db.deny(ctx)
+	return &browser.Estimate{Points: m.Estimate()}, nil
+}
+
+func TestWarnings(t *testing.T) {
+	db := &deniedDatabase{
+		Database: mock.Database{
+			SeriesFn: func() (browser.TimeSeries, error) {
+				return browser.TimeSeries{
+					{Label: "a", Station: "s1", Points: []*browser.Point{{Timestamp: start, Value: 1}}},
+				}, nil
+			},
+		},
+	}
+	s := newTestService(t, db)
+	ctx := context.Background()
+
+	want := `measurements "b": not allowed`
+
+	m := &browser.Message{Measurements: []string{"a", "b"}, Stations: []string{"1"}, Start: start, End: start}
+	e, err := s.Create(ctx, alice, m, "long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Warnings) != 1 || e.Warnings[0] != want {
+		t.Fatalf("got warnings %q, want %q", e.Warnings, want)
+	}
+
+	e = wait(t, s, alice, e.ID)
+	if e.Status != browser.ExportDone || len(e.Warnings) != 1 {
+		t.Fatalf("got export %+v, want done with one warning", e)
+	}
+
+	f, err := s.Open(ctx, alice, e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "# "+want+"\n") {
+		t.Fatalf("export file does not start with the warning:\n%s", b)
+	}
+}
+
+func TestFailed(t *testing.T) {
+	testCases := map[string]struct {
+		err  error
+		want string
+	}{
+		"NotFound": {browser.ErrDataNotFound, browser.ErrDataNotFound.Error()},
+		"Internal": {errors.New("connection refused"), browser.ErrInternal.Error()},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			db := &mock.Database{
+				SeriesFn: func() (browser.TimeSeries, error) {
+					return nil, tc.err
+				},
+			}
+			s := newTestService(t, db)
+
+			m := &browser.Message{Measurements: []string{"a"}, Stations: []string{"1"}, Start: start, End: start}
+			e, err := s.Create(context.Background(), alice, m, "json")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			e = wait(t, s, alice, e.ID)
+			if e.Status != browser.ExportFailed || e.Error != tc.want {
+				t.Fatalf("got status %q with error %q, want %q with error %q", e.Status, e.Error, browser.ExportFailed, tc.want)
+			}
+			if _, err := s.Open(context.Background(), alice, e.ID); !errors.Is(err, browser.ErrExportNotReady) {
+				t.Fatalf("got error %v, want %v", err, browser.ErrExportNotReady)
+			}
+		})
+	}
+}
+
+// redactingDatabase is a browser.Redactor granting the measurement of its
+// current rule.
+type redactingDatabase struct {
+	mock.Database
+
+	mu    sync.Mutex
+	label string
+}
+
+func (db *redactingDatabase) setLabel(label string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.label = label
+}
+
+func (db *redactingDatabase) Series(ctx context.Context, m *browser.Message) (browser.TimeSeries, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return testSeries(db.label), nil
+}
+
+func (db *redactingDatabase) Redact(ctx context.Context, m *browser.Message) (browser.Redacted, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return &testRedacted{label: db.label}, nil
+}
+
+type testRedacted struct {
+	label string
+}
+
+func (r *testRedacted) Estimate() *browser.Estimate { return &browser.Estimate{Points: 1} }
+
+func (r *testRedacted) Series(ctx context.Context) (browser.TimeSeries, error) {
+	return testSeries(r.label), nil
+}
+
+func (r *testRedacted) Stream(ctx context.Context) (*browser.Stream, error) {
+	return browser.NewStream(testSeries(r.label)), nil
+}
+
+func testSeries(label string) browser.TimeSeries {
+	return browser.TimeSeries{
+		{Label: label, Station: "s1", Points: []*browser.Point{{Timestamp: start, Value: 1}}},
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	db := &redactingDatabase{label: "granted"}
+	s := newTestService(t, db)
+	ctx := context.Background()
+
+	m := &browser.Message{Measurements: []string{"granted"}, Stations: []string{"1"}, Start: start, End: start}
+	e, err := s.Create(ctx, alice, m, "long")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing the rules does not change the queued export.
+	db.setLabel("changed")
+
+	e = wait(t, s, alice, e.ID)
+	if e.Status != browser.ExportDone {
+		t.Fatalf("got export %+v, want done", e)
+	}
+
+	f, err := s.Open(ctx, alice, e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "granted") || strings.Contains(string(b), "changed") {
+		t.Fatalf("export file does not contain the redacted time series:\n%s", b)
+	}
+}
+
+func TestRemoveOrphans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]bool{
+		"0123456789abcdef0123456789abcdef":           false,
+		"0123456789abcdef0123456789abcdef-12345.tmp": false,
+		"README": true,
+	}
+	for name := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := NewService(&mock.Database{}, dir, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for name, keep := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if got := err == nil; got != keep {
+			t.Errorf("file %s: got kept %v, want %v", name, got, keep)
+		}
+	}
+}
+
+// blockingDatabase is a browser.Database whose requests block until canceled.
+type blockingDatabase struct {
+	mock.Database
+	started chan struct{}
+}
+
+func (db *blockingDatabase) Series(ctx context.Context, m *browser.Message) (browser.TimeSeries, error) {
+	db.started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestClose(t *testing.T) {
+	db := &blockingDatabase{started: make(chan struct{}, 1)}
+	s := newTestService(t, db)
+	ctx := context.Background()
+
+	m := &browser.Message{Measurements: []string{"a"}, Stations: []string{"1"}, Start: start, End: start}
+	running, err := s.Create(ctx, alice, m, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-db.started
+	queued, err := s.Create(ctx, alice, m, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Close()
+
+	for _, id := range []string{running.ID, queued.ID} {
+		e, err := s.Get(ctx, alice, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Status != browser.ExportFailed || e.Error != browser.ErrExportCanceled.Error() {
+			t.Fatalf("got status %q with error %q, want %q with error %q", e.Status, e.Error, browser.ExportFailed, browser.ErrExportCanceled)
+		}
+	}
+
+	if _, err := s.Create(ctx, alice, m, "json"); !errors.Is(err, browser.ErrExportCanceled) {
+		t.Fatalf("got error %v, want %v", err, browser.ErrExportCanceled)
+	}
+}
@@ -5,16 +5,24 @@
 package http
 
 import (
+	stdjson "encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
 	"github.com/euracresearch/browser"
 	"github.com/euracresearch/browser/internal/encoding/csv"
 	"github.com/euracresearch/browser/internal/encoding/csvf"
+	"github.com/euracresearch/browser/internal/encoding/json"
+	"github.com/euracresearch/browser/internal/encoding/netcdf"
+	"github.com/euracresearch/browser/internal/encoding/parquet"
 	"github.com/euracresearch/browser/static"
 )
 
@@ -31,8 +39,29 @@ func (h *Handler) handleSeries() http.HandlerFunc {
 			return
 		}
 
-		ctx := r.Context()
-		ts, err := h.db.Series(ctx, m)
+		// The CSV formats are written while reading the points from the
+		// database, all other formats need the whole time series in memory.
+		var (
+			report = &browser.Report{}
+			ctx    = browser.NewReportContext(r.Context(), report)
+			format = seriesFormat(r)
+			ts     browser.TimeSeries
+			stream *browser.Stream
+		)
+		switch format {
+		case "json", "parquet", "netcdf":
+			ts, err = h.db.Series(ctx, m)
+		default:
+			stream, err = browser.StreamSeries(ctx, h.db, m)
+		}
+		if errors.Is(err, browser.ErrAccessDenied) {
+			Error(w, err, http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, browser.ErrLimitExceeded) {
+			Error(w, err, http.StatusRequestEntityTooLarge)
+			return
+		}
 		if errors.Is(err, browser.ErrDataNotFound) {
 			Error(w, err, http.StatusBadRequest)
 			return
@@ -42,61 +71,491 @@ func (h *Handler) handleSeries() http.HandlerFunc {
 			return
 		}
 
-		filename := fmt.Sprintf("LTSER_IT25_Matsch_Mazia_%d.csv", time.Now().Unix())
-		w.Header().Set("Content-Type", "text/csv")
-		w.Header().Set("Content-Description", "File Transfer")
-		w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+		// Optionally describe each measurement in a metadata header.
+		var catalogue browser.Catalogue
+		if r.FormValue("metadata") != "" {
+			catalogue, err = h.metadata.Catalogue(ctx, &browser.Message{Measurements: m.Measurements})
+			if err != nil {
+				Error(w, err, http.StatusInternalServerError)
+				return
+			}
+		}
 
-		switch r.FormValue("format") {
+		denials := report.Denials()
+		writeWarnings(w, denials)
+
+		// Errors of the writers are reported by fileError, since the status
+		// is sent as soon as the writers start writing the file.
+		fw := &fileWriter{ResponseWriter: w}
+
+		switch format {
 		default:
-			writer := csv.NewWriter(w)
-			if err := writer.Write(ts); err != nil {
-				Error(w, err, http.StatusInternalServerError)
+			writeFileHeaders(w, "text/csv", "csv")
+			writer := csv.NewWriter(fw)
+			writer.Catalogue = catalogue
+			writer.Flags = r.FormValue("flags") != ""
+			writer.Comments = denials.Strings()
+			if err := writer.WriteStream(stream); err != nil {
+				fileError(fw, err)
 			}
 
 		case "wide":
-			writer := csvf.NewWriter(w)
+			writeFileHeaders(w, "text/csv", "csv")
+			writer := csvf.NewWriter(fw)
+			writer.Catalogue = catalogue
+			writer.Flags = r.FormValue("flags") != ""
+			writer.Comments = denials.Strings()
+			if err := writer.WriteStream(stream); err != nil {
+				fileError(fw, err)
+			}
+
+		case "json":
+			writeFileHeaders(w, "application/json", "json")
+			writer := json.NewWriter(fw)
+			if err := writer.Write(ts); err != nil {
+				fileError(fw, err)
+			}
+
+		case "parquet":
+			writeFileHeaders(w, "application/vnd.apache.parquet", "parquet")
+			writer := parquet.NewWriter(fw)
 			if err := writer.Write(ts); err != nil {
+				fileError(fw, err)
+			}
+
+		case "netcdf":
+			writeFileHeaders(w, "application/x-netcdf", "nc")
+			writer := netcdf.NewWriter(fw)
+			if err := writer.Write(ts); err != nil {
+				fileError(fw, err)
+			}
+		}
+	}
+}
+
+// handleEstimate serves the estimated number of points of a series download
+// together with the limit of the current user and the parts of the request
+// denied by the access rules as JSON. The request takes the same form values
+// as a series download, so that clients can check a request before submitting
+// it.
+func (h *Handler) handleEstimate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Expected POST request", http.StatusMethodNotAllowed)
+			return
+		}
+
+		m, err := parseMessage(r)
+		if err != nil {
+			Error(w, err, http.StatusBadRequest)
+			return
+		}
+
+		report := &browser.Report{}
+		e := &browser.Estimate{Points: m.Estimate()}
+		if estimator, ok := h.db.(browser.Estimator); ok {
+			e, err = estimator.Estimate(browser.NewReportContext(r.Context(), report), m)
+			if errors.Is(err, browser.ErrAccessDenied) {
+				Error(w, err, http.StatusForbidden)
+				return
+			}
+			if err != nil {
 				Error(w, err, http.StatusInternalServerError)
+				return
 			}
 		}
+
+		denials := report.Denials()
+		writeWarnings(w, denials)
+		w.Header().Set("Content-Type", "application/json")
+		err = stdjson.NewEncoder(w).Encode(struct {
+			*browser.Estimate
+			Exceeded bool     `json:"exceeded"`
+			Warnings []string `json:"warnings,omitempty"`
+		}{e, e.Exceeded(), denials.Strings()})
+		if err != nil {
+			Error(w, err, http.StatusInternalServerError)
+		}
 	}
 }
 
-func (h *Handler) handleCodeTemplate() http.HandlerFunc {
-	var (
-		tmpl struct {
-			python, rlang *template.Template
+// handleExports creates a new export of a series download on POST, taking the
+// same form values as a series download, and lists all exports of the current
+// user on GET. Exports are only available to signed in users.
+func (h *Handler) handleExports() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		user := browser.UserFromContext(ctx)
+		if h.exports == nil || !user.Valid() {
+			http.NotFound(w, r)
+			return
 		}
-		err error
-	)
 
-	tmpl.python, err = static.ParseTextTemplates(nil, "templates/python.tmpl")
+		var v interface{}
+		switch r.Method {
+		case http.MethodGet:
+			exports, err := h.exports.List(ctx, user)
+			if err != nil {
+				Error(w, err, http.StatusInternalServerError)
+				return
+			}
+			if exports == nil {
+				exports = []*browser.Export{}
+			}
+			v = exports
+
+		case http.MethodPost:
+			m, err := parseMessage(r)
+			if err != nil {
+				Error(w, err, http.StatusBadRequest)
+				return
+			}
+
+			e, err := h.exports.Create(ctx, user, m, seriesFormat(r))
+			switch {
+			case errors.Is(err, browser.ErrAccessDenied):
+				Error(w, err, http.StatusForbidden)
+				return
+			case errors.Is(err, browser.ErrLimitExceeded):
+				Error(w, err, http.StatusRequestEntityTooLarge)
+				return
+			case errors.Is(err, browser.ErrExportQueueFull):
+				Error(w, err, http.StatusServiceUnavailable)
+				return
+			case err != nil:
+				Error(w, err, http.StatusInternalServerError)
+				return
+			}
+
+			for _, warning := range e.Warnings {
+				w.Header().Add("Warning", warningHeader(warning))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Location", "/api/v1/exports/"+e.ID)
+			w.WriteHeader(http.StatusAccepted)
+			v = e
+
+		default:
+			http.Error(w, "Expected GET or POST request", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := stdjson.NewEncoder(w).Encode(v); err != nil {
+			log.Printf("http error: %v", err)
+		}
+	}
+}
+
+// handleExport serves the export with the id given in the path, e.g.
+// /api/v1/exports/1234, of the current user. The file of the export is served
+// once the export is done, otherwise its status is returned as JSON.
+func (h *Handler) handleExport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		user := browser.UserFromContext(ctx)
+		if h.exports == nil || !user.Valid() {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Expected GET request", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/exports/"), "/")
+		e, err := h.exports.Get(ctx, user, id)
+		if errors.Is(err, browser.ErrExportNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if e.Status != browser.ExportDone {
+			w.Header().Set("Content-Type", "application/json")
+			if err := stdjson.NewEncoder(w).Encode(e); err != nil {
+				Error(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		f, err := h.exports.Open(ctx, user, id)
+		if err != nil {
+			Error(w, err, http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		contentType, ext := exportFileType(e.Format)
+		writeFileHeaders(w, contentType, ext)
+		if _, err := io.Copy(w, f); err != nil {
+			log.Printf("http error: %v", err)
+		}
+	}
+}
+
+// exportFileType returns the content type and file extension of the given
+// series format.
+func exportFileType(format string) (contentType, ext string) {
+	switch format {
+	case "json":
+		return "application/json", "json"
+	case "parquet":
+		return "application/vnd.apache.parquet", "parquet"
+	case "netcdf":
+		return "application/x-netcdf", "nc"
+	default:
+		return "text/csv", "csv"
+	}
+}
+
+// seriesFormat returns the requested output format of a series download. The
+// format form value takes precedence, otherwise JSON is chosen if the client
+// accepts it.
+func seriesFormat(r *http.Request) string {
+	if f := r.FormValue("format"); f != "" {
+		return f
+	}
+
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediatype := strings.TrimSpace(strings.Split(v, ";")[0])
+		if mediatype == "application/json" {
+			return "json"
+		}
+	}
+
+	return ""
+}
+
+// writeWarnings writes a Warning header for each of the given denials.
+func writeWarnings(w http.ResponseWriter, denials browser.Denials) {
+	for _, d := range denials {
+		w.Header().Add("Warning", warningHeader(d.String()))
+	}
+}
+
+// warningHeader returns the value of a Warning header with the given text
+// using the warn-code 299 (miscellaneous persistent warning).
+func warningHeader(text string) string {
+	return "299 - " + strconv.Quote(text)
+}
+
+// fileWriter is a http.ResponseWriter recording whether a file download has
+// started.
+type fileWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *fileWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+// fileError reports the given error of writing a file download. If nothing of
+// the file is written yet, the error is sent instead of the file. Otherwise
+// the status is already sent, thus the connection is aborted, so that the
+// client notices the truncated file instead of receiving the error message as
+// part of it.
+func fileError(w *fileWriter, err error) {
+	if w.started {
+		log.Printf("http error: writing file: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+
+	w.Header().Del("Content-Description")
+	w.Header().Del("Content-Disposition")
+
+	code := http.StatusInternalServerError
+	if errors.Is(err, csvf.ErrNotContinuous) || errors.Is(err, browser.ErrDataNotFound) {
+		code = http.StatusBadRequest
+	}
+	Error(w.ResponseWriter, err, code)
+}
+
+// writeFileHeaders writes the HTTP headers for a file download with the given
+// content type and file extension.
+func writeFileHeaders(w http.ResponseWriter, contentType, ext string) {
+	filename := fmt.Sprintf("LTSER_IT25_Matsch_Mazia_%d.%s", time.Now().Unix(), ext)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Description", "File Transfer")
+	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+}
+
+// handleStations serves the metadata of all stations the current user is
+// allowed to see as JSON. A single station is returned if its id is given in
+// the path, e.g. /api/v1/stations/39.
+//
+// The list of stations can be filtered with the following query parameters:
+//
+//  landuse       only stations with one of the given landuse
+//  measurements  only stations with at least one of the given measurements
+//  minElevation  only stations at or above the given elevation
+//  maxElevation  only stations at or below the given elevation
+func (h *Handler) handleStations() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Expected GET request", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx := r.Context()
+		stations, err := h.metadata.Stations(ctx, &browser.Message{})
+		if err != nil {
+			Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		var v interface{}
+		if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/stations"), "/"); id != "" {
+			station, ok := stations.Get(id)
+			if !ok {
+				Error(w, browser.ErrDataNotFound, http.StatusNotFound)
+				return
+			}
+			v = station
+		} else {
+			stations, err = filterStations(r, stations)
+			if err != nil {
+				Error(w, err, http.StatusBadRequest)
+				return
+			}
+			if stations == nil {
+				stations = browser.Stations{}
+			}
+			v = stations
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := stdjson.NewEncoder(w).Encode(v); err != nil {
+			Error(w, err, http.StatusInternalServerError)
+		}
+	}
+}
+
+// filterStations returns the stations matching the filters given as form
+// values of the request.
+func filterStations(r *http.Request, stations browser.Stations) (browser.Stations, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	minElevation, err := parseElevation(r.FormValue("minElevation"), math.MinInt64)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	maxElevation, err := parseElevation(r.FormValue("maxElevation"), math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+
+	var filtered browser.Stations
+	for _, s := range stations {
+		if s.Elevation < minElevation || s.Elevation > maxElevation {
+			continue
+		}
+
+		if len(r.Form["landuse"]) > 0 && !contains(r.Form["landuse"], s.Landuse) {
+			continue
+		}
+
+		if len(r.Form["measurements"]) > 0 && !containsAny(s.Measurements, r.Form["measurements"]) {
+			continue
+		}
+
+		filtered = append(filtered, s)
+	}
+
+	return filtered, nil
+}
+
+// parseElevation parses the given elevation. If s is empty def is returned.
+func parseElevation(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
 	}
 
-	tmpl.rlang, err = static.ParseTextTemplates(nil, "templates/r.tmpl")
+	e, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
-		log.Fatal(err)
+		return 0, fmt.Errorf("could not parse elevation %q", s)
+	}
+
+	return e, nil
+}
+
+// contains reports whether s is in slice.
+func contains(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
 	}
+	return false
+}
 
+// containsAny reports whether at least one of values is in slice.
+func containsAny(slice []string, values []string) bool {
+	for _, v := range values {
+		if contains(slice, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCacheRefresh refreshes the metadata cache immediately, e.g. after a
+// new station or measurement has been installed.
+func (h *Handler) handleCacheRefresh() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Expected POST request", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var (
-			t   *template.Template
-			ext string
-		)
-		switch r.FormValue("language") {
+		refresher, ok := h.metadata.(browser.Refresher)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if err := refresher.Refresh(r.Context()); err != nil {
+			Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *Handler) handleCodeTemplate() http.HandlerFunc {
+	// Templates are named after the language with a dialect suffix for
+	// statements not written in InfluxQL.
+	tmpl := make(map[string]*template.Template)
+	for _, name := range []string{"python", "r", "python_sql", "r_sql", "python_flux", "r_flux"} {
+		t, err := static.ParseTextTemplates(nil, "templates/"+name+".tmpl")
+		if err != nil {
+			log.Fatal(err)
+		}
+		tmpl[name] = t
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Expected POST request", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var ext string
+		lang := r.FormValue("language")
+		switch lang {
 		case "python":
-			t = tmpl.python
 			ext = "py"
 		case "r":
-			t = tmpl.rlang
 			ext = "r"
 		default:
 			Error(w, browser.ErrInternal, http.StatusInternalServerError)
@@ -109,8 +568,26 @@ func (h *Handler) handleCodeTemplate() http.HandlerFunc {
 			return
 		}
 
-		ctx := r.Context()
-		stmt := h.db.Query(ctx, m)
+		// Query cannot fail, thus strict requests are checked against the
+		// reported denials.
+		report := &browser.Report{}
+		stmt := h.db.Query(browser.NewReportContext(r.Context(), report), m)
+		denials := report.Denials()
+		if m.Strict && len(denials) > 0 {
+			Error(w, denials.Err(), http.StatusForbidden)
+			return
+		}
+		writeWarnings(w, denials)
+
+		name := lang
+		if stmt.Dialect != browser.InfluxQL {
+			name += "_" + string(stmt.Dialect)
+		}
+		t, ok := tmpl[name]
+		if !ok {
+			Error(w, browser.ErrInternal, http.StatusInternalServerError)
+			return
+		}
 
 		filename := fmt.Sprintf("LTSER_IT25_Matsch_Mazia_%d.%s", time.Now().Unix(), ext)
 		w.Header().Set("Content-Description", "File Transfer")
@@ -157,11 +634,30 @@ func parseMessage(r *http.Request) (*browser.Message, error) {
 		return nil, errors.New("at least one station must be given")
 	}
 
+	interval, err := browser.ParseInterval(r.FormValue("interval"))
+	if err != nil {
+		return nil, err
+	}
+
+	fn, err := browser.ParseAggregateFunc(r.FormValue("function"))
+	if err != nil {
+		return nil, err
+	}
+
+	quality, err := browser.ParseQuality(r.FormValue("quality"))
+	if err != nil {
+		return nil, err
+	}
+
 	return &browser.Message{
 		Measurements: r.Form["measurements"],
 		Stations:     r.Form["stations"],
 		Landuse:      r.Form["landuse"],
 		Start:        start,
 		End:          end,
+		Interval:     interval,
+		Function:     fn,
+		Quality:      quality,
+		Strict:       r.FormValue("strict") != "",
 	}, nil
 }
@@ -7,6 +7,10 @@ package http
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -17,7 +21,10 @@ import (
 	"time"
 
 	"github.com/euracresearch/browser"
+	"github.com/euracresearch/browser/internal/mock"
 	"github.com/euracresearch/browser/static"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 type testBackend struct{}
@@ -54,9 +61,31 @@ func (tb *testBackend) Query(ctx context.Context, m *browser.Message) *browser.S
 	}
 }
 
+func (tb *testBackend) Stations(ctx context.Context, m *browser.Message) (browser.Stations, error) {
+	stations := browser.Stations{
+		&browser.Station{ID: "1", Name: "s1", Landuse: "me", Elevation: 1000, Measurements: []string{"a_avg", "b_avg"}},
+	}
+
+	if browser.UserFromContext(ctx).Role == browser.FullAccess {
+		stations = append(stations,
+			&browser.Station{ID: "2", Name: "s2", Landuse: "pa", Elevation: 1500, Measurements: []string{"b_avg"}},
+			&browser.Station{ID: "3", Name: "s3", Landuse: "me", Elevation: 2000, Measurements: []string{"c_avg"}},
+		)
+	}
+
+	return stations, nil
+}
+
+func (tb *testBackend) Catalogue(ctx context.Context, m *browser.Message) (browser.Catalogue, error) {
+	return browser.Catalogue{
+		&browser.Parameter{Label: "test", Description: map[string]string{"en": "Test"}, Unit: "%"},
+	}, nil
+}
+
 func TestHandleSeries(t *testing.T) {
 	h := NewHandler(func(h *Handler) {
 		h.db = new(testBackend)
+		h.metadata = new(testBackend)
 	})
 
 	testCases := map[string]struct {
@@ -78,6 +107,14 @@ func TestHandleSeries(t *testing.T) {
 		"MissingMeasurementsAndStations": {http.MethodPost, http.StatusInternalServerError, "text/plain; charset=utf-8", "startDate=2019-07-23&endDate=2020-01-23&landuse=a", nil},
 		"OK":                             {http.MethodPost, http.StatusOK, "text/csv", "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a", []byte("time,station,landuse,elevation,latitude,longitude,test\n,,,,,,%\n2020-01-01 00:15:00,station,me,1000,3.14159,2.71828,0\n2020-01-01 00:30:00,station,me,1000,3.14159,2.71828,1\n2020-01-01 00:45:00,station,me,1000,3.14159,2.71828,2\n2020-01-01 01:00:00,station,me,1000,3.14159,2.71828,3\n2020-01-01 01:15:00,station,me,1000,3.14159,2.71828,4\n")},
 		"OKWithLanduse":                  {http.MethodPost, http.StatusOK, "text/csv", "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a&landuse=me", []byte("time,station,landuse,elevation,latitude,longitude,test\n,,,,,,%\n2020-01-01 00:15:00,station,me,1000,3.14159,2.71828,0\n2020-01-01 00:30:00,station,me,1000,3.14159,2.71828,1\n2020-01-01 00:45:00,station,me,1000,3.14159,2.71828,2\n2020-01-01 01:00:00,station,me,1000,3.14159,2.71828,3\n2020-01-01 01:15:00,station,me,1000,3.14159,2.71828,4\n")},
+		"InvalidInterval":                {http.MethodPost, http.StatusInternalServerError, "text/plain; charset=utf-8", "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a&interval=weekly", nil},
+		"InvalidFunction":                {http.MethodPost, http.StatusInternalServerError, "text/plain; charset=utf-8", "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a&interval=daily&function=median", nil},
+		"Daily":                          {http.MethodPost, http.StatusOK, "text/csv", "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a&interval=daily&function=max", nil},
+		"Metadata":                       {http.MethodPost, http.StatusOK, "text/csv", "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a&metadata=1", []byte("# test: Test [%]\ntime,station,landuse,elevation,latitude,longitude,test\n,,,,,,%\n2020-01-01 00:15:00,station,me,1000,3.14159,2.71828,0\n2020-01-01 00:30:00,station,me,1000,3.14159,2.71828,1\n2020-01-01 00:45:00,station,me,1000,3.14159,2.71828,2\n2020-01-01 01:00:00,station,me,1000,3.14159,2.71828,3\n2020-01-01 01:15:00,station,me,1000,3.14159,2.71828,4\n")},
+		"InvalidQuality":                 {http.MethodPost, http.StatusInternalServerError, "text/plain; charset=utf-8", "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a&quality=good", nil},
+		"Flags":                          {http.MethodPost, http.StatusOK, "text/csv", "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a&quality=raw&flags=1", []byte("time,station,landuse,elevation,latitude,longitude,test,test_flag\n,,,,,,%,\n2020-01-01 00:15:00,station,me,1000,3.14159,2.71828,0,raw\n2020-01-01 00:30:00,station,me,1000,3.14159,2.71828,1,raw\n2020-01-01 00:45:00,station,me,1000,3.14159,2.71828,2,raw\n2020-01-01 01:00:00,station,me,1000,3.14159,2.71828,3,raw\n2020-01-01 01:15:00,station,me,1000,3.14159,2.71828,4,raw\n")},
+		"Parquet":                        {http.MethodPost, http.StatusOK, "application/vnd.apache.parquet", "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a&format=parquet", nil},
+		"NetCDF":                         {http.MethodPost, http.StatusOK, "application/x-netcdf", "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a&format=netcdf", nil},
 	}
 
 	for k, tc := range testCases {
@@ -112,6 +149,377 @@ func TestHandleSeries(t *testing.T) {
 	}
 }
 
+func TestHandleSeriesTimeout(t *testing.T) {
+	h := NewHandler(WithDatabase(&mock.Database{
+		SeriesFn: func() (browser.TimeSeries, error) {
+			return nil, fmt.Errorf("query: %w", context.DeadlineExceeded)
+		},
+	}))
+
+	for _, format := range []string{"long", "json"} {
+		body := "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a&format=" + format
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/series", strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if got, want := w.Code, http.StatusGatewayTimeout; got != want {
+			t.Fatalf("%s: got status code %d, want %d", format, got, want)
+		}
+	}
+}
+
+// failingStream is a browser.Streamer whose points fail after the given
+// number of points.
+type failingStream struct {
+	mock.Database
+	points int
+}
+
+func (db *failingStream) Stream(ctx context.Context, m *browser.Message) (*browser.Stream, error) {
+	return &browser.Stream{
+		TimeSeries: browser.TimeSeries{{Label: "a", Station: "s1"}},
+		Points: func(m *browser.Measurement) browser.PointIterator {
+			return &failingIterator{n: db.points}
+		},
+	}, nil
+}
+
+type failingIterator struct {
+	n   int
+	cur *browser.Point
+	err error
+}
+
+func (it *failingIterator) Next() bool {
+	if it.n == 0 {
+		it.err = errors.New("connection reset")
+		return false
+	}
+	it.n--
+	it.cur = &browser.Point{Timestamp: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(it.n) * time.Minute)}
+	return true
+}
+
+func (it *failingIterator) Point() *browser.Point { return it.cur }
+func (it *failingIterator) Err() error            { return it.err }
+func (it *failingIterator) Close() error          { return nil }
+
+func TestHandleSeriesWriteError(t *testing.T) {
+	serve := func(h http.Handler, format string) (w *httptest.ResponseRecorder, aborted bool) {
+		body := "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a&format=" + format
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/series", strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+		w = httptest.NewRecorder()
+		defer func() {
+			if r := recover(); r != nil {
+				if r != http.ErrAbortHandler {
+					panic(r)
+				}
+				aborted = true
+			}
+		}()
+		h.ServeHTTP(w, req)
+		return w, false
+	}
+
+	// Measurements starting at different times are refused before the file
+	// is started.
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := NewHandler(WithDatabase(&mock.Database{
+		SeriesFn: func() (browser.TimeSeries, error) {
+			return browser.TimeSeries{
+				{Label: "a", Station: "s1", Points: []*browser.Point{{Timestamp: start}}},
+				{Label: "a", Station: "s2", Points: []*browser.Point{{Timestamp: start.Add(time.Hour)}}},
+			}, nil
+		},
+	}))
+	w, aborted := serve(h, "wide")
+	if aborted {
+		t.Fatal("not continuous: connection aborted, want error response")
+	}
+	if got, want := w.Code, http.StatusBadRequest; got != want {
+		t.Fatalf("not continuous: got status code %d, want %d", got, want)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != "" {
+		t.Fatalf("not continuous: got Content-Disposition %q, want none", got)
+	}
+
+	// Errors after the file is started abort the connection instead of
+	// appending the error message to the file.
+	for _, format := range []string{"long", "wide"} {
+		h := NewHandler(WithDatabase(&failingStream{points: 1000}))
+		w, aborted := serve(h, format)
+		if !aborted {
+			t.Fatalf("%s: got status code %d and body %q, want aborted connection", format, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestHandleSeriesLimit(t *testing.T) {
+	h := NewHandler(WithDatabase(&mock.Database{
+		SeriesFn: func() (browser.TimeSeries, error) {
+			return nil, (&browser.Estimate{Points: 2, Limit: 1}).Err()
+		},
+	}))
+
+	for _, format := range []string{"long", "json"} {
+		body := "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a&format=" + format
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/series", strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if got, want := w.Code, http.StatusRequestEntityTooLarge; got != want {
+			t.Fatalf("%s: got status code %d, want %d", format, got, want)
+		}
+	}
+}
+
+// deniedBackend is a browser.Database denying the measurement "b" like a
+// decorating access.Access.
+type deniedBackend struct {
+	mock.Database
+}
+
+func (db *deniedBackend) Series(ctx context.Context, m *browser.Message) (browser.TimeSeries, error) {
+	denials := browser.Denials{{Field: "measurements", Value: "b", Reason: "not allowed"}}
+	browser.ReportFromContext(ctx).Add(denials...)
+	if m.Strict {
+		return nil, denials.Err()
+	}
+	return db.Database.Series(ctx, m)
+}
+
+func TestHandleSeriesDenied(t *testing.T) {
+	h := NewHandler(WithDatabase(&deniedBackend{
+		Database: mock.Database{
+			SeriesFn: func() (browser.TimeSeries, error) {
+				return browser.TimeSeries{
+					{Label: "a", Station: "s1", Points: []*browser.Point{{Timestamp: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Value: 1}}},
+				}, nil
+			},
+		},
+	}))
+
+	testCases := map[string]struct {
+		strict string
+		code   int
+	}{
+		"Redacted": {"", http.StatusOK},
+		"Strict":   {"1", http.StatusForbidden},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			body := "startDate=2020-01-01&endDate=2020-01-01&stations=1&measurements=a&measurements=b&strict=" + tc.strict
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/series", strings.NewReader(body))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tc.code {
+				t.Fatalf("got status code %d, want %d", w.Code, tc.code)
+			}
+			if !strings.Contains(w.Body.String(), `measurements "b": not allowed`) {
+				t.Fatalf("denial not reported in body:\n%s", w.Body)
+			}
+			if tc.code != http.StatusOK {
+				return
+			}
+
+			if got, want := w.Header().Get("Warning"), `299 - "measurements \"b\": not allowed"`; got != want {
+				t.Fatalf("got warning %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+// estimatorBackend is a browser.Database implementing browser.Estimator with a
+// fixed limit.
+type estimatorBackend struct {
+	mock.Database
+	limit int64
+}
+
+func (e *estimatorBackend) Estimate(ctx context.Context, m *browser.Message) (*browser.Estimate, error) {
+	return &browser.Estimate{Points: m.Estimate(), Limit: e.limit}, nil
+}
+
+func TestHandleEstimate(t *testing.T) {
+	// Two days of raw data of two measurements at a single station.
+	const body = "startDate=2020-01-01&endDate=2020-01-02&stations=1&measurements=a&measurements=b"
+
+	testCases := map[string]struct {
+		db   browser.Database
+		want string
+	}{
+		"NoEstimator": {&mock.Database{}, `{"points":384,"limit":0,"exceeded":false}`},
+		"Within":      {&estimatorBackend{limit: 384}, `{"points":384,"limit":384,"exceeded":false}`},
+		"Exceeded":    {&estimatorBackend{limit: 383}, `{"points":384,"limit":383,"exceeded":true}`},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			h := NewHandler(WithDatabase(tc.db))
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/estimate", strings.NewReader(body))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status code %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tc.want {
+				t.Fatalf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleExports(t *testing.T) {
+	var created *browser.Message
+
+	h := NewHandler(WithExports(&mock.ExportService{
+		CreateFn: func(u *browser.User, m *browser.Message, format string) (*browser.Export, error) {
+			if len(m.Measurements) > 1 {
+				return nil, (&browser.Estimate{Points: 2, Limit: 1}).Err()
+			}
+			created = m
+			return &browser.Export{ID: "ab12", Format: format, Status: browser.ExportQueued}, nil
+		},
+		ListFn: func(u *browser.User) ([]*browser.Export, error) {
+			return []*browser.Export{{ID: "ab12", Status: browser.ExportRunning}}, nil
+		},
+		GetFn: func(u *browser.User, id string) (*browser.Export, error) {
+			switch id {
+			case "running":
+				return &browser.Export{ID: id, Status: browser.ExportRunning, Progress: 0.5}, nil
+			case "done":
+				return &browser.Export{ID: id, Format: "wide", Status: browser.ExportDone}, nil
+			}
+			return nil, browser.ErrExportNotFound
+		},
+		OpenFn: func(u *browser.User, id string) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("time,a\n")), nil
+		},
+	}))
+
+	const body = "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a&format=wide"
+
+	testCases := map[string]struct {
+		method      string
+		path        string
+		ctx         context.Context
+		reqBody     string
+		statusCode  int
+		contentType string
+		contains    string
+	}{
+		"Anonymous":  {http.MethodGet, "/api/v1/exports", context.Background(), "", http.StatusNotFound, "", ""},
+		"List":       {http.MethodGet, "/api/v1/exports", withUser(), "", http.StatusOK, "application/json", `"id":"ab12"`},
+		"Create":     {http.MethodPost, "/api/v1/exports", withUser(), body, http.StatusAccepted, "application/json", `"format":"wide"`},
+		"Exceeded":   {http.MethodPost, "/api/v1/exports", withUser(), body + "&measurements=b", http.StatusRequestEntityTooLarge, "", ""},
+		"BadRequest": {http.MethodPost, "/api/v1/exports", withUser(), "stations=1", http.StatusBadRequest, "", ""},
+		"PUT":        {http.MethodPut, "/api/v1/exports", withUser(), "", http.StatusMethodNotAllowed, "", ""},
+		"Running":    {http.MethodGet, "/api/v1/exports/running", withUser(), "", http.StatusOK, "application/json", `"progress":0.5`},
+		"Done":       {http.MethodGet, "/api/v1/exports/done", withUser(), "", http.StatusOK, "text/csv", "time,a"},
+		"NotFound":   {http.MethodGet, "/api/v1/exports/unknown", withUser(), "", http.StatusNotFound, "", ""},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.reqBody))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			req = req.WithContext(tc.ctx)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if got, want := w.Code, tc.statusCode; got != want {
+				t.Fatalf("got status code %d, want %d", got, want)
+			}
+			if tc.contentType == "" {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tc.contentType {
+				t.Fatalf("got content type %q, want %q", got, tc.contentType)
+			}
+			if !strings.Contains(w.Body.String(), tc.contains) {
+				t.Fatalf("got body %q, want it to contain %q", w.Body.String(), tc.contains)
+			}
+		})
+	}
+
+	if created == nil || created.Stations[0] != "1" {
+		t.Fatalf("got created message %+v, want message of the request", created)
+	}
+}
+
+func TestHandleSeriesJSON(t *testing.T) {
+	h := NewHandler(func(h *Handler) {
+		h.db = new(testBackend)
+	})
+
+	const (
+		body = "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a"
+		want = `[{"label":"test","name":"test","station":"station","landuse":"me","unit":"%","aggregation":"","depth":0,"elevation":1000,"latitude":3.14159,"longitude":2.71828,"points":[{"time":"2020-01-01T00:15:00Z","value":0},{"time":"2020-01-01T00:30:00Z","value":1},{"time":"2020-01-01T00:45:00Z","value":2},{"time":"2020-01-01T01:00:00Z","value":3},{"time":"2020-01-01T01:15:00Z","value":4}]}]
+`
+	)
+
+	testCases := map[string]struct {
+		reqBody         string
+		accept          string
+		respContentType string
+	}{
+		"FormValue":        {body + "&format=json", "", "application/json"},
+		"Accept":           {body, "text/html;q=0.9, application/json", "application/json"},
+		"FormValuePrecede": {body + "&format=long", "application/json", "text/csv"},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/series", strings.NewReader(tc.reqBody))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			if tc.accept != "" {
+				req.Header.Add("Accept", tc.accept)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			resp := w.Result()
+
+			if got, want := resp.StatusCode, http.StatusOK; got != want {
+				t.Fatalf("got unexpected status code: %d, want %d", got, want)
+			}
+
+			if got, want := resp.Header.Get("Content-Type"), tc.respContentType; got != want {
+				t.Fatalf("response header content-type: got %s, want %s", got, want)
+			}
+
+			if tc.respContentType != "application/json" {
+				return
+			}
+
+			defer resp.Body.Close()
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("ioutil.ReadAll(resp.Body): %v", err)
+			}
+
+			if string(b) != want {
+				t.Fatalf("got unexpected body: %q; want %q", b, want)
+			}
+		})
+	}
+}
+
 func TestHandleTemplate(t *testing.T) {
 	h := NewHandler(func(h *Handler) {
 		h.db = new(testBackend)
@@ -195,7 +603,178 @@ func TestHandleTemplate(t *testing.T) {
 
 }
 
+func TestHandleTemplateDialect(t *testing.T) {
+	for _, dialect := range []browser.Dialect{browser.SQL, browser.Flux} {
+		h := NewHandler(func(h *Handler) {
+			h.db = &mock.Database{
+				QueryFn: func(ctx context.Context, m *browser.Message) *browser.Stmt {
+					return &browser.Stmt{Query: "query", Database: "testdb", Dialect: dialect}
+				},
+			}
+		})
+
+		for _, lang := range []string{"python", "r"} {
+			t.Run(string(dialect)+"_"+lang, func(t *testing.T) {
+				tmpl, err := static.ParseTextTemplates(nil, "templates/"+lang+"_"+string(dialect)+".tmpl")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				body := "startDate=2019-07-23&endDate=2020-01-23&stations=1&measurements=a&language=" + lang
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/templates", strings.NewReader(body))
+				req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+				req = req.WithContext(withCTX(browser.FullAccess))
+
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+
+				if got, want := w.Code, http.StatusOK; got != want {
+					t.Fatalf("got unexpected status code: %d, want %d", got, want)
+				}
+
+				var want bytes.Buffer
+				err = tmpl.Execute(&want, struct {
+					Query    string
+					Database string
+				}{
+					"query", "testdb",
+				})
+				if err != nil {
+					t.Fatalf("error executing template: %v", err)
+				}
+
+				if got := w.Body.String(); got != want.String() {
+					t.Fatalf("got unexpected body: %s; want %s", got, want.String())
+				}
+			})
+		}
+	}
+}
+
+func TestHandleStations(t *testing.T) {
+	h := NewHandler(func(h *Handler) {
+		h.metadata = new(testBackend)
+	})
+
+	testCases := map[string]struct {
+		method     string
+		path       string
+		ctx        context.Context
+		statusCode int
+		want       []string
+	}{
+		"POST":             {http.MethodPost, "/api/v1/stations", withCTX(browser.FullAccess), http.StatusMethodNotAllowed, nil},
+		"Public":           {http.MethodGet, "/api/v1/stations", withCTX(browser.Public), http.StatusOK, []string{"1"}},
+		"FullAccess":       {http.MethodGet, "/api/v1/stations", withCTX(browser.FullAccess), http.StatusOK, []string{"1", "2", "3"}},
+		"Landuse":          {http.MethodGet, "/api/v1/stations?landuse=me", withCTX(browser.FullAccess), http.StatusOK, []string{"1", "3"}},
+		"Measurements":     {http.MethodGet, "/api/v1/stations?measurements=b_avg&measurements=x", withCTX(browser.FullAccess), http.StatusOK, []string{"1", "2"}},
+		"Elevation":        {http.MethodGet, "/api/v1/stations?minElevation=1200&maxElevation=2000", withCTX(browser.FullAccess), http.StatusOK, []string{"2", "3"}},
+		"NoMatch":          {http.MethodGet, "/api/v1/stations?landuse=x", withCTX(browser.FullAccess), http.StatusOK, []string{}},
+		"InvalidElevation": {http.MethodGet, "/api/v1/stations?minElevation=high", withCTX(browser.FullAccess), http.StatusBadRequest, nil},
+		"Station":          {http.MethodGet, "/api/v1/stations/2", withCTX(browser.FullAccess), http.StatusOK, []string{"2"}},
+		"StationNotFound":  {http.MethodGet, "/api/v1/stations/4", withCTX(browser.FullAccess), http.StatusNotFound, nil},
+		"StationNoAccess":  {http.MethodGet, "/api/v1/stations/2", withCTX(browser.Public), http.StatusNotFound, nil},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			req = req.WithContext(tc.ctx)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			resp := w.Result()
+
+			if got, want := resp.StatusCode, tc.statusCode; got != want {
+				t.Fatalf("got unexpected status code: %d, want %d", got, want)
+			}
+
+			if tc.want == nil {
+				return
+			}
+
+			if got, want := resp.Header.Get("Content-Type"), "application/json"; got != want {
+				t.Fatalf("response header content-type: got %s, want %s", got, want)
+			}
+
+			defer resp.Body.Close()
+			var stations browser.Stations
+			if strings.HasPrefix(tc.path, "/api/v1/stations/") {
+				var s browser.Station
+				if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+					t.Fatal(err)
+				}
+				stations = append(stations, &s)
+			} else if err := json.NewDecoder(resp.Body).Decode(&stations); err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for _, s := range stations {
+				got = append(got, s.ID)
+			}
+
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// withUser returns a context carrying a signed in user.
+func withUser() context.Context {
+	u := &browser.User{Name: "Alice", Email: "alice@example.com", Provider: "github", Role: browser.FullAccess, License: true}
+	return context.WithValue(context.Background(), browser.UserContextKey, u)
+}
+
 func withCTX(role browser.Role) context.Context {
 	u := &browser.User{Role: role}
 	return context.WithValue(context.Background(), browser.UserContextKey, u)
 }
+
+func withGroups(role browser.Role, groups ...browser.Role) context.Context {
+	u := &browser.User{Role: role, Groups: groups}
+	return context.WithValue(context.Background(), browser.UserContextKey, u)
+}
+
+// refreshMetadata is a browser.Metadata implementing browser.Refresher.
+type refreshMetadata struct {
+	mock.Metadata
+	err error
+}
+
+func (md *refreshMetadata) Refresh(ctx context.Context) error {
+	return md.err
+}
+
+func TestHandleCacheRefresh(t *testing.T) {
+	testCases := map[string]struct {
+		metadata   browser.Metadata
+		method     string
+		ctx        context.Context
+		statusCode int
+	}{
+		"Refresh":      {&refreshMetadata{}, http.MethodPost, withCTX(browser.FullAccess), http.StatusNoContent},
+		"Failed":       {&refreshMetadata{err: browser.ErrInternal}, http.MethodPost, withCTX(browser.FullAccess), http.StatusInternalServerError},
+		"Public":       {&refreshMetadata{}, http.MethodPost, withCTX(browser.Public), http.StatusNotFound},
+		"GET":          {&refreshMetadata{}, http.MethodGet, withCTX(browser.FullAccess), http.StatusMethodNotAllowed},
+		"NotRefresher": {&mock.Metadata{}, http.MethodPost, withCTX(browser.FullAccess), http.StatusNotFound},
+		"Group":        {&refreshMetadata{}, http.MethodPost, withGroups(browser.External, browser.FullAccess), http.StatusNoContent},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			h := NewHandler(WithMetadata(tc.metadata))
+
+			req := httptest.NewRequest(tc.method, "/api/v1/cache/refresh", nil)
+			req = req.WithContext(tc.ctx)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if got, want := w.Code, tc.statusCode; got != want {
+				t.Fatalf("got status code %d, want %d", got, want)
+			}
+		})
+	}
+}
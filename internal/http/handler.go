@@ -20,6 +20,8 @@ type Handler struct {
 
 	db       browser.Database
 	metadata browser.Metadata
+	tokens   browser.TokenService
+	exports  browser.ExportService
 }
 
 // NewHandler creates a new HTTP handler with the given options and initializes
@@ -46,8 +48,16 @@ func NewHandler(options ...Option) *Handler {
 	h.mux.HandleFunc("/static/dl/Official_Glossary.xlsx", grantAccess(static.ServeContent, browser.FullAccess, browser.External))
 	h.mux.HandleFunc("/static/", static.ServeContent)
 
+	h.mux.HandleFunc("/account/tokens", h.handleTokens())
+
 	h.mux.HandleFunc("/api/v1/series", h.handleSeries())
+	h.mux.HandleFunc("/api/v1/estimate", h.handleEstimate())
+	h.mux.HandleFunc("/api/v1/exports", h.handleExports())
+	h.mux.HandleFunc("/api/v1/exports/", h.handleExport())
+	h.mux.HandleFunc("/api/v1/stations", h.handleStations())
+	h.mux.HandleFunc("/api/v1/stations/", h.handleStations())
 	h.mux.HandleFunc("/api/v1/templates", grantAccess(h.handleCodeTemplate(), browser.FullAccess))
+	h.mux.HandleFunc("/api/v1/cache/refresh", grantAccess(h.handleCacheRefresh(), browser.FullAccess))
 
 	return h
 }
@@ -71,6 +81,22 @@ func WithMetadata(m browser.Metadata) Option {
 	}
 }
 
+// WithTokens returns an option function for setting the handler's API token
+// service.
+func WithTokens(t browser.TokenService) Option {
+	return func(h *Handler) {
+		h.tokens = t
+	}
+}
+
+// WithExports returns an option function for setting the handler's export
+// service.
+func WithExports(e browser.ExportService) Option {
+	return func(h *Handler) {
+		h.exports = e
+	}
+}
+
 // WithAnalyticsCode sets the Google Analytics code.
 func WithAnalyticsCode(analytics string) Option {
 	return func(h *Handler) {
@@ -6,8 +6,11 @@
 package http
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/euracresearch/browser"
 )
@@ -19,8 +22,38 @@ func ListenAndServe(addr string, handler http.Handler) error {
 	return http.ListenAndServe(addr, handler)
 }
 
-// Error writes an error message to the response.
+// ShutdownTimeout is the maximum duration Serve waits for active requests
+// during shutdown.
+var ShutdownTimeout = 30 * time.Second
+
+// Serve serves handler on addr until ctx is done. The server is shut down
+// gracefully afterwards, waiting at most ShutdownTimeout for active requests.
+func Serve(ctx context.Context, addr string, handler http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// Error writes an error message to the response. If err is caused by an
+// exceeded deadline the status code is changed to http.StatusGatewayTimeout.
 func Error(w http.ResponseWriter, err error, code int) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		code = http.StatusGatewayTimeout
+	}
+
 	// Log error.
 	log.Printf("http error: %s (code=%d)", err, code)
 
@@ -45,12 +78,27 @@ func grantAccess(h http.HandlerFunc, roles ...browser.Role) http.HandlerFunc {
 	}
 }
 
-// isAllowed checks if the current user makes part of the allowed roles.
+// isAllowed checks if the current user makes part of the allowed roles,
+// either by its role or by one of its groups.
 func isAllowed(r *http.Request, roles ...browser.Role) bool {
 	u := browser.UserFromContext(r.Context())
 
 	for _, v := range roles {
-		if u.Role == v {
+		if u.HasRole(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isRegistered checks if the current user has any role other than
+// browser.Public, either by its role or by one of its groups.
+func isRegistered(r *http.Request) bool {
+	u := browser.UserFromContext(r.Context())
+
+	for _, v := range u.Roles() {
+		if v != browser.Public {
 			return true
 		}
 	}
@@ -25,6 +25,7 @@ func (h *Handler) handleIndex() http.HandlerFunc {
 	funcMap := template.FuncMap{
 		"T":         translate,
 		"Is":        isRole,
+		"Title":     browser.Catalogue.Title,
 		"HasSuffix": strings.HasSuffix,
 		"Mod": func(i int) bool {
 			i++
@@ -58,8 +59,15 @@ func (h *Handler) handleIndex() http.HandlerFunc {
 			return
 		}
 
+		catalogue, err := h.metadata.Catalogue(ctx, &browser.Message{})
+		if err != nil {
+			Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
 		err = tmpl.Execute(w, struct {
 			Data          browser.Stations
+			Catalogue     browser.Catalogue
 			User          *browser.User
 			Language      string
 			Path          string
@@ -69,6 +77,7 @@ func (h *Handler) handleIndex() http.HandlerFunc {
 			EndDate       string
 		}{
 			data,
+			catalogue,
 			user,
 			lang,
 			r.URL.Path,
@@ -198,6 +207,100 @@ func (h *Handler) handleStaticPage() http.HandlerFunc {
 	}
 }
 
+// handleTokens serves the page for managing the personal API tokens of the
+// current user. POST requests create a new token or revoke an existing one,
+// depending on the "action" form value.
+func (h *Handler) handleTokens() http.HandlerFunc {
+	funcMap := template.FuncMap{
+		"T":  translate,
+		"Is": isRole,
+	}
+
+	tmpl, err := static.ParseTemplates(template.New("base.tmpl").Funcs(funcMap), "html/base.tmpl", "html/tokens.tmpl")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		user := browser.UserFromContext(ctx)
+		lang := languageFromCookie(r)
+
+		// Tokens act on behalf of the user, thus they are available to every
+		// user having access beyond browser.Public, be it by role or group.
+		if !isRegistered(r) || h.tokens == nil {
+			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+			return
+		}
+
+		// Tokens can only be managed within a browser session, otherwise a
+		// leaked token could be used for creating new ones.
+		if r.Header.Get("Authorization") != "" {
+			http.Error(w, "tokens cannot be managed with a token", http.StatusForbidden)
+			return
+		}
+
+		var newToken *browser.Token
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			switch r.FormValue("action") {
+			case "create":
+				newToken, err = h.tokens.Create(ctx, user, r.FormValue("name"))
+			case "revoke":
+				err = h.tokens.Revoke(ctx, user, r.FormValue("id"))
+			default:
+				err = errors.New("unknown action")
+			}
+			if err != nil {
+				Error(w, err, http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Expected GET or POST request", http.StatusMethodNotAllowed)
+			return
+		}
+
+		tokens, err := h.tokens.List(ctx, user)
+		if err != nil {
+			Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		data, err := h.metadata.Stations(ctx, &browser.Message{})
+		if err != nil {
+			Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		// The page might show a secret, which must never be cached.
+		w.Header().Set("Cache-Control", "no-store")
+
+		err = tmpl.Execute(w, struct {
+			Data          browser.Stations
+			User          *browser.User
+			Language      string
+			Path          string
+			AnalyticsCode string
+			Token         string
+			Tokens        []*browser.Token
+			NewToken      *browser.Token
+		}{
+			data,
+			user,
+			lang,
+			"tokens",
+			h.analytics,
+			middleware.XSRFTokenPlaceholder,
+			tokens,
+			newToken,
+		})
+		if err != nil {
+			Error(w, err, http.StatusInternalServerError)
+		}
+	}
+}
+
 // pageNameFromPath is a helper for extracing the page name from the request
 // URL. It assumes that the page name is always in the URL.
 func pageNameFromPath(p string) (string, error) {
@@ -0,0 +1,89 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/euracresearch/browser"
+	"github.com/euracresearch/browser/internal/mock"
+)
+
+func TestHandleTokens(t *testing.T) {
+	var revoked string
+
+	h := NewHandler(func(h *Handler) {
+		h.metadata = new(testBackend)
+		h.tokens = &mock.TokenService{
+			CreateFn: func(u *browser.User, name string) (*browser.Token, error) {
+				return &browser.Token{ID: "ab12", Name: name, Secret: "topsecret"}, nil
+			},
+			ListFn: func(u *browser.User) ([]*browser.Token, error) {
+				return []*browser.Token{{ID: "ab12", Name: "cron"}}, nil
+			},
+			RevokeFn: func(u *browser.User, id string) error {
+				revoked = id
+				return nil
+			},
+		}
+	})
+
+	testCases := map[string]struct {
+		method     string
+		ctx        context.Context
+		reqBody    string
+		bearer     bool
+		statusCode int
+		contains   string
+	}{
+		"Public":        {http.MethodGet, withCTX(browser.Public), "", false, http.StatusTemporaryRedirect, ""},
+		"PublicGroups":  {http.MethodGet, withGroups(browser.Public, browser.Public), "", false, http.StatusTemporaryRedirect, ""},
+		"Group":         {http.MethodGet, withGroups(browser.Public, "partners"), "", false, http.StatusOK, "cron"},
+		"List":          {http.MethodGet, withCTX(browser.FullAccess), "", false, http.StatusOK, "cron"},
+		"Create":        {http.MethodPost, withCTX(browser.External), "action=create&name=cron", false, http.StatusOK, "topsecret"},
+		"Revoke":        {http.MethodPost, withCTX(browser.External), "action=revoke&id=ab12", false, http.StatusOK, ""},
+		"UnknownAction": {http.MethodPost, withCTX(browser.External), "action=delete", false, http.StatusBadRequest, ""},
+		"WithToken":     {http.MethodPost, withCTX(browser.External), "action=create&name=cron", true, http.StatusForbidden, ""},
+		"PUT":           {http.MethodPut, withCTX(browser.External), "", false, http.StatusMethodNotAllowed, ""},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/account/tokens", strings.NewReader(tc.reqBody))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			if tc.bearer {
+				req.Header.Add("Authorization", "Bearer abc")
+			}
+			req = req.WithContext(tc.ctx)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			resp := w.Result()
+
+			if got, want := resp.StatusCode, tc.statusCode; got != want {
+				t.Fatalf("got unexpected status code: %d, want %d", got, want)
+			}
+
+			defer resp.Body.Close()
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("ioutil.ReadAll(resp.Body): %v", err)
+			}
+
+			if !strings.Contains(string(b), tc.contains) {
+				t.Fatalf("body does not contain %q", tc.contains)
+			}
+		})
+	}
+
+	if revoked != "ab12" {
+		t.Fatalf("got revoked token %q, want %q", revoked, "ab12")
+	}
+}
@@ -11,8 +11,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"math"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/euracresearch/browser"
@@ -21,13 +24,48 @@ import (
 	client "github.com/influxdata/influxdb1-client/v2"
 )
 
-// Guarantee we implement browser.Series.
-var _ browser.Database = &DB{}
+const (
+	// DefaultChunkSize is the default number of points InfluxDB returns per
+	// chunk when streaming a series.
+	DefaultChunkSize = 10000
+
+	// DefaultWorkers is the default number of queries executed concurrently
+	// by Series.
+	DefaultWorkers = 4
+)
+
+var (
+	// Guarantee we implement browser.Series.
+	_ browser.Database = &DB{}
+
+	// Guarantee we implement browser.Streamer.
+	_ browser.Streamer = &DB{}
+)
+
+// seriesTags are the tags identifying a single series of a measurement.
+var seriesTags = []string{"station", "snipeit_location_ref", "landuse", "unit", "aggr"}
 
 // DB holds information for communicating with InfluxDB.
 type DB struct {
 	Client   client.Client
 	Database string
+
+	// ChunkSize is the number of points per chunk when streaming a series.
+	// If zero DefaultChunkSize is used.
+	ChunkSize int
+
+	// Workers is the maximum number of queries executed concurrently by
+	// Series. If zero DefaultWorkers is used.
+	Workers int
+
+	// SplitStations and SplitYears additionally split the query of each
+	// measurement by station and by year.
+	SplitStations bool
+	SplitYears    bool
+
+	// Timeout limits the duration of a single query. Streamed points are
+	// not limited. If zero only the deadline of the context applies.
+	Timeout time.Duration
 }
 
 // NewDB returns a new instance of DB.
@@ -39,91 +77,398 @@ func NewDB(client client.Client, database string) *DB {
 }
 
 // Series return a browser.TimeSeries from the given message.
+//
+// The message is split into one query per measurement, optionally also per
+// station and year, which are executed concurrently by at most Workers
+// goroutines. The results are merged in the order of the queries, so that the
+// returned time series does not depend on the order in which queries finish.
 func (db *DB) Series(ctx context.Context, m *browser.Message) (browser.TimeSeries, error) {
-	if m == nil {
+	if m == nil || len(m.Measurements) == 0 {
 		return nil, browser.ErrDataNotFound
 	}
 
-	resp, err := db.exec(seriesQuery(m))
+	messages := db.split(m)
+	responses := make([]*client.Response, len(messages))
+
+	err := db.parallel(ctx, len(messages), func(i int) error {
+		resp, err := db.exec(ctx, seriesQuery(messages[i]))
+		responses[i] = resp
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	// serie holds a series merged from the responses of all queries. Series
+	// split by year are concatenated before being folded and filled.
+	type serie struct {
+		measurement *browser.Measurement
+		points      []*browser.Point
+		counts      []int64
+	}
+
+	var (
+		order  []string
+		series = make(map[string]*serie)
+	)
+	for _, resp := range responses {
+		for _, result := range resp.Results {
+			for _, row := range result.Series {
+				key := seriesKey(row.Name, row.Tags)
+				s, ok := series[key]
+				if !ok {
+					s = &serie{
+						measurement: &browser.Measurement{
+							Label:       row.Name,
+							Station:     row.Tags["station"],
+							Landuse:     row.Tags["landuse"],
+							Aggregation: row.Tags["aggr"],
+							Unit:        row.Tags["unit"],
+						},
+					}
+					series[key] = s
+					order = append(order, key)
+				}
+
+				for _, value := range row.Values {
+					t, err := time.ParseInLocation(time.RFC3339, value[0].(string), time.UTC)
+					if err != nil {
+						log.Printf("cannot convert timestamp: %v. skipping.", err)
+						continue
+					}
+
+					f, err := toFloat64(value[1])
+					if err != nil {
+						log.Printf("cannot convert value to float: %v. skipping.", err)
+						continue
+					}
+
+					setMetadata(s.measurement, value)
+
+					// Raw queries carry the quality tag and monthly queries
+					// the number of aggregated points as last column, which
+					// is needed for folding means.
+					q := minQuality(m)
+					if m.Interval == browser.Raw && len(value) > 6 {
+						q = toQuality(value[6])
+					}
+					if m.Interval == browser.Monthly && len(value) > 6 {
+						n, _ := toInt64(value[6])
+						s.counts = append(s.counts, n)
+					}
+
+					s.points = append(s.points, &browser.Point{
+						Timestamp: t,
+						Value:     f,
+						Quality:   q,
+					})
+				}
+			}
+		}
+	}
+
 	var ts browser.TimeSeries
+	for _, key := range order {
+		s := series[key]
+
+		points := s.points
+		if m.Interval == browser.Monthly {
+			points = foldMonthly(points, s.counts, m.FunctionFor(s.measurement.Label))
+		}
+
+		s.measurement.Points = m.Interval.Fill(points, m.Start)
+		s.measurement.Level = level(points, minQuality(m))
+		ts = append(ts, s.measurement)
+	}
+
+	return ts, nil
+}
+
+// split splits the given message into one message per measurement and, if
+// enabled, per station and per year.
+func (db *DB) split(m *browser.Message) []*browser.Message {
+	stations := [][]string{m.Stations}
+	if db.SplitStations && len(m.Stations) > 1 {
+		stations = nil
+		for _, s := range m.Stations {
+			stations = append(stations, []string{s})
+		}
+	}
+
+	ranges := [][2]time.Time{{m.Start, m.End}}
+	if db.SplitYears {
+		ranges = nil
+		for y := m.Start.Year(); y <= m.End.Year(); y++ {
+			start := time.Date(y, time.January, 1, 0, 0, 0, 0, browser.Location)
+			if start.Before(m.Start) {
+				start = m.Start
+			}
+
+			end := time.Date(y, time.December, 31, 0, 0, 0, 0, browser.Location)
+			if end.After(m.End) {
+				end = m.End
+			}
+
+			ranges = append(ranges, [2]time.Time{start, end})
+		}
+	}
+
+	var messages []*browser.Message
+	for _, measure := range m.Measurements {
+		for _, s := range stations {
+			for _, r := range ranges {
+				c := *m
+				c.Measurements = []string{measure}
+				c.Stations = s
+				c.Start, c.End = r[0], r[1]
+
+				messages = append(messages, &c)
+			}
+		}
+	}
+
+	return messages
+}
+
+// parallel calls fn for each index from 0 to n-1 using at most Workers
+// goroutines. No further calls are started once ctx is done or a call
+// returned an error. It returns the first error encountered.
+func (db *DB) parallel(ctx context.Context, n int, fn func(i int) error) error {
+	workers := db.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if workers > n {
+		workers = n
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex // guards first
+		first   error
+		indexes = make(chan int)
+	)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range indexes {
+				if ctx.Err() != nil {
+					continue
+				}
+
+				if err := fn(i); err != nil {
+					mu.Lock()
+					if first == nil {
+						first = err
+					}
+					mu.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+
+loop:
+	for i := 0; i < n; i++ {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if first != nil {
+		return first
+	}
+	return ctx.Err()
+}
+
+// seriesKey returns the key identifying the series of the given measurement
+// with the given tags.
+func seriesKey(measure string, tags map[string]string) string {
+	s := []string{measure}
+	for _, t := range seriesTags {
+		s = append(s, tags[t])
+	}
+	return strings.Join(s, "\x00")
+}
+
+// Stream returns a browser.Stream from the given message. Only the metadata of
+// each series is queried upfront, the points of raw series are read in chunks
+// while iterating. Aggregated series are small and therefore read with Series.
+func (db *DB) Stream(ctx context.Context, m *browser.Message) (*browser.Stream, error) {
+	if m == nil {
+		return nil, browser.ErrDataNotFound
+	}
+
+	if m.Interval != browser.Raw {
+		ts, err := db.Series(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		return browser.NewStream(ts), nil
+	}
+
+	resp, err := db.exec(ctx, metadataQuery(m))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		ts   browser.TimeSeries
+		tags = make(map[*browser.Measurement]map[string]string)
+	)
 	for _, result := range resp.Results {
 		for _, serie := range result.Series {
-			nTime := m.Start
-
-			m := &browser.Measurement{
+			measurement := &browser.Measurement{
 				Label:       serie.Name,
 				Station:     serie.Tags["station"],
 				Landuse:     serie.Tags["landuse"],
 				Aggregation: serie.Tags["aggr"],
 				Unit:        serie.Tags["unit"],
+				Elevation:   -1,
+				Latitude:    -1.0,
+				Longitude:   -1.0,
+				Level:       minQuality(m),
+			}
+			if len(serie.Values) > 0 {
+				setMetadata(measurement, serie.Values[0])
 			}
 
-			for _, value := range serie.Values {
-				t, err := time.ParseInLocation(time.RFC3339, value[0].(string), time.UTC)
-				if err != nil {
-					log.Printf("cannot convert timestamp: %v. skipping.", err)
-					continue
-				}
+			tags[measurement] = serie.Tags
+			ts = append(ts, measurement)
+		}
+	}
 
-				// Fill missing timestamps with NaN values, to return a time
-				// series with a continuous time range. The interval of raw data
-				// in LTER is 15 minutes. See:
-				// https://github.com/euracresearch/browser/issues/10
-				for !t.Equal(nTime) {
-					m.Points = append(m.Points, &browser.Point{
-						Timestamp: nTime,
-						Value:     math.NaN(),
-					})
-					nTime = nTime.Add(browser.DefaultCollectionInterval)
-				}
-				nTime = t.Add(browser.DefaultCollectionInterval)
+	return &browser.Stream{
+		TimeSeries: ts,
+		Points: func(measurement *browser.Measurement) browser.PointIterator {
+			it := &chunkIterator{
+				ctx:   ctx,
+				db:    db,
+				query: pointsQuery(m, measurement.Label, tags[measurement]),
+			}
+			return m.Interval.FillIterator(it, m.Start)
+		},
+	}, nil
+}
 
-				f, err := value[1].(json.Number).Float64()
-				if err != nil {
-					log.Printf("cannot convert value to float: %v. skipping.", err)
-					continue
-				}
+// setMetadata sets the station metadata of the given measurement from a row
+// of values holding elevation, latitude, longitude and depth in the columns 2
+// to 5.
+func setMetadata(measurement *browser.Measurement, value []interface{}) {
+	var err error
 
-				// Add additional metadata only on the first run.
-				m.Elevation, err = value[2].(json.Number).Int64()
-				if err != nil {
-					m.Elevation = -1
-				}
+	measurement.Elevation, err = toInt64(value[2])
+	if err != nil {
+		measurement.Elevation = -1
+	}
 
-				m.Latitude, err = value[3].(json.Number).Float64()
-				if err != nil {
-					m.Latitude = -1.0
-				}
+	measurement.Latitude, err = toFloat64(value[3])
+	if err != nil {
+		measurement.Latitude = -1.0
+	}
 
-				m.Longitude, err = value[4].(json.Number).Float64()
-				if err != nil {
-					m.Longitude = -1.0
-				}
+	measurement.Longitude, err = toFloat64(value[4])
+	if err != nil {
+		measurement.Longitude = -1.0
+	}
 
-				if value[5] == nil {
-					m.Depth = 0
-				} else {
-					m.Depth, err = value[5].(json.Number).Int64()
-					if err != nil {
-						m.Depth = -1
-					}
-				}
-				p := &browser.Point{
-					Timestamp: t,
-					Value:     f,
-				}
-				m.Points = append(m.Points, p)
+	if value[5] == nil {
+		measurement.Depth = 0
+	} else {
+		measurement.Depth, err = toInt64(value[5])
+		if err != nil {
+			measurement.Depth = -1
+		}
+	}
+}
+
+// foldMonthly folds daily aggregated points to monthly points using the given
+// function. InfluxDB 1.x cannot group by calendar months, therefore monthly
+// data is queried in daily windows. counts holds the number of raw points of
+// each daily point and is used for weighting means.
+func foldMonthly(points []*browser.Point, counts []int64, fn browser.AggregateFunc) []*browser.Point {
+	var (
+		folded []*browser.Point
+		cur    *browser.Point
+		n      int64
+	)
+
+	for i, p := range points {
+		var c int64 = 1
+		if i < len(counts) {
+			c = counts[i]
+		}
+
+		month := browser.Monthly.Truncate(p.Timestamp)
+		if cur == nil || !cur.Timestamp.Equal(month) {
+			if cur != nil && fn == browser.Mean {
+				cur.Value /= float64(n)
 			}
 
-			ts = append(ts, m)
+			cur = &browser.Point{Timestamp: month, Value: p.Value, Quality: p.Quality}
+			if fn == browser.Mean {
+				cur.Value *= float64(c)
+			}
+			n = c
+
+			folded = append(folded, cur)
+			continue
+		}
+
+		switch fn {
+		case browser.Min:
+			cur.Value = math.Min(cur.Value, p.Value)
+		case browser.Max:
+			cur.Value = math.Max(cur.Value, p.Value)
+		case browser.Mean:
+			cur.Value += p.Value * float64(c)
+		default:
+			cur.Value += p.Value
 		}
+		n += c
 	}
 
-	return ts, nil
+	if cur != nil && fn == browser.Mean {
+		cur.Value /= float64(n)
+	}
+
+	return folded
+}
+
+// groupByTime returns the InfluxQL time interval for the given interval.
+// Monthly data is queried in daily windows, since InfluxDB 1.x does not
+// support calendar months.
+func groupByTime(i browser.Interval) string {
+	if i == browser.Hourly {
+		return "time(1h)"
+	}
+	return "time(1d)"
+}
+
+func toFloat64(v interface{}) (float64, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("unexpected value %v", v)
+	}
+	return n.Float64()
+}
+
+func toInt64(v interface{}) (int64, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("unexpected value %v", v)
+	}
+	return n.Int64()
 }
 
 func seriesQuery(m *browser.Message) ql.Querier {
@@ -133,23 +478,33 @@ func seriesQuery(m *browser.Message) ql.Querier {
 			args []interface{}
 		)
 
-		// Data in InfluxDB is UTC but LTER data is UTC+1 therefor we need to adapt
-		// start and end times. It will shift the start time to -1 hour and will set
-		// the end time to 22:59:59 in order to capture a full day.
-		start := m.Start.Add(-1 * time.Hour)
-		end := time.Date(m.End.Year(), m.End.Month(), m.End.Day(), 22, 59, 59, 59, time.UTC)
+		start, end := timeRange(m)
 
 		for _, measure := range m.Measurements {
-			columns := []string{measure, "altitude as elevation", "latitude", "longitude", "depth"}
+			columns := []string{measure, "altitude as elevation", "latitude", "longitude", "depth", "quality"}
+			group := "station,snipeit_location_ref,landuse,unit,aggr"
+
+			if m.Interval != browser.Raw {
+				columns = []string{
+					fmt.Sprintf("%s(%s) as %s", m.FunctionFor(measure), measure, measure),
+					"last(altitude) as elevation",
+					"last(latitude) as latitude",
+					"last(longitude) as longitude",
+					"last(depth) as depth",
+				}
+				if m.Interval == browser.Monthly {
+					columns = append(columns, fmt.Sprintf("count(%s) as n", measure))
+				}
+				group = groupByTime(m.Interval) + "," + group
+			}
 
 			sb := ql.Select(columns...)
 			sb.From(measure)
-			sb.Where(
-				ql.Eq(ql.Or(), "snipeit_location_ref", m.Stations...),
-				ql.And(),
-				ql.TimeRange(start, end),
-			)
-			sb.GroupBy("station,snipeit_location_ref,landuse,unit,aggr")
+			sb.Where(where(m, start, end)...)
+			sb.GroupBy(group)
+			if m.Interval != browser.Raw {
+				sb.Fill("none")
+			}
 			sb.OrderBy("time").ASC().TZ("Etc/GMT-1")
 
 			q, arg := sb.Query()
@@ -163,21 +518,32 @@ func seriesQuery(m *browser.Message) ql.Querier {
 	})
 }
 
+// Query returns the InfluxQL statement for the given message. If the message
+// requests an aggregation interval, data is grouped by time and by station
+// using the aggregation function of each measurement. Monthly aggregations are
+// expressed as daily windows, see groupByTime.
 func (db *DB) Query(ctx context.Context, m *browser.Message) *browser.Stmt {
 	c := []string{"station", "landuse", "altitude as elevation", "latitude", "longitude"}
 	c = append(c, m.Measurements...)
 
-	// Data in InfluxDB is UTC but LTER data is UTC+1 therefor we need to adapt
-	// start and end times. It will shift the start time to -1 hour and will set
-	// the end time to 22:59:59 in order to capture a full day.
-	start := m.Start.Add(-1 * time.Hour)
-	end := time.Date(m.End.Year(), m.End.Month(), m.End.Day(), 22, 59, 59, 59, time.UTC)
+	start, end := timeRange(m)
 
-	q, _ := ql.Select(c...).From(m.Measurements...).Where(
+	if m.Interval != browser.Raw {
+		c = []string{"last(altitude) as elevation", "last(latitude) as latitude", "last(longitude) as longitude"}
+		for _, measure := range m.Measurements {
+			c = append(c, fmt.Sprintf("%s(%s) as %s", m.FunctionFor(measure), measure, measure))
+		}
+	}
+
+	sb := ql.Select(c...).From(m.Measurements...).Where(
 		ql.Eq(ql.Or(), "snipeit_location_ref", m.Stations...),
 		ql.And(),
 		ql.TimeRange(start, end),
-	).OrderBy("time").ASC().TZ("Etc/GMT-1").Query()
+	)
+	if m.Interval != browser.Raw {
+		sb.GroupBy(groupByTime(m.Interval) + ",station,landuse").Fill("none")
+	}
+	q, _ := sb.OrderBy("time").ASC().TZ("Etc/GMT-1").Query()
 
 	return &browser.Stmt{
 		Query:    q,
@@ -185,11 +551,18 @@ func (db *DB) Query(ctx context.Context, m *browser.Message) *browser.Stmt {
 	}
 }
 
-// exec executes the given ql query and returns a response.
-func (db *DB) exec(q ql.Querier) (*client.Response, error) {
+// exec executes the given ql query and returns a response. The query is
+// aborted as soon as ctx is done or Timeout is exceeded.
+func (db *DB) exec(ctx context.Context, q ql.Querier) (*client.Response, error) {
 	query, _ := q.Query()
 
-	resp, err := db.Client.Query(client.NewQuery(query, db.Database, ""))
+	if db.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, db.Timeout)
+		defer cancel()
+	}
+
+	resp, err := QueryContext(ctx, db.Client, client.NewQuery(query, db.Database, ""))
 	if err != nil {
 		return nil, err
 	}
@@ -199,3 +572,239 @@ func (db *DB) exec(q ql.Querier) (*client.Response, error) {
 
 	return resp, nil
 }
+
+// timeRange returns the time range in UTC of the given message. Data in
+// InfluxDB is UTC but LTER data is UTC+1 therefor we need to adapt start and
+// end times. It will shift the start time to -1 hour and will set the end time
+// to 22:59:59 in order to capture a full day.
+func timeRange(m *browser.Message) (start, end time.Time) {
+	start = m.Start.Add(-1 * time.Hour)
+	end = time.Date(m.End.Year(), m.End.Month(), m.End.Day(), 22, 59, 59, 59, time.UTC)
+	return start, end
+}
+
+// metadataQuery returns the query for the last metadata of each series of the
+// given message. The columns are the same as for raw series.
+func metadataQuery(m *browser.Message) ql.Querier {
+	return ql.QueryFunc(func() (string, []interface{}) {
+		var buf bytes.Buffer
+
+		start, end := timeRange(m)
+		for _, measure := range m.Measurements {
+			sb := ql.Select(
+				fmt.Sprintf("last(%s) as %s", measure, measure),
+				"last(altitude) as elevation",
+				"last(latitude) as latitude",
+				"last(longitude) as longitude",
+				"last(depth) as depth",
+			)
+			sb.From(measure)
+			sb.Where(where(m, start, end)...)
+			sb.GroupBy(strings.Join(seriesTags, ","))
+
+			q, _ := sb.Query()
+			buf.WriteString(q)
+			buf.WriteString(";")
+		}
+
+		return buf.String(), nil
+	})
+}
+
+// pointsQuery returns the query for the raw points of the series of the given
+// measurement identified by tags.
+func pointsQuery(m *browser.Message, measure string, tags map[string]string) ql.Querier {
+	var where []ql.Querier
+	for _, t := range seriesTags {
+		if v := tags[t]; v != "" {
+			where = append(where, ql.And(), ql.Eq(ql.And(), t, v))
+		}
+	}
+
+	start, end := timeRange(m)
+	where = append(where, ql.And(), ql.TimeRange(start, end))
+	if q := qualityFilter(m); q != nil {
+		where = append(where, ql.And(), q)
+	}
+
+	return ql.Select(measure, "quality").From(measure).Where(where...).OrderBy("time").ASC().TZ("Etc/GMT-1")
+}
+
+// where returns the conditions selecting the points of the stations of the
+// given message between start and end having at least the requested quality.
+func where(m *browser.Message, start, end time.Time) []ql.Querier {
+	w := []ql.Querier{
+		ql.Eq(ql.Or(), "snipeit_location_ref", m.Stations...),
+		ql.And(),
+		ql.TimeRange(start, end),
+	}
+	if q := qualityFilter(m); q != nil {
+		w = append(w, ql.And(), q)
+	}
+	return w
+}
+
+// qualityFilter returns the condition selecting points of at least the
+// minimum quality of the given message or nil if no minimum quality is
+// requested, which is the case for browser.QualityRaw and below. The quality
+// of a point is stored in the quality tag, points without it are raw points.
+func qualityFilter(m *browser.Message) ql.Querier {
+	if m.Quality <= browser.QualityRaw {
+		return nil
+	}
+
+	return ql.QueryFunc(func() (string, []interface{}) {
+		var c []string
+		for q := m.Quality; q <= browser.QualityValidated; q++ {
+			c = append(c, fmt.Sprintf("quality='%s'", q))
+		}
+		return "(" + strings.Join(c, " OR ") + ")", nil
+	})
+}
+
+// minQuality returns the lowest quality of the points returned for the given
+// message.
+func minQuality(m *browser.Message) browser.Quality {
+	if m.Quality < browser.QualityRaw {
+		return browser.QualityBad
+	}
+	return m.Quality
+}
+
+// level returns the processing level of a time series with the given points,
+// which is min if there are no points.
+func level(points []*browser.Point, min browser.Quality) browser.Quality {
+	if len(points) == 0 {
+		return min
+	}
+
+	l := browser.QualityValidated
+	for _, p := range points {
+		if p.Quality < l {
+			l = p.Quality
+		}
+	}
+	return l
+}
+
+// toQuality returns the quality of the given value of the quality tag.
+func toQuality(v interface{}) browser.Quality {
+	s, _ := v.(string)
+	q, err := browser.ParseQuality(s)
+	if err != nil {
+		log.Printf("unknown quality %q, using %s", s, browser.QualityRaw)
+	}
+	return q
+}
+
+// execChunked executes the given ql query and returns a chunked response,
+// which is closed as soon as ctx is done until stop is called.
+func (db *DB) execChunked(ctx context.Context, q ql.Querier) (resp *client.ChunkedResponse, stop func(), err error) {
+	query, _ := q.Query()
+
+	size := db.ChunkSize
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+
+	return queryAsChunk(ctx, db.Client, client.Query{
+		Command:   query,
+		Database:  db.Database,
+		Chunked:   true,
+		ChunkSize: size,
+	})
+}
+
+// chunkIterator is a browser.PointIterator reading the points of a single
+// series chunk by chunk. The query is executed on the first call to Next.
+type chunkIterator struct {
+	ctx   context.Context
+	db    *DB
+	query ql.Querier
+
+	resp   *client.ChunkedResponse
+	stop   func()
+	values [][]interface{} // pending values of the current chunk
+	cur    *browser.Point
+	err    error
+	done   bool
+}
+
+func (it *chunkIterator) Next() bool {
+	if it.err != nil || it.done {
+		return false
+	}
+
+	if it.resp == nil {
+		it.resp, it.stop, it.err = it.db.execChunked(it.ctx, it.query)
+		if it.err != nil {
+			return false
+		}
+	}
+
+	for {
+		for len(it.values) > 0 {
+			value := it.values[0]
+			it.values = it.values[1:]
+
+			t, err := time.ParseInLocation(time.RFC3339, value[0].(string), time.UTC)
+			if err != nil {
+				log.Printf("cannot convert timestamp: %v. skipping.", err)
+				continue
+			}
+
+			f, err := toFloat64(value[1])
+			if err != nil {
+				log.Printf("cannot convert value to float: %v. skipping.", err)
+				continue
+			}
+
+			it.cur = &browser.Point{
+				Timestamp: t,
+				Value:     f,
+			}
+			if len(value) > 2 {
+				it.cur.Quality = toQuality(value[2])
+			}
+			return true
+		}
+
+		if it.err = it.ctx.Err(); it.err != nil {
+			return false
+		}
+
+		resp, err := it.resp.NextResponse()
+		if err == io.EOF {
+			it.done = true
+			return false
+		}
+		if err != nil {
+			// Reading fails if the response was closed on cancellation.
+			if it.err = it.ctx.Err(); it.err == nil {
+				it.err = err
+			}
+			return false
+		}
+		if resp.Error() != nil {
+			it.err = fmt.Errorf("%v", resp.Error())
+			return false
+		}
+
+		for _, result := range resp.Results {
+			for _, serie := range result.Series {
+				it.values = append(it.values, serie.Values...)
+			}
+		}
+	}
+}
+
+func (it *chunkIterator) Point() *browser.Point { return it.cur }
+func (it *chunkIterator) Err() error            { return it.err }
+
+func (it *chunkIterator) Close() error {
+	if it.resp == nil {
+		return nil
+	}
+	it.stop()
+	return it.resp.Close()
+}
@@ -7,9 +7,13 @@ package influx
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,6 +21,7 @@ import (
 	"github.com/euracresearch/browser/internal/mock"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/influxdata/influxdb1-client/models"
 	client "github.com/influxdata/influxdb1-client/v2"
 )
 
@@ -78,6 +83,33 @@ func TestQuery(t *testing.T) {
 				Database: dbName,
 			},
 		},
+		"hourly": {
+			&browser.Message{
+				Measurements: []string{"A_avg", "B_tot"},
+				Stations:     []string{"s1"},
+				Start:        time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				Interval:     browser.Hourly,
+			},
+			&browser.Stmt{
+				Query:    "SELECT last(altitude) as elevation, last(latitude) as latitude, last(longitude) as longitude, mean(A_avg) as A_avg, sum(B_tot) as B_tot FROM A_avg, B_tot WHERE snipeit_location_ref='s1' AND time >= '2019-12-31T23:00:00Z' AND time <= '2020-01-01T22:59:59Z' GROUP BY time(1h),station,landuse fill(none) ORDER BY time ASC TZ('Etc/GMT-1')",
+				Database: dbName,
+			},
+		},
+		"monthly_with_function": {
+			&browser.Message{
+				Measurements: []string{"A_avg"},
+				Stations:     []string{"s1"},
+				Start:        time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				Interval:     browser.Monthly,
+				Function:     browser.Max,
+			},
+			&browser.Stmt{
+				Query:    "SELECT last(altitude) as elevation, last(latitude) as latitude, last(longitude) as longitude, max(A_avg) as A_avg FROM A_avg WHERE snipeit_location_ref='s1' AND time >= '2019-12-31T23:00:00Z' AND time <= '2020-01-01T22:59:59Z' GROUP BY time(1d),station,landuse fill(none) ORDER BY time ASC TZ('Etc/GMT-1')",
+				Database: dbName,
+			},
+		},
 	}
 
 	for name, tc := range testCases {
@@ -239,6 +271,69 @@ func TestSeries(t *testing.T) {
 				},
 			},
 		},
+		"monthly": {
+			in: &browser.Message{
+				Measurements: []string{"air_t_avg", "precip_rt_nrt_tot"},
+				Stations:     []string{"39"},
+				Start:        time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, 3, 31, 0, 0, 0, 0, browser.Location),
+				Interval:     browser.Monthly,
+			},
+			queryFn: queryTestHelper(t, "daily.json"),
+			want: browser.TimeSeries{
+				&browser.Measurement{
+					Label:       "air_t_avg",
+					Station:     "b1",
+					Aggregation: "avg",
+					Landuse:     "me",
+					Unit:        "deg c",
+					Elevation:   990,
+					Latitude:    46.6612188656,
+					Longitude:   10.5902491243,
+					Points: []*browser.Point{
+						testPoint(t, "2020-01-01T00:00:00+01:00", 2),
+						testPoint(t, "2020-02-01T00:00:00+01:00", math.NaN()),
+						testPoint(t, "2020-03-01T00:00:00+01:00", 2),
+					},
+				},
+				&browser.Measurement{
+					Label:       "precip_rt_nrt_tot",
+					Station:     "b1",
+					Aggregation: "tot",
+					Landuse:     "me",
+					Unit:        "mm",
+					Elevation:   990,
+					Latitude:    46.6612188656,
+					Longitude:   10.5902491243,
+					Points: []*browser.Point{
+						testPoint(t, "2020-01-01T00:00:00+01:00", 1),
+						testPoint(t, "2020-02-01T00:00:00+01:00", 5),
+					},
+				},
+			},
+		},
+		"quality": {
+			in:      testMessage,
+			queryFn: queryTestHelper(t, "quality.json"),
+			want: browser.TimeSeries{
+				&browser.Measurement{
+					Label:       "air_t_avg",
+					Station:     "b1",
+					Aggregation: "avg",
+					Landuse:     "me",
+					Unit:        "deg c",
+					Elevation:   990,
+					Latitude:    46.6612188656,
+					Longitude:   10.5902491243,
+					Level:       browser.QualityRaw,
+					Points: []*browser.Point{
+						testQualityPoint(t, "2020-05-04T00:00:00+01:00", 9.1, browser.QualityValidated),
+						testQualityPoint(t, "2020-05-04T00:15:00+01:00", 9.2, browser.QualityRaw),
+						testQualityPoint(t, "2020-05-04T00:30:00+01:00", 9.3, browser.QualityChecked),
+					},
+				},
+			},
+		},
 	}
 
 	for name, tc := range testCases {
@@ -256,6 +351,278 @@ func TestSeries(t *testing.T) {
 	}
 }
 
+func TestSplit(t *testing.T) {
+	m := &browser.Message{
+		Measurements: []string{"a", "b"},
+		Stations:     []string{"s1", "s2"},
+		Start:        time.Date(2019, 6, 1, 0, 0, 0, 0, browser.Location),
+		End:          time.Date(2020, 2, 1, 0, 0, 0, 0, browser.Location),
+	}
+
+	testCases := map[string]struct {
+		db   *DB
+		want []string
+	}{
+		"measurements": {
+			&DB{},
+			[]string{
+				"a [s1 s2] 2019-06-01 2020-02-01",
+				"b [s1 s2] 2019-06-01 2020-02-01",
+			},
+		},
+		"stations": {
+			&DB{SplitStations: true},
+			[]string{
+				"a [s1] 2019-06-01 2020-02-01",
+				"a [s2] 2019-06-01 2020-02-01",
+				"b [s1] 2019-06-01 2020-02-01",
+				"b [s2] 2019-06-01 2020-02-01",
+			},
+		},
+		"years": {
+			&DB{SplitYears: true},
+			[]string{
+				"a [s1 s2] 2019-06-01 2019-12-31",
+				"a [s1 s2] 2020-01-01 2020-02-01",
+				"b [s1 s2] 2019-06-01 2019-12-31",
+				"b [s1 s2] 2020-01-01 2020-02-01",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			for _, c := range tc.db.split(m) {
+				got = append(got, fmt.Sprintf("%s %v %s %s", c.Measurements[0], c.Stations, c.Start.Format("2006-01-02"), c.End.Format("2006-01-02")))
+			}
+
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSeriesParallel(t *testing.T) {
+	// Each query returns a single point at the start of its time range, the
+	// queries of the first year are answered last.
+	c := &mock.InfluxClient{
+		QueryFn: func(q client.Query) (*client.Response, error) {
+			measure := regexp.MustCompile(` FROM (\w+) `).FindStringSubmatch(q.Command)[1]
+
+			ts := "2020-01-01T00:00:00+01:00"
+			if strings.Contains(q.Command, "time >= '2019-12-30T23:00:00Z'") {
+				time.Sleep(10 * time.Millisecond)
+				ts = "2019-12-31T00:00:00+01:00"
+			}
+
+			var resp *client.Response
+			dec := json.NewDecoder(strings.NewReader(fmt.Sprintf(`{"results":[{"series":[{"name":%q,"tags":{"station":"s1"},"columns":["time","v","elevation","latitude","longitude","depth"],"values":[[%q,1,1000,46.6,10.5,null]]}]}]}`, measure, ts)))
+			dec.UseNumber()
+			return resp, dec.Decode(&resp)
+		},
+	}
+	db := &DB{Client: c, Database: "testdb", Workers: 3, SplitYears: true}
+
+	m := &browser.Message{
+		Measurements: []string{"b", "a"},
+		Stations:     []string{"1"},
+		Start:        time.Date(2019, 12, 31, 0, 0, 0, 0, browser.Location),
+		End:          time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+		Interval:     browser.Daily,
+	}
+
+	ts, err := db.Series(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, measurement := range ts {
+		for _, p := range measurement.Points {
+			got = append(got, measurement.Label+" "+p.Timestamp.Format("2006-01-02"))
+		}
+	}
+
+	want := []string{"b 2019-12-31", "b 2020-01-01", "a 2019-12-31", "a 2020-01-01"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSeriesError(t *testing.T) {
+	m := &browser.Message{
+		Measurements: []string{"a", "b", "c"},
+		Start:        time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+		End:          time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+	}
+
+	errQuery := errors.New("query failed")
+	c := &mock.InfluxClient{
+		QueryFn: func(q client.Query) (*client.Response, error) {
+			return nil, errQuery
+		},
+	}
+	db := &DB{Client: c, Database: "testdb", Workers: 2}
+
+	if _, err := db.Series(context.Background(), m); err != errQuery {
+		t.Fatalf("got error %v, want %v", err, errQuery)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	c.QueryFn = func(q client.Query) (*client.Response, error) {
+		t.Error("no query expected after cancellation")
+		return &client.Response{}, nil
+	}
+	if _, err := db.Series(ctx, m); err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSeriesQuery(t *testing.T) {
+	testCases := map[string]struct {
+		in   *browser.Message
+		want string
+	}{
+		"raw": {
+			&browser.Message{
+				Measurements: []string{"a_avg"},
+				Stations:     []string{"s1"},
+				Start:        time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+			},
+			"SELECT a_avg, altitude as elevation, latitude, longitude, depth, quality FROM a_avg WHERE snipeit_location_ref='s1' AND time >= '2019-12-31T23:00:00Z' AND time <= '2020-01-01T22:59:59Z' GROUP BY station,snipeit_location_ref,landuse,unit,aggr ORDER BY time ASC TZ('Etc/GMT-1');",
+		},
+		"checked": {
+			&browser.Message{
+				Measurements: []string{"a_avg"},
+				Stations:     []string{"s1"},
+				Start:        time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				Quality:      browser.QualityChecked,
+			},
+			"SELECT a_avg, altitude as elevation, latitude, longitude, depth, quality FROM a_avg WHERE snipeit_location_ref='s1' AND time >= '2019-12-31T23:00:00Z' AND time <= '2020-01-01T22:59:59Z' AND (quality='checked' OR quality='validated') GROUP BY station,snipeit_location_ref,landuse,unit,aggr ORDER BY time ASC TZ('Etc/GMT-1');",
+		},
+		"daily": {
+			&browser.Message{
+				Measurements: []string{"a_avg", "b_tot"},
+				Stations:     []string{"s1"},
+				Start:        time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				Interval:     browser.Daily,
+			},
+			"SELECT mean(a_avg) as a_avg, last(altitude) as elevation, last(latitude) as latitude, last(longitude) as longitude, last(depth) as depth FROM a_avg WHERE snipeit_location_ref='s1' AND time >= '2019-12-31T23:00:00Z' AND time <= '2020-01-01T22:59:59Z' GROUP BY time(1d),station,snipeit_location_ref,landuse,unit,aggr fill(none) ORDER BY time ASC TZ('Etc/GMT-1');" +
+				"SELECT sum(b_tot) as b_tot, last(altitude) as elevation, last(latitude) as latitude, last(longitude) as longitude, last(depth) as depth FROM b_tot WHERE snipeit_location_ref='s1' AND time >= '2019-12-31T23:00:00Z' AND time <= '2020-01-01T22:59:59Z' GROUP BY time(1d),station,snipeit_location_ref,landuse,unit,aggr fill(none) ORDER BY time ASC TZ('Etc/GMT-1');",
+		},
+		"monthly": {
+			&browser.Message{
+				Measurements: []string{"a_avg"},
+				Stations:     []string{"s1"},
+				Start:        time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				Interval:     browser.Monthly,
+			},
+			"SELECT mean(a_avg) as a_avg, last(altitude) as elevation, last(latitude) as latitude, last(longitude) as longitude, last(depth) as depth, count(a_avg) as n FROM a_avg WHERE snipeit_location_ref='s1' AND time >= '2019-12-31T23:00:00Z' AND time <= '2020-01-01T22:59:59Z' GROUP BY time(1d),station,snipeit_location_ref,landuse,unit,aggr fill(none) ORDER BY time ASC TZ('Etc/GMT-1');",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, _ := seriesQuery(tc.in).Query()
+
+			diff := cmp.Diff(tc.want, got)
+			if diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestStream(t *testing.T) {
+	const (
+		metadata = `{"results":[{"statement_id":0,"series":[{"name":"air_t_avg","tags":{"aggr":"avg","landuse":"me","snipeit_location_ref":"39","station":"b1","unit":"deg c"},"columns":["time","air_t_avg","elevation","latitude","longitude","depth"],"values":[["1970-01-01T01:00:00+01:00",9.02,990,46.6612188656,10.5902491243,null]]}]}]}`
+
+		// Points are returned in two chunks, the first one is partial.
+		chunks = `{"results":[{"statement_id":0,"series":[{"name":"air_t_avg","columns":["time","air_t_avg"],"values":[["2020-05-04T00:15:00+01:00",10.05],["2020-05-04T00:30:00+01:00",9.46]],"partial":true}],"partial":true}]}
+{"results":[{"statement_id":0,"series":[{"name":"air_t_avg","columns":["time","air_t_avg"],"values":[["2020-05-04T01:00:00+01:00",9.02]]}]}]}
+`
+	)
+
+	c := &mock.InfluxClient{
+		QueryAsChunkFn: func(q client.Query) (*client.ChunkedResponse, error) {
+			if strings.HasPrefix(q.Command, "SELECT last(") {
+				return client.NewChunkedResponse(strings.NewReader(metadata)), nil
+			}
+
+			want := "SELECT air_t_avg, quality FROM air_t_avg WHERE station='b1' AND snipeit_location_ref='39' AND landuse='me' AND unit='deg c' AND aggr='avg' AND time >= '2020-05-03T23:00:00Z' AND time <= '2020-05-04T22:59:59Z' ORDER BY time ASC TZ('Etc/GMT-1')"
+			if diff := cmp.Diff(want, q.Command); diff != "" {
+				return nil, fmt.Errorf("query mismatch (-want +got):\n%s", diff)
+			}
+			if q.ChunkSize != DefaultChunkSize {
+				return nil, fmt.Errorf("got chunk size %d, want %d", q.ChunkSize, DefaultChunkSize)
+			}
+			return client.NewChunkedResponse(strings.NewReader(chunks)), nil
+		},
+	}
+	db := &DB{Client: c, Database: "testdb"}
+
+	m := &browser.Message{
+		Measurements: []string{"air_t_avg"},
+		Stations:     []string{"39"},
+		Start:        time.Date(2020, 5, 4, 0, 0, 0, 0, browser.Location),
+		End:          time.Date(2020, 5, 4, 0, 0, 0, 0, browser.Location),
+	}
+
+	s, err := db.Stream(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := browser.TimeSeries{
+		&browser.Measurement{
+			Label:       "air_t_avg",
+			Station:     "b1",
+			Aggregation: "avg",
+			Landuse:     "me",
+			Unit:        "deg c",
+			Elevation:   990,
+			Latitude:    46.6612188656,
+			Longitude:   10.5902491243,
+		},
+	}
+	if diff := cmp.Diff(want, s.TimeSeries); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+
+	it := s.Points(s.TimeSeries[0])
+	defer it.Close()
+
+	var got []*browser.Point
+	for it.Next() {
+		got = append(got, it.Point())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	wantPoints := []*browser.Point{
+		testPoint(t, "2020-05-04T00:00:00+01:00", math.NaN()),
+		testPoint(t, "2020-05-04T00:15:00+01:00", 10.05),
+		testPoint(t, "2020-05-04T00:30:00+01:00", 9.46),
+		testPoint(t, "2020-05-04T00:45:00+01:00", math.NaN()),
+		testPoint(t, "2020-05-04T01:00:00+01:00", 9.02),
+	}
+	diff := cmp.Diff(wantPoints, got, cmp.Comparer(func(x, y float64) bool {
+		return (math.IsNaN(x) && math.IsNaN(y)) || x == y
+	}), cmp.Comparer(func(x, y time.Time) bool { return x.Equal(y) }))
+	if diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
 func testPoint(t *testing.T, s string, value float64) *browser.Point {
 	t.Helper()
 
@@ -269,9 +636,13 @@ func testPoint(t *testing.T, s string, value float64) *browser.Point {
 	}
 }
 
+// queryTestHelper returns a query function responding with the series of the
+// given JSON file which belong to the measurement of the query.
 func queryTestHelper(t *testing.T, filename string) func(q client.Query) (*client.Response, error) {
 	t.Helper()
 
+	from := regexp.MustCompile(` FROM (\w+) `)
+
 	return func(q client.Query) (*client.Response, error) {
 		f, err := os.Open(filepath.Join("testdata", filename))
 		if err != nil {
@@ -287,6 +658,29 @@ func queryTestHelper(t *testing.T, filename string) func(q client.Query) (*clien
 			return nil, err
 		}
 
+		match := from.FindStringSubmatch(q.Command)
+		if match == nil {
+			return nil, fmt.Errorf("unexpected query %q", q.Command)
+		}
+
+		for i, result := range resp.Results {
+			var series []models.Row
+			for _, serie := range result.Series {
+				if serie.Name == match[1] {
+					series = append(series, serie)
+				}
+			}
+			resp.Results[i].Series = series
+		}
+
 		return resp, nil
 	}
 }
+
+func testQualityPoint(t *testing.T, s string, value float64, q browser.Quality) *browser.Point {
+	t.Helper()
+
+	p := testPoint(t, s, value)
+	p.Quality = q
+	return p
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package influx
+
+import (
+	"context"
+	"io"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+// QueryContext executes the given query like client.Client.Query, but returns
+// as soon as ctx is done.
+//
+// The query is executed as chunked query and the response is closed on
+// cancellation, which drops the connection to InfluxDB and aborts the query
+// on the server. Series spanning several chunks are joined, but statements
+// spanning several chunks may be returned as several results.
+func QueryContext(ctx context.Context, c client.Client, q client.Query) (*client.Response, error) {
+	q.Chunked = true
+
+	cr, stop, err := queryAsChunk(ctx, c, q)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	defer cr.Close()
+
+	resp := &client.Response{}
+	for {
+		chunk, err := cr.NextResponse()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Reading fails if the response was closed on cancellation.
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+
+		merge(resp, chunk)
+	}
+
+	return resp, nil
+}
+
+// queryAsChunk executes the given chunked query and returns its response. The
+// response is closed as soon as ctx is done, until the returned stop function
+// is called.
+func queryAsChunk(ctx context.Context, c client.Client, q client.Query) (*client.ChunkedResponse, func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	type result struct {
+		resp *client.ChunkedResponse
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := c.QueryAsChunk(q)
+		ch <- result{resp, err}
+	}()
+
+	var r result
+	select {
+	case r = <-ch:
+	case <-ctx.Done():
+		// Close the response as soon as the server answers.
+		go func() {
+			if r := <-ch; r.resp != nil {
+				r.resp.Close()
+			}
+		}()
+		return nil, nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.resp.Close()
+		case <-done:
+		}
+	}()
+
+	return r.resp, func() { close(done) }, nil
+}
+
+// merge appends the results of the given chunk to resp. A partial series at
+// the end of resp is continued by the first series of the chunk.
+func merge(resp, chunk *client.Response) {
+	if chunk.Err != "" {
+		resp.Err = chunk.Err
+	}
+
+	for _, result := range chunk.Results {
+		n := len(resp.Results)
+		if n == 0 || len(result.Series) == 0 {
+			resp.Results = append(resp.Results, result)
+			continue
+		}
+
+		last := &resp.Results[n-1]
+		if len(last.Series) == 0 || !last.Series[len(last.Series)-1].Partial {
+			resp.Results = append(resp.Results, result)
+			continue
+		}
+
+		row := &last.Series[len(last.Series)-1]
+		row.Values = append(row.Values, result.Series[0].Values...)
+		row.Partial = result.Series[0].Partial
+
+		last.Series = append(last.Series, result.Series[1:]...)
+		last.Messages = append(last.Messages, result.Messages...)
+		if result.Err != "" {
+			last.Err = result.Err
+		}
+	}
+}
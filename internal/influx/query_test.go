@@ -0,0 +1,69 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package influx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/euracresearch/browser/internal/mock"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+func TestQueryContext(t *testing.T) {
+	const chunks = `{"results":[{"statement_id":0,"series":[{"name":"a","columns":["time","a"],"values":[[1,1],[2,2]],"partial":true}],"partial":true}]}
+{"results":[{"statement_id":0,"series":[{"name":"a","columns":["time","a"],"values":[[3,3]]},{"name":"b","columns":["time","b"],"values":[[1,1]]}]}]}
+`
+
+	c := &mock.InfluxClient{
+		QueryAsChunkFn: func(q client.Query) (*client.ChunkedResponse, error) {
+			return client.NewChunkedResponse(strings.NewReader(chunks)), nil
+		},
+	}
+
+	resp, err := QueryContext(context.Background(), c, client.NewQuery("SELECT * FROM a, b", "testdb", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, result := range resp.Results {
+		for _, row := range result.Series {
+			got = append(got, fmt.Sprintf("%s:%d", row.Name, len(row.Values)))
+		}
+	}
+	if want := "a:3 b:1"; strings.Join(got, " ") != want {
+		t.Fatalf("got series %v, want %s", got, want)
+	}
+}
+
+func TestQueryContextCancel(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	c := &mock.InfluxClient{
+		QueryAsChunkFn: func(q client.Query) (*client.ChunkedResponse, error) {
+			return client.NewChunkedResponse(pr), nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// Send the first chunk and cancel while the query is running.
+		fmt.Fprintln(pw, `{"results":[{"series":[{"name":"a","values":[[1,1]],"partial":true}]}]}`)
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := QueryContext(ctx, c, client.NewQuery("SELECT * FROM a", "testdb", ""))
+	if err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package influx
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/euracresearch/browser"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+// Guarantee we implement browser.TokenService.
+var _ browser.TokenService = &TokenService{}
+
+// TokenService represents a service for managing personal API tokens stored in
+// InfluxDB. Tokens are stored in the measurement "<Env>_tokens" and only the
+// SHA-256 hash of a secret is persisted.
+type TokenService struct {
+	Client   client.Client
+	Database string
+	Env      string
+
+	// Users is used for resolving the owner of a token, so that changes of
+	// the role or license of a user apply to its tokens as well.
+	Users browser.UserService
+}
+
+// Create creates a new token for the given user. The returned token is the
+// only one holding the secret.
+func (s *TokenService) Create(ctx context.Context, user *browser.User, name string) (*browser.Token, error) {
+	if user == nil || !user.Valid() {
+		return nil, browser.ErrUserNotValid
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("token name must not be empty")
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	created := time.Now()
+	p, err := client.NewPoint(
+		s.measurement(),
+		map[string]string{
+			"id":       id,
+			"name":     name,
+			"hash":     hash(secret),
+			"provider": user.Provider,
+			"fullname": user.Name,
+			"email":    user.Email,
+		},
+		map[string]interface{}{
+			"created": created.Unix(),
+		},
+		created,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{Database: s.Database})
+	if err != nil {
+		return nil, err
+	}
+	bp.AddPoint(p)
+
+	if err := s.Client.Write(bp); err != nil {
+		return nil, err
+	}
+
+	return &browser.Token{
+		ID:      id,
+		Name:    name,
+		Created: created,
+		Secret:  secret,
+	}, nil
+}
+
+// List returns all tokens of the given user without their secret.
+func (s *TokenService) List(ctx context.Context, user *browser.User) ([]*browser.Token, error) {
+	if user == nil || !user.Valid() {
+		return nil, browser.ErrUserNotValid
+	}
+
+	q := fmt.Sprintf("SELECT created FROM %s WHERE email='%s' AND provider='%s' GROUP BY id,name",
+		s.measurement(),
+		user.Email,
+		user.Provider,
+	)
+
+	resp, err := QueryContext(ctx, s.Client, client.NewQuery(q, s.Database, ""))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error() != nil {
+		return nil, resp.Error()
+	}
+
+	var tokens []*browser.Token
+	for _, result := range resp.Results {
+		for _, serie := range result.Series {
+			if len(serie.Values) < 1 {
+				continue
+			}
+
+			created, err := time.Parse(time.RFC3339, serie.Values[0][0].(string))
+			if err != nil {
+				return nil, err
+			}
+
+			tokens = append(tokens, &browser.Token{
+				ID:      serie.Tags["id"],
+				Name:    serie.Tags["name"],
+				Created: created,
+			})
+		}
+	}
+
+	return tokens, nil
+}
+
+// Revoke deletes the token with the given id of the given user.
+func (s *TokenService) Revoke(ctx context.Context, user *browser.User, id string) error {
+	if user == nil || !user.Valid() {
+		return browser.ErrUserNotValid
+	}
+
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return browser.ErrTokenNotFound
+	}
+
+	tokens, err := s.List(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	var found bool
+	for _, t := range tokens {
+		if t.ID == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return browser.ErrTokenNotFound
+	}
+
+	q := fmt.Sprintf("DELETE FROM %s WHERE id='%s' AND email='%s' AND provider='%s'",
+		s.measurement(),
+		id,
+		user.Email,
+		user.Provider,
+	)
+
+	resp, err := QueryContext(ctx, s.Client, client.NewQuery(q, s.Database, ""))
+	if err != nil {
+		return err
+	}
+
+	return resp.Error()
+}
+
+// User returns the owner of the token with the given secret. If the token or
+// its owner does not exist browser.ErrInvalidToken is returned.
+func (s *TokenService) User(ctx context.Context, secret string) (*browser.User, error) {
+	if secret == "" {
+		return nil, browser.ErrInvalidToken
+	}
+
+	q := fmt.Sprintf("SELECT created FROM %s WHERE hash='%s' GROUP BY email,provider,fullname",
+		s.measurement(),
+		hash(secret),
+	)
+
+	resp, err := QueryContext(ctx, s.Client, client.NewQuery(q, s.Database, ""))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error() != nil {
+		return nil, resp.Error()
+	}
+
+	switch {
+	case len(resp.Results) != 1:
+		return nil, browser.ErrInvalidToken
+	case len(resp.Results[0].Series) != 1:
+		return nil, browser.ErrInvalidToken
+	}
+
+	tags := resp.Results[0].Series[0].Tags
+	u, err := s.Users.Get(ctx, &browser.User{
+		Name:     tags["fullname"],
+		Email:    tags["email"],
+		Provider: tags["provider"],
+	})
+	if err == browser.ErrUserNotFound {
+		return nil, browser.ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (s *TokenService) measurement() string {
+	return s.Env + "_tokens"
+}
+
+// hash returns the hex encoded SHA-256 hash of the given secret.
+func hash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// randomHex returns n random bytes hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package influx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/euracresearch/browser"
+	"github.com/euracresearch/browser/internal/mock"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/influxdata/influxdb1-client/models"
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+const testSecret = "s3cret"
+
+func TestTokenCreate(t *testing.T) {
+	var written client.BatchPoints
+
+	ts := &TokenService{
+		Client: &mock.InfluxClient{
+			WriteFn: func(bp client.BatchPoints) error {
+				written = bp
+				return nil
+			},
+		},
+		Database: "testdb",
+		Env:      "test",
+	}
+	ctx := context.Background()
+
+	if _, err := ts.Create(ctx, nil, "cron"); err != browser.ErrUserNotValid {
+		t.Fatalf("got %v, want %v", err, browser.ErrUserNotValid)
+	}
+
+	if _, err := ts.Create(ctx, testTokenUser(), " "); err == nil {
+		t.Fatal("expected error for empty name")
+	}
+
+	token, err := ts.Create(ctx, testTokenUser(), "cron")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.Secret == "" || token.ID == "" || token.Name != "cron" {
+		t.Fatalf("got unexpected token %+v", token)
+	}
+
+	if len(written.Points()) != 1 {
+		t.Fatalf("got %d points, want 1", len(written.Points()))
+	}
+	p := written.Points()[0]
+
+	if got, want := p.Name(), "test_tokens"; got != want {
+		t.Fatalf("got measurement %q, want %q", got, want)
+	}
+
+	want := map[string]string{
+		"id":       token.ID,
+		"name":     "cron",
+		"hash":     hash(token.Secret),
+		"provider": "test",
+		"fullname": "Jane Doe",
+		"email":    "jane@example.com",
+	}
+	if diff := cmp.Diff(want, p.Tags()); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestTokenUser(t *testing.T) {
+	ts := &TokenService{
+		Client: &mock.InfluxClient{
+			QueryFn: tokenQueryFnHelper(t),
+		},
+		Database: "testdb",
+		Env:      "test",
+		Users: &UserService{
+			Client: &mock.InfluxClient{
+				QueryFn: userQueryFnHelper(t),
+			},
+			Database: "testdb",
+			Env:      "test",
+		},
+	}
+	ctx := context.Background()
+
+	testCases := map[string]struct {
+		in   string
+		err  error
+		want *browser.User
+	}{
+		"empty":   {"", browser.ErrInvalidToken, nil},
+		"unknown": {"unknown", browser.ErrInvalidToken, nil},
+		"ok": {
+			testSecret,
+			nil,
+			&browser.User{
+				Name:     "Jane Doe",
+				Email:    "jane@example.com",
+				License:  true,
+				Picture:  "/static/images/jane.png",
+				Provider: "test",
+				Role:     browser.External,
+				Groups:   []browser.Role{"UniInnsbruck", "Partners"},
+			},
+		},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			got, err := ts.User(ctx, tc.in)
+			if err != tc.err {
+				t.Fatalf("got error %v, want %v", err, tc.err)
+			}
+
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTokenListAndRevoke(t *testing.T) {
+	ts := &TokenService{
+		Client: &mock.InfluxClient{
+			QueryFn: tokenQueryFnHelper(t),
+		},
+		Database: "testdb",
+		Env:      "test",
+	}
+	ctx := context.Background()
+
+	got, err := ts.List(ctx, testTokenUser())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*browser.Token{
+		{ID: "ab12", Name: "cron", Created: time.Date(2020, 10, 19, 14, 8, 29, 0, time.UTC)},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+
+	testCases := map[string]struct {
+		in   string
+		want error
+	}{
+		"ok":       {"ab12", nil},
+		"notfound": {"cd34", browser.ErrTokenNotFound},
+		"invalid":  {"' OR 1=1", browser.ErrTokenNotFound},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			if got := ts.Revoke(ctx, testTokenUser(), tc.in); got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func testTokenUser() *browser.User {
+	return &browser.User{
+		Name:     "Jane Doe",
+		Email:    "jane@example.com",
+		Provider: "test",
+	}
+}
+
+// tokenQueryFnHelper returns a QueryFn for the mock.InfluxClient simulating a
+// single stored token with the secret testSecret.
+func tokenQueryFnHelper(t *testing.T) func(q client.Query) (*client.Response, error) {
+	t.Helper()
+
+	var (
+		lookupQuery = fmt.Sprintf("SELECT created FROM test_tokens WHERE hash='%s' GROUP BY email,provider,fullname", hash(testSecret))
+		listQuery   = "SELECT created FROM test_tokens WHERE email='jane@example.com' AND provider='test' GROUP BY id,name"
+		deleteQuery = "DELETE FROM test_tokens WHERE id='ab12' AND email='jane@example.com' AND provider='test'"
+	)
+
+	serie := func(tags map[string]string) *client.Response {
+		return &client.Response{
+			Results: []client.Result{
+				{
+					Series: []models.Row{
+						{
+							Name:    "test_tokens",
+							Tags:    tags,
+							Columns: []string{"time", "created"},
+							Values:  [][]interface{}{{"2020-10-19T14:08:29Z", json.Number("1603116509")}},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	return func(q client.Query) (*client.Response, error) {
+		switch {
+		case q.Command == lookupQuery:
+			return serie(map[string]string{"email": "jane@example.com", "provider": "test", "fullname": "Jane Doe"}), nil
+		case q.Command == listQuery:
+			return serie(map[string]string{"id": "ab12", "name": "cron"}), nil
+		case q.Command == deleteQuery:
+			return &client.Response{}, nil
+		case strings.HasPrefix(q.Command, "SELECT"):
+			return &client.Response{}, nil
+		}
+
+		return nil, errors.New("unexpected query: " + q.Command)
+	}
+}
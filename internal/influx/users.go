@@ -8,6 +8,7 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	client "github.com/influxdata/influxdb1-client/v2"
@@ -38,7 +39,7 @@ func (s *UserService) Get(ctx context.Context, user *browser.User) (*browser.Use
 		return nil, browser.ErrUserNotFound
 	}
 
-	u, err := s.get(user)
+	u, err := s.get(ctx, user)
 	if err != nil {
 		return nil, err
 	}
@@ -50,17 +51,18 @@ func (s *UserService) Get(ctx context.Context, user *browser.User) (*browser.Use
 		Provider: u.Provider,
 		License:  u.License,
 		Role:     u.Role,
+		Groups:   u.Groups,
 	}, nil
 }
 
-func (s *UserService) get(u *browser.User) (*user, error) {
-	q := fmt.Sprintf("SELECT updated FROM %s WHERE email='%s' and provider='%s' GROUP BY provider,fullname,email,picture,license,role",
+func (s *UserService) get(ctx context.Context, u *browser.User) (*user, error) {
+	q := fmt.Sprintf("SELECT updated FROM %s WHERE email='%s' and provider='%s' GROUP BY provider,fullname,email,picture,license,role,groups",
 		s.Env,
 		u.Email,
 		u.Provider,
 	)
 
-	resp, err := s.Client.Query(client.NewQuery(q, s.Database, ""))
+	resp, err := QueryContext(ctx, s.Client, client.NewQuery(q, s.Database, ""))
 	if err != nil {
 		return nil, err
 	}
@@ -98,6 +100,7 @@ func (s *UserService) get(u *browser.User) (*user, error) {
 			Provider: tags["provider"],
 			License:  lic,
 			Role:     browser.NewRole(tags["role"]),
+			Groups:   browser.ParseRoles(tags["groups"]),
 		},
 
 		created,
@@ -127,6 +130,7 @@ func (s *UserService) create(user *browser.User, ts time.Time) error {
 			"picture":  user.Picture,
 			"license":  strconv.FormatBool(user.License),
 			"role":     string(user.Role),
+			"groups":   joinRoles(user.Groups),
 		},
 		map[string]interface{}{
 			"updated": time.Now().Unix(),
@@ -146,6 +150,15 @@ func (s *UserService) create(user *browser.User, ts time.Time) error {
 	return s.Client.Write(bp)
 }
 
+// joinRoles returns the given roles as comma separated list.
+func joinRoles(roles []browser.Role) string {
+	s := make([]string, len(roles))
+	for i, r := range roles {
+		s[i] = string(r)
+	}
+	return strings.Join(s, ",")
+}
+
 // Update will update the user information stored in the database. In Influx we
 // cannot update single entries so we first need to retrieve the current stored
 // user, delete it and re-create it with the given user.
@@ -154,12 +167,14 @@ func (s *UserService) Update(ctx context.Context, user *browser.User) error {
 		return browser.ErrUserNotValid
 	}
 
-	dbuser, err := s.get(user)
+	dbuser, err := s.get(ctx, user)
 	if err != nil {
 		return err
 	}
 
-	if err := s.delete(dbuser); err != nil {
+	// Once deleted the user must be re-created, therefore the deletion is
+	// not cancelled together with ctx.
+	if err := s.delete(context.Background(), dbuser); err != nil {
 		return err
 	}
 
@@ -172,15 +187,15 @@ func (s *UserService) Delete(ctx context.Context, user *browser.User) error {
 		return browser.ErrUserNotValid
 	}
 
-	dbuser, err := s.get(user)
+	dbuser, err := s.get(ctx, user)
 	if err != nil {
 		return err
 	}
 
-	return s.delete(dbuser)
+	return s.delete(ctx, dbuser)
 }
 
-func (s *UserService) delete(dbuser *user) error {
+func (s *UserService) delete(ctx context.Context, dbuser *user) error {
 	q := fmt.Sprintf("DELETE FROM %s WHERE email='%s' AND provider='%s' AND time=%d",
 		s.Env,
 		dbuser.Email,
@@ -188,7 +203,7 @@ func (s *UserService) delete(dbuser *user) error {
 		dbuser.created.UnixNano(),
 	)
 
-	resp, err := s.Client.Query(client.NewQuery(q, s.Database, ""))
+	resp, err := QueryContext(ctx, s.Client, client.NewQuery(q, s.Database, ""))
 	if err != nil {
 		return err
 	}
@@ -22,7 +22,7 @@ import (
 
 var (
 	// testSelectQuery is the query we expect in test to lookup an user.
-	testSelectQuery = "select updated from test where email='jane@example.com' and provider='test' group by provider,fullname,email,picture,license,role"
+	testSelectQuery = "select updated from test where email='jane@example.com' and provider='test' group by provider,fullname,email,picture,license,role,groups"
 
 	// testDeleteQuery is the query we expect to get when delete an user.
 	testDeleteQuery = "delete from test where email='jane@example.com' and provider='test' and time=1603116509454279000"
@@ -53,6 +53,7 @@ func TestGet(t *testing.T) {
 				Picture:  "/static/images/jane.png",
 				Provider: "test",
 				Role:     browser.External,
+				Groups:   []browser.Role{"UniInnsbruck", "Partners"},
 			},
 		},
 		"partial": {
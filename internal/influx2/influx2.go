@@ -0,0 +1,457 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package influx2 provides the implementation of the browser.Database
+// interface using InfluxDB 2.x and Flux as backend.
+//
+// The data is expected as migrated from InfluxDB 1.x: every measurement has a
+// field named like the measurement holding the values and the fields altitude,
+// latitude, longitude and depth holding the metadata of the station.
+package influx2
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/euracresearch/browser"
+)
+
+// DefaultWorkers is the default number of queries executed concurrently by
+// Series.
+const DefaultWorkers = 4
+
+// Guarantee we implement browser.Database.
+var _ browser.Database = &DB{}
+
+// seriesTags are the tags identifying a single series of a measurement.
+var seriesTags = []string{"station", "snipeit_location_ref", "landuse", "unit", "aggr"}
+
+// DB holds information for communicating with InfluxDB 2.x.
+type DB struct {
+	Addr   string
+	Token  string
+	Org    string
+	Bucket string
+	Client *http.Client
+
+	// Workers is the maximum number of queries executed concurrently by
+	// Series. If zero DefaultWorkers is used.
+	Workers int
+}
+
+// NewDB returns a new instance of DB.
+func NewDB(addr, token, org, bucket string) *DB {
+	return &DB{
+		Addr:   strings.TrimSuffix(addr, "/"),
+		Token:  token,
+		Org:    org,
+		Bucket: bucket,
+		Client: http.DefaultClient,
+	}
+}
+
+// Series return a browser.TimeSeries from the given message.
+//
+// The message is split into one query per measurement, which are executed
+// concurrently by at most Workers goroutines. The results are merged in the
+// order of the measurements.
+func (db *DB) Series(ctx context.Context, m *browser.Message) (browser.TimeSeries, error) {
+	if m == nil {
+		return nil, browser.ErrDataNotFound
+	}
+
+	results := make([][]*record, len(m.Measurements))
+	err := db.parallel(ctx, len(m.Measurements), func(i int) error {
+		tables, err := db.exec(ctx, seriesQuery(db.Bucket, m, m.Measurements[i]))
+		results[i] = tables
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ts browser.TimeSeries
+	for i, measure := range m.Measurements {
+		tables := results[i]
+
+		var (
+			order  []string
+			series = make(map[string]*browser.Measurement)
+			points = make(map[string][]*browser.Point)
+		)
+		for _, r := range tables {
+			key := r.key()
+			measurement, ok := series[key]
+			if !ok {
+				measurement = &browser.Measurement{
+					Label:       measure,
+					Station:     r.tags["station"],
+					Landuse:     r.tags["landuse"],
+					Aggregation: r.tags["aggr"],
+					Unit:        r.tags["unit"],
+					Elevation:   -1,
+					Latitude:    -1.0,
+					Longitude:   -1.0,
+				}
+				series[key] = measurement
+				order = append(order, key)
+			}
+
+			// Null values are empty, e.g. the depth of stations above
+			// ground, which is left at zero.
+			if r.value == "" {
+				continue
+			}
+
+			f, err := strconv.ParseFloat(r.value, 64)
+			if err != nil {
+				log.Printf("cannot convert value to float: %v. skipping.", err)
+				continue
+			}
+
+			switch r.field {
+			case "altitude":
+				measurement.Elevation = int64(f)
+			case "latitude":
+				measurement.Latitude = f
+			case "longitude":
+				measurement.Longitude = f
+			case "depth":
+				measurement.Depth = int64(f)
+			default:
+				t, err := time.Parse(time.RFC3339Nano, r.time)
+				if err != nil {
+					log.Printf("cannot convert timestamp: %v. skipping.", err)
+					continue
+				}
+
+				points[key] = append(points[key], &browser.Point{
+					Timestamp: t.In(browser.Location),
+					Value:     f,
+				})
+			}
+		}
+
+		for _, key := range order {
+			measurement := series[key]
+			measurement.Points = m.Interval.Fill(points[key], m.Start)
+			ts = append(ts, measurement)
+		}
+	}
+
+	return ts, nil
+}
+
+// parallel calls fn for each index from 0 to n-1 using at most Workers
+// goroutines. No further calls are started once ctx is done or a call
+// returned an error. It returns the first error encountered.
+func (db *DB) parallel(ctx context.Context, n int, fn func(i int) error) error {
+	workers := db.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if workers > n {
+		workers = n
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex // guards first
+		first   error
+		indexes = make(chan int)
+	)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range indexes {
+				if ctx.Err() != nil {
+					continue
+				}
+
+				if err := fn(i); err != nil {
+					mu.Lock()
+					if first == nil {
+						first = err
+					}
+					mu.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+
+loop:
+	for i := 0; i < n; i++ {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if first != nil {
+		return first
+	}
+	return ctx.Err()
+}
+
+// Query returns the Flux query for the given message. The values of all
+// measurements are returned in long format, grouped by measurement and
+// station.
+func (db *DB) Query(ctx context.Context, m *browser.Message) *browser.Stmt {
+	var (
+		buf    bytes.Buffer
+		tables []string
+	)
+
+	for i, measure := range m.Measurements {
+		name := fmt.Sprintf("t%d", i)
+		tables = append(tables, name)
+
+		fmt.Fprintf(&buf, "%s = %s\n", name, fromQuery(db.Bucket, m, measure))
+		fmt.Fprintf(&buf, "\t|> filter(fn: (r) => r._field == %s)\n", quote(measure))
+		writeAggregate(&buf, m, measure)
+		buf.WriteString("\n")
+	}
+
+	fmt.Fprintf(&buf, "union(tables: [%s])\n", strings.Join(tables, ", "))
+	buf.WriteString("\t|> keep(columns: [\"_time\", \"_measurement\", \"_value\", \"station\", \"landuse\"])\n")
+	buf.WriteString("\t|> group(columns: [\"_measurement\", \"station\"])\n")
+	buf.WriteString("\t|> sort(columns: [\"_time\"])")
+
+	return &browser.Stmt{
+		Query:    buf.String(),
+		Database: db.Bucket,
+		Dialect:  browser.Flux,
+	}
+}
+
+// seriesQuery returns the Flux query for a single measurement. The values are
+// yielded as "data" and the last metadata of each series as "meta".
+func seriesQuery(bucket string, m *browser.Message, measure string) string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "data = %s\n", fromQuery(bucket, m, measure))
+
+	buf.WriteString("data\n")
+	fmt.Fprintf(&buf, "\t|> filter(fn: (r) => r._field == %s)\n", quote(measure))
+	writeAggregate(&buf, m, measure)
+	buf.WriteString("\t|> yield(name: \"data\")\n")
+
+	buf.WriteString("data\n")
+	buf.WriteString("\t|> filter(fn: (r) => r._field == \"altitude\" or r._field == \"latitude\" or r._field == \"longitude\" or r._field == \"depth\")\n")
+	buf.WriteString("\t|> last()\n")
+	buf.WriteString("\t|> yield(name: \"meta\")\n")
+
+	return buf.String()
+}
+
+// fromQuery returns the Flux query selecting all fields of the given
+// measurement for the stations, time range and minimum quality of the message.
+func fromQuery(bucket string, m *browser.Message, measure string) string {
+	var buf bytes.Buffer
+
+	// Data in InfluxDB is UTC but LTER data is UTC+1 therefor we need to adapt
+	// start and end times. It will shift the start time to -1 hour and will set
+	// the end time to 23:00:00 (exclusive) in order to capture a full day.
+	start := m.Start.Add(-1 * time.Hour)
+	end := time.Date(m.End.Year(), m.End.Month(), m.End.Day(), 23, 0, 0, 0, time.UTC)
+
+	fmt.Fprintf(&buf, "from(bucket: %s)\n", quote(bucket))
+	fmt.Fprintf(&buf, "\t|> range(start: %s, stop: %s)\n", start.Format("2006-01-02T15:04:05Z"), end.Format("2006-01-02T15:04:05Z"))
+	fmt.Fprintf(&buf, "\t|> filter(fn: (r) => r._measurement == %s)\n", quote(measure))
+
+	var stations []string
+	for _, s := range m.Stations {
+		stations = append(stations, "r.snipeit_location_ref == "+quote(s))
+	}
+	if len(stations) > 0 {
+		fmt.Fprintf(&buf, "\t|> filter(fn: (r) => %s)\n", strings.Join(stations, " or "))
+	}
+
+	// The quality of a point is stored in the quality tag, points without it
+	// are raw points. Like in InfluxDB 1.x, QualityRaw applies no filter.
+	if m.Quality > browser.QualityRaw {
+		var levels []string
+		for q := m.Quality; q <= browser.QualityValidated; q++ {
+			levels = append(levels, "r.quality == "+quote(q.String()))
+		}
+		fmt.Fprintf(&buf, "\t|> filter(fn: (r) => %s)\n", strings.Join(levels, " or "))
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// writeAggregate writes the window aggregation of the requested interval.
+// Windows are shifted by -1 hour to start at midnight UTC+1.
+func writeAggregate(buf *bytes.Buffer, m *browser.Message, measure string) {
+	if m.Interval == browser.Raw {
+		return
+	}
+
+	fmt.Fprintf(buf, "\t|> aggregateWindow(every: %s, offset: -1h, fn: %s, createEmpty: false, timeSrc: \"_start\")\n", every(m.Interval), m.FunctionFor(measure))
+}
+
+// every returns the Flux duration of the given interval.
+func every(i browser.Interval) string {
+	switch i {
+	case browser.Hourly:
+		return "1h"
+	case browser.Monthly:
+		return "1mo"
+	default:
+		return "1d"
+	}
+}
+
+// quote returns s as a Flux string literal.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`).Replace(s) + `"`
+}
+
+// record is a single row of a Flux result.
+type record struct {
+	time  string
+	value string
+	field string
+	tags  map[string]string
+}
+
+// key returns the key of the series the record belongs to.
+func (r *record) key() string {
+	var s []string
+	for _, t := range seriesTags {
+		s = append(s, r.tags[t])
+	}
+	return strings.Join(s, "\x00")
+}
+
+// exec executes the given Flux query and returns all records of the result.
+func (db *DB) exec(ctx context.Context, query string) ([]*record, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"query": query,
+		"type":  "flux",
+		"dialect": map[string]interface{}{
+			"header":      true,
+			"annotations": []string{"datatype", "group", "default"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u := fmt.Sprintf("%s/api/v2/query?%s", db.Addr, url.Values{"org": {db.Org}}.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Token "+db.Token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/csv")
+
+	resp, err := db.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+		}
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if err := json.Unmarshal(b, &e); err != nil || e.Message == "" {
+			e.Message = strings.TrimSpace(string(b))
+		}
+		return nil, fmt.Errorf("influx2: %s: %s", resp.Status, e.Message)
+	}
+
+	return parse(resp.Body)
+}
+
+// parse parses an annotated CSV Flux result. Each table starts with annotation
+// rows followed by a header row.
+func parse(r io.Reader) ([]*record, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	var (
+		records []*record
+		header  map[string]int
+		next    bool // next row is a header
+	)
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("influx2: could not parse result: %v", err)
+		}
+
+		if strings.HasPrefix(row[0], "#") {
+			next = true
+			continue
+		}
+
+		if next {
+			header = make(map[string]int, len(row))
+			for i, name := range row {
+				header[name] = i
+			}
+			next = false
+			continue
+		}
+
+		if header == nil {
+			continue
+		}
+
+		if i, ok := header["error"]; ok {
+			return nil, fmt.Errorf("influx2: %s", row[i])
+		}
+
+		col := func(name string) string {
+			i, ok := header[name]
+			if !ok || i >= len(row) {
+				return ""
+			}
+			return row[i]
+		}
+
+		rec := &record{
+			time:  col("_time"),
+			value: col("_value"),
+			field: col("_field"),
+			tags:  make(map[string]string, len(seriesTags)),
+		}
+		for _, t := range seriesTags {
+			rec.tags[t] = col(t)
+		}
+		records = append(records, rec)
+	}
+
+	return records, nil
+}
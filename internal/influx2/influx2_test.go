@@ -0,0 +1,302 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package influx2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/euracresearch/browser"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestQuery(t *testing.T) {
+	db := NewDB("http://localhost:8086", "token", "org", "lter")
+
+	testCases := map[string]struct {
+		in   *browser.Message
+		want string
+	}{
+		"raw": {
+			&browser.Message{
+				Measurements: []string{"a_avg"},
+				Stations:     []string{"s1", "s2"},
+				Start:        time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+			},
+			`t0 = from(bucket: "lter")
+	|> range(start: 2019-12-31T23:00:00Z, stop: 2020-01-01T23:00:00Z)
+	|> filter(fn: (r) => r._measurement == "a_avg")
+	|> filter(fn: (r) => r.snipeit_location_ref == "s1" or r.snipeit_location_ref == "s2")
+	|> filter(fn: (r) => r._field == "a_avg")
+
+union(tables: [t0])
+	|> keep(columns: ["_time", "_measurement", "_value", "station", "landuse"])
+	|> group(columns: ["_measurement", "station"])
+	|> sort(columns: ["_time"])`,
+		},
+		"monthly": {
+			&browser.Message{
+				Measurements: []string{"a_avg", "b_tot"},
+				Stations:     []string{"s1"},
+				Start:        time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, 3, 31, 0, 0, 0, 0, browser.Location),
+				Interval:     browser.Monthly,
+			},
+			`t0 = from(bucket: "lter")
+	|> range(start: 2019-12-31T23:00:00Z, stop: 2020-03-31T23:00:00Z)
+	|> filter(fn: (r) => r._measurement == "a_avg")
+	|> filter(fn: (r) => r.snipeit_location_ref == "s1")
+	|> filter(fn: (r) => r._field == "a_avg")
+	|> aggregateWindow(every: 1mo, offset: -1h, fn: mean, createEmpty: false, timeSrc: "_start")
+
+t1 = from(bucket: "lter")
+	|> range(start: 2019-12-31T23:00:00Z, stop: 2020-03-31T23:00:00Z)
+	|> filter(fn: (r) => r._measurement == "b_tot")
+	|> filter(fn: (r) => r.snipeit_location_ref == "s1")
+	|> filter(fn: (r) => r._field == "b_tot")
+	|> aggregateWindow(every: 1mo, offset: -1h, fn: sum, createEmpty: false, timeSrc: "_start")
+
+union(tables: [t0, t1])
+	|> keep(columns: ["_time", "_measurement", "_value", "station", "landuse"])
+	|> group(columns: ["_measurement", "station"])
+	|> sort(columns: ["_time"])`,
+		},
+		"checked": {
+			&browser.Message{
+				Measurements: []string{"a_avg"},
+				Stations:     []string{"s1"},
+				Start:        time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				Quality:      browser.QualityChecked,
+			},
+			`t0 = from(bucket: "lter")
+	|> range(start: 2019-12-31T23:00:00Z, stop: 2020-01-01T23:00:00Z)
+	|> filter(fn: (r) => r._measurement == "a_avg")
+	|> filter(fn: (r) => r.snipeit_location_ref == "s1")
+	|> filter(fn: (r) => r.quality == "checked" or r.quality == "validated")
+	|> filter(fn: (r) => r._field == "a_avg")
+
+union(tables: [t0])
+	|> keep(columns: ["_time", "_measurement", "_value", "station", "landuse"])
+	|> group(columns: ["_measurement", "station"])
+	|> sort(columns: ["_time"])`,
+		},
+		"quoting": {
+			&browser.Message{
+				Measurements: []string{`a"b`},
+				Stations:     []string{"${x}"},
+				Start:        time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location),
+			},
+			`t0 = from(bucket: "lter")
+	|> range(start: 2019-12-31T23:00:00Z, stop: 2020-01-01T23:00:00Z)
+	|> filter(fn: (r) => r._measurement == "a\"b")
+	|> filter(fn: (r) => r.snipeit_location_ref == "\${x}")
+	|> filter(fn: (r) => r._field == "a\"b")
+
+union(tables: [t0])
+	|> keep(columns: ["_time", "_measurement", "_value", "station", "landuse"])
+	|> group(columns: ["_measurement", "station"])
+	|> sort(columns: ["_time"])`,
+		},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			got := db.Query(context.Background(), tc.in)
+			want := &browser.Stmt{Query: tc.want, Database: "lter", Dialect: browser.Flux}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+const testResult = `#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string,string,string,string,string,string
+#group,false,false,true,true,false,false,true,true,true,true,true,true,true
+#default,data,,,,,,,,,,,,
+,result,table,_start,_stop,_time,_value,_field,_measurement,station,snipeit_location_ref,landuse,unit,aggr
+,,0,2019-12-31T23:00:00Z,2020-01-01T23:00:00Z,2019-12-31T23:00:00Z,1.5,a_avg,a_avg,s1,1,me,c,avg
+,,0,2019-12-31T23:00:00Z,2020-01-01T23:00:00Z,2019-12-31T23:30:00Z,2.5,a_avg,a_avg,s1,1,me,c,avg
+
+#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string,string,string,string,string,string
+#group,false,false,true,true,false,false,true,true,true,true,true,true,true
+#default,meta,,,,,,,,,,,,
+,result,table,_start,_stop,_time,_value,_field,_measurement,station,snipeit_location_ref,landuse,unit,aggr
+,,1,2019-12-31T23:00:00Z,2020-01-01T23:00:00Z,2019-12-31T23:30:00Z,1000,altitude,a_avg,s1,1,me,c,avg
+,,2,2019-12-31T23:00:00Z,2020-01-01T23:00:00Z,2019-12-31T23:30:00Z,46.6,latitude,a_avg,s1,1,me,c,avg
+,,3,2019-12-31T23:00:00Z,2020-01-01T23:00:00Z,2019-12-31T23:30:00Z,10.5,longitude,a_avg,s1,1,me,c,avg
+,,4,2019-12-31T23:00:00Z,2020-01-01T23:00:00Z,2019-12-31T23:30:00Z,,depth,a_avg,s1,1,me,c,avg
+`
+
+func TestSeries(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/query", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"code":"unauthorized","message":"unauthorized access"}`)
+			return
+		}
+
+		var body struct {
+			Query string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.FormValue("org") != "lter" || !strings.Contains(body.Query, `r._measurement == "a_avg"`) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"code":"invalid","message":"unexpected request"}`)
+			return
+		}
+
+		fmt.Fprint(w, testResult)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location)
+	m := &browser.Message{
+		Measurements: []string{"a_avg"},
+		Stations:     []string{"1"},
+		Start:        start,
+		End:          start,
+	}
+
+	// The null depth must not be logged as invalid value.
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	got, err := NewDB(ts.URL, "secret", "lter", "lter").Series(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() > 0 {
+		t.Fatalf("got unexpected log output %q", logs.String())
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("got %d measurements, want 1", len(got))
+	}
+
+	a := got[0]
+	if a.Label != "a_avg" || a.Station != "s1" || a.Unit != "c" || a.Elevation != 1000 || a.Latitude != 46.6 || a.Longitude != 10.5 || a.Depth != 0 {
+		t.Fatalf("got unexpected measurement %+v", a)
+	}
+
+	// The gap at 00:15 UTC+1 must be filled.
+	if len(a.Points) != 3 || a.Points[0].Value != 1.5 || !math.IsNaN(a.Points[1].Value) || a.Points[2].Value != 2.5 {
+		t.Fatalf("got unexpected points %v", a.Points)
+	}
+	if !a.Points[0].Timestamp.Equal(start) {
+		t.Fatalf("got first timestamp %v, want %v", a.Points[0].Timestamp, start)
+	}
+
+	_, err = NewDB(ts.URL, "invalid", "lter", "lter").Series(context.Background(), m)
+	if err == nil || !strings.Contains(err.Error(), "unauthorized access") {
+		t.Fatalf("got error %v, want unauthorized access", err)
+	}
+}
+
+func TestSeriesParallel(t *testing.T) {
+	// Each query returns a single point of its measurement, the query of the
+	// first measurement is answered last.
+	var (
+		mu     sync.Mutex
+		active int
+		max    int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > max {
+			max = active
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+
+		var body struct {
+			Query string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		measure := "b"
+		if strings.Contains(body.Query, `r._measurement == "a"`) {
+			measure = "a"
+			time.Sleep(20 * time.Millisecond)
+		} else {
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		fmt.Fprintf(w, "#datatype,string,long,dateTime:RFC3339,double,string,string\n#group,false,false,false,false,true,true\n#default,data,,,,,\n,result,table,_time,_value,_field,station\n,,0,2019-12-31T23:00:00Z,1,%s,s1\n", measure)
+	}))
+	defer ts.Close()
+
+	db := NewDB(ts.URL, "secret", "lter", "lter")
+	db.Workers = 2
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, browser.Location)
+	m := &browser.Message{
+		Measurements: []string{"a", "b", "b", "b"},
+		Start:        start,
+		End:          start,
+		Interval:     browser.Daily,
+	}
+
+	got, err := db.Series(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var labels []string
+	for _, measurement := range got {
+		labels = append(labels, measurement.Label)
+	}
+	if diff := cmp.Diff(m.Measurements, labels); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+	if max > db.Workers {
+		t.Fatalf("got %d concurrent queries, want at most %d", max, db.Workers)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.Series(ctx, m); err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	in := "#datatype,string,string\n#group,true,true\n#default,,\n,error,reference\n,division by zero,897\n"
+
+	_, err := parse(strings.NewReader(in))
+	if err == nil || err.Error() != "influx2: division by zero" {
+		t.Fatalf("got error %v, want %q", err, "influx2: division by zero")
+	}
+}
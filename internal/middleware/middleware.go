@@ -7,6 +7,7 @@
 package middleware
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"strings"
@@ -73,3 +74,41 @@ func Robots(filename string) Middleware {
 		})
 	}
 }
+
+// Timeout sets a deadline of the given duration on the context of each
+// request. Handlers and the services they call are expected to stop working
+// once the deadline is exceeded. A duration of zero disables the deadline.
+//
+// Requests for one of the exempt paths, or a path below an exempt path ending
+// in a slash, get no deadline. These are long running downloads which are
+// streamed to the client and would otherwise be cut off.
+func Timeout(d time.Duration, exempt ...string) Middleware {
+	return func(h http.Handler) http.Handler {
+		if d <= 0 {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isExempt(r.URL.Path, exempt) {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// isExempt reports whether path matches one of the given paths like a pattern
+// of http.ServeMux does.
+func isExempt(path string, exempt []string) bool {
+	for _, e := range exempt {
+		if path == e || (strings.HasSuffix(e, "/") && strings.HasPrefix(path, e)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) {
+	testCases := map[string]struct {
+		timeout      time.Duration
+		path         string
+		wantDeadline bool
+	}{
+		"disabled":        {0, "/", false},
+		"enabled":         {time.Minute, "/", true},
+		"exempt":          {time.Minute, "/api/v1/series", false},
+		"exemptSubtree":   {time.Minute, "/api/v1/exports/1234", false},
+		"exemptNoSubtree": {time.Minute, "/api/v1/series/x", true},
+		"notExempt":       {time.Minute, "/api/v1/exports", true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var (
+				deadline time.Time
+				ok       bool
+			)
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				deadline, ok = r.Context().Deadline()
+			})
+
+			start := time.Now()
+			Timeout(tc.timeout, "/api/v1/series", "/api/v1/exports/")(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if ok != tc.wantDeadline {
+				t.Fatalf("got deadline %v, want %v", ok, tc.wantDeadline)
+			}
+			if ok && deadline.Before(start.Add(tc.timeout)) {
+				t.Fatalf("got deadline %v, want at least %v", deadline, start.Add(tc.timeout))
+			}
+		})
+	}
+}
+
+func TestTimeoutStream(t *testing.T) {
+	const chunks = 5
+
+	// The handler streams longer than the timeout and stops once the context
+	// of the request is done.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < chunks; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			fmt.Fprintf(w, "%d\n", i)
+		}
+	})
+	h := Timeout(20*time.Millisecond, "/api/v1/series")(handler)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/series", nil))
+	if got := strings.Count(rec.Body.String(), "\n"); got != chunks {
+		t.Fatalf("streamed download: got %d chunks, want %d", got, chunks)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := strings.Count(rec.Body.String(), "\n"); got >= chunks {
+		t.Fatalf("other request: got %d chunks, want less than %d", got, chunks)
+	}
+}
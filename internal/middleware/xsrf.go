@@ -6,8 +6,10 @@ package middleware
 
 import (
 	"bytes"
+	"context"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/euracresearch/browser"
 	"golang.org/x/net/xsrftoken"
@@ -20,14 +22,20 @@ const XSRFTokenPlaceholder = "$$XSRFTOKEN$$"
 
 // XSRFProtect is a HTTP middlware adding XSRF/CSRF token protection for
 // non-safe HTTP Methods.
+//
+// Requests with an "Authorization: Bearer" header but without a valid XSRF
+// token are passed on, since browsers never add such a header on their own.
+// They are marked with TokenAuthRequired and must be rejected by the
+// authentication handler unless it authenticated them by their bearer token.
 func XSRFProtect(key string) Middleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !isSafeMethod(r.Method) {
-				if !xsrftoken.Valid(r.FormValue("token"), key, "", "") {
+			if !isSafeMethod(r.Method) && !xsrftoken.Valid(r.FormValue("token"), key, "", "") {
+				if !hasBearerToken(r) {
 					http.Error(w, browser.ErrInvalidToken.Error(), http.StatusForbidden)
 					return
 				}
+				r = r.WithContext(context.WithValue(r.Context(), tokenAuthRequiredKey{}, true))
 			}
 
 			crw := &capturingResponseWriter{ResponseWriter: w}
@@ -55,6 +63,25 @@ func (c *capturingResponseWriter) bytes() []byte {
 	return c.buf.Bytes()
 }
 
+// tokenAuthRequiredKey is the context key marking requests which skipped the
+// XSRF check.
+type tokenAuthRequiredKey struct{}
+
+// TokenAuthRequired reports whether the XSRF check of the request with the
+// given context was skipped because of its "Authorization: Bearer" header. Such
+// a request must only be served if it is authenticated by its token.
+func TokenAuthRequired(ctx context.Context) bool {
+	required, _ := ctx.Value(tokenAuthRequiredKey{}).(bool)
+	return required
+}
+
+// hasBearerToken reports whether the request carries an "Authorization:
+// Bearer" header.
+func hasBearerToken(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	return len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ")
+}
+
 // isSafeMethod checks if the given method is considered safe. Safe methods are
 // GET/HEAD/OPTIONS/TRACE.
 func isSafeMethod(m string) bool {
@@ -11,6 +11,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"regexp"
+	"strings"
 	"testing"
 
 	"golang.org/x/net/xsrftoken"
@@ -69,4 +70,19 @@ func TestXSRFProtect(t *testing.T) {
 		t.Fatalf("POST: want status code %d, got %d", http.StatusForbidden, res.StatusCode)
 	}
 
+	req, err := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader(url.Values{"token": {"randome"}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer abc")
+
+	res, err = ts.Client().Do(req)
+	if err != nil {
+		t.Errorf("POST returned error %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("POST with bearer token: want status code %d, got %d", http.StatusOK, res.StatusCode)
+	}
 }
@@ -7,8 +7,11 @@
 package mock
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"io"
 	"time"
 
 	client "github.com/influxdata/influxdb1-client/v2"
@@ -17,8 +20,9 @@ import (
 
 // InfluxClient represents a mock implementation of client.Client.
 type InfluxClient struct {
-	QueryFn func(q client.Query) (*client.Response, error)
-	WriteFn func(bp client.BatchPoints) error
+	QueryFn        func(q client.Query) (*client.Response, error)
+	QueryAsChunkFn func(q client.Query) (*client.ChunkedResponse, error)
+	WriteFn        func(bp client.BatchPoints) error
 }
 
 func (c *InfluxClient) Ping(timeout time.Duration) (time.Duration, string, error) {
@@ -26,7 +30,32 @@ func (c *InfluxClient) Ping(timeout time.Duration) (time.Duration, string, error
 }
 
 func (c *InfluxClient) QueryAsChunk(q client.Query) (*client.ChunkedResponse, error) {
-	return nil, errors.New("not implemented")
+	if q.Database == "" {
+		return nil, errors.New("empty database")
+	}
+
+	if q.Command == "" {
+		return nil, errors.New("empty query")
+	}
+
+	if !q.Chunked {
+		return nil, errors.New("query is not chunked")
+	}
+
+	if c.QueryAsChunkFn != nil {
+		return c.QueryAsChunkFn(q)
+	}
+
+	// Respond with the response of QueryFn as single chunk.
+	resp, err := c.QueryFn(q)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewChunkedResponse(bytes.NewReader(b)), nil
 }
 
 func (c *InfluxClient) Write(bp client.BatchPoints) error {
@@ -60,3 +89,65 @@ func (db *Database) Series(ctx context.Context, m *browser.Message) (browser.Tim
 func (db *Database) Query(ctx context.Context, m *browser.Message) *browser.Stmt {
 	return db.QueryFn(ctx, m)
 }
+
+// Metadata represents a mock implementation of browser.Metadata.
+type Metadata struct {
+	StationsFn  func(ctx context.Context, m *browser.Message) (browser.Stations, error)
+	CatalogueFn func(ctx context.Context, m *browser.Message) (browser.Catalogue, error)
+}
+
+func (md *Metadata) Stations(ctx context.Context, m *browser.Message) (browser.Stations, error) {
+	return md.StationsFn(ctx, m)
+}
+
+func (md *Metadata) Catalogue(ctx context.Context, m *browser.Message) (browser.Catalogue, error) {
+	return md.CatalogueFn(ctx, m)
+}
+
+// TokenService represents a mock implementation of browser.TokenService.
+type TokenService struct {
+	CreateFn func(u *browser.User, name string) (*browser.Token, error)
+	ListFn   func(u *browser.User) ([]*browser.Token, error)
+	RevokeFn func(u *browser.User, id string) error
+	UserFn   func(secret string) (*browser.User, error)
+}
+
+func (s *TokenService) Create(ctx context.Context, u *browser.User, name string) (*browser.Token, error) {
+	return s.CreateFn(u, name)
+}
+
+func (s *TokenService) List(ctx context.Context, u *browser.User) ([]*browser.Token, error) {
+	return s.ListFn(u)
+}
+
+func (s *TokenService) Revoke(ctx context.Context, u *browser.User, id string) error {
+	return s.RevokeFn(u, id)
+}
+
+func (s *TokenService) User(ctx context.Context, secret string) (*browser.User, error) {
+	return s.UserFn(secret)
+}
+
+// ExportService represents a mock implementation of browser.ExportService.
+type ExportService struct {
+	CreateFn func(u *browser.User, m *browser.Message, format string) (*browser.Export, error)
+	ListFn   func(u *browser.User) ([]*browser.Export, error)
+	GetFn    func(u *browser.User, id string) (*browser.Export, error)
+	OpenFn   func(u *browser.User, id string) (io.ReadCloser, error)
+}
+
+func (s *ExportService) Create(ctx context.Context, u *browser.User, m *browser.Message, format string) (*browser.Export, error) {
+	return s.CreateFn(u, m, format)
+}
+
+func (s *ExportService) List(ctx context.Context, u *browser.User) ([]*browser.Export, error) {
+	return s.ListFn(u)
+}
+
+func (s *ExportService) Get(ctx context.Context, u *browser.User, id string) (*browser.Export, error) {
+	return s.GetFn(u, id)
+}
+
+func (s *ExportService) Open(ctx context.Context, u *browser.User, id string) (io.ReadCloser, error) {
+	return s.OpenFn(u, id)
+}
@@ -86,8 +86,13 @@ func (m *Microsoft) User(ctx context.Context, token *oauth2.Token) (*browser.Use
 		Role:     browser.External,
 	}
 
+	// The first role claim is the role of the user, all others are its
+	// groups.
 	if len(claims.Roles) >= 1 {
 		u.Role = browser.NewRole(claims.Roles[0])
+		for _, r := range claims.Roles[1:] {
+			u.Groups = append(u.Groups, browser.NewRole(r))
+		}
 	}
 
 	return u, nil
@@ -15,6 +15,7 @@ import (
 
 	"github.com/coreos/go-oidc"
 	"github.com/euracresearch/browser"
+	"github.com/euracresearch/browser/internal/middleware"
 	"golang.org/x/oauth2"
 )
 
@@ -48,6 +49,11 @@ type Handler struct {
 	Auth  Authenticator
 	Users browser.UserService
 
+	// Tokens is used for authenticating requests with a personal API token
+	// given as "Authorization: Bearer <token>" header. If nil, token
+	// authentication is disabled.
+	Tokens browser.TokenService
+
 	mux *http.ServeMux
 }
 
@@ -199,6 +205,24 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	switch {
 	default:
+		if secret, ok := BearerToken(r); ok && h.Tokens != nil {
+			u, err := h.Tokens.User(ctx, secret)
+			if err != nil {
+				log.Printf("oauth2: token authentication failed: %v\n", err)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, browser.ErrInvalidToken.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			ctx = context.WithValue(ctx, browser.UserContextKey, u)
+			h.Next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		if !h.xsrfChecked(w, r) {
+			return
+		}
+
 		u, err := h.Auth.Validate(ctx, r)
 		if err != nil {
 			h.Next.ServeHTTP(w, r)
@@ -210,7 +234,35 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.Next.ServeHTTP(w, r.WithContext(ctx))
 
 	case strings.HasPrefix(r.URL.Path, "/auth"):
+		if !h.xsrfChecked(w, r) {
+			return
+		}
 		h.mux.ServeHTTP(w, r)
 	}
 
 }
+
+// xsrfChecked reports whether the request passed the XSRF check. Requests
+// which skipped it for their bearer token, but are not authenticated by that
+// token, are rejected since the session cookie would authenticate them
+// otherwise.
+func (h *Handler) xsrfChecked(w http.ResponseWriter, r *http.Request) bool {
+	if middleware.TokenAuthRequired(r.Context()) {
+		http.Error(w, browser.ErrInvalidToken.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// BearerToken returns the token of an "Authorization: Bearer" header of the
+// given request and reports whether such a header was found.
+func BearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package oauth2
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/euracresearch/browser"
+	"github.com/euracresearch/browser/internal/middleware"
+	"github.com/euracresearch/browser/internal/mock"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestServeHTTPBearerToken(t *testing.T) {
+	testUser := &browser.User{
+		Name:     "Jane Doe",
+		Email:    "jane@example.com",
+		Provider: "test",
+		License:  true,
+		Role:     browser.FullAccess,
+	}
+
+	h := &Handler{
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, browser.UserFromContext(r.Context()).Role)
+		}),
+		Auth: &Cookie{
+			Secret: "testsecret",
+			Cookie: securecookie.New(securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32)),
+		},
+		Tokens: &mock.TokenService{
+			UserFn: func(secret string) (*browser.User, error) {
+				if secret != "valid" {
+					return nil, browser.ErrInvalidToken
+				}
+				return testUser, nil
+			},
+		},
+	}
+
+	testCases := map[string]struct {
+		header     string
+		statusCode int
+		body       string
+	}{
+		"none":      {"", http.StatusOK, string(browser.Public)},
+		"valid":     {"Bearer valid", http.StatusOK, string(browser.FullAccess)},
+		"lowercase": {"bearer valid", http.StatusOK, string(browser.FullAccess)},
+		"invalid":   {"Bearer invalid", http.StatusUnauthorized, browser.ErrInvalidToken.Error() + "\n"},
+		"basic":     {"Basic dXNlcjpwYXNz", http.StatusOK, string(browser.Public)},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/stations", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if got, want := w.Code, tc.statusCode; got != want {
+				t.Fatalf("got status code %d, want %d", got, want)
+			}
+
+			if got, want := w.Body.String(), tc.body; got != want {
+				t.Fatalf("got body %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPXSRF(t *testing.T) {
+	const xsrfKey = "testkey"
+
+	cookieUser := &browser.User{
+		Name:     "John Doe",
+		Email:    "john@example.com",
+		Provider: "test",
+		License:  true,
+		Role:     browser.FullAccess,
+	}
+	auth := &Cookie{
+		Secret: "testsecret",
+		Cookie: securecookie.New(securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32)),
+	}
+	rec := httptest.NewRecorder()
+	if err := auth.Authorize(context.Background(), rec, cookieUser); err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+
+	tokens := &mock.TokenService{
+		UserFn: func(secret string) (*browser.User, error) {
+			if secret != "valid" {
+				return nil, browser.ErrInvalidToken
+			}
+			return &browser.User{Role: browser.External, License: true}, nil
+		},
+	}
+
+	testCases := map[string]struct {
+		tokens     browser.TokenService
+		path       string
+		header     string
+		cookie     bool
+		statusCode int
+	}{
+		"Cookie":               {tokens, "/api/v1/exports", "", true, http.StatusForbidden},
+		"CookieBogusBearer":    {tokens, "/api/v1/exports", "Bearer bogus", true, http.StatusUnauthorized},
+		"CookieBearerNoTokens": {nil, "/api/v1/exports", "Bearer bogus", true, http.StatusForbidden},
+		"CookieBearerAuth":     {tokens, "/auth/account/license", "Bearer valid", true, http.StatusForbidden},
+		"Bearer":               {tokens, "/api/v1/exports", "Bearer valid", false, http.StatusOK},
+		"BearerAndCookie":      {tokens, "/api/v1/exports", "Bearer valid", true, http.StatusOK},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			h := &Handler{
+				Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, browser.UserFromContext(r.Context()).Role)
+				}),
+				Auth:   auth,
+				Tokens: tc.tokens,
+				mux:    http.NewServeMux(),
+			}
+			h.mux.HandleFunc("/auth/account/license", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "license")
+			})
+
+			req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			if tc.cookie {
+				for _, c := range cookies {
+					req.AddCookie(c)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			middleware.XSRFProtect(xsrfKey)(h).ServeHTTP(w, req)
+
+			if got, want := w.Code, tc.statusCode; got != want {
+				t.Fatalf("got status code %d, want %d (body %q)", got, want, w.Body.String())
+			}
+		})
+	}
+}
@@ -223,6 +223,7 @@ type SelectBuilder struct {
 	where    *WhereBuilder
 	order    string
 	group    string
+	fill     string
 	orderDir string
 	limit    string
 	timezone string
@@ -262,6 +263,15 @@ func (sb *SelectBuilder) GroupBy(column string) *SelectBuilder {
 	return sb
 }
 
+// Fill sets the value reported for time intervals with no data when grouping
+// by time, e.g. "none", "null" or "previous".
+func (sb *SelectBuilder) Fill(option string) *SelectBuilder {
+	if option != "" {
+		sb.fill = fmt.Sprintf(" fill(%s)", option)
+	}
+	return sb
+}
+
 func (sb *SelectBuilder) ASC() *SelectBuilder {
 	sb.orderDir = " ASC"
 	return sb
@@ -299,6 +309,10 @@ func (sb *SelectBuilder) Query() (string, []interface{}) {
 		sb.b.Append(sb.group)
 	}
 
+	if sb.fill != "" {
+		sb.b.Append(sb.fill)
+	}
+
 	if sb.order != "" {
 		sb.b.Append(" ORDER BY ")
 		sb.b.Append(sb.order)
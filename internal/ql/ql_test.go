@@ -63,6 +63,7 @@ func TestSelectBuilder(t *testing.T) {
 		{Select("a", "b"), "SELECT a, b"},
 		{Select("a", "b").From("c"), "SELECT a, b FROM c"},
 		{Select("a", "b").From("c").Where(Eq(And(), "x", "b")).GroupBy("t").OrderBy("a").ASC(), "SELECT a, b FROM c WHERE x='b' GROUP BY t ORDER BY a ASC"},
+		{Select("mean(a)").From("c").GroupBy("time(1h)").Fill("none").OrderBy("time").ASC(), "SELECT mean(a) FROM c GROUP BY time(1h) fill(none) ORDER BY time ASC"},
 	}
 	for _, tc := range testCases {
 		if got, _ := tc.in.Query(); got != tc.want {
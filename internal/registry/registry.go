@@ -0,0 +1,271 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package registry implements browser.Metadata backed by a static YAML or
+// JSON file. It is meant for local development, tests and small deployments
+// without a SnipeIT instance.
+//
+// The file is decoded as JSON if its extension is .json and as YAML
+// otherwise. An example of a registry file is presented below:
+//
+// 	stations:
+// 	  - id: "1"
+// 	    name: "Station 1"
+// 	    landuse: "me"
+// 	    elevation: 1000
+// 	    latitude: 46.6
+// 	    longitude: 10.5
+// 	    image: "https://example.com/s1.jpg"
+// 	    dashboard: "https://example.com/d/s1"
+// 	    measurements: ["air_t_avg", "air_rh_avg"]
+// 	catalogue:
+// 	  - label: "air_t_avg"
+// 	    description:
+// 	      en: "Air temperature"
+// 	    unit: "°C"
+// 	    aggregation: "avg"
+// 	    sensorHeight: 2
+//
+// Changes to the file are picked up every DefaultRefreshInterval.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/euracresearch/browser"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultRefreshInterval is the interval in which the registry file is
+// checked for changes.
+var DefaultRefreshInterval = time.Minute
+
+// Guarantee we implement browser.Metadata.
+var _ browser.Metadata = &Registry{}
+
+// Registry represents a parsed registry file.
+type Registry struct {
+	file string
+
+	mu        sync.RWMutex // guards the fields below
+	last      time.Time
+	stations  browser.Stations
+	catalogue browser.Catalogue
+}
+
+// station is the representation of a station inside the registry file.
+type station struct {
+	ID           string   `json:"id" yaml:"id"`
+	Name         string   `json:"name" yaml:"name"`
+	Landuse      string   `json:"landuse" yaml:"landuse"`
+	Elevation    int64    `json:"elevation" yaml:"elevation"`
+	Latitude     float64  `json:"latitude" yaml:"latitude"`
+	Longitude    float64  `json:"longitude" yaml:"longitude"`
+	Image        string   `json:"image" yaml:"image"`
+	Dashboard    string   `json:"dashboard" yaml:"dashboard"`
+	Measurements []string `json:"measurements" yaml:"measurements"`
+}
+
+// parameter is the representation of a catalogue entry inside the registry
+// file.
+type parameter struct {
+	Label        string            `json:"label" yaml:"label"`
+	Description  map[string]string `json:"description" yaml:"description"`
+	Unit         string            `json:"unit" yaml:"unit"`
+	Aggregation  string            `json:"aggregation" yaml:"aggregation"`
+	Depth        int64             `json:"depth" yaml:"depth"`
+	SensorHeight float64           `json:"sensorHeight" yaml:"sensorHeight"`
+	ValidMin     *float64          `json:"validMin" yaml:"validMin"`
+	ValidMax     *float64          `json:"validMax" yaml:"validMax"`
+}
+
+// New returns a new instance of Registry reading the given file.
+func New(file string) (*Registry, error) {
+	r := &Registry{file: file}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	go r.refresh()
+
+	return r, nil
+}
+
+// Stations implements browser.Metadata. Only stations matching the stations
+// and landuse of the message are returned. If the message contains
+// measurements only those are listed per station and stations without any of
+// them are omitted.
+func (r *Registry) Stations(ctx context.Context, m *browser.Message) (browser.Stations, error) {
+	r.mu.RLock()
+	stations := r.stations
+	r.mu.RUnlock()
+
+	var filtered browser.Stations
+	for _, s := range stations {
+		if !inArray(s.ID, m.Stations) || !inArray(s.Landuse, m.Landuse) {
+			continue
+		}
+
+		var measurements []string
+		for _, l := range s.Measurements {
+			if inArray(l, m.Measurements) {
+				measurements = append(measurements, l)
+			}
+		}
+		if len(measurements) == 0 {
+			continue
+		}
+
+		c := *s
+		c.Measurements = measurements
+		filtered = append(filtered, &c)
+	}
+
+	return filtered, nil
+}
+
+// Catalogue implements browser.Metadata.
+func (r *Registry) Catalogue(ctx context.Context, m *browser.Message) (browser.Catalogue, error) {
+	r.mu.RLock()
+	catalogue := r.catalogue
+	r.mu.RUnlock()
+
+	var filtered browser.Catalogue
+	for _, p := range catalogue {
+		if inArray(p.Label, m.Measurements) {
+			filtered = append(filtered, p)
+		}
+	}
+
+	return filtered, nil
+}
+
+// load loads the registry file if it has changed since the last load.
+func (r *Registry) load() error {
+	fi, err := os.Stat(r.file)
+	if err != nil {
+		return fmt.Errorf("registry: %v", err)
+	}
+
+	mtime := fi.ModTime()
+	if !mtime.After(r.last) {
+		return nil // no changes to registry file
+	}
+
+	b, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		return fmt.Errorf("registry: error in opening %q: %v", r.file, err)
+	}
+
+	var content struct {
+		Stations  []*station   `json:"stations" yaml:"stations"`
+		Catalogue []*parameter `json:"catalogue" yaml:"catalogue"`
+	}
+
+	if strings.EqualFold(filepath.Ext(r.file), ".json") {
+		err = json.Unmarshal(b, &content)
+	} else {
+		err = yaml.UnmarshalStrict(b, &content)
+	}
+	if err != nil {
+		return fmt.Errorf("registry: error in decoding %q: %v", r.file, err)
+	}
+
+	stations := make(browser.Stations, 0, len(content.Stations))
+	seen := make(map[string]bool)
+	for _, s := range content.Stations {
+		if s.ID == "" {
+			return fmt.Errorf("registry: station %q in %q has no id", s.Name, r.file)
+		}
+		if seen[s.ID] {
+			return fmt.Errorf("registry: duplicate station id %q in %q", s.ID, r.file)
+		}
+		seen[s.ID] = true
+
+		stations = append(stations, &browser.Station{
+			ID:           s.ID,
+			Name:         s.Name,
+			Landuse:      s.Landuse,
+			Elevation:    s.Elevation,
+			Latitude:     s.Latitude,
+			Longitude:    s.Longitude,
+			Image:        s.Image,
+			Dashboard:    s.Dashboard,
+			Measurements: s.Measurements,
+		})
+	}
+
+	catalogue := make(browser.Catalogue, 0, len(content.Catalogue))
+	for _, p := range content.Catalogue {
+		catalogue = append(catalogue, &browser.Parameter{
+			Label:        p.Label,
+			Description:  p.Description,
+			Unit:         p.Unit,
+			Aggregation:  p.Aggregation,
+			Depth:        p.Depth,
+			SensorHeight: p.SensorHeight,
+			ValidMin:     p.ValidMin,
+			ValidMax:     p.ValidMax,
+		})
+	}
+
+	// Sort stations by name and parameters by label.
+	sort.Slice(stations, func(i, j int) bool {
+		return stations[i].Name < stations[j].Name
+	})
+	sort.Slice(catalogue, func(i, j int) bool {
+		return catalogue[i].Label < catalogue[j].Label
+	})
+
+	r.mu.Lock()
+	r.last = mtime
+	r.stations = stations
+	r.catalogue = catalogue
+	r.mu.Unlock()
+
+	log.Printf("registry: update stations from file %q\n", r.file)
+
+	return nil
+}
+
+// refresh reloads the registry file every DefaultRefreshInterval. On errors
+// the previously loaded registry is kept.
+func (r *Registry) refresh() {
+	ticker := time.NewTicker(DefaultRefreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := r.load(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// inArray checks if the given s is in the given slice. If the given slice is
+// empty true will be returned.
+func inArray(s string, a []string) bool {
+	if len(a) == 0 {
+		return true
+	}
+
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
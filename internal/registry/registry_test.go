@@ -0,0 +1,166 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package registry
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/euracresearch/browser"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStations(t *testing.T) {
+	for _, file := range []string{"testdata/registry.yaml", "testdata/registry.json"} {
+		r, err := New(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+
+		testCases := map[string]struct {
+			in   *browser.Message
+			want map[string][]string // station ID to measurements
+		}{
+			"all": {
+				&browser.Message{},
+				map[string][]string{"1": {"air_t_avg", "air_rh_avg"}, "2": {"air_t_avg", "snow_height"}},
+			},
+			"stations": {
+				&browser.Message{Stations: []string{"2"}},
+				map[string][]string{"2": {"air_t_avg", "snow_height"}},
+			},
+			"landuse": {
+				&browser.Message{Landuse: []string{"me"}},
+				map[string][]string{"1": {"air_t_avg", "air_rh_avg"}},
+			},
+			"measurements": {
+				&browser.Message{Measurements: []string{"snow_height"}},
+				map[string][]string{"2": {"snow_height"}},
+			},
+			"none": {
+				&browser.Message{Stations: []string{"3"}},
+				map[string][]string{},
+			},
+		}
+
+		for k, tc := range testCases {
+			t.Run(file+"/"+k, func(t *testing.T) {
+				stations, err := r.Stations(ctx, tc.in)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got := make(map[string][]string)
+				for _, s := range stations {
+					got[s.ID] = s.Measurements
+				}
+
+				if diff := cmp.Diff(tc.want, got); diff != "" {
+					t.Fatalf("mismatch (-want +got):\n%s", diff)
+				}
+			})
+		}
+
+		stations, _ := r.Stations(ctx, &browser.Message{})
+		want := &browser.Station{
+			ID:           "2",
+			Name:         "A Station",
+			Landuse:      "pa",
+			Elevation:    1500,
+			Latitude:     46.7,
+			Longitude:    10.6,
+			Measurements: []string{"air_t_avg", "snow_height"},
+		}
+		if diff := cmp.Diff(want, stations[0]); diff != "" {
+			t.Fatalf("%s: mismatch (-want +got):\n%s", file, diff)
+		}
+	}
+}
+
+func TestCatalogue(t *testing.T) {
+	r, err := New("testdata/registry.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := r.Catalogue(context.Background(), &browser.Message{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"air_rh_avg: Relative humidity [%], valid range 0..100",
+		"air_t_avg: Air temperature [°C], aggregation avg, sensor height 2 m",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d parameters, want %d", len(got), len(want))
+	}
+	for i, p := range got {
+		if p.String() != want[i] {
+			t.Errorf("got %q, want %q", p.String(), want[i])
+		}
+	}
+
+	if got, want := got.Title("air_t_avg", "de"), "Lufttemperatur"; got != want {
+		t.Errorf("got title %q, want %q", got, want)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "registry.yaml")
+	write := func(content string, mtime time.Time) {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	write("stations:\n  - id: \"1\"\n    measurements: [a]\n", now)
+
+	r, err := New(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := func() int {
+		s, err := r.Stations(context.Background(), &browser.Message{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(s)
+	}
+
+	write("stations:\n  - id: \"1\"\n    measurements: [a]\n  - id: \"2\"\n    measurements: [a]\n", now.Add(time.Minute))
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(); got != 2 {
+		t.Fatalf("got %d stations after reload, want 2", got)
+	}
+
+	// An invalid file must keep the previously loaded stations.
+	write("stations:\n  - id: \"1\"\n  - id: \"1\"\n", now.Add(2*time.Minute))
+	if err := r.load(); err == nil {
+		t.Fatal("expected error for duplicate station id")
+	}
+	if got := count(); got != 2 {
+		t.Fatalf("got %d stations after invalid reload, want 2", got)
+	}
+}
@@ -7,12 +7,16 @@ package snipeit
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/euracresearch/browser"
+	"github.com/euracresearch/browser/internal/influx"
 	"github.com/euracresearch/browser/internal/ql"
 
 	"github.com/euracresearch/go-snipeit"
@@ -31,8 +35,30 @@ type SnipeITService struct {
 
 	db       client.Client
 	database string
+
+	// CatalogueFile is a JSON file holding the measurement catalogue. If
+	// set it takes precedence over CatalogueCategory.
+	CatalogueFile string
+
+	// CatalogueCategory is the ID of the SnipeIT category of the assets
+	// describing measurements. Each asset is named after the label of a
+	// measurement and holds its metadata in custom fields.
+	CatalogueCategory int
 }
 
+// Names of the SnipeIT custom fields holding the metadata of a measurement.
+// Descriptions are stored in a custom field per language, e.g.
+// "Description EN".
+const (
+	fieldDescription  = "Description "
+	fieldUnit         = "Unit"
+	fieldAggregation  = "Aggregation"
+	fieldDepth        = "Depth"
+	fieldSensorHeight = "Sensor Height"
+	fieldValidMin     = "Valid Min"
+	fieldValidMax     = "Valid Max"
+)
+
 // NewSnipeITService returns a new instance of SnipeITService.
 func NewSnipeITService(baseurl, token string, db client.Client, database string) (*SnipeITService, error) {
 	c, err := snipeit.NewClient(baseurl, token)
@@ -58,7 +84,7 @@ func (s *SnipeITService) Stations(ctx context.Context, m *browser.Message) (brow
 	}
 
 	q, _ := ql.ShowTagValues().From(m.Measurements...).WithKeyIn("snipeit_location_ref").Where(where).Query()
-	resp, err := s.db.Query(client.NewQuery(q, s.database, ""))
+	resp, err := influx.QueryContext(ctx, s.db, client.NewQuery(q, s.database, ""))
 	if err != nil {
 		return nil, err
 	}
@@ -76,7 +102,7 @@ func (s *SnipeITService) Stations(ctx context.Context, m *browser.Message) (brow
 		}
 	}
 
-	stations, err := s.stations(m, measurements)
+	stations, err := s.stations(ctx, m, measurements)
 	if err != nil {
 		return nil, err
 	}
@@ -84,21 +110,128 @@ func (s *SnipeITService) Stations(ctx context.Context, m *browser.Message) (brow
 	return stations, nil
 }
 
-func (s *SnipeITService) stations(m *browser.Message, measurements map[string][]string) (browser.Stations, error) {
+// Catalogue implements browser.Metadata. The catalogue is read from
+// CatalogueFile if given, otherwise from the assets of CatalogueCategory. If
+// none is configured an empty catalogue is returned.
+func (s *SnipeITService) Catalogue(ctx context.Context, m *browser.Message) (browser.Catalogue, error) {
+	var (
+		catalogue browser.Catalogue
+		err       error
+	)
+
+	switch {
+	case s.CatalogueFile != "":
+		catalogue, err = readCatalogue(s.CatalogueFile)
+	case s.CatalogueCategory > 0:
+		catalogue, err = s.catalogue(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var filtered browser.Catalogue
+	for _, p := range catalogue {
+		if !inArray(p.Label, m.Measurements) {
+			continue
+		}
+		filtered = append(filtered, p)
+	}
+
+	// Sort parameters by label.
+	sort.Slice(filtered, func(i, j int) bool {
+		return filtered[i].Label < filtered[j].Label
+	})
+
+	return filtered, nil
+}
+
+func (s *SnipeITService) catalogue(ctx context.Context) (browser.Catalogue, error) {
+	opts := &snipeit.HardwareOptions{
+		CategoryID: s.CatalogueCategory,
+		Limit:      500,
+	}
+
+	var hardware []*snipeit.Hardware
+	if err := s.list(ctx, "hardware", opts, &hardware); err != nil {
+		return nil, err
+	}
+
+	var catalogue browser.Catalogue
+	for _, h := range hardware {
+		p := &browser.Parameter{
+			Label:       h.Name,
+			Description: make(map[string]string),
+		}
+
+		for name, field := range h.CustomFields {
+			v := strings.TrimSpace(field.Value)
+			if v == "" {
+				continue
+			}
+
+			switch name {
+			case fieldUnit:
+				p.Unit = v
+			case fieldAggregation:
+				p.Aggregation = v
+			case fieldDepth:
+				p.Depth, _ = strconv.ParseInt(v, 10, 64)
+			case fieldSensorHeight:
+				p.SensorHeight, _ = strconv.ParseFloat(v, 64)
+			case fieldValidMin:
+				p.ValidMin = parseFloat(v)
+			case fieldValidMax:
+				p.ValidMax = parseFloat(v)
+			default:
+				if strings.HasPrefix(name, fieldDescription) {
+					lang := strings.ToLower(strings.TrimPrefix(name, fieldDescription))
+					p.Description[lang] = v
+				}
+			}
+		}
+
+		catalogue = append(catalogue, p)
+	}
+
+	return catalogue, nil
+}
+
+// readCatalogue reads a JSON encoded catalogue from the given file.
+func readCatalogue(file string) (browser.Catalogue, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("snipeit: error in reading catalogue %q: %v", file, err)
+	}
+
+	var c browser.Catalogue
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("snipeit: error in JSON decoding catalogue %q: %v", file, err)
+	}
+
+	return c, nil
+}
+
+// parseFloat returns a pointer to the float value of s or nil if s is not a
+// valid float.
+func parseFloat(s string) *float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil
+	}
+	return &f
+}
+
+func (s *SnipeITService) stations(ctx context.Context, m *browser.Message, measurements map[string][]string) (browser.Stations, error) {
 	opts := &snipeit.LocationOptions{
 		Search: "LTER",
 		Limit:  100,
 	}
 
-	locations, resp, err := s.client.Locations(opts)
-	if err != nil {
+	var locations []*snipeit.Location
+	if err := s.list(ctx, "locations", opts, &locations); err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("SnipeIT API returned an error: %s", resp.Status)
-	}
-
 	var stations browser.Stations
 	for _, l := range locations {
 		if l.Name == "LTER" {
@@ -141,6 +274,35 @@ func (s *SnipeITService) stations(m *browser.Message, measurements map[string][]
 	return stations, nil
 }
 
+// list requests the given list endpoint of the SnipeIT API with the given
+// options and decodes the returned rows into rows. Unlike the list methods of
+// snipeit.Client the request is cancelled as soon as ctx is done.
+func (s *SnipeITService) list(ctx context.Context, endpoint string, opts interface{}, rows interface{}) error {
+	u, err := s.client.AddOptions(endpoint, opts)
+	if err != nil {
+		return err
+	}
+
+	req, err := s.client.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+
+	response := struct {
+		Rows interface{}
+	}{rows}
+	resp, err := s.client.Do(req.WithContext(ctx), &response)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("SnipeIT API returned an error: %s", resp.Status)
+	}
+
+	return nil
+}
+
 // inArray checks if the given s is in the given slice. If the given slice is
 // empty true will be returned.
 func inArray(s string, a []string) bool {
@@ -86,6 +86,55 @@ func TestStations(t *testing.T) {
 	}
 }
 
+func TestCatalogue(t *testing.T) {
+	mux.HandleFunc("/hardware", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(snipeITHardwareJSON)
+	})
+
+	c, err := NewSnipeITService(testBaseURL, "testtoken", &mock.InfluxClient{}, "testdb")
+	if err != nil {
+		t.Fatalf("NewSnipeITService failed: %v", err)
+	}
+	c.CatalogueCategory = 42
+	ctx := context.Background()
+
+	var testCases = []struct {
+		in   []string
+		want []string // Parameter.String()
+	}{
+		{
+			nil,
+			[]string{
+				"air_rh_avg: Relative humidity [%], aggregation avg, sensor height 2 m, valid range 0..100",
+				"air_t_avg: Air temperature [°C], aggregation avg, sensor height 2 m",
+			},
+		},
+		{[]string{"unknown"}, nil},
+		{
+			[]string{"air_t_avg"},
+			[]string{"air_t_avg: Air temperature [°C], aggregation avg, sensor height 2 m"},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(fmt.Sprintf("%v", tt.in), func(t *testing.T) {
+			got, err := c.Catalogue(ctx, &browser.Message{Measurements: tt.in})
+			if err != nil {
+				t.Fatalf("Catalogue failed: %v", err)
+			}
+
+			if len(tt.want) != len(got) {
+				t.Fatalf("catalogue: got %d, want %d", len(got), len(tt.want))
+			}
+
+			for i, p := range got {
+				if p.String() != tt.want[i] {
+					t.Errorf("got %q, want %q", p.String(), tt.want[i])
+				}
+			}
+		})
+	}
+}
+
 func TestMain(m *testing.M) {
 	mux = http.NewServeMux()
 
@@ -298,3 +347,33 @@ var snipeITLocationJSON = []byte(`{
 	]
 }
 `)
+
+var snipeITHardwareJSON = []byte(`{
+	"total": 2,
+	"rows": [
+		{
+			"id": 1,
+			"name": "air_t_avg",
+			"custom_fields": {
+				"Description EN": {"field": "_snipeit_description_en_1", "value": "Air temperature"},
+				"Description DE": {"field": "_snipeit_description_de_2", "value": "Lufttemperatur"},
+				"Unit": {"field": "_snipeit_unit_3", "value": "°C"},
+				"Aggregation": {"field": "_snipeit_aggregation_4", "value": "avg"},
+				"Sensor Height": {"field": "_snipeit_sensor_height_5", "value": "2"},
+				"Valid Min": {"field": "_snipeit_valid_min_6", "value": ""}
+			}
+		},
+		{
+			"id": 2,
+			"name": "air_rh_avg",
+			"custom_fields": {
+				"Description EN": {"field": "_snipeit_description_en_1", "value": "Relative humidity"},
+				"Unit": {"field": "_snipeit_unit_3", "value": "%"},
+				"Aggregation": {"field": "_snipeit_aggregation_4", "value": "avg"},
+				"Sensor Height": {"field": "_snipeit_sensor_height_5", "value": "2"},
+				"Valid Min": {"field": "_snipeit_valid_min_6", "value": "0"},
+				"Valid Max": {"field": "_snipeit_valid_max_7", "value": "100"}
+			}
+		}
+	]
+}`)
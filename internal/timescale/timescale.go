@@ -0,0 +1,288 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package timescale provides the implementation of the browser.Database
+// interface using TimescaleDB or plain PostgreSQL as backend.
+//
+// Points are expected in a single table in long format, with one row per
+// measurement, station and timestamp:
+//
+//  CREATE TABLE measurements (
+//      time        TIMESTAMPTZ NOT NULL,
+//      measurement TEXT NOT NULL,
+//      station_id  TEXT NOT NULL,
+//      station     TEXT NOT NULL,
+//      landuse     TEXT NOT NULL,
+//      unit        TEXT,
+//      aggr        TEXT,
+//      value       DOUBLE PRECISION,
+//      elevation   BIGINT,
+//      latitude    DOUBLE PRECISION,
+//      longitude   DOUBLE PRECISION,
+//      depth       BIGINT,
+//      quality     TEXT
+//  );
+//  SELECT create_hypertable('measurements', 'time');
+//  CREATE INDEX ON measurements (measurement, station_id, time DESC);
+//
+// The station_id column holds the SnipeIT location ID of the station, like
+// the snipeit_location_ref tag in InfluxDB. The quality column holds the name
+// of the browser.Quality of a point, like the quality tag in InfluxDB. It is
+// only read if a minimum quality is requested.
+package timescale
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/euracresearch/browser"
+
+	"github.com/lib/pq"
+)
+
+// DefaultTable is the default name of the table holding the points.
+const DefaultTable = "measurements"
+
+// timezone is the time zone LTER data is recorded in. A fixed offset is used
+// to avoid problems with daylight saving time.
+const timezone = "Etc/GMT-1"
+
+// Guarantee we implement browser.Database.
+var _ browser.Database = &DB{}
+
+// DB holds information for communicating with PostgreSQL.
+type DB struct {
+	DB       *sql.DB
+	Database string
+	Table    string
+}
+
+// NewDB returns a new instance of DB reading from DefaultTable.
+func NewDB(db *sql.DB, database string) *DB {
+	return &DB{
+		DB:       db,
+		Database: database,
+		Table:    DefaultTable,
+	}
+}
+
+// Series return a browser.TimeSeries from the given message.
+func (db *DB) Series(ctx context.Context, m *browser.Message) (browser.TimeSeries, error) {
+	if m == nil || len(m.Measurements) == 0 {
+		return nil, browser.ErrDataNotFound
+	}
+
+	var args []interface{}
+	q := db.query(m, func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	})
+
+	rows, err := db.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		ts          browser.TimeSeries
+		measurement *browser.Measurement
+		points      []*browser.Point
+		key         string
+	)
+
+	// Rows are ordered by series, therefore a series is complete as soon
+	// as the key changes.
+	flush := func() {
+		if measurement == nil {
+			return
+		}
+		measurement.Points = m.Interval.Fill(points, m.Start)
+		ts = append(ts, measurement)
+	}
+
+	for rows.Next() {
+		var (
+			t                   time.Time
+			label, id, station  string
+			landuse             string
+			unit, aggr          sql.NullString
+			value               sql.NullFloat64
+			elevation, depth    sql.NullInt64
+			latitude, longitude sql.NullFloat64
+		)
+
+		err := rows.Scan(&t, &label, &id, &station, &landuse, &unit, &aggr, &value, &elevation, &latitude, &longitude, &depth)
+		if err != nil {
+			return nil, err
+		}
+
+		if k := strings.Join([]string{label, id, station, landuse, unit.String, aggr.String}, "\x00"); k != key {
+			flush()
+
+			key = k
+			points = nil
+			measurement = &browser.Measurement{
+				Label:       label,
+				Station:     station,
+				Landuse:     landuse,
+				Aggregation: aggr.String,
+				Unit:        unit.String,
+				Elevation:   -1,
+				Latitude:    -1.0,
+				Longitude:   -1.0,
+			}
+		}
+
+		if elevation.Valid {
+			measurement.Elevation = elevation.Int64
+		}
+		if latitude.Valid {
+			measurement.Latitude = latitude.Float64
+		}
+		if longitude.Valid {
+			measurement.Longitude = longitude.Float64
+		}
+		measurement.Depth = depth.Int64
+
+		// NULL values are handled like missing points.
+		if !value.Valid {
+			continue
+		}
+
+		points = append(points, &browser.Point{
+			Timestamp: t.In(browser.Location),
+			Value:     value.Float64,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+
+	return ts, nil
+}
+
+// Query returns the SQL statement for the given message. The statement returns
+// the points in long format, ordered by measurement, station and time.
+func (db *DB) Query(ctx context.Context, m *browser.Message) *browser.Stmt {
+	return &browser.Stmt{
+		Query:    db.query(m, literal),
+		Database: db.Database,
+		Dialect:  browser.SQL,
+	}
+}
+
+// query returns the SQL query for the given message. User given values are
+// passed to bind, which returns their representation inside the query.
+//
+// Aggregations are computed in the LTER time zone UTC+1 with date_trunc, which
+// in contrast to InfluxDB also supports calendar months.
+func (db *DB) query(m *browser.Message, bind func(interface{}) string) string {
+	var (
+		buf   strings.Builder
+		where []string
+	)
+
+	where = append(where, "measurement IN ("+bindAll(m.Measurements, bind)+")")
+	if len(m.Stations) > 0 {
+		where = append(where, "station_id IN ("+bindAll(m.Stations, bind)+")")
+	}
+	// The end date is inclusive, therefore points are queried until the
+	// beginning of the following day.
+	where = append(where,
+		"time >= "+bind(m.Start),
+		"time < "+bind(m.End.AddDate(0, 0, 1)),
+	)
+	// Like in InfluxDB, the zero value QualityRaw applies no filter.
+	if m.Quality > browser.QualityRaw {
+		var levels []string
+		for q := m.Quality; q <= browser.QualityValidated; q++ {
+			levels = append(levels, q.String())
+		}
+		where = append(where, "quality IN ("+bindAll(levels, bind)+")")
+	}
+
+	series := "measurement, station_id, station, landuse, unit, aggr"
+	if m.Interval == browser.Raw {
+		buf.WriteString("SELECT time, " + series + ", value, elevation, latitude, longitude, depth")
+	} else {
+		buf.WriteString(fmt.Sprintf("SELECT date_trunc('%s', time AT TIME ZONE %s) AT TIME ZONE %s AS time, ", truncUnit(m.Interval), literal(timezone), literal(timezone)))
+		buf.WriteString(series + ", ")
+		buf.WriteString(db.aggregate(m, bind) + " AS value, ")
+		buf.WriteString("max(elevation) AS elevation, max(latitude) AS latitude, max(longitude) AS longitude, max(depth) AS depth")
+	}
+
+	buf.WriteString(" FROM " + pq.QuoteIdentifier(db.Table))
+	buf.WriteString(" WHERE " + strings.Join(where, " AND "))
+	if m.Interval != browser.Raw {
+		buf.WriteString(" GROUP BY 1, " + series)
+	}
+	buf.WriteString(" ORDER BY " + series + ", time")
+
+	return buf.String()
+}
+
+// aggregate returns the SQL expression aggregating the values. If measurements
+// use different functions the function is chosen by a CASE expression.
+func (db *DB) aggregate(m *browser.Message, bind func(interface{}) string) string {
+	fns := make(map[browser.AggregateFunc]bool)
+	for _, measure := range m.Measurements {
+		fns[m.FunctionFor(measure)] = true
+	}
+	if len(fns) == 1 {
+		return sqlFunc(m.FunctionFor(m.Measurements[0])) + "(value)"
+	}
+
+	var buf strings.Builder
+	buf.WriteString("CASE measurement")
+	for _, measure := range m.Measurements {
+		fmt.Fprintf(&buf, " WHEN %s THEN %s(value)", bind(measure), sqlFunc(m.FunctionFor(measure)))
+	}
+	buf.WriteString(" END")
+
+	return buf.String()
+}
+
+// truncUnit returns the date_trunc unit of the given interval.
+func truncUnit(i browser.Interval) string {
+	switch i {
+	case browser.Hourly:
+		return "hour"
+	case browser.Monthly:
+		return "month"
+	default:
+		return "day"
+	}
+}
+
+// sqlFunc returns the name of the SQL aggregate function of fn.
+func sqlFunc(fn browser.AggregateFunc) string {
+	if fn == browser.Mean {
+		return "avg"
+	}
+	return string(fn)
+}
+
+// bindAll binds all given values and returns them as a comma separated list.
+func bindAll(values []string, bind func(interface{}) string) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = bind(v)
+	}
+	return strings.Join(s, ", ")
+}
+
+// literal returns v as a quoted SQL literal. Times are formatted in RFC3339,
+// which PostgreSQL parses as timestamp with time zone.
+func literal(v interface{}) string {
+	if t, ok := v.(time.Time); ok {
+		return pq.QuoteLiteral(t.Format(time.RFC3339))
+	}
+	return pq.QuoteLiteral(fmt.Sprint(v))
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package timescale
+
+import (
+	"context"
+	"math"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/euracresearch/browser"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestQuery(t *testing.T) {
+	db := NewDB(nil, "testdb")
+
+	testCases := map[string]struct {
+		in   *browser.Message
+		want string
+	}{
+		"raw": {
+			&browser.Message{
+				Measurements: []string{"a_avg", "b_tot"},
+				Stations:     []string{"s1"},
+				Start:        time.Date(2020, time.January, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, time.January, 1, 0, 0, 0, 0, browser.Location),
+			},
+			"SELECT time, measurement, station_id, station, landuse, unit, aggr, value, elevation, latitude, longitude, depth FROM \"measurements\" WHERE measurement IN ('a_avg', 'b_tot') AND station_id IN ('s1') AND time >= '2020-01-01T00:00:00+01:00' AND time < '2020-01-02T00:00:00+01:00' ORDER BY measurement, station_id, station, landuse, unit, aggr, time",
+		},
+		"checked": {
+			&browser.Message{
+				Measurements: []string{"a_avg"},
+				Stations:     []string{"s1"},
+				Start:        time.Date(2020, time.January, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, time.January, 1, 0, 0, 0, 0, browser.Location),
+				Quality:      browser.QualityChecked,
+			},
+			"SELECT time, measurement, station_id, station, landuse, unit, aggr, value, elevation, latitude, longitude, depth FROM \"measurements\" WHERE measurement IN ('a_avg') AND station_id IN ('s1') AND time >= '2020-01-01T00:00:00+01:00' AND time < '2020-01-02T00:00:00+01:00' AND quality IN ('checked', 'validated') ORDER BY measurement, station_id, station, landuse, unit, aggr, time",
+		},
+		"monthly": {
+			&browser.Message{
+				Measurements: []string{"a_avg", "b_tot"},
+				Start:        time.Date(2020, time.January, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, time.March, 31, 0, 0, 0, 0, browser.Location),
+				Interval:     browser.Monthly,
+			},
+			"SELECT date_trunc('month', time AT TIME ZONE 'Etc/GMT-1') AT TIME ZONE 'Etc/GMT-1' AS time, measurement, station_id, station, landuse, unit, aggr, CASE measurement WHEN 'a_avg' THEN avg(value) WHEN 'b_tot' THEN sum(value) END AS value, max(elevation) AS elevation, max(latitude) AS latitude, max(longitude) AS longitude, max(depth) AS depth FROM \"measurements\" WHERE measurement IN ('a_avg', 'b_tot') AND time >= '2020-01-01T00:00:00+01:00' AND time < '2020-04-01T00:00:00+01:00' GROUP BY 1, measurement, station_id, station, landuse, unit, aggr ORDER BY measurement, station_id, station, landuse, unit, aggr, time",
+		},
+		"hourly_with_function": {
+			&browser.Message{
+				Measurements: []string{"a_avg", "b_tot"},
+				Stations:     []string{"s1", "s'2"},
+				Start:        time.Date(2020, time.January, 1, 0, 0, 0, 0, browser.Location),
+				End:          time.Date(2020, time.January, 1, 0, 0, 0, 0, browser.Location),
+				Interval:     browser.Hourly,
+				Function:     browser.Max,
+			},
+			"SELECT date_trunc('hour', time AT TIME ZONE 'Etc/GMT-1') AT TIME ZONE 'Etc/GMT-1' AS time, measurement, station_id, station, landuse, unit, aggr, max(value) AS value, max(elevation) AS elevation, max(latitude) AS latitude, max(longitude) AS longitude, max(depth) AS depth FROM \"measurements\" WHERE measurement IN ('a_avg', 'b_tot') AND station_id IN ('s1', 's''2') AND time >= '2020-01-01T00:00:00+01:00' AND time < '2020-01-02T00:00:00+01:00' GROUP BY 1, measurement, station_id, station, landuse, unit, aggr ORDER BY measurement, station_id, station, landuse, unit, aggr, time",
+		},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			got := db.Query(context.Background(), tc.in)
+			want := &browser.Stmt{Query: tc.want, Database: "testdb", Dialect: browser.SQL}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSeries(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Date(2020, time.January, 1, 0, 0, 0, 0, browser.Location)
+	m := &browser.Message{
+		Measurements: []string{"a_avg", "b_avg"},
+		Stations:     []string{"1"},
+		Start:        start,
+		End:          start,
+		Interval:     browser.Hourly,
+	}
+
+	columns := []string{"time", "measurement", "station_id", "station", "landuse", "unit", "aggr", "value", "elevation", "latitude", "longitude", "depth"}
+	rows := sqlmock.NewRows(columns).
+		AddRow(start, "a_avg", "1", "s1", "me", "c", "avg", 1.0, 1000, 46.6, 10.5, nil).
+		AddRow(start.Add(2*time.Hour), "a_avg", "1", "s1", "me", "c", "avg", 3.0, 1000, 46.6, 10.5, nil).
+		AddRow(start.Add(time.Hour), "b_avg", "1", "s1", "me", "%", "avg", 2.0, nil, nil, nil, 20)
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM \"measurements\" WHERE measurement IN ($1, $2) AND station_id IN ($3) AND time >= $4 AND time < $5")).
+		WithArgs("a_avg", "b_avg", "1", start, start.AddDate(0, 0, 1)).
+		WillReturnRows(rows)
+
+	ts, err := NewDB(conn, "testdb").Series(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ts) != 2 {
+		t.Fatalf("got %d measurements, want 2", len(ts))
+	}
+
+	a := ts[0]
+	if a.Label != "a_avg" || a.Unit != "c" || a.Elevation != 1000 || a.Latitude != 46.6 || a.Depth != 0 {
+		t.Fatalf("got unexpected measurement %+v", a)
+	}
+	if len(a.Points) != 3 || !math.IsNaN(a.Points[1].Value) || a.Points[2].Value != 3 {
+		t.Fatalf("got unexpected points %v", a.Points)
+	}
+
+	b := ts[1]
+	if b.Label != "b_avg" || b.Elevation != -1 || b.Latitude != -1 || b.Depth != 20 {
+		t.Fatalf("got unexpected measurement %+v", b)
+	}
+	if len(b.Points) != 2 || !math.IsNaN(b.Points[0].Value) || !b.Points[1].Timestamp.Equal(start.Add(time.Hour)) {
+		t.Fatalf("got unexpected points %v", b.Points)
+	}
+
+	if _, err := NewDB(conn, "testdb").Series(context.Background(), &browser.Message{}); err != browser.ErrDataNotFound {
+		t.Fatalf("got error %v, want %v", err, browser.ErrDataNotFound)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package browser
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Denial represents a part of a request which was removed or changed by the
+// access rules.
+type Denial struct {
+	// Field is the field of the Message, e.g. "measurements".
+	Field string `json:"field"`
+
+	// Value is the denied value.
+	Value string `json:"value"`
+
+	// Reason describes why the value was denied.
+	Reason string `json:"reason"`
+}
+
+func (d Denial) String() string {
+	return fmt.Sprintf("%s %q: %s", d.Field, d.Value, d.Reason)
+}
+
+// Denials represents all denials of a request.
+type Denials []Denial
+
+// Strings returns each denial as string.
+func (d Denials) Strings() []string {
+	var s []string
+	for _, v := range d {
+		s = append(s, v.String())
+	}
+	return s
+}
+
+// Err returns an error wrapping ErrAccessDenied describing the denials or nil
+// if there are none.
+func (d Denials) Err() error {
+	if len(d) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrAccessDenied, strings.Join(d.Strings(), "; "))
+}
+
+// Report collects the denials of a request. Decorating access controls add
+// the denials of a request to the report of its context. A nil Report
+// discards all denials.
+type Report struct {
+	mu      sync.Mutex
+	denials Denials
+}
+
+// Add adds the given denials to the report.
+func (r *Report) Add(d ...Denial) {
+	if r == nil || len(d) == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.denials = append(r.denials, d...)
+}
+
+// Denials returns all denials added to the report.
+func (r *Report) Denials() Denials {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append(Denials(nil), r.denials...)
+}
+
+// reportContextKey is a custom type to be used as key type for the report of
+// a context.
+type reportContextKey struct{}
+
+// NewReportContext returns a new context carrying the given report.
+func NewReportContext(ctx context.Context, r *Report) context.Context {
+	return context.WithValue(ctx, reportContextKey{}, r)
+}
+
+// ReportFromContext returns the report of the given context or nil if it has
+// none.
+func ReportFromContext(ctx context.Context) *Report {
+	r, _ := ctx.Value(reportContextKey{}).(*Report)
+	return r
+}
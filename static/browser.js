@@ -463,40 +463,63 @@ function browser(opts) {
 		$(opts.dateEl).popover('hide');
 	});
 
+	// checkEstimate asks the server for the estimated number of points of the
+	// download and calls fn only if the limit of the user is not exceeded. If
+	// the estimate is not available the download is submitted anyway.
+	function checkEstimate(fn) {
+		$.post("/api/v1/estimate", $(opts.formEl).serialize())
+			.done(function(data) {
+				if (data.exceeded) {
+					alert("The selected data of about " + data.points.toLocaleString() +
+						" points exceeds the download limit of " + data.limit.toLocaleString() +
+						" points. Please select fewer stations, measurements or a shorter time range.");
+					return
+				}
+				fn();
+			})
+			.fail(function() {
+				fn();
+			});
+	}
+
 	$(opts.submitLongBtnEl).click(function(e){
 		$(opts.formatEl).val('long');
 
-		var startDate = new Date($(opts.sDateEl).val());
-		startDate.setHours(0,0,0,0);
+		checkEstimate(function() {
+			var startDate = new Date($(opts.sDateEl).val());
+			startDate.setHours(0,0,0,0);
 
-		var endDate = new Date($(opts.eDateEl).val());
-		endDate.setFullYear(endDate.getFullYear() - 1);
-		endDate.setHours(0,0,0,0);
+			var endDate = new Date($(opts.eDateEl).val());
+			endDate.setFullYear(endDate.getFullYear() - 1);
+			endDate.setHours(0,0,0,0);
 
-		if (maxMeasurementSelected() || (startDate < endDate)) {
-			$(opts.infoModalEl).modal();
-			return
-		}
+			if (maxMeasurementSelected() || (startDate < endDate)) {
+				$(opts.infoModalEl).modal();
+				return
+			}
 
-		$(opts.formEl).submit();
+			$(opts.formEl).submit();
+		});
 	});
 
 	$(opts.submitWideBtnEl).click(function(e){
 		$(opts.formatEl).val('wide');
 
-		var startDate = new Date($(opts.sDateEl).val());
-		startDate.setHours(0,0,0,0);
+		checkEstimate(function() {
+			var startDate = new Date($(opts.sDateEl).val());
+			startDate.setHours(0,0,0,0);
 
-		var endDate = new Date($(opts.eDateEl).val());
-		endDate.setFullYear(endDate.getFullYear() - 1);
-		endDate.setHours(0,0,0,0);
+			var endDate = new Date($(opts.eDateEl).val());
+			endDate.setFullYear(endDate.getFullYear() - 1);
+			endDate.setHours(0,0,0,0);
 
-		if (maxMeasurementSelected() || (startDate < endDate)) {
-			$(opts.infoModalEl).modal();
-			return
-		}
+			if (maxMeasurementSelected() || (startDate < endDate)) {
+				$(opts.infoModalEl).modal();
+				return
+			}
 
-		$(opts.formEl).submit();
+			$(opts.formEl).submit();
+		});
 	});
 
 	$(opts.infoModalEl).find('.btn-primary').click(function(){
@@ -0,0 +1,153 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package browser
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+)
+
+// PointIterator iterates over the points of a single measurement in
+// chronological order. An iterator must be closed after use.
+type PointIterator interface {
+	// Next advances the iterator to the next point. It returns false at the
+	// end of the points or if an error occurred.
+	Next() bool
+
+	// Point returns the current point.
+	Point() *Point
+
+	// Err returns the first error encountered by the iterator.
+	Err() error
+
+	// Close releases all resources held by the iterator.
+	Close() error
+}
+
+// Stream is a TimeSeries whose points are read lazily from the database, so
+// that memory usage does not depend on the length of the time series.
+type Stream struct {
+	// TimeSeries holds the metadata of all measurements of the stream. The
+	// points of the measurements are not set.
+	TimeSeries TimeSeries
+
+	// Points returns an iterator over the points of the given measurement,
+	// which must be part of TimeSeries.
+	Points func(m *Measurement) PointIterator
+}
+
+// Streamer is implemented by a Database able to stream time series.
+type Streamer interface {
+	// Stream returns a Stream from the given Message. Like the points of
+	// Database.Series, the points of a Stream have a continuous time
+	// range.
+	Stream(ctx context.Context, m *Message) (*Stream, error)
+}
+
+// StreamSeries returns a Stream from the given Message. If db does not
+// implement Streamer the time series is read into memory.
+func StreamSeries(ctx context.Context, db Database, m *Message) (*Stream, error) {
+	if s, ok := db.(Streamer); ok {
+		return s.Stream(ctx, m)
+	}
+
+	ts, err := db.Series(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	return NewStream(ts), nil
+}
+
+// NewStream returns a Stream iterating over the points of the given TimeSeries
+// held in memory. Points are iterated sorted by timestamp, the given
+// TimeSeries will not be modified.
+func NewStream(ts TimeSeries) *Stream {
+	return &Stream{
+		TimeSeries: ts,
+		Points: func(m *Measurement) PointIterator {
+			return &sliceIterator{points: SortedPoints(m.Points), pos: -1}
+		},
+	}
+}
+
+// sliceIterator is a PointIterator over a slice of points.
+type sliceIterator struct {
+	points []*Point
+	pos    int
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.pos >= len(it.points) {
+		return false
+	}
+	it.pos++
+	return it.pos < len(it.points)
+}
+
+func (it *sliceIterator) Point() *Point { return it.points[it.pos] }
+func (it *sliceIterator) Err() error    { return nil }
+func (it *sliceIterator) Close() error  { return nil }
+
+// SortedPoints returns the given points sorted by timestamp. If the points are
+// not already sorted, a sorted copy is returned, thus the given points will
+// never be modified.
+func SortedPoints(p []*Point) []*Point {
+	less := func(p []*Point) func(i, j int) bool {
+		return func(i, j int) bool { return p[i].Timestamp.Before(p[j].Timestamp) }
+	}
+	if sort.SliceIsSorted(p, less(p)) {
+		return p
+	}
+
+	c := append([]*Point(nil), p...)
+	sort.SliceStable(c, less(c))
+	return c
+}
+
+// FillIterator returns a PointIterator filling missing timestamps of the
+// points of it like Fill does.
+func (i Interval) FillIterator(it PointIterator, start time.Time) PointIterator {
+	return &fillIterator{
+		it:       it,
+		interval: i,
+		next:     i.Truncate(start),
+	}
+}
+
+// fillIterator is a PointIterator returning NaN values for the gaps between
+// the points of the underlying iterator.
+type fillIterator struct {
+	it       PointIterator
+	interval Interval
+
+	next    time.Time // next expected timestamp
+	pending *Point    // point of it not returned yet
+	cur     *Point
+}
+
+func (f *fillIterator) Next() bool {
+	if f.pending == nil {
+		if !f.it.Next() {
+			return false
+		}
+		f.pending = f.it.Point()
+	}
+
+	if f.next.Before(f.pending.Timestamp) {
+		f.cur = &Point{Timestamp: f.next, Value: math.NaN()}
+		f.next = f.interval.Next(f.next)
+		return true
+	}
+
+	f.cur, f.pending = f.pending, nil
+	f.next = f.interval.Next(f.cur.Timestamp)
+	return true
+}
+
+func (f *fillIterator) Point() *Point { return f.cur }
+func (f *fillIterator) Err() error    { return f.it.Err() }
+func (f *fillIterator) Close() error  { return f.it.Close() }